@@ -1,13 +1,16 @@
 package filetransfer
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 	"io"
 	"log"
+	"os"
 	"path/filepath"
+	"summersea.top/filetransfer/transferframe"
 	"time"
 )
 
@@ -17,39 +20,121 @@ type UploadData UploadInitReqBody
 
 type DownloadData DownloadInitReqBody
 
+type CopyData CopyReqBody
+
 type FileTranDataAdapter struct {
 	dataStore DataStore
+	sshConfig SshConfig
+	pool      *sshPool
 }
 
 func NewFileTranDataAdapter(store DataStore) *FileTranDataAdapter {
-	return &FileTranDataAdapter{store}
+	return NewFileTranDataAdapterWithConfig(store, SshConfig{})
+}
+
+func NewFileTranDataAdapterWithConfig(store DataStore, config SshConfig) *FileTranDataAdapter {
+	return &FileTranDataAdapter{dataStore: store, sshConfig: config, pool: newSshPool(config.Pool)}
 }
 
 func (f *FileTranDataAdapter) SaveUploadData(taskId string, uploadData UploadData) {
 	f.dataStore.SaveUploadData(taskId, uploadData)
 }
 
+func (f *FileTranDataAdapter) GetUploadData(taskId string) *UploadData {
+	return f.dataStore.GetUploadData(taskId)
+}
+
 func (f *FileTranDataAdapter) IsUploadTaskExist(taskId string) bool {
 	return f.dataStore.IsUploadTaskExist(taskId)
 }
 
-func (f *FileTranDataAdapter) GetUploadChannel(taskId string) (WriteCloseRollback, error) {
-	uploadData := f.dataStore.GetUploadDataRemove(taskId)
-	return f.createUploadSftpChannel(*uploadData)
+func (f *FileTranDataAdapter) GetUploadChannel(ctx context.Context, taskId string, options UploadOptions) (WriteCloseRollback, error) {
+	uploadData := f.dataStore.GetUploadData(taskId)
+	if uploadData == nil {
+		return nil, fmt.Errorf("upload task %s not found", taskId)
+	}
+	data, ok := uploadData.forTarget(options.Target)
+	if !ok {
+		return nil, fmt.Errorf("upload target %d of task %s not found", options.Target, taskId)
+	}
+	if options.Filename != "" {
+		data.Filename = options.Filename
+	}
+	data.FileAttributes = data.FileAttributes.withClientModTime(options.ModTime)
+	return f.createUploadSftpChannel(ctx, taskId, data, options)
+}
+
+// RemoveUploadTemp 删除上传任务还未确认的临时文件，解压上传没有临时文件
+func (f *FileTranDataAdapter) RemoveUploadTemp(ctx context.Context, taskId string) error {
+	uploadData := f.dataStore.GetUploadData(taskId)
+	if uploadData == nil {
+		return fmt.Errorf("upload task %s not found", taskId)
+	}
+	if uploadData.Extract != "" {
+		return nil
+	}
+	tempPath := sftp.Join(uploadData.Path, uploadTempName(uploadData.Filename, taskId))
+	return f.removeTempFile(ctx, uploadData.Resource, tempPath)
+}
+
+func (f *FileTranDataAdapter) GetUploadOffset(taskId string) int64 {
+	return f.dataStore.GetUploadOffset(taskId)
+}
+
+func (f *FileTranDataAdapter) CommitUploadOffset(taskId string, offset int64) {
+	f.dataStore.SaveUploadOffset(taskId, offset)
+}
+
+func (f *FileTranDataAdapter) FinishUpload(taskId string) {
+	f.dataStore.GetUploadDataRemove(taskId)
+}
+
+func (f *FileTranDataAdapter) RenewTask(taskId string) {
+	f.dataStore.RenewTask(taskId)
+}
+
+func (f *FileTranDataAdapter) SaveTaskStatus(taskId string, status TaskStatus) {
+	f.dataStore.SaveTaskStatus(taskId, status)
+}
+
+func (f *FileTranDataAdapter) GetTaskStatus(taskId string) *TaskStatus {
+	return f.dataStore.GetTaskStatus(taskId)
+}
+
+func (f *FileTranDataAdapter) SubscribeTaskStatus(taskId string) (<-chan TaskStatus, func()) {
+	return f.dataStore.SubscribeTaskStatus(taskId)
+}
+
+func (f *FileTranDataAdapter) CancelTask(taskId string) {
+	f.dataStore.SaveTaskCancel(taskId)
+}
+
+func (f *FileTranDataAdapter) IsTaskCanceled(taskId string) bool {
+	return f.dataStore.IsTaskCanceled(taskId)
 }
 
 func (f *FileTranDataAdapter) IsDownloadTaskExist(taskId string) bool {
 	return f.dataStore.IsDownloadTaskExist(taskId)
 }
 
-func (f *FileTranDataAdapter) GetDownloadChannelFilename(taskId string) (io.ReadCloser, string, error) {
-	downloadData := f.dataStore.GetDownloadDataRemove(taskId)
-	channel, err := f.createSftpDownloadChannel(downloadData.Resource, downloadData.Path)
+func (f *FileTranDataAdapter) GetDownloadChannelFilename(ctx context.Context, taskId string) (io.ReadCloser, string, error) {
+	downloadData := f.dataStore.GetDownloadData(taskId)
+	if downloadData == nil {
+		return nil, "", fmt.Errorf("download task %s not found", taskId)
+	}
+	if downloadData.Archive != "" {
+		channel, err := f.createArchiveDownloadChannel(ctx, downloadData.Resource, downloadData.Path, downloadData.Archive)
+		if err != nil {
+			return nil, "", fmt.Errorf("problem create channel: %w", err)
+		}
+		return channel, filepath.Base(downloadData.Path) + "." + downloadData.Archive, nil
+	}
+	channel, err := f.createSftpDownloadChannel(ctx, downloadData.Resource, downloadData.Path)
 	if err != nil {
 		if err == DownloadDir {
 			return nil, "", err
 		} else {
-			return nil, "", fmt.Errorf("problem create channel: %v", err)
+			return nil, "", fmt.Errorf("problem create channel: %w", err)
 		}
 	}
 	filename := filepath.Base(downloadData.Path)
@@ -60,26 +145,162 @@ func (f *FileTranDataAdapter) SaveDownloadData(taskId string, downloadData Downl
 	f.dataStore.SaveDownloadData(taskId, downloadData)
 }
 
-func (f *FileTranDataAdapter) createUploadSftpChannel(data UploadData) (WriteCloseRollback, error) {
-	sftpClient, err := f.createSftpClient(data.Resource)
+func (f *FileTranDataAdapter) GetDownloadData(taskId string) *DownloadData {
+	return f.dataStore.GetDownloadData(taskId)
+}
+
+func (f *FileTranDataAdapter) SaveCopyData(taskId string, copyData CopyData) {
+	f.dataStore.SaveCopyData(taskId, copyData)
+}
+
+func (f *FileTranDataAdapter) GetCopyData(taskId string) *CopyData {
+	return f.dataStore.GetCopyData(taskId)
+}
+
+func (f *FileTranDataAdapter) IsCopyTaskExist(taskId string) bool {
+	return f.dataStore.IsCopyTaskExist(taskId)
+}
+
+func (f *FileTranDataAdapter) FinishCopy(taskId string) {
+	f.dataStore.GetCopyDataRemove(taskId)
+}
+
+func (f *FileTranDataAdapter) GetCopySourceChannel(ctx context.Context, taskId string) (io.ReadCloser, error) {
+	copyData := f.dataStore.GetCopyData(taskId)
+	if copyData == nil {
+		return nil, fmt.Errorf("copy task %s not found", taskId)
+	}
+	channel, err := f.createSftpDownloadChannel(ctx, copyData.Source.Resource, copyData.Source.Path)
 	if err != nil {
-		return nil, fmt.Errorf("%v", err)
+		if err == DownloadDir {
+			return nil, err
+		}
+		return nil, fmt.Errorf("problem create channel: %w", err)
+	}
+	return channel, nil
+}
+
+func (f *FileTranDataAdapter) GetCopyDestinationChannel(ctx context.Context, taskId string, offset int64) (WriteCloseRollback, error) {
+	copyData := f.dataStore.GetCopyData(taskId)
+	if copyData == nil {
+		return nil, fmt.Errorf("copy task %s not found", taskId)
+	}
+	dir, filename := sftp.Split(copyData.Destination.Path)
+	data := UploadData{Resource: copyData.Destination.Resource, Path: dir, Filename: filename}
+	return f.createUploadSftpChannel(ctx, taskId, data, UploadOptions{Offset: offset})
+}
+
+// RemoveCopyTemp 删除复制任务还未确认的临时文件
+func (f *FileTranDataAdapter) RemoveCopyTemp(ctx context.Context, taskId string) error {
+	copyData := f.dataStore.GetCopyData(taskId)
+	if copyData == nil {
+		return fmt.Errorf("copy task %s not found", taskId)
+	}
+	dir, filename := sftp.Split(copyData.Destination.Path)
+	return f.removeTempFile(ctx, copyData.Destination.Resource, sftp.Join(dir, uploadTempName(filename, taskId)))
+}
+
+// removeTempFile 删除临时文件，临时文件不存在时不报错
+func (f *FileTranDataAdapter) removeTempFile(ctx context.Context, resource Resource, tempPath string) error {
+	sftpClient, err := f.createSftpClient(ctx, resource)
+	if err != nil {
+		return err
+	}
+	defer closeWithErrLog(sftpClient)
+	if err = sftpClient.Remove(tempPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("problem remove temp file: %v", err)
+	}
+	return nil
+}
+
+func (f *FileTranDataAdapter) PushJob(job Job) {
+	f.dataStore.PushJob(job)
+}
+
+func (f *FileTranDataAdapter) PopJob(lease time.Duration) *Job {
+	return f.dataStore.PopJob(lease)
+}
+
+func (f *FileTranDataAdapter) RenewJob(job Job, lease time.Duration) bool {
+	return f.dataStore.RenewJob(job, lease)
+}
+
+func (f *FileTranDataAdapter) FinishJob(job Job) {
+	f.dataStore.FinishJob(job)
+}
+
+// createUploadSftpChannel 上传的数据先写入同一目录下的临时文件，确认后重命名为目标文件
+// 临时文件名包括任务id，断点续传与重试时继续写入同一个临时文件
+func (f *FileTranDataAdapter) createUploadSftpChannel(ctx context.Context, taskId string, data UploadData, options UploadOptions) (WriteCloseRollback, error) {
+	sftpClient, err := f.createSftpClient(ctx, data.Resource)
+	if err != nil {
+		return nil, err
+	}
+	if data.Extract != "" {
+		return f.createExtractUploadChannel(sftpClient, data, options.Offset)
 	}
 	filePath := sftp.Join(data.Path, data.Filename)
-	transferChannel, err := sftpClient.Create(filePath)
+	tempPath := sftp.Join(data.Path, uploadTempName(data.Filename, taskId))
+	transferChannel, err := f.openUploadFile(sftpClient.Client, tempPath, options.Offset)
 	if err != nil {
 		_ = sftpClient.Close()
 		return nil, fmt.Errorf("problem create upload channel: %v", err)
 	}
-	channel := &SftpUploadChannel{sftpClient.sshClient, sftpClient.Client, transferChannel, filePath}
+	channel := &SftpUploadChannel{sshClient: sftpClient.sshClient, sftpClient: sftpClient.Client,
+		WriteCloser: transferChannel, filePath: filePath, tempPath: tempPath, attrs: data.FileAttributes,
+		partial: options.Partial}
 
 	return channel, nil
 }
 
-func (f *FileTranDataAdapter) createSftpDownloadChannel(resource Resource, path string) (io.ReadCloser, error) {
-	sftpClient, err := f.createSftpClient(resource)
+// createExtractUploadChannel 解压上传的压缩包到data.Path，解压不支持断点续传
+func (f *FileTranDataAdapter) createExtractUploadChannel(client *ClientPackage, data UploadData, offset int64) (WriteCloseRollback, error) {
+	if offset != 0 {
+		_ = client.Close()
+		return nil, fmt.Errorf("problem create upload channel: extract does not support offset %d", offset)
+	}
+	channel, err := newExtractUploadChannel(client, data.Path, data.Extract)
+	if err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("problem create upload channel: %v", err)
+	}
+	return channel, nil
+}
+
+// openUploadFile 打开上传的目标文件
+// offset为0时创建或截断文件，否则丢弃offset之后的内容并从offset处继续写入
+func (f *FileTranDataAdapter) openUploadFile(client *sftp.Client, filePath string, offset int64) (*sftp.File, error) {
+	if offset == 0 {
+		return client.Create(filePath)
+	}
+	file, err := client.OpenFile(filePath, os.O_WRONLY)
+	if err != nil {
+		return nil, err
+	}
+	fileInfo, err := file.Stat()
 	if err != nil {
-		return nil, fmt.Errorf("%v", err)
+		closeWithErrLog(file)
+		return nil, err
+	}
+	if fileInfo.Size() < offset {
+		closeWithErrLog(file)
+		return nil, fmt.Errorf("remote file size %d is less than offset %d", fileInfo.Size(), offset)
+	}
+	if err = file.Truncate(offset); err != nil {
+		closeWithErrLog(file)
+		return nil, err
+	}
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		closeWithErrLog(file)
+		return nil, err
+	}
+	return file, nil
+}
+
+func (f *FileTranDataAdapter) createSftpDownloadChannel(ctx context.Context, resource Resource, path string) (io.ReadCloser, error) {
+	sftpClient, err := f.createSftpClient(ctx, resource)
+	if err != nil {
+		return nil, err
 	}
 	fileInfo, err := sftpClient.Stat(path)
 	if err != nil {
@@ -95,44 +316,307 @@ func (f *FileTranDataAdapter) createSftpDownloadChannel(resource Resource, path
 		_ = sftpClient.Close()
 		return nil, fmt.Errorf("problem open file %v", err)
 	}
-	return &sftpDownloadChannel{sftpClient, file}, nil
+	return &sftpDownloadChannel{client: sftpClient, info: fileInfo, ReadSeekCloser: file}, nil
+}
+
+func (f *FileTranDataAdapter) ListDir(ctx context.Context, resource Resource, path string) ([]FileEntry, error) {
+	sftpClient, err := f.createSftpClient(ctx, resource)
+	if err != nil {
+		return nil, err
+	}
+	defer closeWithErrLog(sftpClient)
+	dirInfo, err := sftpClient.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("problem while search dir: %w", err)
+	}
+	if !dirInfo.IsDir() {
+		return nil, NotDirectory
+	}
+	infos, err := sftpClient.ReadDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("problem read dir: %w", err)
+	}
+	entries := make([]FileEntry, 0, len(infos))
+	for _, info := range infos {
+		var linkTarget string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if linkTarget, err = sftpClient.ReadLink(sftp.Join(path, info.Name())); err != nil {
+				log.Printf("problem read link %s: %v", info.Name(), err)
+			}
+		}
+		entries = append(entries, newFileEntry(info, linkTarget))
+	}
+	return entries, nil
+}
+
+func (f *FileTranDataAdapter) Stat(ctx context.Context, resource Resource, path string) (FileEntry, error) {
+	var entry FileEntry
+	err := f.operateRemote(ctx, resource, "stat", path, func(client *ClientPackage) error {
+		info, err := client.Lstat(path)
+		if err != nil {
+			return err
+		}
+		var linkTarget string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if linkTarget, err = client.ReadLink(path); err != nil {
+				log.Printf("problem read link %s: %v", path, err)
+			}
+		}
+		entry = newFileEntry(info, linkTarget)
+		return nil
+	})
+	return entry, err
+}
+
+func (f *FileTranDataAdapter) MakeDir(ctx context.Context, resource Resource, path string, parents bool) error {
+	return f.operateRemote(ctx, resource, "mkdir", path, func(client *ClientPackage) error {
+		if parents {
+			return client.MkdirAll(path)
+		}
+		if err := checkNotExist(client, path); err != nil {
+			return err
+		}
+		return client.Mkdir(path)
+	})
+}
+
+func (f *FileTranDataAdapter) Rename(ctx context.Context, resource Resource, path, newPath string) error {
+	return f.operateRemote(ctx, resource, "rename", path, func(client *ClientPackage) error {
+		if err := checkNotExist(client, newPath); err != nil {
+			return err
+		}
+		return client.Rename(path, newPath)
+	})
+}
+
+func (f *FileTranDataAdapter) Remove(ctx context.Context, resource Resource, path string, recursive bool) error {
+	return f.operateRemote(ctx, resource, "remove", path, func(client *ClientPackage) error {
+		info, err := client.Lstat(path)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return client.Remove(path)
+		}
+		if recursive {
+			return removeAll(client.Client, path)
+		}
+		children, err := client.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		if len(children) > 0 {
+			return DirectoryNotEmpty
+		}
+		return client.RemoveDirectory(path)
+	})
+}
+
+func (f *FileTranDataAdapter) Chmod(ctx context.Context, resource Resource, path string, mode os.FileMode) error {
+	return f.operateRemote(ctx, resource, "chmod", path, func(client *ClientPackage) error {
+		return client.Chmod(path, mode)
+	})
+}
+
+func (f *FileTranDataAdapter) Chown(ctx context.Context, resource Resource, path string, uid, gid int) error {
+	return f.operateRemote(ctx, resource, "chown", path, func(client *ClientPackage) error {
+		return client.Chown(path, uid, gid)
+	})
+}
+
+func (f *FileTranDataAdapter) Symlink(ctx context.Context, resource Resource, target, link string) error {
+	return f.operateRemote(ctx, resource, "symlink", link, func(client *ClientPackage) error {
+		if err := checkNotExist(client, link); err != nil {
+			return err
+		}
+		return client.Symlink(target, link)
+	})
+}
+
+// operateRemote 在目标资源上执行操作，操作失败时返回包括操作与路径的*os.PathError
+func (f *FileTranDataAdapter) operateRemote(ctx context.Context, resource Resource, op, path string, operate func(client *ClientPackage) error) error {
+	sftpClient, err := f.createSftpClient(ctx, resource)
+	if err != nil {
+		return err
+	}
+	defer closeWithErrLog(sftpClient)
+	if err = operate(sftpClient); err != nil {
+		// sftp返回的错误可能已经包括了内部调用的操作，只保留原因
+		var pathErr *os.PathError
+		if errors.As(err, &pathErr) {
+			err = pathErr.Err
+		}
+		return &os.PathError{Op: op, Path: path, Err: err}
+	}
+	return nil
+}
+
+// checkNotExist 路径已存在时返回os.ErrExist，sftp协议的失败状态无法区分已存在与其它原因
+func checkNotExist(client *ClientPackage, path string) error {
+	_, err := client.Lstat(path)
+	if err == nil {
+		return os.ErrExist
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
 }
 
-func (f *FileTranDataAdapter) createShhConfig(account Account) *ssh.ClientConfig {
+// removeAll 删除目录及其中的所有内容，符号链接只删除链接本身
+func removeAll(client *sftp.Client, root string) error {
+	var dirs []string
+	walker := client.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return err
+		}
+		if walker.Stat().IsDir() {
+			dirs = append(dirs, walker.Path())
+		} else if err := client.Remove(walker.Path()); err != nil {
+			return err
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := client.RemoveDirectory(dirs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createArchiveDownloadChannel 将目录或文件打包后下载
+func (f *FileTranDataAdapter) createArchiveDownloadChannel(ctx context.Context, resource Resource, path, format string) (io.ReadCloser, error) {
+	sftpClient, err := f.createSftpClient(ctx, resource)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = sftpClient.Stat(path); err != nil {
+		_ = sftpClient.Close()
+		return nil, fmt.Errorf("problem while search file %v", err)
+	}
+	return newArchiveDownloadChannel(sftpClient, path, format), nil
+}
+
+func (f *FileTranDataAdapter) createShhConfig(account Account, hostKeyCallback ssh.HostKeyCallback) (*ssh.ClientConfig, func(), error) {
+	authMethods, cleanup, err := f.createAuthMethods(account)
+	if err != nil {
+		return nil, nil, fmt.Errorf("problem create auth method: %v", err)
+	}
 	return &ssh.ClientConfig{
-		User: account.Name,
-		Auth: []ssh.AuthMethod{
-			ssh.Password(account.Password),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		User:            account.Name,
+		Auth:            authMethods,
+		HostKeyCallback: hostKeyCallback,
 		ClientVersion:   "",
-		Timeout:         10 * time.Second,
+		Timeout:         f.dialTimeout(),
+	}, cleanup, nil
+}
+
+func (f *FileTranDataAdapter) dialTimeout() time.Duration {
+	if f.sshConfig.Timeout > 0 {
+		return time.Duration(f.sshConfig.Timeout) * time.Second
 	}
+	return defaultDialTimeout
 }
 
-func (f *FileTranDataAdapter) createSftpClient(resource Resource) (*ClientPackage, error) {
-	sshConfig := f.createShhConfig(resource.Account)
-	sshClient, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", resource.Address, resource.Port), sshConfig)
+// createSftpClient 从连接池取出到目标资源的连接并打开sftp会话，关闭时连接归还到连接池
+func (f *FileTranDataAdapter) createSftpClient(ctx context.Context, resource Resource) (*ClientPackage, error) {
+	conn, err := f.pool.get(ctx, resource, func() (*ssh.Client, error) { return f.dialWithRetry(ctx, resource) })
 	if err != nil {
-		return nil, fmt.Errorf("problem dial target resource: %v", err)
+		return nil, err
 	}
-	sftpClient, err := sftp.NewClient(sshClient)
+	sftpClient, err := sftp.NewClient(conn.client)
 	if err != nil {
-		closeWithErrLog(sshClient)
+		conn.discard()
 		return nil, fmt.Errorf("problem create sftp client: %v", err)
 	}
-	c := &ClientPackage{sshClient: sshClient}
-	c.Client = sftpClient
-	return c, nil
+	return &ClientPackage{Client: sftpClient, sshClient: conn}, nil
+}
+
+// dialWithRetry 连接目标资源，连接失败时按配置的重试策略重试，ctx结束时停止等待重试
+func (f *FileTranDataAdapter) dialWithRetry(ctx context.Context, resource Resource) (*ssh.Client, error) {
+	policy := f.sshConfig.Retry
+	for retries := 0; ; retries++ {
+		client, err := f.dial(resource)
+		if err == nil || !isDialRetryable(err) || !policy.canRetry(retries) {
+			return client, err
+		}
+		backoff := policy.backoff(retries)
+		log.Printf("problem connect %s:%d, retry in %v: %v", resource.Address, resource.Port, backoff, err)
+		if !sleepContext(ctx, backoff) {
+			return nil, fmt.Errorf("problem wait for retry: %w", transferframe.CancelErr)
+		}
+	}
+}
+
+// 任务数据的存活时间
+const taskExpiration = 10 * time.Minute
+
+// statusExpiration 任务状态比任务保留更久，任务过期后仍可以查询到状态
+const statusExpiration = 24 * time.Hour
+
+// statusBufferSize 订阅任务状态的通道缓冲大小
+const statusBufferSize = 16
+
+// publishStatus 不阻塞地发送状态，通道已满时丢弃最早的状态
+func publishStatus(channel chan TaskStatus, status TaskStatus) {
+	for {
+		select {
+		case channel <- status:
+			return
+		default:
+		}
+		select {
+		case <-channel:
+		default:
+		}
+	}
 }
 
 type DataStore interface {
 	SaveUploadData(taskId string, data UploadData)
+	// GetUploadData 获取上传任务数据，不会删除任务
+	GetUploadData(taskId string) *UploadData
+	// GetUploadDataRemove 获取上传任务数据并删除任务，包括已提交的字节数
 	GetUploadDataRemove(taskId string) *UploadData
 	IsUploadTaskExist(taskId string) bool
+	// SaveUploadOffset 保存上传任务已提交的字节数，任务不存在时忽略
+	SaveUploadOffset(taskId string, offset int64)
+	// RenewTask 延长任务数据的存活时间，传输过程中保存进度时调用，任务不存在时忽略
+	RenewTask(taskId string)
+	// GetUploadOffset 获取上传任务已提交的字节数，没有记录时返回0
+	GetUploadOffset(taskId string) int64
+	// SaveHostKeyIfAbsent host没有保存过主机密钥时保存key，返回host当前信任的主机密钥
+	SaveHostKeyIfAbsent(host string, key string) string
 	SaveDownloadData(taskId string, data DownloadData)
+	// GetDownloadData 获取下载任务数据，任务在存活时间内可以重复使用
+	GetDownloadData(taskId string) *DownloadData
 	GetDownloadDataRemove(taskId string) *DownloadData
 	IsDownloadTaskExist(taskId string) bool
+	// SaveTaskStatus 保存任务状态并通知订阅者，状态在statusExpiration后过期
+	SaveTaskStatus(taskId string, status TaskStatus)
+	// GetTaskStatus 获取任务状态，没有记录时返回nil
+	GetTaskStatus(taskId string) *TaskStatus
+	// SubscribeTaskStatus 订阅任务状态的变化，调用返回的函数取消订阅并关闭通道
+	// 订阅者处理不及时会丢弃较早的状态
+	SubscribeTaskStatus(taskId string) (<-chan TaskStatus, func())
+	// SaveTaskCancel 标记任务被取消，执行传输的实例会轮询该标记
+	SaveTaskCancel(taskId string)
+	IsTaskCanceled(taskId string) bool
+	// SaveCopyData 保存复制任务，数据包括账号信息，与其它任务一样在taskExpiration后过期，只有任务状态保留statusExpiration
+	SaveCopyData(taskId string, data CopyData)
+	// GetCopyData 获取复制任务数据，不会删除任务
+	GetCopyData(taskId string) *CopyData
+	GetCopyDataRemove(taskId string) *CopyData
+	IsCopyTaskExist(taskId string) bool
+	// PushJob 将任务加入队列的末尾，队列不会过期
+	PushJob(job Job)
+	// PopJob 取出队首的任务并持有lease时长的租约，租约过期的任务会先回到队首，队列为空时返回nil
+	PopJob(lease time.Duration) *Job
+	// RenewJob 延长租约，租约已过期或任务已结束时返回false
+	RenewJob(job Job, lease time.Duration) bool
+	// FinishJob 删除任务的租约，任务不再回到队列
+	FinishJob(job Job)
 }
 
 type WriteCloseRollback interface {
@@ -140,24 +624,90 @@ type WriteCloseRollback interface {
 	RollBack() error
 }
 
+// Committer 上传通道在数据写完后需要确认时实现该接口，确认失败时上传会被回滚
+type Committer interface {
+	Commit() error
+}
+
 type SftpUploadChannel struct {
 	sshClient  io.Closer
 	sftpClient *sftp.Client
 	io.WriteCloser
 	filePath string
+	// tempPath 写入数据的临时文件，确认后重命名为filePath
+	tempPath   string
+	attrs      FileAttributes
+	partial    bool
+	fileClosed bool
+	committed  bool
+}
+
+// Commit 上传结束后设置文件属性并将临时文件重命名为目标文件，分段上传的中间请求不做处理
+func (s *SftpUploadChannel) Commit() error {
+	if s.partial {
+		return nil
+	}
+	// 部分服务端不能重命名打开的文件
+	s.fileClosed = true
+	if err := s.WriteCloser.Close(); err != nil {
+		return fmt.Errorf("problem close %s: %w", s.tempPath, err)
+	}
+	if err := applyFileAttributes(s.sftpClient, s.tempPath, s.attrs); err != nil {
+		return err
+	}
+	if err := replaceFile(s.sftpClient, s.tempPath, s.filePath); err != nil {
+		return fmt.Errorf("problem rename %s to %s: %w", s.tempPath, s.filePath, err)
+	}
+	s.committed = true
+	return nil
 }
 
 func (s *SftpUploadChannel) Close() error {
-	closeWithErrLog(s.WriteCloser)
+	if !s.fileClosed {
+		closeWithErrLog(s.WriteCloser)
+	}
 	closeWithErrLog(s.sftpClient)
 	closeWithErrLog(s.sshClient)
 	return nil
 }
 
+// RollBack 删除临时文件，目标文件保持上传前的内容，已确认的上传删除重命名后的目标文件
 func (s *SftpUploadChannel) RollBack() error {
-	return s.sftpClient.Remove(s.filePath)
+	if s.committed {
+		return s.sftpClient.Remove(s.filePath)
+	}
+	return s.sftpClient.Remove(s.tempPath)
 }
 
+// posixRenameExtension 服务端支持该扩展时重命名可以原子地替换已存在的文件
+const posixRenameExtension = "posix-rename@openssh.com"
+
+// uploadTempName 上传时写入的隐藏临时文件名
+func uploadTempName(filename, taskId string) string {
+	return fmt.Sprintf(".%s.%s.part", filename, taskId)
+}
+
+// replaceFile 将oldPath重命名为newPath，newPath为已存在的文件时被替换
+// 服务端不支持posix-rename扩展时先删除newPath再重命名，此时替换不是原子的
+func replaceFile(client *sftp.Client, oldPath, newPath string) error {
+	if _, ok := client.HasExtension(posixRenameExtension); ok {
+		return client.PosixRename(oldPath, newPath)
+	}
+	info, err := client.Lstat(newPath)
+	if err == nil {
+		if info.IsDir() {
+			return fmt.Errorf("%s is a directory", newPath)
+		}
+		if err = client.Remove(newPath); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return client.Rename(oldPath, newPath)
+}
+
+// ClientPackage sftp会话与所在的ssh连接，关闭时ssh连接归还到连接池
 type ClientPackage struct {
 	*sftp.Client
 	sshClient io.Closer
@@ -169,13 +719,20 @@ func (c *ClientPackage) Close() error {
 	return nil
 }
 
+// sftpDownloadChannel 可以定位读取位置的下载通道
 type sftpDownloadChannel struct {
 	client *ClientPackage
-	io.ReadCloser
+	info   os.FileInfo
+	io.ReadSeekCloser
+}
+
+// Stat 返回打开通道时获取的文件信息
+func (sf *sftpDownloadChannel) Stat() (os.FileInfo, error) {
+	return sf.info, nil
 }
 
 func (sf *sftpDownloadChannel) Close() error {
-	closeWithErrLog(sf.ReadCloser)
+	closeWithErrLog(sf.ReadSeekCloser)
 	_ = sf.client.Close()
 	return nil
 }
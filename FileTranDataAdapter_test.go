@@ -1,10 +1,15 @@
 package filetransfer_test
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"os"
+	"path/filepath"
 	"summersea.top/filetransfer"
 	"summersea.top/filetransfer/test"
 	"testing"
+	"time"
 )
 
 type StubDataStore struct {
@@ -16,15 +21,25 @@ type StubDataStore struct {
 	downloadExistCalls      int
 	getDownloadChannelCalls int
 	uploadData              filetransfer.UploadData
+	uploadOffset            int64
 	downloadData            filetransfer.DownloadData
+	hostKeys                map[string]string
+	statuses                map[string]filetransfer.TaskStatus
 }
 
 func (s *StubDataStore) SaveUploadData(taskId string, data filetransfer.UploadData) {
 	s.saveUploadCalls++
 }
 
-func (s *StubDataStore) GetUploadDataRemove(taskId string) *filetransfer.UploadData {
+func (s *StubDataStore) GetUploadData(taskId string) *filetransfer.UploadData {
 	s.getUploadChannelCalls++
+	if taskId == s.taskId {
+		return &s.uploadData
+	}
+	return nil
+}
+
+func (s *StubDataStore) GetUploadDataRemove(taskId string) *filetransfer.UploadData {
 	if taskId == s.taskId {
 		s.taskId = ""
 		return &s.uploadData
@@ -37,12 +52,73 @@ func (s *StubDataStore) IsUploadTaskExist(taskId string) bool {
 	return s.taskId == taskId
 }
 
+func (s *StubDataStore) SaveUploadOffset(taskId string, offset int64) {
+	if taskId == s.taskId {
+		s.uploadOffset = offset
+	}
+}
+
+func (s *StubDataStore) RenewTask(string) {
+	// Do nothing
+}
+
+func (s *StubDataStore) GetUploadOffset(taskId string) int64 {
+	if taskId == s.taskId {
+		return s.uploadOffset
+	}
+	return 0
+}
+
+func (s *StubDataStore) SaveHostKeyIfAbsent(host string, key string) string {
+	if s.hostKeys == nil {
+		s.hostKeys = make(map[string]string)
+	}
+	if trustedKey, exist := s.hostKeys[host]; exist {
+		return trustedKey
+	}
+	s.hostKeys[host] = key
+	return key
+}
+
+func (s *StubDataStore) SaveTaskStatus(taskId string, status filetransfer.TaskStatus) {
+	if s.statuses == nil {
+		s.statuses = make(map[string]filetransfer.TaskStatus)
+	}
+	s.statuses[taskId] = status
+}
+
+func (s *StubDataStore) GetTaskStatus(taskId string) *filetransfer.TaskStatus {
+	status, exist := s.statuses[taskId]
+	if !exist {
+		return nil
+	}
+	return &status
+}
+
+func (s *StubDataStore) SubscribeTaskStatus(string) (<-chan filetransfer.TaskStatus, func()) {
+	return make(chan filetransfer.TaskStatus), func() {}
+}
+
+func (s *StubDataStore) SaveTaskCancel(string) {
+}
+
+func (s *StubDataStore) IsTaskCanceled(string) bool {
+	return false
+}
+
 func (s *StubDataStore) SaveDownloadData(taskId string, data filetransfer.DownloadData) {
 	s.saveDownloadCalls++
 }
 
-func (s *StubDataStore) GetDownloadDataRemove(taskId string) *filetransfer.DownloadData {
+func (s *StubDataStore) GetDownloadData(taskId string) *filetransfer.DownloadData {
 	s.getDownloadChannelCalls++
+	if taskId == s.taskId {
+		return &s.downloadData
+	}
+	return nil
+}
+
+func (s *StubDataStore) GetDownloadDataRemove(taskId string) *filetransfer.DownloadData {
 	if taskId == s.taskId {
 		s.taskId = ""
 		return &s.downloadData
@@ -55,6 +131,35 @@ func (s *StubDataStore) IsDownloadTaskExist(taskId string) bool {
 	return s.taskId == taskId
 }
 
+func (s *StubDataStore) SaveCopyData(string, filetransfer.CopyData) {
+}
+
+func (s *StubDataStore) GetCopyData(string) *filetransfer.CopyData {
+	return nil
+}
+
+func (s *StubDataStore) GetCopyDataRemove(string) *filetransfer.CopyData {
+	return nil
+}
+
+func (s *StubDataStore) IsCopyTaskExist(string) bool {
+	return false
+}
+
+func (s *StubDataStore) PushJob(filetransfer.Job) {
+}
+
+func (s *StubDataStore) PopJob(time.Duration) *filetransfer.Job {
+	return nil
+}
+
+func (s *StubDataStore) RenewJob(filetransfer.Job, time.Duration) bool {
+	return false
+}
+
+func (s *StubDataStore) FinishJob(filetransfer.Job) {
+}
+
 func TestFileTranDataAdapter_SaveUploadData(t *testing.T) {
 	store := &StubDataStore{}
 	adapter := filetransfer.NewFileTranDataAdapter(store)
@@ -81,7 +186,7 @@ func TestFileTranDataAdapter_GetUploadChannel(t *testing.T) {
 		Filename: "testAaa.txt",
 	}}
 	adapter := filetransfer.NewFileTranDataAdapter(store)
-	channel, err := adapter.GetUploadChannel(existedTaskId)
+	channel, err := adapter.GetUploadChannel(context.Background(), existedTaskId, filetransfer.UploadOptions{})
 	if err != nil {
 		log.Printf("%v", err)
 	}
@@ -91,9 +196,89 @@ func TestFileTranDataAdapter_GetUploadChannel(t *testing.T) {
 		testutil.AssertNil(t, channel.RollBack())
 		testutil.AssertNil(t, channel.Close())
 	}
+	testutil.AssertTrue(t, adapter.IsUploadTaskExist(existedTaskId))
+	adapter.FinishUpload(existedTaskId)
 	testutil.AssertFalse(t, adapter.IsUploadTaskExist(existedTaskId))
 }
 
+func TestFileTranDataAdapter_AtomicUpload(t *testing.T) {
+	server := testutil.StartSshServer(t, testutil.NewPasswordServerConfig(t, "test", "pwd"))
+	resource := filetransfer.Resource{Address: server.Address, Port: server.Port,
+		Account: filetransfer.Account{Name: "test", Password: "pwd"}}
+	adapter := filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStore())
+	prepare := func(t *testing.T) (string, string) {
+		t.Helper()
+		dir := t.TempDir()
+		_ = os.WriteFile(filepath.Join(dir, "a.txt"), []byte("old"), 0644)
+		taskId := filetransfer.NewTaskId()
+		adapter.SaveUploadData(taskId, filetransfer.UploadData{Resource: resource, Path: dir, Filename: "a.txt"})
+		return dir, taskId
+	}
+	write := func(t *testing.T, taskId string, options filetransfer.UploadOptions, content string) filetransfer.WriteCloseRollback {
+		t.Helper()
+		channel, err := adapter.GetUploadChannel(context.Background(), taskId, options)
+		if err != nil {
+			t.Fatalf("problem get upload channel: %v", err)
+		}
+		_, err = channel.Write([]byte(content))
+		testutil.AssertNil(t, err)
+		return channel
+	}
+	assertContent := func(t *testing.T, path, want string) {
+		t.Helper()
+		got, err := os.ReadFile(path)
+		testutil.AssertNil(t, err)
+		testutil.AssertStringEqual(t, string(got), want)
+	}
+	tempPath := func(dir, taskId string) string {
+		return filepath.Join(dir, fmt.Sprintf(".a.txt.%s.part", taskId))
+	}
+
+	t.Run("replaced after commit", func(t *testing.T) {
+		dir, taskId := prepare(t)
+		channel := write(t, taskId, filetransfer.UploadOptions{}, "new")
+		assertContent(t, filepath.Join(dir, "a.txt"), "old")
+		assertContent(t, tempPath(dir, taskId), "new")
+		testutil.AssertNil(t, channel.(filetransfer.Committer).Commit())
+		testutil.AssertNil(t, channel.Close())
+		assertContent(t, filepath.Join(dir, "a.txt"), "new")
+		_, err := os.Stat(tempPath(dir, taskId))
+		testutil.AssertTrue(t, os.IsNotExist(err))
+	})
+
+	t.Run("rollback keeps previous file", func(t *testing.T) {
+		dir, taskId := prepare(t)
+		channel := write(t, taskId, filetransfer.UploadOptions{}, "new")
+		testutil.AssertNil(t, channel.RollBack())
+		testutil.AssertNil(t, channel.Close())
+		assertContent(t, filepath.Join(dir, "a.txt"), "old")
+		_, err := os.Stat(tempPath(dir, taskId))
+		testutil.AssertTrue(t, os.IsNotExist(err))
+	})
+
+	t.Run("resume temp file", func(t *testing.T) {
+		dir, taskId := prepare(t)
+		channel := write(t, taskId, filetransfer.UploadOptions{Partial: true}, "abc")
+		testutil.AssertNil(t, channel.(filetransfer.Committer).Commit())
+		testutil.AssertNil(t, channel.Close())
+		assertContent(t, filepath.Join(dir, "a.txt"), "old")
+		channel = write(t, taskId, filetransfer.UploadOptions{Offset: 3}, "def")
+		testutil.AssertNil(t, channel.(filetransfer.Committer).Commit())
+		testutil.AssertNil(t, channel.Close())
+		assertContent(t, filepath.Join(dir, "a.txt"), "abcdef")
+	})
+}
+
+func TestFileTranDataAdapter_CommitUploadOffset(t *testing.T) {
+	existedTaskId := filetransfer.NewTaskId()
+	store := &StubDataStore{taskId: existedTaskId}
+	adapter := filetransfer.NewFileTranDataAdapter(store)
+	testutil.AssertTrue(t, adapter.GetUploadOffset(existedTaskId) == 0)
+	adapter.CommitUploadOffset(existedTaskId, 100)
+	testutil.AssertTrue(t, adapter.GetUploadOffset(existedTaskId) == 100)
+	testutil.AssertTrue(t, adapter.GetUploadOffset(filetransfer.NewTaskId()) == 0)
+}
+
 func TestFileTranDataAdapter_SaveDownloadData(t *testing.T) {
 	store := &StubDataStore{}
 	adapter := filetransfer.NewFileTranDataAdapter(store)
@@ -115,7 +300,7 @@ func TestFileTranDataAdapter_IsDownloadTaskExist(t *testing.T) {
 // Path指定的目标为目录
 // 析出filename
 // sftp连接成功
-// 任务号清空
+// 任务在存活时间内保留
 func TestFileTranDataAdapter_GetDownloadChannelFilename(t *testing.T) {
 	existedTaskId := filetransfer.NewTaskId()
 	t.Run("common test", func(t *testing.T) {
@@ -125,7 +310,7 @@ func TestFileTranDataAdapter_GetDownloadChannelFilename(t *testing.T) {
 			Path: "/home/test/ccc.txt",
 		}}
 		adapter := filetransfer.NewFileTranDataAdapter(store)
-		channel, filename, err := adapter.GetDownloadChannelFilename(existedTaskId)
+		channel, filename, err := adapter.GetDownloadChannelFilename(context.Background(), existedTaskId)
 		if err != nil {
 			log.Printf("%v", err)
 		}
@@ -135,7 +320,7 @@ func TestFileTranDataAdapter_GetDownloadChannelFilename(t *testing.T) {
 			testutil.AssertNil(t, channel.Close())
 		}
 		testutil.AssertStringEqual(t, filename, "ccc.txt")
-		testutil.AssertFalse(t, adapter.IsUploadTaskExist(existedTaskId))
+		testutil.AssertTrue(t, adapter.IsDownloadTaskExist(existedTaskId))
 	})
 
 	t.Run("input path without filename", func(t *testing.T) {
@@ -144,7 +329,7 @@ func TestFileTranDataAdapter_GetDownloadChannelFilename(t *testing.T) {
 			Path:     "/home/test",
 		}}
 		adapter := filetransfer.NewFileTranDataAdapter(store)
-		_, _, err := adapter.GetDownloadChannelFilename(existedTaskId)
+		_, _, err := adapter.GetDownloadChannelFilename(context.Background(), existedTaskId)
 		testutil.AssertErrEquals(t, err, filetransfer.DownloadDir)
 	})
 }
@@ -0,0 +1,36 @@
+package filetransfer
+
+// SshConfig 连接目标资源时使用的ssh配置
+type SshConfig struct {
+	// Keys 服务端保存的私钥，请求中通过keyId引用
+	Keys []SshKeyConfig `yaml:"keys,omitempty"`
+	// HostKey 主机密钥的校验方式
+	HostKey HostKeyConfig `yaml:"hostKey,omitempty"`
+	// Retry 连接目标资源失败时的重试策略
+	Retry RetryPolicy `yaml:"retry,omitempty"`
+	// Pool ssh连接池的配置
+	Pool PoolConfig `yaml:"pool,omitempty"`
+	// AllowAgent 是否允许请求使用服务端的ssh agent认证，agent中的私钥对所有请求可用，默认不允许
+	AllowAgent bool `yaml:"allowAgent,omitempty"`
+	// Timeout 连接与ssh握手的超时时间，单位为秒，经过跳板机时每一跳单独计算，为0时使用defaultDialTimeout
+	Timeout int `yaml:"timeout,omitempty"`
+}
+
+type HostKeyConfig struct {
+	// Policy 校验策略，可选tofu、knownHosts、insecure，默认为tofu
+	Policy string `yaml:"policy,omitempty"`
+	// KnownHosts known_hosts文件的路径，knownHosts策略时使用
+	KnownHosts string `yaml:"knownHosts,omitempty"`
+}
+
+type SshKeyConfig struct {
+	Id         string `yaml:"id"`
+	Path       string `yaml:"path"`
+	Passphrase string `yaml:"passphrase,omitempty"`
+}
+
+// CreateAdapterByConfig 根据配置文件创建数据适配器，没有配置时使用默认配置
+// 已经读取过配置时使用NewFileTranDataAdapterWithConfig，避免重复读取配置文件
+func CreateAdapterByConfig(store DataStore) *FileTranDataAdapter {
+	return NewFileTranDataAdapterWithConfig(store, LoadConfig().Ssh)
+}
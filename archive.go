@@ -0,0 +1,198 @@
+package filetransfer
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"github.com/pkg/sftp"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+const ArchiveZip = "zip"
+const ArchiveTar = "tar"
+const ArchiveTarGz = "tar.gz"
+
+func isArchiveFormatValid(format string) bool {
+	return format == ArchiveZip || format == ArchiveTar || format == ArchiveTarGz
+}
+
+// archiveDownloadChannel 边遍历远程目录边生成压缩包，压缩包不会缓存到本地
+type archiveDownloadChannel struct {
+	client *ClientPackage
+	*io.PipeReader
+	done chan struct{}
+}
+
+// newArchiveDownloadChannel 在后台协程中将root打包为format格式写入管道
+func newArchiveDownloadChannel(client *ClientPackage, root, format string) *archiveDownloadChannel {
+	reader, writer := io.Pipe()
+	channel := &archiveDownloadChannel{client: client, PipeReader: reader, done: make(chan struct{})}
+	go func() {
+		defer close(channel.done)
+		_ = writer.CloseWithError(writeArchive(client.Client, root, format, writer))
+	}()
+	return channel
+}
+
+// Close 关闭管道后等待打包协程退出，再关闭sftp连接
+func (a *archiveDownloadChannel) Close() error {
+	closeWithErrLog(a.PipeReader)
+	<-a.done
+	return a.client.Close()
+}
+
+// writeArchive 将root打包写入writer，包内的路径以root的名称开头
+func writeArchive(client *sftp.Client, root, format string, writer io.Writer) error {
+	switch format {
+	case ArchiveZip:
+		zipWriter := zip.NewWriter(writer)
+		if err := walkArchive(client, root, zipEntryWriter(client, zipWriter)); err != nil {
+			return err
+		}
+		return zipWriter.Close()
+	case ArchiveTar:
+		tarWriter := tar.NewWriter(writer)
+		if err := walkArchive(client, root, tarEntryWriter(client, tarWriter)); err != nil {
+			return err
+		}
+		return tarWriter.Close()
+	case ArchiveTarGz:
+		gzipWriter := gzip.NewWriter(writer)
+		tarWriter := tar.NewWriter(gzipWriter)
+		if err := walkArchive(client, root, tarEntryWriter(client, tarWriter)); err != nil {
+			return err
+		}
+		if err := tarWriter.Close(); err != nil {
+			return err
+		}
+		return gzipWriter.Close()
+	}
+	return fmt.Errorf("unknown archive format %s", format)
+}
+
+// archiveEntryWriter 写入压缩包中的一项，name为包内路径，filePath为远程路径
+type archiveEntryWriter func(name, filePath string, info os.FileInfo) error
+
+func walkArchive(client *sftp.Client, root string, writeEntry archiveEntryWriter) error {
+	base := path.Base(root)
+	walker := client.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return fmt.Errorf("problem walk %s: %v", walker.Path(), err)
+		}
+		name := path.Join(base, strings.TrimPrefix(walker.Path(), root))
+		if err := writeEntry(name, walker.Path(), walker.Stat()); err != nil {
+			return fmt.Errorf("problem archive %s: %v", walker.Path(), err)
+		}
+	}
+	return nil
+}
+
+func zipEntryWriter(client *sftp.Client, zipWriter *zip.Writer) archiveEntryWriter {
+	return func(name, filePath string, info os.FileInfo) error {
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		switch {
+		case info.IsDir():
+			header.Name += "/"
+			_, err = zipWriter.CreateHeader(header)
+			return err
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := client.ReadLink(filePath)
+			if err != nil {
+				return err
+			}
+			entry, err := zipWriter.CreateHeader(header)
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(entry, target)
+			return err
+		case info.Mode().IsRegular():
+			header.Method = zip.Deflate
+			entry, err := zipWriter.CreateHeader(header)
+			if err != nil {
+				return err
+			}
+			return copyRemoteFile(client, filePath, entry)
+		}
+		return nil
+	}
+}
+
+func tarEntryWriter(client *sftp.Client, tarWriter *tar.Writer) archiveEntryWriter {
+	return func(name, filePath string, info os.FileInfo) error {
+		link := ""
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := client.ReadLink(filePath)
+			if err != nil {
+				return err
+			}
+			link = target
+		} else if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if stat, ok := info.Sys().(*sftp.FileStat); ok {
+			header.Uid = int(stat.UID)
+			header.Gid = int(stat.GID)
+		}
+		if err = tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			return copyTarFile(client, filePath, header.Size, tarWriter)
+		}
+		return nil
+	}
+}
+
+// copyTarFile 按头部中的大小写入文件内容，打包过程中文件变大时截断，变小时补0，避免整个压缩包失败
+func copyTarFile(client *sftp.Client, filePath string, size int64, tarWriter *tar.Writer) error {
+	file, err := client.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer closeWithErrLog(file)
+	written, err := io.CopyN(tarWriter, file, size)
+	if err == io.EOF {
+		log.Printf("problem archive %s: file shrunk from %d to %d bytes", filePath, size, written)
+		_, err = io.CopyN(tarWriter, zeroReader{}, size-written)
+	}
+	return err
+}
+
+// zeroReader 读出的内容全部为0
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+func copyRemoteFile(client *sftp.Client, filePath string, writer io.Writer) error {
+	file, err := client.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer closeWithErrLog(file)
+	_, err = io.Copy(writer, file)
+	return err
+}
@@ -0,0 +1,177 @@
+package filetransfer_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"summersea.top/filetransfer"
+	testutil "summersea.top/filetransfer/test"
+	"testing"
+)
+
+func TestFileTranDataAdapter_ArchiveDownload(t *testing.T) {
+	server := testutil.StartSshServer(t, testutil.NewPasswordServerConfig(t, "test", "pwd"))
+	resource := filetransfer.Resource{Address: server.Address, Port: server.Port,
+		Account: filetransfer.Account{Name: "test", Password: "pwd"}}
+	root := filepath.Join(t.TempDir(), "logs")
+	wantFiles := map[string]string{
+		"logs/app.log":         "app log content",
+		"logs/nested/err.log":  "error log content",
+		"logs/nested/deep/a.z": "",
+	}
+	for name, content := range wantFiles {
+		filePath := filepath.Join(filepath.Dir(root), name)
+		_ = os.MkdirAll(filepath.Dir(filePath), 0755)
+		_ = os.WriteFile(filePath, []byte(content), 0644)
+	}
+	wantNames := []string{"logs/", "logs/app.log", "logs/nested/", "logs/nested/deep/", "logs/nested/deep/a.z", "logs/nested/err.log"}
+
+	download := func(t *testing.T, format string) ([]byte, string) {
+		t.Helper()
+		taskId := filetransfer.NewTaskId()
+		adapter := filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStore())
+		adapter.SaveDownloadData(taskId, filetransfer.DownloadData{Resource: resource, Path: root, Archive: format})
+		channel, filename, err := adapter.GetDownloadChannelFilename(context.Background(), taskId)
+		if err != nil {
+			t.Fatalf("problem get download channel: %v", err)
+		}
+		content, err := io.ReadAll(channel)
+		testutil.AssertNil(t, err)
+		testutil.AssertNil(t, channel.Close())
+		return content, filename
+	}
+
+	t.Run("zip", func(t *testing.T) {
+		content, filename := download(t, filetransfer.ArchiveZip)
+		testutil.AssertStringEqual(t, filename, "logs.zip")
+		zipReader, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+		if err != nil {
+			t.Fatalf("problem read zip: %v", err)
+		}
+		gotFiles := map[string]string{}
+		var gotNames []string
+		for _, file := range zipReader.File {
+			gotNames = append(gotNames, file.Name)
+			if !file.FileInfo().IsDir() {
+				reader, _ := file.Open()
+				fileContent, _ := io.ReadAll(reader)
+				_ = reader.Close()
+				gotFiles[file.Name] = string(fileContent)
+			}
+		}
+		sort.Strings(gotNames)
+		testutil.AssertStructEquals(t, gotNames, wantNames)
+		testutil.AssertStructEquals(t, gotFiles, wantFiles)
+	})
+
+	for _, format := range []string{filetransfer.ArchiveTar, filetransfer.ArchiveTarGz} {
+		t.Run(format, func(t *testing.T) {
+			content, filename := download(t, format)
+			testutil.AssertStringEqual(t, filename, "logs."+format)
+			var reader io.Reader = bytes.NewReader(content)
+			if format == filetransfer.ArchiveTarGz {
+				gzipReader, err := gzip.NewReader(reader)
+				if err != nil {
+					t.Fatalf("problem read gzip: %v", err)
+				}
+				reader = gzipReader
+			}
+			tarReader := tar.NewReader(reader)
+			gotFiles := map[string]string{}
+			var gotNames []string
+			for {
+				header, err := tarReader.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("problem read tar: %v", err)
+				}
+				gotNames = append(gotNames, header.Name)
+				if !strings.HasSuffix(header.Name, "/") {
+					fileContent, _ := io.ReadAll(tarReader)
+					gotFiles[header.Name] = string(fileContent)
+				}
+			}
+			sort.Strings(gotNames)
+			testutil.AssertStructEquals(t, gotNames, wantNames)
+			testutil.AssertStructEquals(t, gotFiles, wantFiles)
+		})
+	}
+
+	t.Run("directory without archive", func(t *testing.T) {
+		taskId := filetransfer.NewTaskId()
+		adapter := filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStore())
+		adapter.SaveDownloadData(taskId, filetransfer.DownloadData{Resource: resource, Path: root})
+		_, _, err := adapter.GetDownloadChannelFilename(context.Background(), taskId)
+		testutil.AssertErrEquals(t, err, filetransfer.DownloadDir)
+	})
+
+	t.Run("close before finished", func(t *testing.T) {
+		taskId := filetransfer.NewTaskId()
+		adapter := filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStore())
+		adapter.SaveDownloadData(taskId, filetransfer.DownloadData{Resource: resource, Path: root, Archive: filetransfer.ArchiveTar})
+		channel, _, err := adapter.GetDownloadChannelFilename(context.Background(), taskId)
+		if err != nil {
+			t.Fatalf("problem get download channel: %v", err)
+		}
+		_, _ = channel.Read(make([]byte, 10))
+		testutil.AssertNil(t, channel.Close())
+	})
+}
+
+func TestFileTranDataAdapter_ArchiveSizeChanged(t *testing.T) {
+	server := testutil.StartSshServer(t, testutil.NewPasswordServerConfig(t, "test", "pwd"))
+	resource := filetransfer.Resource{Address: server.Address, Port: server.Port,
+		Account: filetransfer.Account{Name: "test", Password: "pwd"}}
+	root := filepath.Join(t.TempDir(), "changing")
+	_ = os.MkdirAll(root, 0755)
+	big := strings.Repeat("a", 256*1024)
+	_ = os.WriteFile(filepath.Join(root, "a.log"), []byte(big), 0644)
+	_ = os.WriteFile(filepath.Join(root, "b.log"), []byte("grow"), 0644)
+	_ = os.WriteFile(filepath.Join(root, "c.log"), []byte("shrink"), 0644)
+	taskId := filetransfer.NewTaskId()
+	adapter := filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStore())
+	adapter.SaveDownloadData(taskId, filetransfer.DownloadData{Resource: resource, Path: root, Archive: filetransfer.ArchiveTar})
+	channel, _, err := adapter.GetDownloadChannelFilename(context.Background(), taskId)
+	if err != nil {
+		t.Fatalf("problem get download channel: %v", err)
+	}
+	defer func() { _ = channel.Close() }()
+	// 读到a.log的内容时目录已经列出，此时修改的文件大小与头部中的不一致
+	head := make([]byte, 2048)
+	_, err = io.ReadFull(channel, head)
+	testutil.AssertNil(t, err)
+	_ = os.WriteFile(filepath.Join(root, "b.log"), []byte("grow more"), 0644)
+	_ = os.WriteFile(filepath.Join(root, "c.log"), []byte("shr"), 0644)
+	rest, err := io.ReadAll(channel)
+	testutil.AssertNil(t, err)
+
+	tarReader := tar.NewReader(io.MultiReader(bytes.NewReader(head), bytes.NewReader(rest)))
+	gotFiles := map[string]string{}
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("problem read tar: %v", err)
+		}
+		if !strings.HasSuffix(header.Name, "/") {
+			fileContent, _ := io.ReadAll(tarReader)
+			gotFiles[header.Name] = string(fileContent)
+		}
+	}
+	testutil.AssertStructEquals(t, gotFiles, map[string]string{
+		"changing/a.log": big,
+		"changing/b.log": "grow",
+		"changing/c.log": "shr\x00\x00\x00",
+	})
+}
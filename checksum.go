@@ -0,0 +1,189 @@
+package filetransfer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"summersea.top/filetransfer/transferframe"
+)
+
+var ChecksumMismatch = errors.New("checksum mismatch")
+
+var InvalidChecksum = errors.New("invalid checksum")
+
+var ChecksumRangeUnsupported = errors.New("checksum not supported for ranged upload")
+
+// Checksum 上传文件的期望摘要
+type Checksum struct {
+	// Algorithm 摘要算法，可选md5、sha1、sha256
+	Algorithm string `json:"algorithm"`
+	// Value 十六进制的摘要
+	Value string `json:"value"`
+}
+
+// getExpectedChecksums 获取上传请求的期望摘要，包括任务初始化时指定的摘要
+// 初始化时指定的摘要只能在一次请求中校验整个文件，请求体不是整个文件时返回ChecksumRangeUnsupported
+func (fs *FileServerController) getExpectedChecksums(taskId string, request *http.Request, uploadRange uploadRange) (expectedChecksums, error) {
+	expected, err := parseChecksumHeader(textproto.MIMEHeader(request.Header))
+	if err != nil {
+		return nil, err
+	}
+	data := fs.dataAdapter.GetUploadData(taskId)
+	if data == nil || data.Checksum == nil {
+		return expected, nil
+	}
+	if !uploadRange.isWhole(request.ContentLength) {
+		return nil, ChecksumRangeUnsupported
+	}
+	digest, err := data.Checksum.digest()
+	if err != nil {
+		return nil, err
+	}
+	if err = expected.add(data.Checksum.Algorithm, digest); err != nil {
+		return nil, err
+	}
+	return expected, nil
+}
+
+func isChecksumValid(checksum Checksum) bool {
+	_, err := checksum.digest()
+	return err == nil
+}
+
+func (c Checksum) digest() ([]byte, error) {
+	digest, err := hex.DecodeString(c.Value)
+	if err != nil || !isDigestSizeValid(c.Algorithm, digest) {
+		return nil, InvalidChecksum
+	}
+	return digest, nil
+}
+
+// digestAlgorithms RFC 3230中Digest请求头的算法名与摘要算法的对应关系
+var digestAlgorithms = map[string]string{
+	"md5":     transferframe.ChecksumMD5,
+	"sha":     transferframe.ChecksumSHA1,
+	"sha-256": transferframe.ChecksumSHA256,
+}
+
+// expectedChecksums 摘要算法对应的期望摘要
+type expectedChecksums map[string][]byte
+
+// parseChecksumHeader 解析Content-MD5与Digest头中的期望摘要，Digest中不支持的算法会被忽略
+func parseChecksumHeader(header textproto.MIMEHeader) (expectedChecksums, error) {
+	expected := expectedChecksums{}
+	if contentMd5 := header.Get("Content-MD5"); contentMd5 != "" {
+		if err := expected.addBase64(transferframe.ChecksumMD5, contentMd5); err != nil {
+			return nil, err
+		}
+	}
+	for _, value := range header.Values("Digest") {
+		for _, item := range strings.Split(value, ",") {
+			sepIndex := strings.Index(item, "=")
+			if sepIndex < 0 {
+				return nil, InvalidChecksum
+			}
+			algorithm, ok := digestAlgorithms[strings.ToLower(strings.TrimSpace(item[:sepIndex]))]
+			if !ok {
+				continue
+			}
+			if err := expected.addBase64(algorithm, strings.TrimSpace(item[sepIndex+1:])); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return expected, nil
+}
+
+func (e expectedChecksums) addBase64(algorithm, value string) error {
+	digest, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || !isDigestSizeValid(algorithm, digest) {
+		return InvalidChecksum
+	}
+	return e.add(algorithm, digest)
+}
+
+// add 添加期望摘要，同一算法的摘要不一致时返回InvalidChecksum
+func (e expectedChecksums) add(algorithm string, digest []byte) error {
+	if saved, ok := e[algorithm]; ok && !bytes.Equal(saved, digest) {
+		return InvalidChecksum
+	}
+	e[algorithm] = digest
+	return nil
+}
+
+func (e expectedChecksums) writers() []*transferframe.ChecksumWriter {
+	writers := make([]*transferframe.ChecksumWriter, 0, len(e))
+	for algorithm := range e {
+		writer, _ := transferframe.NewChecksumWriter(algorithm)
+		writers = append(writers, writer)
+	}
+	return writers
+}
+
+// verify 比较传输过程中计算的摘要
+func (e expectedChecksums) verify(writers []*transferframe.ChecksumWriter) error {
+	for _, writer := range writers {
+		if sum := writer.Sum(); !bytes.Equal(sum, e[writer.Algorithm()]) {
+			return fmt.Errorf("%w: %s got %s", ChecksumMismatch, writer.Algorithm(), hex.EncodeToString(sum))
+		}
+	}
+	return nil
+}
+
+func isDigestSizeValid(algorithm string, digest []byte) bool {
+	size := transferframe.ChecksumSize(algorithm)
+	return size > 0 && len(digest) == size
+}
+
+// getDigestAlgorithm 根据Want-Digest头选择下载时计算的摘要算法，默认为sha256
+// 返回的名称用于Digest头
+func getDigestAlgorithm(request *http.Request) (string, string) {
+	wantDigest := request.Header.Get("Want-Digest")
+	bestName, bestQuality := "", -1.0
+	for _, item := range strings.Split(wantDigest, ",") {
+		name, quality := parseWantDigestItem(item)
+		if _, ok := digestAlgorithms[name]; ok && quality > 0 && quality > bestQuality {
+			bestName, bestQuality = name, quality
+		}
+	}
+	if bestName == "" {
+		return "SHA-256", transferframe.ChecksumSHA256
+	}
+	return strings.ToUpper(bestName), digestAlgorithms[bestName]
+}
+
+// wantsDigestTrailer 客户端发送Want-Digest或在TE头中声明接受trailers时返回true
+func wantsDigestTrailer(request *http.Request) bool {
+	if request.Header.Get("Want-Digest") != "" {
+		return true
+	}
+	for _, value := range request.Header.Values("TE") {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(strings.Split(item, ";")[0]), "trailers") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseWantDigestItem 解析“sha-256;q=0.5”格式的算法与权重，没有权重时为1
+func parseWantDigestItem(item string) (string, float64) {
+	params := strings.Split(item, ";")
+	name := strings.ToLower(strings.TrimSpace(params[0]))
+	quality := 1.0
+	for _, param := range params[1:] {
+		param = strings.TrimSpace(param)
+		if strings.HasPrefix(param, "q=") {
+			if _, err := fmt.Sscanf(param[2:], "%g", &quality); err != nil {
+				quality = 0
+			}
+		}
+	}
+	return name, quality
+}
@@ -0,0 +1,223 @@
+package filetransfer_test
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	uuid "github.com/satori/go.uuid"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"summersea.top/filetransfer"
+	testutil "summersea.top/filetransfer/test"
+	"testing"
+)
+
+func TestUploadInitWithChecksum(t *testing.T) {
+	fileServer := filetransfer.NewFileServer(&StubAdapter{})
+	resource := filetransfer.Resource{Address: "addr", Port: 22, Account: filetransfer.Account{Name: "a", Password: "pwd"}}
+	sha256Sum := sha256.Sum256([]byte("content"))
+	testCases := []struct {
+		checksum   filetransfer.Checksum
+		wantStatus int
+	}{
+		{filetransfer.Checksum{Algorithm: "sha256", Value: hex.EncodeToString(sha256Sum[:])}, http.StatusOK},
+		{filetransfer.Checksum{Algorithm: "md5", Value: hex.EncodeToString(sha256Sum[:])}, http.StatusBadRequest},
+		{filetransfer.Checksum{Algorithm: "crc32", Value: "cbf43926"}, http.StatusBadRequest},
+		{filetransfer.Checksum{Algorithm: "sha256", Value: "not hex"}, http.StatusBadRequest},
+	}
+	for _, test := range testCases {
+		checksum := test.checksum
+		body := filetransfer.UploadInitReqBody{Resource: resource, Path: "/root", Filename: "a.txt", Checksum: &checksum}
+		testCase(t, initTestCase{requestBody: body, wantResponseStatus: test.wantStatus}, initUploadUrl, fileServer)
+	}
+}
+
+func TestUploadChecksum(t *testing.T) {
+	const content = "0123456789"
+	md5Sum := md5.Sum([]byte(content))
+	sha1Sum := sha1.Sum([]byte(content))
+	sha256Sum := sha256.Sum256([]byte(content))
+	wrongSum := md5.Sum([]byte("wrong"))
+	newChecksumServer := func(checksum *filetransfer.Checksum) (*StubAdapter, http.Handler, string) {
+		taskId := uuid.NewV4().String()
+		adapter := &StubAdapter{filename: filepath.Join(t.TempDir(), "checksum.txt")}
+		adapter.SaveUploadData(taskId, filetransfer.UploadData{Checksum: checksum})
+		return adapter, filetransfer.NewFileServer(adapter), taskId
+	}
+	upload := func(fileServer http.Handler, taskId string, header http.Header) *httptest.ResponseRecorder {
+		request := newPostRequestReader(fmt.Sprintf("%s?taskId=%s", uploadUrl, taskId), strings.NewReader(content))
+		for key, values := range header {
+			request.Header[key] = values
+		}
+		response := httptest.NewRecorder()
+		fileServer.ServeHTTP(response, request)
+		return response
+	}
+
+	okCases := map[string]http.Header{
+		"content md5": {"Content-Md5": {base64.StdEncoding.EncodeToString(md5Sum[:])}},
+		"digest": {"Digest": {"unixsum=30637, SHA=" + base64.StdEncoding.EncodeToString(sha1Sum[:]) +
+			",SHA-256=" + base64.StdEncoding.EncodeToString(sha256Sum[:])}},
+	}
+	for name, header := range okCases {
+		t.Run(name, func(t *testing.T) {
+			adapter, fileServer, taskId := newChecksumServer(nil)
+			testutil.AssertIntEquals(t, upload(fileServer, taskId, header).Code, http.StatusNoContent)
+			got, _ := os.ReadFile(adapter.filename)
+			testutil.AssertStringEqual(t, string(got), content)
+		})
+	}
+
+	t.Run("init checksum", func(t *testing.T) {
+		adapter, fileServer, taskId := newChecksumServer(&filetransfer.Checksum{Algorithm: "sha256",
+			Value: hex.EncodeToString(sha256Sum[:])})
+		testutil.AssertIntEquals(t, upload(fileServer, taskId, nil).Code, http.StatusNoContent)
+		got, _ := os.ReadFile(adapter.filename)
+		testutil.AssertStringEqual(t, string(got), content)
+	})
+
+	t.Run("mismatch rolls back", func(t *testing.T) {
+		adapter, fileServer, taskId := newChecksumServer(&filetransfer.Checksum{Algorithm: "md5",
+			Value: hex.EncodeToString(wrongSum[:])})
+		response := upload(fileServer, taskId, nil)
+		testutil.AssertIntEquals(t, response.Code, http.StatusBadRequest)
+		testutil.AssertStringEqual(t, extractErrorBody(t, response).Error.Code, filetransfer.ErrorCodeChecksumMismatch)
+		_, err := os.Stat(adapter.filename)
+		testutil.AssertTrue(t, os.IsNotExist(err))
+		testutil.AssertTrue(t, adapter.IsUploadTaskExist(taskId))
+		testutil.AssertIntEquals(t, int(adapter.GetUploadOffset(taskId)), 0)
+	})
+
+	t.Run("init checksum rejected for partial upload", func(t *testing.T) {
+		adapter, fileServer, taskId := newChecksumServer(&filetransfer.Checksum{Algorithm: "md5",
+			Value: hex.EncodeToString(md5Sum[:])})
+		response := upload(fileServer, taskId, http.Header{"Content-Range": {"bytes 0-9/20"}})
+		testutil.AssertIntEquals(t, response.Code, http.StatusBadRequest)
+		testutil.AssertStringEqual(t, extractErrorBody(t, response).Error.Code, filetransfer.ErrorCodeInvalidParam)
+		testutil.AssertIntEquals(t, int(adapter.GetUploadOffset(taskId)), 0)
+	})
+
+	t.Run("init checksum for whole file range", func(t *testing.T) {
+		adapter, fileServer, taskId := newChecksumServer(&filetransfer.Checksum{Algorithm: "md5",
+			Value: hex.EncodeToString(wrongSum[:])})
+		response := upload(fileServer, taskId, http.Header{"Content-Range": {"bytes 0-9/10"}})
+		testutil.AssertIntEquals(t, response.Code, http.StatusBadRequest)
+		testutil.AssertStringEqual(t, extractErrorBody(t, response).Error.Code, filetransfer.ErrorCodeChecksumMismatch)
+		_, err := os.Stat(adapter.filename)
+		testutil.AssertTrue(t, os.IsNotExist(err))
+	})
+
+	invalidCases := map[string]http.Header{
+		"invalid content md5": {"Content-Md5": {"not base64"}},
+		"invalid digest size": {"Digest": {"SHA-256=" + base64.StdEncoding.EncodeToString(md5Sum[:])}},
+		"conflicting digests": {"Content-Md5": {base64.StdEncoding.EncodeToString(md5Sum[:])},
+			"Digest": {"MD5=" + base64.StdEncoding.EncodeToString(wrongSum[:])}},
+	}
+	for name, header := range invalidCases {
+		t.Run(name, func(t *testing.T) {
+			_, fileServer, taskId := newChecksumServer(nil)
+			response := upload(fileServer, taskId, header)
+			testutil.AssertIntEquals(t, response.Code, http.StatusBadRequest)
+			testutil.AssertStringEqual(t, extractErrorBody(t, response).Error.Code, filetransfer.ErrorCodeInvalidParam)
+		})
+	}
+}
+
+func TestMultipartUploadChecksum(t *testing.T) {
+	taskId := uuid.NewV4().String()
+	dir := t.TempDir()
+	adapter := &StubAdapter{uploadTaskId: taskId, filename: filepath.Join(dir, "unused.txt")}
+	fileServer := filetransfer.NewFileServer(adapter)
+	body := &bytes.Buffer{}
+	partWriter := multipart.NewWriter(body)
+	contents := map[string]string{"a.txt": "content a", "b.txt": "content b"}
+	goodSum := md5.Sum([]byte(contents["a.txt"]))
+	for _, name := range []string{"a.txt", "b.txt"} {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="files"; filename="%s"`, name))
+		header.Set("Content-MD5", base64.StdEncoding.EncodeToString(goodSum[:]))
+		part, _ := partWriter.CreatePart(header)
+		_, _ = part.Write([]byte(contents[name]))
+	}
+	_ = partWriter.Close()
+
+	request := newPostRequestReader(fmt.Sprintf("%s?taskId=%s", uploadUrl, taskId), body)
+	request.Header.Set("Content-Type", partWriter.FormDataContentType())
+	response := httptest.NewRecorder()
+	fileServer.ServeHTTP(response, request)
+	testutil.AssertIntEquals(t, response.Code, http.StatusOK)
+
+	var gotBody struct {
+		Data struct {
+			Files []filetransfer.UploadFileResult `json:"files"`
+		} `json:"data"`
+	}
+	_ = json.NewDecoder(response.Body).Decode(&gotBody)
+	testutil.AssertIntEquals(t, len(gotBody.Data.Files), 2)
+	testutil.AssertTrue(t, gotBody.Data.Files[0].Error == nil)
+	testutil.AssertStringEqual(t, gotBody.Data.Files[1].Error.Code, filetransfer.ErrorCodeChecksumMismatch)
+	testutil.AssertIntEquals(t, int(gotBody.Data.Files[1].Size), 0)
+	_, err := os.Stat(filepath.Join(dir, "b.txt"))
+	testutil.AssertTrue(t, os.IsNotExist(err))
+}
+
+func TestDownloadDigest(t *testing.T) {
+	const content = "download content"
+	path := filepath.Join(t.TempDir(), "digest.txt")
+	_ = os.WriteFile(path, []byte(content), 0644)
+	taskId := uuid.NewV4().String()
+	fileServer := filetransfer.NewFileServer(&StubAdapter{downloadTaskId: taskId, path: path})
+	md5Sum := md5.Sum([]byte(content))
+	sha256Sum := sha256.Sum256([]byte(content))
+	testCases := []struct {
+		name              string
+		te                string
+		wantDigest        string
+		want              string
+		wantContentLength string
+	}{
+		{"default sha-256", "trailers", "", "SHA-256=" + base64.StdEncoding.EncodeToString(sha256Sum[:]), ""},
+		{"want md5", "", "sha-256;q=0.3, md5;q=0.8, unixsum", "MD5=" + base64.StdEncoding.EncodeToString(md5Sum[:]), ""},
+		{"content length without trailers", "", "", "", strconv.Itoa(len(content))},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			request := newGetRequest(fmt.Sprintf("%s?taskId=%s", downloadUrl, taskId))
+			if test.te != "" {
+				request.Header.Set("TE", test.te)
+			}
+			if test.wantDigest != "" {
+				request.Header.Set("Want-Digest", test.wantDigest)
+			}
+			recorder := httptest.NewRecorder()
+			fileServer.ServeHTTP(recorder, request)
+			response := recorder.Result()
+			got, _ := io.ReadAll(response.Body)
+			testutil.AssertStringEqual(t, string(got), content)
+			testutil.AssertStringEqual(t, response.Trailer.Get("Digest"), test.want)
+			testutil.AssertStringEqual(t, response.Header.Get("Content-Length"), test.wantContentLength)
+		})
+	}
+
+	t.Run("no digest for range", func(t *testing.T) {
+		request := newGetRequest(fmt.Sprintf("%s?taskId=%s", downloadUrl, taskId))
+		request.Header.Set("Range", "bytes=0-3")
+		recorder := httptest.NewRecorder()
+		fileServer.ServeHTTP(recorder, request)
+		response := recorder.Result()
+		testutil.AssertIntEquals(t, response.StatusCode, http.StatusPartialContent)
+		testutil.AssertStringEqual(t, response.Trailer.Get("Digest"), "")
+	})
+}
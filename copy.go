@@ -0,0 +1,150 @@
+package filetransfer
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/kirinlabs/utils/str"
+	"io"
+	"log"
+	"net/http"
+	"summersea.top/filetransfer/transferframe"
+)
+
+// 服务端之间复制文件，任务加入队列后由worker执行，返回202与任务id，进度通过任务状态查询
+func (fs *FileServerController) copyHandler(ctx *gin.Context) {
+	var copyBody CopyReqBody
+	if err := ctx.ShouldBindJSON(&copyBody); err != nil {
+		ctx.JSON(http.StatusBadRequest, getInvalidParamErr())
+		return
+	}
+	if !fs.isCopyReqBodyValid(copyBody) {
+		ctx.JSON(http.StatusBadRequest, getInvalidParamErr())
+		return
+	}
+	taskId := NewTaskId()
+	fs.dataAdapter.SaveCopyData(taskId, CopyData(copyBody))
+	fs.saveTaskPending(taskId, TaskTypeCopy)
+	fs.pushJob(Job{TaskId: taskId, Type: TaskTypeCopy})
+	ctx.JSON(http.StatusAccepted, OkBody{Data: Data{"taskId": taskId}})
+}
+
+func (fs *FileServerController) isCopyReqBodyValid(body CopyReqBody) bool {
+	for _, endpoint := range []CopyEndpoint{body.Source, body.Destination} {
+		if !fs.isValidPathInLinux(endpoint.Path) || str.EndsWith(endpoint.Path, "/") {
+			return false
+		}
+		if !fs.isResourceReqBodyValid(endpoint.Resource) {
+			return false
+		}
+	}
+	return isTransferOptionsValid(body.TransferOptions)
+}
+
+// copyProgress 复制任务在多次尝试之间保留的进度
+type copyProgress struct {
+	// committed 已写入目标文件的字节数，重试时从这里继续
+	committed int64
+	// created 目标文件已被创建，复制失败时需要删除
+	created bool
+}
+
+// executeCopy 将源文件写入目标文件，传输失败时按配置的重试策略从已写入的位置继续
+// 最终失败或被取消时删除目标文件，ctx在任务的租约失效时被取消，此时保留目标文件与任务数据
+func (fs *FileServerController) executeCopy(ctx context.Context, taskId string) {
+	if fs.dataAdapter.IsTaskCanceled(taskId) {
+		fs.dataAdapter.FinishCopy(taskId)
+		return
+	}
+	// 实例在任务结束后、删除租约前失效时任务会被重新取出，此时不能覆盖已结束的状态
+	if status := fs.dataAdapter.GetTaskStatus(taskId); status != nil && isTaskFinished(status.State) {
+		log.Printf("skip copy %s: task already %s", taskId, status.State)
+		fs.dataAdapter.FinishCopy(taskId)
+		return
+	}
+	if fs.dataAdapter.GetCopyData(taskId) == nil {
+		log.Printf("skip copy %s: copy data not found", taskId)
+		return
+	}
+	tracker := fs.startTracking(ctx, taskId, TaskTypeCopy, 0, -1)
+	progress := &copyProgress{}
+	var err error
+	for retries := 0; ; retries++ {
+		err = fs.handleCopy(taskId, progress, tracker)
+		if err == nil || !isTransferRetryable(err) || !fs.config.Retry.canRetry(retries) {
+			break
+		}
+		log.Printf("problem copy file, retry from %d: %v", progress.committed, err)
+		tracker.retry(err, progress.committed)
+		if !sleepContext(tracker.ctx, fs.config.Retry.backoff(retries)) {
+			err = fmt.Errorf("problem wait for retry: %w", transferframe.CancelErr)
+			break
+		}
+	}
+	if err != nil && ctx.Err() != nil {
+		// 租约已失效，任务由其它实例重新执行，不能删除目标文件或修改任务的数据
+		log.Printf("problem copy file %s: job lease lost", taskId)
+		tracker.abandon()
+		return
+	}
+	if err != nil {
+		log.Printf("problem copy file: %v", err)
+		// 开始前被取消时任务数据可能已被删除，此时失败也是因为取消
+		tracker.checkCanceled()
+		if progress.created {
+			fs.removeCopied(ctx, taskId)
+		}
+	}
+	tracker.finish(err, err == nil)
+	fs.dataAdapter.FinishCopy(taskId)
+}
+
+// handleCopy 从progress.committed处继续复制，源文件不能定位时从头复制
+func (fs *FileServerController) handleCopy(taskId string, progress *copyProgress, tracker *taskTracker) error {
+	reader, err := fs.dataAdapter.GetCopySourceChannel(tracker.ctx, taskId)
+	if err != nil {
+		if err == DownloadDir {
+			return err
+		}
+		return fmt.Errorf("problem create copy source channel %w", err)
+	}
+	defer closeWithErrLog(reader)
+	seeker, ok := reader.(io.Seeker)
+	if !ok {
+		progress.committed = 0
+	} else {
+		size, err := seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return fmt.Errorf("problem get file size: %v", err)
+		}
+		if _, err = seeker.Seek(progress.committed, io.SeekStart); err != nil {
+			return fmt.Errorf("problem seek file: %v", err)
+		}
+		tracker.setTotal(size)
+	}
+	writer, err := fs.dataAdapter.GetCopyDestinationChannel(tracker.ctx, taskId, progress.committed)
+	if err != nil {
+		return fmt.Errorf("problem create copy destination channel %w", err)
+	}
+	defer closeWithErrLog(writer)
+	progress.created = true
+	counter := &countWriter{writer: writer}
+	err = fs.transfer(reader, counter, tracker)
+	progress.committed += counter.count
+	if err != nil {
+		return err
+	}
+	if committer, ok := writer.(Committer); ok {
+		if err = committer.Commit(); err != nil {
+			return fmt.Errorf("problem commit copy: %w", err)
+		}
+	}
+	return nil
+}
+
+// removeCopied 删除复制失败的目标文件
+func (fs *FileServerController) removeCopied(ctx context.Context, taskId string) {
+	if err := fs.dataAdapter.RemoveCopyTemp(ctx, taskId); err != nil {
+		log.Printf("problem remove failed copy: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package filetransfer_test
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"summersea.top/filetransfer"
+	testutil "summersea.top/filetransfer/test"
+	"testing"
+)
+
+const copyUrl = "/file/copy"
+
+func TestCopyInit(t *testing.T) {
+	fileServer := filetransfer.NewFileServer(&StubAdapter{})
+	resource := filetransfer.Resource{Address: "addr", Port: 22, Account: filetransfer.Account{Name: "a", Password: "pwd"}}
+	testCases := []struct {
+		name       string
+		body       filetransfer.CopyReqBody
+		wantStatus int
+	}{
+		{"valid", filetransfer.CopyReqBody{Source: filetransfer.CopyEndpoint{Resource: resource, Path: "/root/a.txt"},
+			Destination: filetransfer.CopyEndpoint{Resource: resource, Path: "/tmp/a.txt"}}, http.StatusAccepted},
+		{"relative source", filetransfer.CopyReqBody{Source: filetransfer.CopyEndpoint{Resource: resource, Path: "a.txt"},
+			Destination: filetransfer.CopyEndpoint{Resource: resource, Path: "/tmp/a.txt"}}, http.StatusBadRequest},
+		{"destination dir", filetransfer.CopyReqBody{Source: filetransfer.CopyEndpoint{Resource: resource, Path: "/root/a.txt"},
+			Destination: filetransfer.CopyEndpoint{Resource: resource, Path: "/tmp/"}}, http.StatusBadRequest},
+		{"no destination resource", filetransfer.CopyReqBody{Source: filetransfer.CopyEndpoint{Resource: resource, Path: "/root/a.txt"},
+			Destination: filetransfer.CopyEndpoint{Path: "/tmp/a.txt"}}, http.StatusBadRequest},
+		{"negative timeout", filetransfer.CopyReqBody{Source: filetransfer.CopyEndpoint{Resource: resource, Path: "/root/a.txt"},
+			Destination:     filetransfer.CopyEndpoint{Resource: resource, Path: "/tmp/a.txt"},
+			TransferOptions: filetransfer.TransferOptions{Timeout: -1}}, http.StatusBadRequest},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			testCase(t, initTestCase{requestBody: test.body, wantResponseStatus: test.wantStatus}, copyUrl, fileServer)
+		})
+	}
+}
+
+func TestCopy(t *testing.T) {
+	resource := filetransfer.Resource{Address: "addr", Port: 22, Account: filetransfer.Account{Name: "a", Password: "pwd"}}
+	startCopy := func(t *testing.T, fileServer http.Handler, source, destination string, options filetransfer.TransferOptions) string {
+		t.Helper()
+		body := filetransfer.CopyReqBody{Source: filetransfer.CopyEndpoint{Resource: resource, Path: source},
+			Destination: filetransfer.CopyEndpoint{Resource: resource, Path: destination}, TransferOptions: options}
+		response := testCase(t, initTestCase{requestBody: body, wantResponseStatus: http.StatusAccepted}, copyUrl, fileServer)
+		return extractOkBody(response.Body).Data["taskId"].(string)
+	}
+
+	t.Run("copy succeeded", func(t *testing.T) {
+		dir := t.TempDir()
+		source := filepath.Join(dir, "source.txt")
+		content := bytes.Repeat([]byte("copy content"), 1000)
+		_ = os.WriteFile(source, content, 0644)
+		destination := filepath.Join(dir, "destination.txt")
+		fileServer := filetransfer.NewFileServer(&StubAdapter{})
+
+		taskId := startCopy(t, fileServer, source, destination, filetransfer.TransferOptions{})
+		waitTaskState(t, fileServer, taskId, filetransfer.TaskStateSucceeded)
+		status := queryTaskStatus(t, fileServer, taskId)
+		testutil.AssertStringEqual(t, status.Type, filetransfer.TaskTypeCopy)
+		testutil.AssertIntEquals(t, int(status.Transferred), len(content))
+		testutil.AssertIntEquals(t, int(status.Total), len(content))
+		got, _ := os.ReadFile(destination)
+		testutil.AssertTrue(t, bytes.Equal(got, content))
+	})
+
+	t.Run("source not found", func(t *testing.T) {
+		dir := t.TempDir()
+		destination := filepath.Join(dir, "destination.txt")
+		fileServer := filetransfer.NewFileServer(&StubAdapter{})
+
+		taskId := startCopy(t, fileServer, filepath.Join(dir, "missing.txt"), destination, filetransfer.TransferOptions{})
+		waitTaskState(t, fileServer, taskId, filetransfer.TaskStateFailed)
+		_, err := os.Stat(destination)
+		testutil.AssertTrue(t, os.IsNotExist(err))
+	})
+
+	t.Run("cancel running copy", func(t *testing.T) {
+		dir := t.TempDir()
+		source := filepath.Join(dir, "source.txt")
+		_ = os.WriteFile(source, make([]byte, 64*1024), 0644)
+		destination := filepath.Join(dir, "destination.txt")
+		fileServer := filetransfer.NewFileServer(&StubAdapter{})
+
+		taskId := startCopy(t, fileServer, source, destination, filetransfer.TransferOptions{RateLimit: 1024})
+		waitTaskState(t, fileServer, taskId, filetransfer.TaskStateRunning)
+		testutil.AssertIntEquals(t, deleteTask(fileServer, taskId).Code, http.StatusAccepted)
+		waitTaskState(t, fileServer, taskId, filetransfer.TaskStateCanceled)
+		_, err := os.Stat(destination)
+		testutil.AssertTrue(t, os.IsNotExist(err))
+	})
+}
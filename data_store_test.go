@@ -4,6 +4,7 @@ import (
 	"summersea.top/filetransfer"
 	"summersea.top/filetransfer/test"
 	"testing"
+	"time"
 )
 
 func TestMemoryStore_GetUploadDataRemove(t *testing.T) {
@@ -25,6 +26,45 @@ func TestMemoryStore_GetUploadDataRemove(t *testing.T) {
 	}
 }
 
+func TestMemoryStore_GetUploadData(t *testing.T) {
+	dataStores := createStores(t)
+	for _, store := range dataStores {
+		t.Run("test get non exist data", func(t *testing.T) {
+			testutil.AssertNil(t, store.GetUploadData(filetransfer.NewTaskId()))
+		})
+
+		t.Run("test data kept", func(t *testing.T) {
+			taskId := filetransfer.NewTaskId()
+			saved := filetransfer.UploadData{Path: "/root", Filename: "a.txt"}
+			store.SaveUploadData(taskId, saved)
+			got := store.GetUploadData(taskId)
+			testutil.AssertStructEquals(t, *got, saved)
+			testutil.AssertTrue(t, store.IsUploadTaskExist(taskId))
+		})
+	}
+}
+
+func TestMemoryStore_UploadOffset(t *testing.T) {
+	dataStores := createStores(t)
+	for _, store := range dataStores {
+		t.Run("test offset of non exist task", func(t *testing.T) {
+			taskId := filetransfer.NewTaskId()
+			store.SaveUploadOffset(taskId, 10)
+			testutil.AssertTrue(t, store.GetUploadOffset(taskId) == 0)
+		})
+
+		t.Run("test offset removed with task", func(t *testing.T) {
+			taskId := filetransfer.NewTaskId()
+			store.SaveUploadData(taskId, filetransfer.UploadData{})
+			testutil.AssertTrue(t, store.GetUploadOffset(taskId) == 0)
+			store.SaveUploadOffset(taskId, 10)
+			testutil.AssertTrue(t, store.GetUploadOffset(taskId) == 10)
+			store.GetUploadDataRemove(taskId)
+			testutil.AssertTrue(t, store.GetUploadOffset(taskId) == 0)
+		})
+	}
+}
+
 func TestMemoryStore_IsUploadTaskExist(t *testing.T) {
 	dataStores := createStores(t)
 	for _, store := range dataStores {
@@ -101,6 +141,24 @@ func TestMemoryStore_GetDownloadDataRemove(t *testing.T) {
 	}
 }
 
+func TestMemoryStore_GetDownloadData(t *testing.T) {
+	dataStores := createStores(t)
+	for _, store := range dataStores {
+		t.Run("test get non exist data", func(t *testing.T) {
+			testutil.AssertNil(t, store.GetDownloadData(filetransfer.NewTaskId()))
+		})
+
+		t.Run("test data reusable", func(t *testing.T) {
+			taskId := filetransfer.NewTaskId()
+			saved := filetransfer.DownloadData{Path: "/root/a.txt"}
+			store.SaveDownloadData(taskId, saved)
+			testutil.AssertStructEquals(t, *store.GetDownloadData(taskId), saved)
+			testutil.AssertStructEquals(t, *store.GetDownloadData(taskId), saved)
+			testutil.AssertTrue(t, store.IsDownloadTaskExist(taskId))
+		})
+	}
+}
+
 func TestMemoryStore_IsDownloadTaskExist(t *testing.T) {
 	dataStores := createStores(t)
 	for _, store := range dataStores {
@@ -157,6 +215,122 @@ func TestMemoryStore_SaveDownloadData(t *testing.T) {
 	}
 }
 
+func TestMemoryStore_CopyData(t *testing.T) {
+	dataStores := createStores(t)
+	for _, store := range dataStores {
+		t.Run("test get non exist data", func(t *testing.T) {
+			testutil.AssertNil(t, store.GetCopyData(filetransfer.NewTaskId()))
+			testutil.AssertFalse(t, store.IsCopyTaskExist(filetransfer.NewTaskId()))
+		})
+
+		t.Run("test data removed", func(t *testing.T) {
+			taskId := filetransfer.NewTaskId()
+			saved := filetransfer.CopyData{Source: filetransfer.CopyEndpoint{Path: "/root/a.txt"},
+				Destination: filetransfer.CopyEndpoint{Path: "/tmp/a.txt"}}
+			store.SaveCopyData(taskId, saved)
+			testutil.AssertStructEquals(t, *store.GetCopyData(taskId), saved)
+			testutil.AssertTrue(t, store.IsCopyTaskExist(taskId))
+			testutil.AssertStructEquals(t, *store.GetCopyDataRemove(taskId), saved)
+			testutil.AssertFalse(t, store.IsCopyTaskExist(taskId))
+		})
+	}
+}
+
+func TestMemoryStore_JobQueue(t *testing.T) {
+	dataStores := createStores(t)
+	for _, store := range dataStores {
+		// 队列在所有测试间共享，先清空之前遗留的任务
+		for job := store.PopJob(time.Minute); job != nil; job = store.PopJob(time.Minute) {
+			store.FinishJob(*job)
+		}
+
+		t.Run("test pop in order", func(t *testing.T) {
+			first := filetransfer.Job{TaskId: filetransfer.NewTaskId(), Type: filetransfer.TaskTypeCopy}
+			second := filetransfer.Job{TaskId: filetransfer.NewTaskId(), Type: filetransfer.TaskTypeCopy}
+			store.PushJob(first)
+			store.PushJob(second)
+			testutil.AssertStructEquals(t, *store.PopJob(time.Minute), first)
+			testutil.AssertStructEquals(t, *store.PopJob(time.Minute), second)
+			testutil.AssertNil(t, store.PopJob(time.Minute))
+			store.FinishJob(first)
+			store.FinishJob(second)
+		})
+
+		t.Run("test expired lease requeued", func(t *testing.T) {
+			job := filetransfer.Job{TaskId: filetransfer.NewTaskId(), Type: filetransfer.TaskTypeCopy}
+			store.PushJob(job)
+			testutil.AssertStructEquals(t, *store.PopJob(50 * time.Millisecond), job)
+			testutil.AssertTrue(t, store.RenewJob(job, 50*time.Millisecond))
+			testutil.AssertNil(t, store.PopJob(time.Minute))
+			time.Sleep(100 * time.Millisecond)
+			testutil.AssertFalse(t, store.RenewJob(job, time.Minute))
+			testutil.AssertStructEquals(t, *store.PopJob(time.Minute), job)
+			store.FinishJob(job)
+			testutil.AssertFalse(t, store.RenewJob(job, time.Minute))
+			testutil.AssertNil(t, store.PopJob(time.Minute))
+		})
+	}
+}
+
+func TestMemoryStore_TaskStatus(t *testing.T) {
+	dataStores := createStores(t)
+	for _, store := range dataStores {
+		t.Run("test get non exist status", func(t *testing.T) {
+			testutil.AssertNil(t, store.GetTaskStatus(filetransfer.NewTaskId()))
+		})
+
+		t.Run("test status kept after task removed", func(t *testing.T) {
+			taskId := filetransfer.NewTaskId()
+			store.SaveUploadData(taskId, filetransfer.UploadData{Path: "/root", Filename: "a.txt"})
+			saved := filetransfer.TaskStatus{TaskId: taskId, Type: filetransfer.TaskTypeUpload,
+				State: filetransfer.TaskStateSucceeded, Transferred: 10, Total: 10}
+			store.SaveTaskStatus(taskId, saved)
+			store.GetUploadDataRemove(taskId)
+			got := store.GetTaskStatus(taskId)
+			testutil.AssertStructEquals(t, *got, saved)
+		})
+	}
+}
+
+func TestMemoryStore_SubscribeTaskStatus(t *testing.T) {
+	dataStores := createStores(t)
+	for _, store := range dataStores {
+		t.Run("test receive saved status", func(t *testing.T) {
+			taskId := filetransfer.NewTaskId()
+			statusChannel, cancel := store.SubscribeTaskStatus(taskId)
+			saved := filetransfer.TaskStatus{TaskId: taskId, State: filetransfer.TaskStateRunning, Transferred: 5}
+			store.SaveTaskStatus(taskId, saved)
+			store.SaveTaskStatus(filetransfer.NewTaskId(), filetransfer.TaskStatus{State: filetransfer.TaskStateFailed})
+			select {
+			case got := <-statusChannel:
+				testutil.AssertStructEquals(t, got, saved)
+			case <-time.After(time.Second):
+				t.Fatalf("status not received")
+			}
+			cancel()
+			_, ok := <-statusChannel
+			testutil.AssertFalse(t, ok)
+		})
+
+		t.Run("test slow subscriber keeps latest status", func(t *testing.T) {
+			taskId := filetransfer.NewTaskId()
+			statusChannel, cancel := store.SubscribeTaskStatus(taskId)
+			defer cancel()
+			for i := int64(1); i <= 100; i++ {
+				store.SaveTaskStatus(taskId, filetransfer.TaskStatus{TaskId: taskId, Transferred: i})
+			}
+			var last filetransfer.TaskStatus
+			for last.Transferred != 100 {
+				select {
+				case last = <-statusChannel:
+				case <-time.After(time.Second):
+					t.Fatalf("latest status not received, last %d", last.Transferred)
+				}
+			}
+		})
+	}
+}
+
 func createStores(t *testing.T) []filetransfer.DataStore {
 	redisStore, err := filetransfer.NewRedisStore("localhost:6379", "", 0)
 	memoryStore := filetransfer.NewMemoryStore()
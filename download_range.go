@@ -0,0 +1,106 @@
+package filetransfer
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+var UnsatisfiableRange = errors.New("range not satisfiable")
+
+var InvalidRange = errors.New("invalid range")
+
+// httpRange 下载请求中的一个字节范围
+type httpRange struct {
+	start  int64
+	length int64
+}
+
+func (r httpRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+func (r httpRange) mimeHeader(contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {r.contentRange(size)},
+		"Content-Type":  {contentType},
+	}
+}
+
+// parseRange 解析Range请求头，格式为 bytes=0-99,200-,-100
+// 格式错误或单位不是bytes时返回InvalidRange，按RFC 7233应忽略Range返回整个文件
+// 超出文件大小的范围会被忽略，所有范围都无法满足时返回UnsatisfiableRange
+func parseRange(header string, size int64) ([]httpRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return nil, InvalidRange
+	}
+	var ranges []httpRange
+	specCount := 0
+	for _, spec := range strings.Split(header[len(prefix):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		specCount++
+		sepIndex := strings.Index(spec, "-")
+		if sepIndex < 0 {
+			return nil, InvalidRange
+		}
+		startSpec, endSpec := strings.TrimSpace(spec[:sepIndex]), strings.TrimSpace(spec[sepIndex+1:])
+		var r httpRange
+		if startSpec == "" {
+			// 后缀范围，表示最后的N个字节
+			suffixLen, err := strconv.ParseInt(endSpec, 10, 64)
+			if err != nil || suffixLen < 0 {
+				return nil, InvalidRange
+			}
+			if suffixLen > size {
+				suffixLen = size
+			}
+			r.start = size - suffixLen
+			r.length = suffixLen
+		} else {
+			start, err := strconv.ParseInt(startSpec, 10, 64)
+			if err != nil || start < 0 {
+				return nil, InvalidRange
+			}
+			end := size - 1
+			if endSpec != "" {
+				end, err = strconv.ParseInt(endSpec, 10, 64)
+				if err != nil || end < start {
+					return nil, InvalidRange
+				}
+			}
+			if start >= size {
+				continue
+			}
+			if end >= size {
+				end = size - 1
+			}
+			r.start = start
+			r.length = end - start + 1
+		}
+		if r.length > 0 {
+			ranges = append(ranges, r)
+		}
+	}
+	if specCount == 0 {
+		return nil, InvalidRange
+	}
+	if len(ranges) == 0 {
+		return nil, UnsatisfiableRange
+	}
+	return ranges, nil
+}
+
+// sumRangesSize 计算所有范围的总长度
+func sumRangesSize(ranges []httpRange) int64 {
+	var size int64
+	for _, r := range ranges {
+		size += r.length
+	}
+	return size
+}
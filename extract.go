@@ -0,0 +1,390 @@
+package filetransfer
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+)
+
+var UnsafeArchiveEntry = errors.New("archive entry escapes target directory")
+
+// extractUploadChannel 将上传的压缩包解压到远程目录
+// tar格式边上传边解压，zip格式需要随机读取，先写入目标目录下的临时文件再解压
+// 未调用Commit就关闭时会回滚已创建的文件
+type extractUploadChannel struct {
+	client    *ClientPackage
+	extractor *remoteExtractor
+	format    string
+	writer    io.WriteCloser
+	// tar格式解压协程的结果
+	done chan error
+	// zip格式的临时文件路径
+	zipPath   string
+	committed bool
+}
+
+func newExtractUploadChannel(client *ClientPackage, root, format string) (*extractUploadChannel, error) {
+	extractor := &remoteExtractor{client: client.Client, root: path.Clean(root), id: NewTaskId(), dirModes: map[string]os.FileMode{}}
+	channel := &extractUploadChannel{client: client, extractor: extractor, format: format}
+	if err := extractor.mkdirAll(extractor.root); err != nil {
+		return nil, fmt.Errorf("problem create target directory: %v", err)
+	}
+	switch format {
+	case ArchiveZip:
+		channel.zipPath = path.Join(extractor.root, "."+NewTaskId()+".zip")
+		file, err := client.Create(channel.zipPath)
+		if err != nil {
+			extractor.rollback()
+			return nil, fmt.Errorf("problem create temp file: %v", err)
+		}
+		channel.writer = file
+	case ArchiveTar, ArchiveTarGz:
+		reader, writer := io.Pipe()
+		channel.writer = writer
+		channel.done = make(chan error, 1)
+		go func() {
+			err := extractor.extractTar(reader, format == ArchiveTarGz)
+			_ = reader.CloseWithError(err)
+			channel.done <- err
+		}()
+	default:
+		extractor.rollback()
+		return nil, fmt.Errorf("unknown archive format %s", format)
+	}
+	return channel, nil
+}
+
+func (e *extractUploadChannel) Write(p []byte) (int, error) {
+	return e.writer.Write(p)
+}
+
+// Commit 等待解压结束，解压失败时返回错误
+func (e *extractUploadChannel) Commit() error {
+	err := e.finish()
+	if err != nil {
+		return err
+	}
+	e.committed = true
+	return nil
+}
+
+func (e *extractUploadChannel) finish() error {
+	if e.done != nil {
+		_ = e.writer.Close()
+		err := <-e.done
+		e.done = nil
+		return err
+	}
+	if e.zipPath == "" {
+		return nil
+	}
+	_ = e.writer.Close()
+	defer e.removeZip()
+	return e.extractor.extractZip(e.zipPath)
+}
+
+func (e *extractUploadChannel) removeZip() {
+	if err := e.client.Remove(e.zipPath); err != nil {
+		log.Printf("problem remove temp file: %v", err)
+	}
+	e.zipPath = ""
+}
+
+// RollBack 删除解压过程中创建的所有文件与目录
+func (e *extractUploadChannel) RollBack() error {
+	if e.done != nil {
+		if pipeWriter, ok := e.writer.(*io.PipeWriter); ok {
+			_ = pipeWriter.CloseWithError(errors.New("extract rollback"))
+		}
+		<-e.done
+		e.done = nil
+	}
+	if e.zipPath != "" {
+		_ = e.writer.Close()
+		e.removeZip()
+	}
+	return e.extractor.rollback()
+}
+
+func (e *extractUploadChannel) Close() error {
+	if !e.committed {
+		if err := e.RollBack(); err != nil {
+			log.Printf("problem roll back extraction: %v", err)
+		}
+	}
+	return e.client.Close()
+}
+
+// remoteExtractor 通过sftp在root下创建压缩包中的文件，并记录创建过的路径用于回滚
+// 文件先写入同目录下的临时文件，全部解压成功后再替换目标，失败时已存在的文件不会被修改
+type remoteExtractor struct {
+	client *sftp.Client
+	root   string
+	// id 临时文件名中的标识
+	id      string
+	created []string
+	pending []pendingFile
+	// 目录权限在所有文件写入之后再设置，避免只读目录无法写入
+	dirModes map[string]os.FileMode
+}
+
+func (e *remoteExtractor) extractTar(reader io.Reader, gzipped bool) error {
+	if gzipped {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return fmt.Errorf("problem read gzip: %v", err)
+		}
+		reader = gzipReader
+	}
+	tarReader := tar.NewReader(reader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("problem read tar: %v", err)
+		}
+		mode := os.FileMode(header.Mode).Perm()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = e.createDir(header.Name, mode)
+		case tar.TypeReg, tar.TypeRegA:
+			err = e.createFile(header.Name, mode, tarReader)
+		case tar.TypeSymlink:
+			err = e.createSymlink(header.Name, header.Linkname)
+		default:
+			log.Printf("skip unsupported tar entry %s", header.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// 读完tar的结束标记之后可能还有填充数据
+	_, _ = io.Copy(io.Discard, reader)
+	return e.finish()
+}
+
+func (e *remoteExtractor) extractZip(zipPath string) error {
+	file, err := e.client.Open(zipPath)
+	if err != nil {
+		return fmt.Errorf("problem open temp file: %v", err)
+	}
+	defer closeWithErrLog(file)
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("problem stat temp file: %v", err)
+	}
+	zipReader, err := zip.NewReader(file, info.Size())
+	if err != nil {
+		return fmt.Errorf("problem read zip: %v", err)
+	}
+	for _, entry := range zipReader.File {
+		if err = e.extractZipEntry(entry); err != nil {
+			return err
+		}
+	}
+	return e.finish()
+}
+
+func (e *remoteExtractor) extractZipEntry(entry *zip.File) error {
+	mode := entry.Mode()
+	if mode.IsDir() {
+		return e.createDir(entry.Name, mode.Perm())
+	}
+	reader, err := entry.Open()
+	if err != nil {
+		return fmt.Errorf("problem read zip entry %s: %v", entry.Name, err)
+	}
+	defer closeWithErrLog(reader)
+	if mode&os.ModeSymlink != 0 {
+		linkname, err := io.ReadAll(reader)
+		if err != nil {
+			return fmt.Errorf("problem read zip entry %s: %v", entry.Name, err)
+		}
+		return e.createSymlink(entry.Name, string(linkname))
+	}
+	if !mode.IsRegular() {
+		log.Printf("skip unsupported zip entry %s", entry.Name)
+		return nil
+	}
+	return e.createFile(entry.Name, mode.Perm(), reader)
+}
+
+// target 计算压缩包中的路径在远程主机上的位置，拒绝跳出root的路径
+// 只按字面检查不够，串联的符号链接可以指向root之外，所以root下已存在的路径中也不能有符号链接
+func (e *remoteExtractor) target(name string) (string, error) {
+	target := path.Join(e.root, name)
+	if !e.isInRoot(target) {
+		return "", fmt.Errorf("%w: %s", UnsafeArchiveEntry, name)
+	}
+	if err := e.checkNoSymlink(name, target); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// checkNoSymlink 依次检查root与target之间的每一级路径，遇到不存在的路径时之后的路径都会新建
+func (e *remoteExtractor) checkNoSymlink(name, target string) error {
+	current := e.root
+	for _, part := range strings.Split(strings.TrimPrefix(target, e.root), "/") {
+		if part == "" {
+			continue
+		}
+		current = path.Join(current, part)
+		info, err := e.client.Lstat(current)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("problem stat %s: %v", current, err)
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%w: %s passes through symlink %s", UnsafeArchiveEntry, name, current)
+		}
+	}
+	return nil
+}
+
+func (e *remoteExtractor) isInRoot(target string) bool {
+	return target == e.root || strings.HasPrefix(target, e.root+"/")
+}
+
+func (e *remoteExtractor) createDir(name string, mode os.FileMode) error {
+	target, err := e.target(name)
+	if err != nil {
+		return err
+	}
+	if err = e.mkdirAll(target); err != nil {
+		return fmt.Errorf("problem create directory %s: %v", name, err)
+	}
+	if target != e.root {
+		e.dirModes[target] = mode
+	}
+	return nil
+}
+
+func (e *remoteExtractor) createFile(name string, mode os.FileMode, reader io.Reader) error {
+	target, err := e.target(name)
+	if err != nil {
+		return err
+	}
+	if err = e.mkdirAll(path.Dir(target)); err != nil {
+		return fmt.Errorf("problem create directory of %s: %v", name, err)
+	}
+	// 压缩包中可能有重复的路径，每个文件使用不同的临时文件，替换时后写入的生效
+	tempPath := path.Join(path.Dir(target), uploadTempName(path.Base(target), fmt.Sprintf("%s.%d", e.id, len(e.pending))))
+	file, err := e.client.Create(tempPath)
+	if err != nil {
+		return fmt.Errorf("problem create file %s: %v", name, err)
+	}
+	e.pending = append(e.pending, pendingFile{tempPath: tempPath, target: target})
+	_, err = io.Copy(file, reader)
+	closeWithErrLog(file)
+	if err != nil {
+		return fmt.Errorf("problem write file %s: %v", name, err)
+	}
+	if err = e.client.Chmod(tempPath, mode); err != nil {
+		return fmt.Errorf("problem chmod file %s: %v", name, err)
+	}
+	return nil
+}
+
+// pendingFile 已写入临时文件、等待替换目标的文件
+type pendingFile struct {
+	tempPath string
+	target   string
+}
+
+// finish 用临时文件替换目标文件，之后再设置目录权限
+func (e *remoteExtractor) finish() error {
+	for len(e.pending) > 0 {
+		file := e.pending[0]
+		_, statErr := e.client.Lstat(file.target)
+		if err := replaceFile(e.client, file.tempPath, file.target); err != nil {
+			return fmt.Errorf("problem replace file %s: %v", file.target, err)
+		}
+		if statErr != nil {
+			e.created = append(e.created, file.target)
+		}
+		e.pending = e.pending[1:]
+	}
+	return e.applyDirModes()
+}
+
+// createSymlink 只允许指向root内部的相对链接
+func (e *remoteExtractor) createSymlink(name, linkname string) error {
+	target, err := e.target(name)
+	if err != nil {
+		return err
+	}
+	if path.IsAbs(linkname) || !e.isInRoot(path.Join(path.Dir(target), linkname)) {
+		return fmt.Errorf("%w: %s -> %s", UnsafeArchiveEntry, name, linkname)
+	}
+	if err = e.mkdirAll(path.Dir(target)); err != nil {
+		return fmt.Errorf("problem create directory of %s: %v", name, err)
+	}
+	if err = e.client.Symlink(linkname, target); err != nil {
+		return fmt.Errorf("problem create symlink %s: %v", name, err)
+	}
+	e.created = append(e.created, target)
+	return nil
+}
+
+// mkdirAll 创建目录及其不存在的父目录，并记录创建过的目录
+func (e *remoteExtractor) mkdirAll(dir string) error {
+	info, err := e.client.Stat(dir)
+	if err == nil {
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+		return nil
+	}
+	if parent := path.Dir(dir); parent != dir {
+		if err = e.mkdirAll(parent); err != nil {
+			return err
+		}
+	}
+	if err = e.client.Mkdir(dir); err != nil {
+		return err
+	}
+	e.created = append(e.created, dir)
+	return nil
+}
+
+func (e *remoteExtractor) applyDirModes() error {
+	for dir, mode := range e.dirModes {
+		if err := e.client.Chmod(dir, mode); err != nil {
+			return fmt.Errorf("problem chmod directory %s: %v", dir, err)
+		}
+	}
+	return nil
+}
+
+// rollback 删除还未替换目标的临时文件，再按创建的相反顺序删除文件与目录
+func (e *remoteExtractor) rollback() error {
+	var lastErr error
+	for _, file := range e.pending {
+		if err := e.client.Remove(file.tempPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("problem remove %s: %v", file.tempPath, err)
+			lastErr = err
+		}
+	}
+	e.pending = nil
+	for i := len(e.created) - 1; i >= 0; i-- {
+		if err := e.client.Remove(e.created[i]); err != nil {
+			log.Printf("problem remove %s: %v", e.created[i], err)
+			lastErr = err
+		}
+	}
+	e.created = nil
+	return lastErr
+}
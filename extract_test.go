@@ -0,0 +1,236 @@
+package filetransfer_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"summersea.top/filetransfer"
+	testutil "summersea.top/filetransfer/test"
+	"testing"
+)
+
+type archiveEntry struct {
+	name     string
+	content  string
+	mode     int64
+	linkname string
+}
+
+var extractEntries = []archiveEntry{
+	{name: "site/", mode: 0750},
+	{name: "site/index.html", content: "<html></html>", mode: 0644},
+	{name: "site/bin/run.sh", content: "#!/bin/sh", mode: 0755},
+	{name: "site/current", linkname: "index.html"},
+}
+
+func TestFileTranDataAdapter_ExtractUpload(t *testing.T) {
+	server := testutil.StartSshServer(t, testutil.NewPasswordServerConfig(t, "test", "pwd"))
+	resource := filetransfer.Resource{Address: server.Address, Port: server.Port,
+		Account: filetransfer.Account{Name: "test", Password: "pwd"}}
+
+	for _, format := range []string{filetransfer.ArchiveZip, filetransfer.ArchiveTar, filetransfer.ArchiveTarGz} {
+		t.Run(format, func(t *testing.T) {
+			root := filepath.Join(t.TempDir(), "deploy")
+			err := extractUpload(t, resource, root, format, buildArchive(t, format, extractEntries))
+			testutil.AssertNil(t, err)
+			assertFileContent(t, filepath.Join(root, "site/index.html"), "<html></html>", 0644)
+			assertFileContent(t, filepath.Join(root, "site/bin/run.sh"), "#!/bin/sh", 0755)
+			info, _ := os.Stat(filepath.Join(root, "site"))
+			testutil.AssertTrue(t, info.Mode().Perm() == 0750)
+			link, _ := os.Readlink(filepath.Join(root, "site/current"))
+			testutil.AssertStringEqual(t, link, "index.html")
+			entries, _ := os.ReadDir(root)
+			testutil.AssertIntEquals(t, len(entries), 1)
+		})
+	}
+
+	unsafeCases := map[string]archiveEntry{
+		"parent path":       {name: "../evil.txt", content: "evil", mode: 0644},
+		"absolute symlink":  {name: "passwd", linkname: "/etc/passwd"},
+		"escaping symlink":  {name: "up", linkname: "../../outside"},
+		"nested parent dir": {name: "a/../../evil.txt", content: "evil", mode: 0644},
+	}
+	for name, unsafeEntry := range unsafeCases {
+		t.Run(name, func(t *testing.T) {
+			parent := t.TempDir()
+			root := filepath.Join(parent, "deploy")
+			entries := append(append([]archiveEntry{}, extractEntries...), unsafeEntry)
+			err := extractUpload(t, resource, root, filetransfer.ArchiveTar, buildArchive(t, filetransfer.ArchiveTar, entries))
+			testutil.AssertTrue(t, errors.Is(err, filetransfer.UnsafeArchiveEntry))
+			left, _ := os.ReadDir(parent)
+			testutil.AssertIntEquals(t, len(left), 0)
+		})
+	}
+
+	for _, format := range []string{filetransfer.ArchiveZip, filetransfer.ArchiveTar} {
+		t.Run("chained symlinks "+format, func(t *testing.T) {
+			parent := t.TempDir()
+			root := filepath.Join(parent, "deploy")
+			entries := []archiveEntry{
+				{name: "s", linkname: "."},
+				{name: "esc", linkname: "s/.."},
+				{name: "esc/evil.txt", content: "evil", mode: 0644},
+			}
+			err := extractUpload(t, resource, root, format, buildArchive(t, format, entries))
+			testutil.AssertTrue(t, errors.Is(err, filetransfer.UnsafeArchiveEntry))
+			left, _ := os.ReadDir(parent)
+			testutil.AssertIntEquals(t, len(left), 0)
+		})
+	}
+
+	t.Run("roll back keeps existing files", func(t *testing.T) {
+		root := t.TempDir()
+		existing := filepath.Join(root, "keep.txt")
+		_ = os.WriteFile(existing, []byte("keep"), 0644)
+		entries := append(append([]archiveEntry{}, extractEntries...), archiveEntry{name: "../evil.txt", mode: 0644})
+		err := extractUpload(t, resource, root, filetransfer.ArchiveZip, buildArchive(t, filetransfer.ArchiveZip, entries))
+		testutil.AssertTrue(t, errors.Is(err, filetransfer.UnsafeArchiveEntry))
+		left, _ := os.ReadDir(root)
+		testutil.AssertIntEquals(t, len(left), 1)
+		assertFileContent(t, existing, "keep", 0644)
+	})
+
+	for _, format := range []string{filetransfer.ArchiveZip, filetransfer.ArchiveTar} {
+		t.Run("failure keeps existing file "+format, func(t *testing.T) {
+			root := t.TempDir()
+			existing := filepath.Join(root, "site/index.html")
+			_ = os.MkdirAll(filepath.Dir(existing), 0755)
+			_ = os.WriteFile(existing, []byte("old"), 0644)
+			entries := append(append([]archiveEntry{}, extractEntries...), archiveEntry{name: "../evil.txt", mode: 0644})
+			err := extractUpload(t, resource, root, format, buildArchive(t, format, entries))
+			testutil.AssertTrue(t, errors.Is(err, filetransfer.UnsafeArchiveEntry))
+			assertFileContent(t, existing, "old", 0644)
+			left, _ := os.ReadDir(filepath.Dir(existing))
+			testutil.AssertIntEquals(t, len(left), 1)
+		})
+
+		t.Run("replace existing file "+format, func(t *testing.T) {
+			root := t.TempDir()
+			existing := filepath.Join(root, "site/index.html")
+			_ = os.MkdirAll(filepath.Dir(existing), 0755)
+			_ = os.WriteFile(existing, []byte("old"), 0600)
+			err := extractUpload(t, resource, root, format, buildArchive(t, format, extractEntries))
+			testutil.AssertNil(t, err)
+			assertFileContent(t, existing, "<html></html>", 0644)
+			left, _ := os.ReadDir(filepath.Dir(existing))
+			testutil.AssertIntEquals(t, len(left), 3)
+		})
+	}
+
+	t.Run("close without commit", func(t *testing.T) {
+		parent := t.TempDir()
+		channel := getExtractChannel(t, resource, filepath.Join(parent, "deploy"), filetransfer.ArchiveTar, 0)
+		_, _ = channel.Write(buildArchive(t, filetransfer.ArchiveTar, extractEntries)[:1024])
+		testutil.AssertNil(t, channel.Close())
+		left, _ := os.ReadDir(parent)
+		testutil.AssertIntEquals(t, len(left), 0)
+	})
+
+	t.Run("offset not supported", func(t *testing.T) {
+		adapter := filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStore())
+		taskId := filetransfer.NewTaskId()
+		adapter.SaveUploadData(taskId, filetransfer.UploadData{Resource: resource, Path: t.TempDir(), Extract: filetransfer.ArchiveTar})
+		channel, err := adapter.GetUploadChannel(context.Background(), taskId, filetransfer.UploadOptions{Offset: 10})
+		testutil.AssertNotNil(t, err)
+		testutil.AssertNil(t, channel)
+	})
+}
+
+// extractUpload 分块写入压缩包并确认，返回确认的结果
+func extractUpload(t *testing.T, resource filetransfer.Resource, root, format string, content []byte) error {
+	t.Helper()
+	channel := getExtractChannel(t, resource, root, format, 0)
+	defer channel.Close()
+	for start := 0; start < len(content); start += 100 {
+		end := start + 100
+		if end > len(content) {
+			end = len(content)
+		}
+		if _, err := channel.Write(content[start:end]); err != nil {
+			break
+		}
+	}
+	committer, ok := channel.(filetransfer.Committer)
+	if !ok {
+		t.Fatalf("extract channel should be committer")
+	}
+	return committer.Commit()
+}
+
+func getExtractChannel(t *testing.T, resource filetransfer.Resource, root, format string, offset int64) filetransfer.WriteCloseRollback {
+	t.Helper()
+	adapter := filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStore())
+	taskId := filetransfer.NewTaskId()
+	adapter.SaveUploadData(taskId, filetransfer.UploadData{Resource: resource, Path: root, Extract: format})
+	channel, err := adapter.GetUploadChannel(context.Background(), taskId, filetransfer.UploadOptions{Offset: offset})
+	if err != nil {
+		t.Fatalf("problem get upload channel: %v", err)
+	}
+	return channel
+}
+
+func buildArchive(t *testing.T, format string, entries []archiveEntry) []byte {
+	t.Helper()
+	buffer := &bytes.Buffer{}
+	if format == filetransfer.ArchiveZip {
+		zipWriter := zip.NewWriter(buffer)
+		for _, entry := range entries {
+			header := &zip.FileHeader{Name: entry.name, Method: zip.Deflate}
+			switch {
+			case entry.linkname != "":
+				header.SetMode(os.ModeSymlink | 0777)
+			case entry.name[len(entry.name)-1] == '/':
+				header.SetMode(os.ModeDir | os.FileMode(entry.mode))
+			default:
+				header.SetMode(os.FileMode(entry.mode))
+			}
+			writer, _ := zipWriter.CreateHeader(header)
+			_, _ = writer.Write([]byte(entry.content + entry.linkname))
+		}
+		_ = zipWriter.Close()
+		return buffer.Bytes()
+	}
+	var gzipWriter *gzip.Writer
+	tarWriter := tar.NewWriter(buffer)
+	if format == filetransfer.ArchiveTarGz {
+		gzipWriter = gzip.NewWriter(buffer)
+		tarWriter = tar.NewWriter(gzipWriter)
+	}
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: entry.mode, Size: int64(len(entry.content))}
+		switch {
+		case entry.linkname != "":
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = entry.linkname
+		case entry.name[len(entry.name)-1] == '/':
+			header.Typeflag = tar.TypeDir
+		default:
+			header.Typeflag = tar.TypeReg
+		}
+		_ = tarWriter.WriteHeader(header)
+		_, _ = tarWriter.Write([]byte(entry.content))
+	}
+	_ = tarWriter.Close()
+	if gzipWriter != nil {
+		_ = gzipWriter.Close()
+	}
+	return buffer.Bytes()
+}
+
+func assertFileContent(t *testing.T, filePath, want string, wantMode os.FileMode) {
+	t.Helper()
+	got, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("problem read %s: %v", filePath, err)
+	}
+	testutil.AssertStringEqual(t, string(got), want)
+	info, _ := os.Stat(filePath)
+	if info.Mode().Perm() != wantMode {
+		t.Errorf("got mode %v, want %v", info.Mode().Perm(), wantMode)
+	}
+}
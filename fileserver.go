@@ -1,32 +1,80 @@
 package filetransfer
 
 import (
+	"context"
+	"encoding/base64"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/kirinlabs/utils/str"
 	"github.com/satori/go.uuid"
 	"io"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
 	"summersea.top/filetransfer/transferframe"
+	"sync"
+	"time"
 )
 
 func init() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 }
 
+// transferBufferSize 每次从输入端读取的字节数
+const transferBufferSize = 32 * 1024
+
 type FileServerController struct {
 	dataAdapter DataAdapter
+	config      TransferConfig
+	// globalLimiter 所有传输共享的限速器，不限速时为nil
+	globalLimiter *transferframe.RateLimiter
+	taskLimiters  *taskLimiters
+	// runningTasks 本实例上正在传输的任务
+	runningTasks *runningTasks
+	// jobWake 本实例加入任务时唤醒空闲的worker
+	jobWake     chan struct{}
+	workersOnce sync.Once
 }
 
 func NewFileServer(adapter DataAdapter) *gin.Engine {
-	fileServer := &FileServerController{}
-	r := gin.Default()
+	return NewFileServerWithConfig(adapter, TransferConfig{})
+}
+
+func NewFileServerWithConfig(adapter DataAdapter, config TransferConfig) *gin.Engine {
+	fileServer := &FileServerController{config: config, taskLimiters: newTaskLimiters(config.Clock),
+		runningTasks: newRunningTasks()}
+	if config.RateLimit > 0 {
+		fileServer.globalLimiter, _ = newRateLimiter(config.RateLimit, config.Clock)
+	}
+	r := gin.New()
+	r.Use(gin.Logger(), gin.CustomRecovery(recoverPanic))
 	r.POST("/file/upload/initialization", fileServer.uploadInitHandler)
 	r.POST("/file/upload", fileServer.uploadHandler)
+	r.GET("/file/upload/offset", fileServer.uploadOffsetHandler)
 	r.POST("/file/download/initialization", fileServer.downloadInitHandler)
 	r.GET("/file/download", fileServer.downloadHandler)
+	r.HEAD("/file/download", fileServer.downloadHeadHandler)
+	r.GET("/file/task/:taskId", fileServer.taskStatusHandler)
+	r.GET("/file/task/:taskId/progress", fileServer.taskProgressHandler)
+	r.DELETE("/file/task/:taskId", fileServer.taskCancelHandler)
+	r.POST("/file/copy", fileServer.copyHandler)
+	r.POST("/file/list", fileServer.listHandler)
+	r.POST("/file/stat", fileServer.statHandler)
+	r.POST("/file/mkdir", fileServer.mkdirHandler)
+	r.POST("/file/rename", fileServer.renameHandler)
+	r.POST("/file/delete", fileServer.deleteHandler)
+	r.POST("/file/chmod", fileServer.chmodHandler)
+	r.POST("/file/chown", fileServer.chownHandler)
+	r.POST("/file/symlink", fileServer.symlinkHandler)
 	fileServer.dataAdapter = adapter
+	fileServer.jobWake = make(chan struct{}, fileServer.workerCount())
+	if config.Workers > 0 {
+		fileServer.startWorkers()
+	}
 	return r
 }
 
@@ -47,6 +95,7 @@ func (fs *FileServerController) uploadInitHandler(ctx *gin.Context) {
 func (fs *FileServerController) handleUploadInit(uploadData UploadData) string {
 	taskId := NewTaskId()
 	fs.dataAdapter.SaveUploadData(taskId, uploadData)
+	fs.saveTaskPending(taskId, TaskTypeUpload)
 	return taskId
 }
 
@@ -67,6 +116,7 @@ func (fs *FileServerController) downloadInitHandler(ctx *gin.Context) {
 func (fs *FileServerController) handleDownloadInit(downloadData DownloadData) string {
 	taskId := NewTaskId()
 	fs.dataAdapter.SaveDownloadData(taskId, downloadData)
+	fs.saveTaskPending(taskId, TaskTypeDownload)
 	return taskId
 }
 
@@ -74,75 +124,378 @@ func (fs *FileServerController) uploadHandler(ctx *gin.Context) {
 	taskId := ctx.Query("taskId")
 	if !fs.dataAdapter.IsUploadTaskExist(taskId) {
 		ctx.JSON(http.StatusBadRequest, getTaskNotFoundErr())
-	} else {
-		err := fs.handleUpload(taskId, ctx.Request.Body)
-		if err != nil {
-			log.Printf("problem upload file: %v", err)
-			ctx.Status(http.StatusBadRequest)
-		} else {
-			ctx.Status(http.StatusNoContent)
-		}
+		return
 	}
-}
-
-func (fs *FileServerController) handleUpload(taskId string, reader io.Reader) error {
-	writeCloser, err := fs.dataAdapter.GetUploadChannel(taskId)
+	if fs.dataAdapter.IsTaskCanceled(taskId) {
+		ctx.JSON(http.StatusBadRequest, getTaskCanceledErr())
+		return
+	}
+	if data := fs.dataAdapter.GetUploadData(taskId); data != nil && len(data.Targets) > 0 {
+		fs.multiTargetUploadHandler(ctx, taskId, *data)
+		return
+	}
+	if isMultipartUpload(ctx.Request) {
+		fs.multipartUploadHandler(ctx, taskId)
+		return
+	}
+	uploadRange, err := parseUploadRange(ctx.Request)
 	if err != nil {
-		return fmt.Errorf("problem create upload channel %v", err)
+		ctx.JSON(http.StatusBadRequest, getInvalidParamErr())
+		return
 	}
-	defer closeWithErrLog(writeCloser)
-	manager, err := transferframe.NewTransferManager(reader)
+	offset := uploadRange.start
+	if offset != 0 && offset != fs.dataAdapter.GetUploadOffset(taskId) {
+		ctx.JSON(http.StatusConflict, getOffsetMismatchErr())
+		return
+	}
+	total := uploadRange.total
+	if !uploadRange.ranged {
+		total = ctx.Request.ContentLength
+	}
+	expected, err := fs.getExpectedChecksums(taskId, ctx.Request, uploadRange)
 	if err != nil {
-		return fmt.Errorf("problem create transfer manager: %v", err)
+		ctx.JSON(http.StatusBadRequest, getInvalidParamErr())
+		return
 	}
-	writer, _ := transferframe.NewBasicWriter(writeCloser)
-	_ = manager.AddWriter(writer)
-	err = manager.StartTransfer()
+	modTime, err := parseLastModified(ctx.Request.Header)
 	if err != nil {
-		return fmt.Errorf("problem transfer file: %v", err)
+		ctx.JSON(http.StatusBadRequest, getInvalidParamErr())
+		return
+	}
+	options := UploadOptions{Offset: offset, ModTime: modTime, Partial: !uploadRange.isFinal()}
+	tracker := fs.startTracking(ctx.Request.Context(), taskId, TaskTypeUpload, offset, total)
+	target, err := fs.handleUpload(taskId, ctx.Request.Body, options, expected, tracker)
+	if tracker.isCanceled() {
+		tracker.finish(err, false)
+		fs.dataAdapter.FinishUpload(taskId)
+		fs.responseUploadErr(ctx, err)
+		return
+	}
+	committed := offset + target.written()
+	if target.rolledBack {
+		// 校验或确认失败时目标文件已被删除，需要重新上传
+		committed = 0
+	}
+	fs.dataAdapter.CommitUploadOffset(taskId, committed)
+	tracker.status.Transferred = committed
+	if err != nil {
+		log.Printf("problem upload file: %v", err)
+		tracker.finish(err, false)
+		fs.responseUploadErr(ctx, err)
+		return
+	}
+	complete := uploadRange.isComplete(committed)
+	tracker.finish(nil, complete)
+	if complete {
+		fs.dataAdapter.FinishUpload(taskId)
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// 查询上传任务已提交的字节数，客户端据此续传
+func (fs *FileServerController) uploadOffsetHandler(ctx *gin.Context) {
+	taskId := ctx.Query("taskId")
+	if !fs.dataAdapter.IsUploadTaskExist(taskId) {
+		ctx.JSON(http.StatusBadRequest, getTaskNotFoundErr())
+		return
+	}
+	ctx.JSON(http.StatusOK, OkBody{Data: Data{"offset": fs.dataAdapter.GetUploadOffset(taskId)}})
+}
+
+// handleUpload 按options上传，返回上传目标，目标被回滚时写入的数据已被删除
+// 上传的数据与expected中的摘要不一致时回滚并返回ChecksumMismatch
+func (fs *FileServerController) handleUpload(taskId string, reader io.Reader, options UploadOptions, expected expectedChecksums, tracker *taskTracker) (*uploadTarget, error) {
+	targets, err := fs.uploadToTargets(taskId, reader, options, 1, expected, tracker)
+	defer closeTargets(targets)
+	if err != nil {
+		return targets[0], err
+	}
+	fs.commitTargets(targets, RollbackAll)
+	return targets[0], targets[0].err
+}
+
+func (fs *FileServerController) rollBack(channel WriteCloseRollback) {
+	if err := channel.RollBack(); err != nil {
+		log.Printf("problem roll back upload: %v", err)
 	}
-	return nil
 }
 
 // 下载API的处理器，负责view部分的业务
 func (fs *FileServerController) downloadHandler(ctx *gin.Context) {
 	taskId := ctx.Query("taskId")
-	setFilename := func(value string) {
-		ctx.Writer.Header().Set("Content-Disposition", "attachment; filename="+value)
-	}
 	if !fs.dataAdapter.IsDownloadTaskExist(taskId) {
 		ctx.JSON(http.StatusBadRequest, getTaskNotFoundErr())
+		return
+	}
+	if fs.dataAdapter.IsTaskCanceled(taskId) {
+		ctx.JSON(http.StatusBadRequest, getTaskCanceledErr())
+		return
+	}
+	tracker := fs.startTracking(ctx.Request.Context(), taskId, TaskTypeDownload, 0, -1)
+	err := fs.handleDownload(taskId, ctx.Request, ctx.Writer, tracker)
+	tracker.finish(err, err == nil)
+	if err == DownloadDir {
+		ctx.JSON(http.StatusBadRequest, NewErrorBody("InvalidDownload", "Can not download directory"))
+		return
+	}
+	if err == UnsatisfiableRange {
+		ctx.Status(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if err != nil {
+		log.Printf("problem download file: %v", err)
+		fs.responseTransferErr(ctx, err)
+	}
+}
+
+// responseUploadErr 出错时请求体可能没有读完，关闭连接以免服务端读完请求体才响应
+func (fs *FileServerController) responseUploadErr(ctx *gin.Context, err error) {
+	ctx.Header("Connection", "close")
+	fs.responseTransferErr(ctx, err)
+}
+
+// responseTransferErr 可识别的错误返回对应的错误信息，其余错误只返回状态码
+// 响应体已开始写入时不能再返回错误，中止连接让客户端感知传输失败
+func (fs *FileServerController) responseTransferErr(ctx *gin.Context, err error) {
+	if ctx.Writer.Written() {
+		abortConnection(ctx)
+		return
+	}
+	if errorBody, ok := getTransferErr(err); ok {
+		ctx.JSON(http.StatusBadRequest, errorBody)
 	} else {
-		err := fs.handleDownload(taskId, ctx.Writer, setFilename)
+		ctx.Status(http.StatusBadRequest)
+	}
+}
+
+// abortConnection 关闭底层连接，不支持劫持连接时(如HTTP/2)交给net/http中止响应
+func abortConnection(ctx *gin.Context) {
+	conn, _, err := ctx.Writer.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	closeWithErrLog(conn)
+}
+
+// recoverPanic 中止响应的panic交给net/http关闭连接，其余panic返回500
+func recoverPanic(ctx *gin.Context, err interface{}) {
+	if err == http.ErrAbortHandler {
+		panic(err)
+	}
+	ctx.AbortWithStatus(http.StatusInternalServerError)
+}
+
+// 下载API的HEAD请求，只返回与下载时相同的响应头，不读取文件内容也不记录任务进度
+func (fs *FileServerController) downloadHeadHandler(ctx *gin.Context) {
+	taskId := ctx.Query("taskId")
+	if !fs.dataAdapter.IsDownloadTaskExist(taskId) {
+		ctx.JSON(http.StatusBadRequest, getTaskNotFoundErr())
+		return
+	}
+	if fs.dataAdapter.IsTaskCanceled(taskId) {
+		ctx.JSON(http.StatusBadRequest, getTaskCanceledErr())
+		return
+	}
+	readCloser, size, err := fs.openDownload(ctx.Request.Context(), taskId, ctx.Writer.Header())
+	if err == DownloadDir {
+		ctx.JSON(http.StatusBadRequest, NewErrorBody("InvalidDownload", "Can not download directory"))
+		return
+	}
+	if err != nil {
+		log.Printf("problem get download headers: %v", err)
+		fs.responseTransferErr(ctx, err)
+		return
+	}
+	closeWithErrLog(readCloser)
+	if size >= 0 {
+		ctx.Header("Content-Length", strconv.FormatInt(size, 10))
+	}
+	ctx.Status(http.StatusOK)
+}
+
+// handleDownload 下载文件，下载通道可以定位时支持Range请求
+func (fs *FileServerController) handleDownload(taskId string, request *http.Request, writer http.ResponseWriter, tracker *taskTracker) error {
+	readCloser, size, err := fs.openDownload(tracker.ctx, taskId, writer.Header())
+	if err != nil {
+		return err
+	}
+	defer closeWithErrLog(readCloser)
+	seeker, ok := readCloser.(io.ReadSeeker)
+	if !ok {
+		return fs.transferWhole(readCloser, -1, request, writer, tracker)
+	}
+	rangeHeader := request.Header.Get("Range")
+	if rangeHeader == "" {
+		tracker.setTotal(size)
+		return fs.transferWhole(seeker, size, request, writer, tracker)
+	}
+	ranges, err := parseRange(rangeHeader, size)
+	if err == InvalidRange {
+		tracker.setTotal(size)
+		return fs.transferWhole(seeker, size, request, writer, tracker)
+	}
+	if err != nil {
+		writer.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		return err
+	}
+	if sumRangesSize(ranges) > size {
+		// 范围重叠过多时直接返回整个文件
+		tracker.setTotal(size)
+		return fs.transferWhole(seeker, size, request, writer, tracker)
+	}
+	tracker.setTotal(sumRangesSize(ranges))
+	if len(ranges) == 1 {
+		return fs.transferRange(seeker, ranges[0], size, writer, tracker)
+	}
+	return fs.transferMultiRange(seeker, ranges, size, writer, tracker)
+}
+
+// openDownload 获取下载通道并设置文件名、类型与修改时间等响应头
+// 返回文件大小，下载通道不能定位时大小未知，返回-1
+func (fs *FileServerController) openDownload(ctx context.Context, taskId string, header http.Header) (io.ReadCloser, int64, error) {
+	readCloser, filename, err := fs.dataAdapter.GetDownloadChannelFilename(ctx, taskId)
+	if err != nil {
 		if err == DownloadDir {
-			ctx.JSON(http.StatusBadRequest, NewErrorBody("InvalidDownload", "Can not download directory"))
+			return nil, 0, err
 		}
-		if err != nil {
-			log.Printf("problem download file: %v", err)
-			ctx.Status(http.StatusBadRequest)
+		return nil, 0, fmt.Errorf("problem create download channel %w", err)
+	}
+	header.Set("Content-Disposition", "attachment; filename="+filename)
+	header.Set("Content-Type", contentTypeByFilename(filename))
+	if stater, ok := readCloser.(fileStater); ok {
+		if info, err := stater.Stat(); err != nil {
+			log.Printf("problem stat download file: %v", err)
+		} else if !info.ModTime().IsZero() {
+			header.Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
 		}
 	}
+	seeker, ok := readCloser.(io.Seeker)
+	if !ok {
+		return readCloser, -1, nil
+	}
+	header.Set("Accept-Ranges", "bytes")
+	size, err := seeker.Seek(0, io.SeekEnd)
+	if err != nil {
+		closeWithErrLog(readCloser)
+		return nil, 0, fmt.Errorf("problem get file size: %v", err)
+	}
+	if _, err = seeker.Seek(0, io.SeekStart); err != nil {
+		closeWithErrLog(readCloser)
+		return nil, 0, fmt.Errorf("problem seek file: %v", err)
+	}
+	return readCloser, size, nil
 }
 
-func (fs *FileServerController) handleDownload(taskId string, writer io.Writer, setFilename func(value string)) error {
-	readCloser, filename, err := fs.dataAdapter.GetDownloadChannelFilename(taskId)
-	if err != nil {
-		if err == DownloadDir {
+// fileStater 可以获取文件信息的下载通道，用于设置Last-Modified
+type fileStater interface {
+	Stat() (os.FileInfo, error)
+}
+
+// contentTypeByFilename 根据扩展名猜测文件类型，无法识别时为application/octet-stream
+func contentTypeByFilename(filename string) string {
+	if contentType := mime.TypeByExtension(filepath.Ext(filename)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// transferWhole 传输整个文件，文件大小已知时设置Content-Length
+// 文件大小未知或客户端通过Want-Digest、TE: trailers请求摘要时改为分块传输，传输成功后设置Digest尾部头
+// 设置Content-Length时尾部头会被丢弃，所以大小已知时摘要需要客户端显式请求
+func (fs *FileServerController) transferWhole(reader io.Reader, size int64, request *http.Request, writer http.ResponseWriter, tracker *taskTracker) error {
+	if size >= 0 && !wantsDigestTrailer(request) {
+		writer.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		return fs.transfer(reader, writer, tracker)
+	}
+	digestName, algorithm := getDigestAlgorithm(request)
+	checksumWriter, _ := transferframe.NewChecksumWriter(algorithm)
+	writer.Header().Set("Trailer", "Digest")
+	if err := fs.transfer(reader, writer, tracker, checksumWriter); err != nil {
+		return err
+	}
+	writer.Header().Set("Digest", digestName+"="+base64.StdEncoding.EncodeToString(checksumWriter.Sum()))
+	return nil
+}
+
+func (fs *FileServerController) transferRange(seeker io.ReadSeeker, r httpRange, size int64, writer http.ResponseWriter, tracker *taskTracker) error {
+	header := writer.Header()
+	header.Set("Content-Range", r.contentRange(size))
+	header.Set("Content-Length", strconv.FormatInt(r.length, 10))
+	writer.WriteHeader(http.StatusPartialContent)
+	if _, err := seeker.Seek(r.start, io.SeekStart); err != nil {
+		return fmt.Errorf("problem seek file: %v", err)
+	}
+	return fs.transfer(io.LimitReader(seeker, r.length), writer, tracker)
+}
+
+// transferMultiRange 以multipart/byteranges格式返回多个范围
+func (fs *FileServerController) transferMultiRange(seeker io.ReadSeeker, ranges []httpRange, size int64, writer http.ResponseWriter, tracker *taskTracker) error {
+	header := writer.Header()
+	partContentType := header.Get("Content-Type")
+	counter := &countWriter{writer: io.Discard}
+	countPart := multipart.NewWriter(counter)
+	for _, r := range ranges {
+		_, _ = countPart.CreatePart(r.mimeHeader(partContentType, size))
+		counter.count += r.length
+	}
+	_ = countPart.Close()
+
+	partWriter := multipart.NewWriter(writer)
+	_ = partWriter.SetBoundary(countPart.Boundary())
+	header.Set("Content-Type", "multipart/byteranges; boundary="+partWriter.Boundary())
+	header.Set("Content-Length", strconv.FormatInt(counter.count, 10))
+	writer.WriteHeader(http.StatusPartialContent)
+	for _, r := range ranges {
+		part, err := partWriter.CreatePart(r.mimeHeader(partContentType, size))
+		if err != nil {
+			return fmt.Errorf("problem create part: %v", err)
+		}
+		if _, err = seeker.Seek(r.start, io.SeekStart); err != nil {
+			return fmt.Errorf("problem seek file: %v", err)
+		}
+		if err = fs.transfer(io.LimitReader(seeker, r.length), part, tracker); err != nil {
 			return err
 		}
-		return fmt.Errorf("problem create download channel %v", err)
 	}
-	setFilename(filename)
-	defer closeWithErrLog(readCloser)
-	manager, err := transferframe.NewTransferManager(readCloser)
+	return partWriter.Close()
+}
+
+// transfer 将reader传输到writer，extraWriters一同接收传输的数据，tracker不为nil时记录传输进度
+// 写入writer失败时停止传输并返回该错误
+func (fs *FileServerController) transfer(reader io.Reader, writer io.Writer, tracker *taskTracker, extraWriters ...transferframe.TransferWriter) error {
+	transferWriter, _ := transferframe.NewBasicWriter(writer)
+	manager, err := fs.newTransferManager(reader, extraWriters)
 	if err != nil {
-		return fmt.Errorf("problem create transfer manager: %v", err)
+		return err
 	}
-	transferWriter, _ := transferframe.NewBasicWriter(writer)
-	_ = manager.AddWriter(transferWriter)
-	err = manager.StartTransfer()
+	_ = manager.AddWriterWithOptions(transferWriter, transferframe.WriterOptions{Required: true})
+	return fs.startTransfer(manager, tracker)
+}
+
+func (fs *FileServerController) newTransferManager(reader io.Reader, writers []transferframe.TransferWriter) (*transferframe.TransferManager, error) {
+	manager, err := transferframe.NewTransferManager(reader)
 	if err != nil {
-		return fmt.Errorf("problem transfer file: %v", err)
+		return nil, fmt.Errorf("problem create transfer manager: %v", err)
+	}
+	_ = manager.SetBufferSize(transferBufferSize)
+	for _, writer := range writers {
+		_ = manager.AddWriter(writer)
+	}
+	return manager, nil
+}
+
+func (fs *FileServerController) startTransfer(manager *transferframe.TransferManager, tracker *taskTracker) error {
+	ctx := context.Background()
+	if tracker != nil {
+		_ = manager.AddWriter(tracker.progressWriter())
+		manager.SetIdleTimeout(tracker.idleTimeout)
+		for _, limiter := range tracker.limiters {
+			_ = manager.AddRateLimiter(limiter)
+		}
+		ctx = tracker.ctx
+	}
+	if err := manager.StartTransferContext(ctx); err != nil {
+		return fmt.Errorf("problem transfer file: %w", err)
 	}
 	return nil
 }
@@ -151,27 +504,62 @@ func (fs *FileServerController) isUploadInitReqBodyValid(body UploadInitReqBody)
 	if !str.StartsWith(body.Path, "/") {
 		return false
 	}
-	if body.Filename == "" || str.StartsWith(body.Filename, "/") {
+	if !isTransferOptionsValid(body.TransferOptions) {
 		return false
 	}
+	if body.Checksum != nil && !isChecksumValid(*body.Checksum) {
+		return false
+	}
+	if body.Extract != "" {
+		if !isArchiveFormatValid(body.Extract) {
+			return false
+		}
+	} else if body.Filename == "" {
+		return false
+	}
+	if str.StartsWith(body.Filename, "/") {
+		return false
+	}
+	if !isRollbackPolicyValid(body.RollbackPolicy) {
+		return false
+	}
+	if !isFileAttributesValid(body.FileAttributes, body.Extract) {
+		return false
+	}
+	for _, target := range body.Targets {
+		if !fs.isUploadTargetValid(target, body.Extract) {
+			return false
+		}
+	}
 	return fs.isResourceReqBodyValid(body.Resource)
 }
 
 func (fs *FileServerController) isDownloadInitReqBodyValid(body DownloadInitReqBody) bool {
-	if body.Path == "" || str.EndsWith(body.Path, "/") {
+	if !fs.isRemotePathValid(body.Path) || str.EndsWith(body.Path, "/") {
 		return false
 	}
-	if !fs.isValidPathInLinux(body.Path) && !fs.isValidPathInWindows(body.Path) {
+	if body.Archive != "" && !isArchiveFormatValid(body.Archive) {
+		return false
+	}
+	if !isTransferOptionsValid(body.TransferOptions) {
 		return false
 	}
 	return fs.isResourceReqBodyValid(body.Resource)
 }
 
+// isRemotePathValid 目标资源上的路径需要是linux或windows的绝对路径
+func (fs *FileServerController) isRemotePathValid(path string) bool {
+	return fs.isValidPathInLinux(path) || fs.isValidPathInWindows(path)
+}
+
 func (fs *FileServerController) isValidPathInLinux(path string) bool {
 	return str.StartsWith(path, "/")
 }
 
 func (fs *FileServerController) isValidPathInWindows(path string) bool {
+	if len(path) < 3 {
+		return false
+	}
 	driveLetter := path[0]
 	sep := path[1:3]
 	return 64 < driveLetter && driveLetter < 91 && sep == ":\\"
@@ -184,26 +572,140 @@ func (fs *FileServerController) isResourceReqBodyValid(resource Resource) bool {
 	if resource.Address == "" {
 		return false
 	}
-	account := resource.Account
-	if account.Name == "" {
+	for _, fingerprint := range resource.Fingerprints {
+		if !isFingerprintValid(fingerprint) {
+			return false
+		}
+	}
+	if len(resource.Proxies) > maxProxyHops {
 		return false
 	}
-	if account.Password == "" {
+	for _, hop := range resource.Proxies {
+		if !fs.isResourceReqBodyValid(hop.resource()) {
+			return false
+		}
+	}
+	return fs.isAccountValid(resource.Account)
+}
+
+// isAccountValid 根据认证方式检查账号所需的凭据
+func (fs *FileServerController) isAccountValid(account Account) bool {
+	if account.Name == "" {
 		return false
 	}
-	return true
+	switch account.AuthType {
+	case "", AuthTypePassword, AuthTypeKeyboardInteractive:
+		return account.Password != ""
+	case AuthTypePublicKey:
+		_, err := parsePrivateKey([]byte(account.PrivateKey), account.Passphrase)
+		return err == nil
+	case AuthTypeKeyId:
+		return account.KeyId != ""
+	case AuthTypeAgent:
+		policy, ok := fs.dataAdapter.(agentAuthPolicy)
+		return ok && policy.IsAgentAuthAllowed()
+	}
+	return false
+}
+
+// agentAuthPolicy 数据适配器实现该接口时由其决定是否允许ssh agent认证，未实现时不允许
+type agentAuthPolicy interface {
+	IsAgentAuthAllowed() bool
 }
 
 type DataAdapter interface {
 	IsUploadTaskExist(taskId string) bool
-	GetUploadChannel(taskId string) (WriteCloseRollback, error)
+	// GetUploadChannel 获取上传通道，上传任务在FinishUpload之前可以多次获取通道以续传
+	GetUploadChannel(ctx context.Context, taskId string, options UploadOptions) (WriteCloseRollback, error)
+	// RemoveUploadTemp 删除上传任务还未确认的临时文件，临时文件不存在时不报错
+	RemoveUploadTemp(ctx context.Context, taskId string) error
 	SaveUploadData(taskId string, uploadData UploadData)
+	// GetUploadData 获取上传任务数据，任务不存在时返回nil
+	GetUploadData(taskId string) *UploadData
+	// GetUploadOffset 获取上传任务已提交的字节数
+	GetUploadOffset(taskId string) int64
+	// CommitUploadOffset 记录上传任务已提交的字节数
+	CommitUploadOffset(taskId string, offset int64)
+	// FinishUpload 结束上传任务，之后任务不再存在
+	FinishUpload(taskId string)
 	IsDownloadTaskExist(taskId string) bool
 	// GetDownloadChannelFilename 获取下载通道，并获取下载的文件名
-	GetDownloadChannelFilename(taskId string) (io.ReadCloser, string, error)
+	// 下载通道同时实现io.Seeker时支持范围下载，下载任务在存活时间内可以重复获取通道
+	GetDownloadChannelFilename(ctx context.Context, taskId string) (io.ReadCloser, string, error)
 	SaveDownloadData(taskId string, downloadData DownloadData)
+	// GetDownloadData 获取下载任务数据，任务不存在时返回nil
+	GetDownloadData(taskId string) *DownloadData
+	SaveTaskStatus(taskId string, status TaskStatus)
+	// RenewTask 延长任务数据的存活时间，传输过程中保存进度时调用，避免长时间的传输在结束前过期
+	RenewTask(taskId string)
+	GetTaskStatus(taskId string) *TaskStatus
+	SubscribeTaskStatus(taskId string) (<-chan TaskStatus, func())
+	// CancelTask 取消任务，集群中正在执行该任务的实例会停止传输
+	CancelTask(taskId string)
+	IsTaskCanceled(taskId string) bool
+	SaveCopyData(taskId string, copyData CopyData)
+	// GetCopyData 获取复制任务数据，任务不存在时返回nil
+	GetCopyData(taskId string) *CopyData
+	IsCopyTaskExist(taskId string) bool
+	// FinishCopy 结束复制任务，之后任务不再存在
+	FinishCopy(taskId string)
+	// GetCopySourceChannel 获取复制任务读取源文件的通道，通道同时实现io.Seeker时可以获取文件大小
+	GetCopySourceChannel(ctx context.Context, taskId string) (io.ReadCloser, error)
+	// GetCopyDestinationChannel 获取复制任务写入目标文件的通道，offset的含义与UploadOptions.Offset相同
+	GetCopyDestinationChannel(ctx context.Context, taskId string, offset int64) (WriteCloseRollback, error)
+	// RemoveCopyTemp 删除复制任务还未确认的临时文件，临时文件不存在时不报错
+	RemoveCopyTemp(ctx context.Context, taskId string) error
+	// PushJob 将任务加入集群共享的队列
+	PushJob(job Job)
+	// PopJob 从队列中取出任务并持有lease时长的租约，队列为空时返回nil
+	PopJob(lease time.Duration) *Job
+	// RenewJob 延长任务的租约，租约已失效时返回false
+	RenewJob(job Job, lease time.Duration) bool
+	// FinishJob 任务执行结束，从队列中删除
+	FinishJob(job Job)
+	// ListDir 列出目标资源上目录中的条目，路径不存在时返回的错误包装os.ErrNotExist，不是目录时返回NotDirectory
+	ListDir(ctx context.Context, resource Resource, path string) ([]FileEntry, error)
+	// Stat 获取目标资源上路径的信息，符号链接不会被跟随，路径不存在时返回的错误包装os.ErrNotExist
+	Stat(ctx context.Context, resource Resource, path string) (FileEntry, error)
+	// 以下操作失败时返回*os.PathError，路径不存在、已存在与没有权限时分别包装os.ErrNotExist、os.ErrExist与os.ErrPermission
+	// MakeDir 创建目录，parents为true时同时创建上级目录且目录已存在时不报错
+	MakeDir(ctx context.Context, resource Resource, path string, parents bool) error
+	// Rename 重命名或移动，newPath已存在时失败
+	Rename(ctx context.Context, resource Resource, path, newPath string) error
+	// Remove 删除文件或目录，目录非空且recursive为false时返回DirectoryNotEmpty
+	Remove(ctx context.Context, resource Resource, path string, recursive bool) error
+	Chmod(ctx context.Context, resource Resource, path string, mode os.FileMode) error
+	Chown(ctx context.Context, resource Resource, path string, uid, gid int) error
+	// Symlink 在link处创建指向target的符号链接
+	Symlink(ctx context.Context, resource Resource, target, link string) error
+}
+
+// UploadOptions 获取上传通道时的选项
+type UploadOptions struct {
+	// Offset 从该字节处继续写入目标文件，为0时会截断目标文件
+	Offset int64
+	// Filename 不为空时代替上传任务中的文件名，多文件上传时使用
+	Filename string
+	// Target 上传目标的序号，0为上传任务的Resource，之后依次为Targets
+	Target int
+	// ModTime 客户端通过Last-Modified头提供的修改时间，上传任务设置了PreserveTime时使用
+	ModTime time.Time
+	// Partial 本次写入后上传还没有结束，此时不设置文件属性
+	Partial bool
 }
 
 func NewTaskId() string {
 	return uuid.NewV4().String()
 }
+
+// countWriter 统计成功写入的字节数
+type countWriter struct {
+	writer io.Writer
+	count  int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.writer.Write(p)
+	c.count += int64(n)
+	return n, err
+}
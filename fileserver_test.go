@@ -2,12 +2,16 @@ package filetransfer_test
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/kirinlabs/utils/str"
 	uuid "github.com/satori/go.uuid"
 	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -15,12 +19,16 @@ import (
 	"strings"
 	"summersea.top/filetransfer"
 	"summersea.top/filetransfer/test"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 const correctJson = `{"resource":{"address":"summersea1.top","port":22,"account":{"name":"ccc","password":"pwd"}},"path":"/root","filename":"test.txt"}`
 const initUploadUrl = "/file/upload/initialization"
 const uploadUrl = "/file/upload"
+const uploadOffsetUrl = "/file/upload/offset"
 const initDownloadUrl = "/file/download/initialization"
 const downloadUrl = "/file/download"
 
@@ -238,11 +246,143 @@ func TestUploadFileInitialise(t *testing.T) {
 	})
 }
 
+func TestInitWithAuthType(t *testing.T) {
+	fileServer := filetransfer.NewFileServer(&StubAdapter{})
+	privateKey := testutil.NewPrivateKeyPEM(t, "secret")
+	testCases := []struct {
+		account    filetransfer.Account
+		wantStatus int
+	}{
+		{filetransfer.Account{Name: "a", AuthType: filetransfer.AuthTypePassword, Password: "pwd"}, http.StatusOK},
+		{filetransfer.Account{Name: "a", AuthType: filetransfer.AuthTypeKeyboardInteractive, Password: "pwd"}, http.StatusOK},
+		{filetransfer.Account{Name: "a", AuthType: filetransfer.AuthTypeKeyboardInteractive}, http.StatusBadRequest},
+		{filetransfer.Account{Name: "a", AuthType: filetransfer.AuthTypePublicKey, PrivateKey: privateKey, Passphrase: "secret"}, http.StatusOK},
+		{filetransfer.Account{Name: "a", AuthType: filetransfer.AuthTypePublicKey, PrivateKey: privateKey, Passphrase: "wrong"}, http.StatusBadRequest},
+		{filetransfer.Account{Name: "a", AuthType: filetransfer.AuthTypePublicKey, PrivateKey: "not a key"}, http.StatusBadRequest},
+		{filetransfer.Account{Name: "a", AuthType: filetransfer.AuthTypeKeyId, KeyId: "deploy"}, http.StatusOK},
+		{filetransfer.Account{Name: "a", AuthType: filetransfer.AuthTypeKeyId}, http.StatusBadRequest},
+		{filetransfer.Account{Name: "a", AuthType: filetransfer.AuthTypeAgent}, http.StatusBadRequest},
+		{filetransfer.Account{Name: "a", AuthType: "token", Password: "pwd"}, http.StatusBadRequest},
+	}
+	for _, test := range testCases {
+		resource := filetransfer.Resource{Address: "addr", Port: 22, Account: test.account}
+		assertInitStatus(t, fileServer, resource, test.wantStatus)
+	}
+
+	t.Run("agent allowed", func(t *testing.T) {
+		fileServer := filetransfer.NewFileServer(&StubAdapter{allowAgent: true})
+		resource := filetransfer.Resource{Address: "addr", Port: 22,
+			Account: filetransfer.Account{Name: "a", AuthType: filetransfer.AuthTypeAgent}}
+		assertInitStatus(t, fileServer, resource, http.StatusOK)
+		resource.Account.Name = ""
+		assertInitStatus(t, fileServer, resource, http.StatusBadRequest)
+	})
+}
+
+func TestInitWithFingerprints(t *testing.T) {
+	fileServer := filetransfer.NewFileServer(&StubAdapter{})
+	account := filetransfer.Account{Name: "a", Password: "pwd"}
+	testCases := []struct {
+		fingerprints []string
+		wantStatus   int
+	}{
+		{nil, http.StatusOK},
+		{[]string{"SHA256:nThbg6kXUpJWGl7E1IGOCspRomTxdCARLviKw6E5SY8"}, http.StatusOK},
+		{[]string{"SHA256:"}, http.StatusBadRequest},
+		{[]string{"16:27:ac:a5:76:28:2d:36:63:1b:56:4d:eb:df:a6:48"}, http.StatusBadRequest},
+	}
+	for _, test := range testCases {
+		resource := filetransfer.Resource{Address: "addr", Port: 22, Account: account, Fingerprints: test.fingerprints}
+		assertInitStatus(t, fileServer, resource, test.wantStatus)
+	}
+}
+
+func TestDownloadInitWithArchive(t *testing.T) {
+	fileServer := filetransfer.NewFileServer(&StubAdapter{})
+	resource := filetransfer.Resource{Address: "addr", Port: 22, Account: filetransfer.Account{Name: "a", Password: "pwd"}}
+	testCases := []struct {
+		archive    string
+		wantStatus int
+	}{
+		{"", http.StatusOK},
+		{filetransfer.ArchiveZip, http.StatusOK},
+		{filetransfer.ArchiveTar, http.StatusOK},
+		{filetransfer.ArchiveTarGz, http.StatusOK},
+		{"rar", http.StatusBadRequest},
+	}
+	for _, test := range testCases {
+		body := filetransfer.DownloadInitReqBody{Resource: resource, Path: "/var/log", Archive: test.archive}
+		testCase(t, initTestCase{requestBody: body, wantResponseStatus: test.wantStatus}, initDownloadUrl, fileServer)
+	}
+}
+
+func TestUploadInitWithExtract(t *testing.T) {
+	fileServer := filetransfer.NewFileServer(&StubAdapter{})
+	resource := filetransfer.Resource{Address: "addr", Port: 22, Account: filetransfer.Account{Name: "a", Password: "pwd"}}
+	testCases := []struct {
+		filename   string
+		extract    string
+		wantStatus int
+	}{
+		{"", filetransfer.ArchiveZip, http.StatusOK},
+		{"", filetransfer.ArchiveTarGz, http.StatusOK},
+		{"site.tar", filetransfer.ArchiveTar, http.StatusOK},
+		{"", "", http.StatusBadRequest},
+		{"", "rar", http.StatusBadRequest},
+	}
+	for _, test := range testCases {
+		body := filetransfer.UploadInitReqBody{Resource: resource, Path: "/var/www", Filename: test.filename, Extract: test.extract}
+		testCase(t, initTestCase{requestBody: body, wantResponseStatus: test.wantStatus}, initUploadUrl, fileServer)
+	}
+}
+
+func TestInitWithTransferOptions(t *testing.T) {
+	fileServer := filetransfer.NewFileServer(&StubAdapter{})
+	resource := filetransfer.Resource{Address: "addr", Port: 22, Account: filetransfer.Account{Name: "a", Password: "pwd"}}
+	testCases := []struct {
+		timeout    filetransfer.TransferOptions
+		wantStatus int
+	}{
+		{filetransfer.TransferOptions{}, http.StatusOK},
+		{filetransfer.TransferOptions{Timeout: 3600, IdleTimeout: 30, RateLimit: 1 << 20}, http.StatusOK},
+		{filetransfer.TransferOptions{Timeout: -1}, http.StatusBadRequest},
+		{filetransfer.TransferOptions{IdleTimeout: -1}, http.StatusBadRequest},
+		{filetransfer.TransferOptions{RateLimit: -1}, http.StatusBadRequest},
+	}
+	for _, test := range testCases {
+		uploadBody := filetransfer.UploadInitReqBody{Resource: resource, Path: "/root", Filename: "a.txt", TransferOptions: test.timeout}
+		testCase(t, initTestCase{requestBody: uploadBody, wantResponseStatus: test.wantStatus}, initUploadUrl, fileServer)
+		downloadBody := filetransfer.DownloadInitReqBody{Resource: resource, Path: "/root/a.txt", TransferOptions: test.timeout}
+		testCase(t, initTestCase{requestBody: downloadBody, wantResponseStatus: test.wantStatus}, initDownloadUrl, fileServer)
+	}
+}
+
+func assertInitStatus(t *testing.T, fileServer http.Handler, resource filetransfer.Resource, wantStatus int) {
+	t.Helper()
+	uploadBody := filetransfer.UploadInitReqBody{Resource: resource, Path: "/root", Filename: "a.txt"}
+	testCase(t, initTestCase{requestBody: uploadBody, wantResponseStatus: wantStatus}, initUploadUrl, fileServer)
+	downloadBody := filetransfer.DownloadInitReqBody{Resource: resource, Path: "/root/a.txt"}
+	testCase(t, initTestCase{requestBody: downloadBody, wantResponseStatus: wantStatus}, initDownloadUrl, fileServer)
+}
+
 type StubAdapter struct {
 	uploadTaskId   string
+	uploadOffset   int64
+	uploadErr      error
+	commitErr      error
 	filename       string
 	path           string
 	downloadTaskId string
+	uploadData     *filetransfer.UploadData
+	downloadData   *filetransfer.DownloadData
+	statusStore    *filetransfer.MemoryStore
+	storeOnce      sync.Once
+	listEntries    []filetransfer.FileEntry
+	statEntry      filetransfer.FileEntry
+	uploadOptions  []filetransfer.UploadOptions
+	remoteErr      error
+	remoteCalls    []string
+	allowAgent     bool
 }
 
 type fileRollback struct {
@@ -253,18 +393,83 @@ func (f *fileRollback) RollBack() error {
 	return os.Remove(f.Name())
 }
 
-func (s *StubAdapter) GetUploadChannel(taskId string) (filetransfer.WriteCloseRollback, error) {
+// committingRollback 模拟需要确认的上传通道
+type committingRollback struct {
+	fileRollback
+	commitErr error
+}
+
+func (c *committingRollback) Commit() error {
+	return c.commitErr
+}
+
+func (s *StubAdapter) GetUploadChannel(_ context.Context, taskId string, options filetransfer.UploadOptions) (filetransfer.WriteCloseRollback, error) {
+	if s.uploadErr != nil {
+		return nil, s.uploadErr
+	}
 	if s.uploadTaskId == taskId {
+		s.uploadOptions = append(s.uploadOptions, options)
 		rollback := fileRollback{}
-		file, _ := os.OpenFile(s.filename, os.O_RDWR|os.O_CREATE, 0777)
+		filename := s.filename
+		if options.Filename != "" {
+			filename = filepath.Join(filepath.Dir(s.filename), options.Filename)
+		}
+		if options.Target > 0 {
+			target := s.uploadData.Targets[options.Target-1]
+			filename = filepath.Join(target.Path, target.Filename)
+			if _, err := os.Stat(target.Path); err != nil {
+				return nil, err
+			}
+		}
+		file, _ := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0777)
+		_ = file.Truncate(options.Offset)
+		_, _ = file.Seek(options.Offset, io.SeekStart)
 		rollback.File = file
+		if s.commitErr != nil {
+			return &committingRollback{rollback, s.commitErr}, nil
+		}
 		return &rollback, nil
 	}
 	return nil, nil
 }
 
-func (s *StubAdapter) SaveUploadData(taskId string, _ filetransfer.UploadData) {
+func (s *StubAdapter) RemoveUploadTemp(_ context.Context, taskId string) error {
+	if s.uploadTaskId == taskId {
+		return removeIfExist(s.filename)
+	}
+	return nil
+}
+
+func (s *StubAdapter) GetUploadOffset(taskId string) int64 {
+	if s.uploadTaskId == taskId {
+		return s.uploadOffset
+	}
+	return 0
+}
+
+func (s *StubAdapter) CommitUploadOffset(taskId string, offset int64) {
+	if s.uploadTaskId == taskId {
+		s.uploadOffset = offset
+	}
+}
+
+func (s *StubAdapter) FinishUpload(taskId string) {
+	if s.uploadTaskId == taskId {
+		s.uploadTaskId = ""
+		s.uploadOffset = 0
+	}
+}
+
+func (s *StubAdapter) SaveUploadData(taskId string, uploadData filetransfer.UploadData) {
 	s.uploadTaskId = taskId
+	s.uploadData = &uploadData
+}
+
+func (s *StubAdapter) GetUploadData(taskId string) *filetransfer.UploadData {
+	if s.uploadTaskId == taskId {
+		return s.uploadData
+	}
+	return nil
 }
 
 func (s *StubAdapter) IsUploadTaskExist(taskId string) bool {
@@ -275,7 +480,7 @@ func (s *StubAdapter) IsDownloadTaskExist(taskId string) bool {
 	return s.downloadTaskId == taskId
 }
 
-func (s *StubAdapter) GetDownloadChannelFilename(taskId string) (io.ReadCloser, string, error) {
+func (s *StubAdapter) GetDownloadChannelFilename(_ context.Context, taskId string) (io.ReadCloser, string, error) {
 	if s.downloadTaskId == taskId {
 		file, _ := os.OpenFile(s.path, os.O_RDWR, 0666)
 		return file, filepath.Base(s.path), nil
@@ -283,9 +488,170 @@ func (s *StubAdapter) GetDownloadChannelFilename(taskId string) (io.ReadCloser,
 	return nil, "", nil
 }
 
+func (s *StubAdapter) SaveTaskStatus(taskId string, status filetransfer.TaskStatus) {
+	s.getStatusStore().SaveTaskStatus(taskId, status)
+}
+
+func (s *StubAdapter) RenewTask(taskId string) {
+	s.getStatusStore().RenewTask(taskId)
+}
+
+func (s *StubAdapter) GetTaskStatus(taskId string) *filetransfer.TaskStatus {
+	return s.getStatusStore().GetTaskStatus(taskId)
+}
+
+func (s *StubAdapter) SubscribeTaskStatus(taskId string) (<-chan filetransfer.TaskStatus, func()) {
+	return s.getStatusStore().SubscribeTaskStatus(taskId)
+}
+
+func (s *StubAdapter) CancelTask(taskId string) {
+	s.getStatusStore().SaveTaskCancel(taskId)
+}
+
+func (s *StubAdapter) IsTaskCanceled(taskId string) bool {
+	return s.getStatusStore().IsTaskCanceled(taskId)
+}
+
+// getStatusStore 任务状态、复制任务与队列保存在内存存储中，以便测试状态的订阅与worker的执行
+func (s *StubAdapter) getStatusStore() *filetransfer.MemoryStore {
+	s.storeOnce.Do(func() {
+		if s.statusStore == nil {
+			s.statusStore = filetransfer.NewMemoryStore()
+		}
+	})
+	return s.statusStore
+}
+
 func (s *StubAdapter) SaveDownloadData(taskId string, downloadData filetransfer.DownloadData) {
 	s.downloadTaskId = taskId
 	s.path = downloadData.Path
+	s.downloadData = &downloadData
+}
+
+func (s *StubAdapter) GetDownloadData(taskId string) *filetransfer.DownloadData {
+	if s.downloadTaskId == taskId {
+		return s.downloadData
+	}
+	return nil
+}
+
+func (s *StubAdapter) SaveCopyData(taskId string, copyData filetransfer.CopyData) {
+	s.getStatusStore().SaveCopyData(taskId, copyData)
+}
+
+func (s *StubAdapter) GetCopyData(taskId string) *filetransfer.CopyData {
+	return s.getStatusStore().GetCopyData(taskId)
+}
+
+func (s *StubAdapter) IsCopyTaskExist(taskId string) bool {
+	return s.getStatusStore().IsCopyTaskExist(taskId)
+}
+
+func (s *StubAdapter) FinishCopy(taskId string) {
+	s.getStatusStore().GetCopyDataRemove(taskId)
+}
+
+func (s *StubAdapter) PushJob(job filetransfer.Job) {
+	s.getStatusStore().PushJob(job)
+}
+
+func (s *StubAdapter) PopJob(lease time.Duration) *filetransfer.Job {
+	return s.getStatusStore().PopJob(lease)
+}
+
+func (s *StubAdapter) RenewJob(job filetransfer.Job, lease time.Duration) bool {
+	return s.getStatusStore().RenewJob(job, lease)
+}
+
+func (s *StubAdapter) FinishJob(job filetransfer.Job) {
+	s.getStatusStore().FinishJob(job)
+}
+
+// GetCopySourceChannel 复制任务的两端都是本地文件
+func (s *StubAdapter) GetCopySourceChannel(_ context.Context, taskId string) (io.ReadCloser, error) {
+	copyData := s.GetCopyData(taskId)
+	if copyData == nil {
+		return nil, fmt.Errorf("copy task %s not found", taskId)
+	}
+	return os.Open(copyData.Source.Path)
+}
+
+func (s *StubAdapter) GetCopyDestinationChannel(_ context.Context, taskId string, offset int64) (filetransfer.WriteCloseRollback, error) {
+	copyData := s.GetCopyData(taskId)
+	if copyData == nil {
+		return nil, fmt.Errorf("copy task %s not found", taskId)
+	}
+	file, err := os.OpenFile(copyData.Destination.Path, os.O_WRONLY|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	_ = file.Truncate(offset)
+	_, _ = file.Seek(offset, io.SeekStart)
+	return &fileRollback{file}, nil
+}
+
+func (s *StubAdapter) RemoveCopyTemp(_ context.Context, taskId string) error {
+	copyData := s.GetCopyData(taskId)
+	if copyData == nil {
+		return fmt.Errorf("copy task %s not found", taskId)
+	}
+	return removeIfExist(copyData.Destination.Path)
+}
+
+func removeIfExist(filename string) error {
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ListDir 返回预设的条目，每次返回新的切片以免排序影响之后的请求
+func (s *StubAdapter) ListDir(context.Context, filetransfer.Resource, string) ([]filetransfer.FileEntry, error) {
+	if s.remoteErr != nil {
+		return nil, s.remoteErr
+	}
+	return append([]filetransfer.FileEntry(nil), s.listEntries...), nil
+}
+
+func (s *StubAdapter) Stat(_ context.Context, _ filetransfer.Resource, path string) (filetransfer.FileEntry, error) {
+	if err := s.recordRemote("stat", path); err != nil {
+		return filetransfer.FileEntry{}, err
+	}
+	return s.statEntry, nil
+}
+
+func (s *StubAdapter) MakeDir(_ context.Context, _ filetransfer.Resource, path string, parents bool) error {
+	return s.recordRemote("mkdir", path, parents)
+}
+
+func (s *StubAdapter) Rename(_ context.Context, _ filetransfer.Resource, path, newPath string) error {
+	return s.recordRemote("rename", path, newPath)
+}
+
+func (s *StubAdapter) Remove(_ context.Context, _ filetransfer.Resource, path string, recursive bool) error {
+	return s.recordRemote("remove", path, recursive)
+}
+
+func (s *StubAdapter) Chmod(_ context.Context, _ filetransfer.Resource, path string, mode os.FileMode) error {
+	return s.recordRemote("chmod", path, mode)
+}
+
+func (s *StubAdapter) Chown(_ context.Context, _ filetransfer.Resource, path string, uid, gid int) error {
+	return s.recordRemote("chown", path, uid, gid)
+}
+
+func (s *StubAdapter) Symlink(_ context.Context, _ filetransfer.Resource, target, link string) error {
+	return s.recordRemote("symlink", target, link)
+}
+
+func (s *StubAdapter) IsAgentAuthAllowed() bool {
+	return s.allowAgent
+}
+
+// recordRemote 记录远程文件操作的参数，返回预设的错误
+func (s *StubAdapter) recordRemote(op string, args ...interface{}) error {
+	s.remoteCalls = append(s.remoteCalls, strings.TrimSpace(fmt.Sprintln(append([]interface{}{op}, args...)...)))
+	return s.remoteErr
 }
 
 func TestUploadFile(t *testing.T) {
@@ -317,6 +683,256 @@ func TestUploadFile(t *testing.T) {
 	})
 }
 
+func TestResumeUpload(t *testing.T) {
+	const content = "0123456789"
+	newResumeServer := func() (*StubAdapter, http.Handler, string, func()) {
+		taskId := uuid.NewV4().String()
+		dstFilename := createRandomFilename("tempFile", ".txt")
+		adapter := &StubAdapter{uploadTaskId: taskId, filename: dstFilename}
+		return adapter, filetransfer.NewFileServer(adapter), taskId, func() { _ = os.Remove(dstFilename) }
+	}
+	upload := func(fileServer http.Handler, requestUrl, contentRange, body string) *httptest.ResponseRecorder {
+		request := newPostRequestReader(requestUrl, strings.NewReader(body))
+		if contentRange != "" {
+			request.Header.Set("Content-Range", contentRange)
+		}
+		response := httptest.NewRecorder()
+		fileServer.ServeHTTP(response, request)
+		return response
+	}
+	queryOffset := func(fileServer http.Handler, taskId string) float64 {
+		response := httptest.NewRecorder()
+		fileServer.ServeHTTP(response, newGetRequest(fmt.Sprintf("%s?taskId=%s", uploadOffsetUrl, taskId)))
+		testutil.AssertIntEquals(t, response.Code, http.StatusOK)
+		return extractOkBody(response.Body).Data["offset"].(float64)
+	}
+
+	t.Run("resume with content range", func(t *testing.T) {
+		adapter, fileServer, taskId, clean := newResumeServer()
+		defer clean()
+		requestUrl := fmt.Sprintf("%s?taskId=%s", uploadUrl, taskId)
+
+		response := upload(fileServer, requestUrl, "bytes 0-3/10", content[:4])
+		testutil.AssertIntEquals(t, response.Code, http.StatusNoContent)
+		testutil.AssertTrue(t, queryOffset(fileServer, taskId) == 4)
+
+		response = upload(fileServer, requestUrl, "bytes 4-9/10", content[4:])
+		testutil.AssertIntEquals(t, response.Code, http.StatusNoContent)
+		testutil.AssertFalse(t, adapter.IsUploadTaskExist(taskId))
+		got, _ := os.ReadFile(adapter.filename)
+		testutil.AssertStringEqual(t, string(got), content)
+	})
+
+	t.Run("resume with offset param", func(t *testing.T) {
+		adapter, fileServer, taskId, clean := newResumeServer()
+		defer clean()
+
+		response := upload(fileServer, fmt.Sprintf("%s?taskId=%s&offset=0&size=10", uploadUrl, taskId), "", content[:6])
+		testutil.AssertIntEquals(t, response.Code, http.StatusNoContent)
+		testutil.AssertTrue(t, adapter.IsUploadTaskExist(taskId))
+
+		response = upload(fileServer, fmt.Sprintf("%s?taskId=%s&offset=6&size=10", uploadUrl, taskId), "", content[6:])
+		testutil.AssertIntEquals(t, response.Code, http.StatusNoContent)
+		testutil.AssertFalse(t, adapter.IsUploadTaskExist(taskId))
+		got, _ := os.ReadFile(adapter.filename)
+		testutil.AssertStringEqual(t, string(got), content)
+		testutil.AssertTrue(t, adapter.uploadOptions[0].Partial)
+		testutil.AssertFalse(t, adapter.uploadOptions[1].Partial)
+	})
+
+	t.Run("resume with offset only", func(t *testing.T) {
+		adapter, fileServer, taskId, clean := newResumeServer()
+		defer clean()
+
+		response := upload(fileServer, fmt.Sprintf("%s?taskId=%s&offset=0&size=10", uploadUrl, taskId), "", content[:6])
+		testutil.AssertIntEquals(t, response.Code, http.StatusNoContent)
+
+		// 不知道文件总大小时无法判断哪次请求结束上传，临时文件永远不会被重命名
+		response = upload(fileServer, fmt.Sprintf("%s?taskId=%s&offset=6", uploadUrl, taskId), "", content[6:])
+		testutil.AssertIntEquals(t, response.Code, http.StatusBadRequest)
+		response = upload(fileServer, fmt.Sprintf("%s?taskId=%s", uploadUrl, taskId), "bytes 6-9/*", content[6:])
+		testutil.AssertIntEquals(t, response.Code, http.StatusBadRequest)
+		testutil.AssertTrue(t, queryOffset(fileServer, taskId) == 6)
+		testutil.AssertIntEquals(t, len(adapter.uploadOptions), 1)
+
+		response = upload(fileServer, fmt.Sprintf("%s?taskId=%s&offset=6&size=10", uploadUrl, taskId), "", content[6:])
+		testutil.AssertIntEquals(t, response.Code, http.StatusNoContent)
+		testutil.AssertFalse(t, adapter.IsUploadTaskExist(taskId))
+		testutil.AssertFalse(t, adapter.uploadOptions[1].Partial)
+	})
+
+	t.Run("offset mismatch", func(t *testing.T) {
+		_, fileServer, taskId, clean := newResumeServer()
+		defer clean()
+		requestUrl := fmt.Sprintf("%s?taskId=%s", uploadUrl, taskId)
+
+		response := upload(fileServer, requestUrl, "bytes 3-9/10", content[3:])
+		testutil.AssertIntEquals(t, response.Code, http.StatusConflict)
+		var gotErrorBody filetransfer.ErrorBody
+		_ = json.NewDecoder(response.Body).Decode(&gotErrorBody)
+		testutil.AssertStringEqual(t, gotErrorBody.Error.Code, filetransfer.ErrorCodeOffsetMismatch)
+	})
+
+	t.Run("invalid range", func(t *testing.T) {
+		_, fileServer, taskId, clean := newResumeServer()
+		defer clean()
+		requestUrl := fmt.Sprintf("%s?taskId=%s", uploadUrl, taskId)
+
+		for _, contentRange := range []string{"bytes 5-3/10", "bytes 0-10/10", "items 0-1/2", "bytes 0-1", "bytes 0-1/*"} {
+			response := upload(fileServer, requestUrl, contentRange, "ab")
+			testutil.AssertIntEquals(t, response.Code, http.StatusBadRequest)
+		}
+	})
+}
+
+func TestResumeLongUpload(t *testing.T) {
+	server := testutil.StartSshServer(t, testutil.NewPasswordServerConfig(t, "test", "pwd"))
+	resource := filetransfer.Resource{Address: server.Address, Port: server.Port,
+		Account: filetransfer.Account{Name: "test", Password: "pwd"}}
+	// 任务数据1.5秒后过期，第一次上传持续2.5秒后失败，失败时仍能记录已提交的字节数
+	adapter := filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStoreWithExpiration(1500 * time.Millisecond))
+	fileServer := filetransfer.NewFileServer(adapter)
+	dir := t.TempDir()
+	taskId := filetransfer.NewTaskId()
+	adapter.SaveUploadData(taskId, filetransfer.UploadData{Resource: resource, Path: dir, Filename: "long.txt"})
+	reader, writer := io.Pipe()
+	go func() {
+		for i := 0; i < 25; i++ {
+			time.Sleep(100 * time.Millisecond)
+			_, _ = writer.Write([]byte("a"))
+		}
+		_ = writer.CloseWithError(errors.New("client gone"))
+	}()
+	response := httptest.NewRecorder()
+	fileServer.ServeHTTP(response, newPostRequestReader(fmt.Sprintf("%s?taskId=%s", uploadUrl, taskId), reader))
+	testutil.AssertTrue(t, response.Code != http.StatusNoContent)
+
+	response = httptest.NewRecorder()
+	fileServer.ServeHTTP(response, newGetRequest(fmt.Sprintf("%s?taskId=%s", uploadOffsetUrl, taskId)))
+	testutil.AssertIntEquals(t, response.Code, http.StatusOK)
+	testutil.AssertTrue(t, extractOkBody(response.Body).Data["offset"].(float64) == 25)
+
+	request := newPostRequestReader(fmt.Sprintf("%s?taskId=%s&offset=25&size=30", uploadUrl, taskId), strings.NewReader("bbbbb"))
+	response = httptest.NewRecorder()
+	fileServer.ServeHTTP(response, request)
+	testutil.AssertIntEquals(t, response.Code, http.StatusNoContent)
+	got, _ := os.ReadFile(filepath.Join(dir, "long.txt"))
+	testutil.AssertStringEqual(t, string(got), strings.Repeat("a", 25)+"bbbbb")
+}
+
+func TestUploadHostKeyErr(t *testing.T) {
+	testCases := []struct {
+		err      error
+		wantCode string
+	}{
+		{fmt.Errorf("wrapped: %w", filetransfer.HostKeyMismatch), filetransfer.ErrorCodeHostKeyMismatch},
+		{fmt.Errorf("wrapped: %w", filetransfer.HostKeyUnknown), filetransfer.ErrorCodeHostKeyUnknown},
+	}
+	for _, test := range testCases {
+		taskId := uuid.NewV4().String()
+		fileServer := filetransfer.NewFileServer(&StubAdapter{uploadTaskId: taskId, uploadErr: test.err})
+		request := newPostRequestReader(fmt.Sprintf("%s?taskId=%s", uploadUrl, taskId), strings.NewReader("content"))
+		response := httptest.NewRecorder()
+		fileServer.ServeHTTP(response, request)
+		testutil.AssertIntEquals(t, response.Code, http.StatusBadRequest)
+		var gotErrorBody filetransfer.ErrorBody
+		_ = json.NewDecoder(response.Body).Decode(&gotErrorBody)
+		testutil.AssertStringEqual(t, gotErrorBody.Error.Code, test.wantCode)
+	}
+}
+
+func TestMultipartUpload(t *testing.T) {
+	t.Run("upload every file part", func(t *testing.T) {
+		taskId := uuid.NewV4().String()
+		dir := t.TempDir()
+		adapter := &StubAdapter{uploadTaskId: taskId, filename: filepath.Join(dir, "unused.txt")}
+		fileServer := filetransfer.NewFileServer(adapter)
+		body := &bytes.Buffer{}
+		partWriter := multipart.NewWriter(body)
+		_ = partWriter.WriteField("comment", "not a file")
+		files := map[string]string{"a.txt": "content a", "b.log": strings.Repeat("b", 5000)}
+		for _, name := range []string{"a.txt", "b.log"} {
+			part, _ := partWriter.CreateFormFile("files", name)
+			_, _ = part.Write([]byte(files[name]))
+		}
+		_ = partWriter.Close()
+
+		request := newPostRequestReader(fmt.Sprintf("%s?taskId=%s", uploadUrl, taskId), body)
+		request.Header.Set("Content-Type", partWriter.FormDataContentType())
+		response := httptest.NewRecorder()
+		fileServer.ServeHTTP(response, request)
+		testutil.AssertIntEquals(t, response.Code, http.StatusOK)
+
+		var gotBody struct {
+			Data struct {
+				Files []filetransfer.UploadFileResult `json:"files"`
+			} `json:"data"`
+		}
+		_ = json.NewDecoder(response.Body).Decode(&gotBody)
+		wantFiles := []filetransfer.UploadFileResult{{Filename: "a.txt", Size: 9}, {Filename: "b.log", Size: 5000}}
+		testutil.AssertStructEquals(t, gotBody.Data.Files, wantFiles)
+		for name, content := range files {
+			got, _ := os.ReadFile(filepath.Join(dir, name))
+			testutil.AssertStringEqual(t, string(got), content)
+		}
+		testutil.AssertTrue(t, !adapter.IsUploadTaskExist(taskId))
+	})
+
+	t.Run("report failed file", func(t *testing.T) {
+		taskId := uuid.NewV4().String()
+		dir := t.TempDir()
+		adapter := &StubAdapter{uploadTaskId: taskId, filename: filepath.Join(dir, "unused.txt"), commitErr: filetransfer.IncompleteWrite}
+		fileServer := filetransfer.NewFileServer(adapter)
+		body := &bytes.Buffer{}
+		partWriter := multipart.NewWriter(body)
+		part, _ := partWriter.CreateFormFile("files", "a.txt")
+		_, _ = part.Write([]byte("content a"))
+		_ = partWriter.Close()
+		request := newPostRequestReader(fmt.Sprintf("%s?taskId=%s", uploadUrl, taskId), body)
+		request.Header.Set("Content-Type", partWriter.FormDataContentType())
+		response := httptest.NewRecorder()
+		fileServer.ServeHTTP(response, request)
+		testutil.AssertIntEquals(t, response.Code, http.StatusOK)
+		var gotBody struct {
+			Data struct {
+				Files []filetransfer.UploadFileResult `json:"files"`
+			} `json:"data"`
+		}
+		_ = json.NewDecoder(response.Body).Decode(&gotBody)
+		testutil.AssertIntEquals(t, len(gotBody.Data.Files), 1)
+		testutil.AssertStringEqual(t, gotBody.Data.Files[0].Error.Code, filetransfer.ErrorCodeTransferFailed)
+		_, err := os.Stat(filepath.Join(dir, "a.txt"))
+		testutil.AssertTrue(t, os.IsNotExist(err))
+	})
+
+	t.Run("no file part", func(t *testing.T) {
+		taskId := uuid.NewV4().String()
+		fileServer := filetransfer.NewFileServer(&StubAdapter{uploadTaskId: taskId})
+		body := &bytes.Buffer{}
+		partWriter := multipart.NewWriter(body)
+		_ = partWriter.WriteField("comment", "not a file")
+		_ = partWriter.Close()
+		request := newPostRequestReader(fmt.Sprintf("%s?taskId=%s", uploadUrl, taskId), body)
+		request.Header.Set("Content-Type", partWriter.FormDataContentType())
+		response := httptest.NewRecorder()
+		fileServer.ServeHTTP(response, request)
+		testutil.AssertIntEquals(t, response.Code, http.StatusBadRequest)
+	})
+}
+
+func TestUploadCommitErr(t *testing.T) {
+	taskId := uuid.NewV4().String()
+	dstFilename := filepath.Join(t.TempDir(), "commit.txt")
+	adapter := &StubAdapter{uploadTaskId: taskId, filename: dstFilename, commitErr: filetransfer.UnsafeArchiveEntry}
+	fileServer := filetransfer.NewFileServer(adapter)
+	request := newPostRequestReader(fmt.Sprintf("%s?taskId=%s", uploadUrl, taskId), strings.NewReader("content"))
+	response := httptest.NewRecorder()
+	fileServer.ServeHTTP(response, request)
+	testutil.AssertIntEquals(t, response.Code, http.StatusBadRequest)
+	_, err := os.Stat(dstFilename)
+	testutil.AssertTrue(t, os.IsNotExist(err))
+}
+
 func TestDownloadFileInit(t *testing.T) {
 	url := initDownloadUrl
 	fileServer := filetransfer.NewFileServer(&StubAdapter{})
@@ -475,6 +1091,176 @@ func TestDownloadFile(t *testing.T) {
 	_ = os.Remove(downloadFilename)
 }
 
+func TestDownloadFailAfterWritten(t *testing.T) {
+	taskId := uuid.NewV4().String()
+	adapter := &brokenDownloadAdapter{StubAdapter: &StubAdapter{downloadTaskId: taskId}}
+	server := httptest.NewServer(filetransfer.NewFileServer(adapter))
+	defer server.Close()
+	response, err := http.Get(fmt.Sprintf("%s%s?taskId=%s", server.URL, downloadUrl, taskId))
+	testutil.AssertNil(t, err)
+	defer response.Body.Close()
+	testutil.AssertIntEquals(t, response.StatusCode, http.StatusOK)
+	// 响应体已开始写入后出错时连接被中止，不能在文件内容后追加错误信息
+	body, err := io.ReadAll(response.Body)
+	testutil.AssertNotNil(t, err)
+	testutil.AssertFalse(t, strings.Contains(string(body), "{"))
+}
+
+// brokenDownloadAdapter 下载通道读出部分内容后出错
+type brokenDownloadAdapter struct {
+	*StubAdapter
+}
+
+func (b *brokenDownloadAdapter) GetDownloadChannelFilename(_ context.Context, taskId string) (io.ReadCloser, string, error) {
+	if b.downloadTaskId != taskId {
+		return nil, "", nil
+	}
+	reader := io.MultiReader(strings.NewReader(strings.Repeat("a", 64*1024)), iotest.ErrReader(errors.New("disk gone")))
+	return io.NopCloser(reader), "broken.txt", nil
+}
+
+func TestDownloadFileRange(t *testing.T) {
+	taskId := uuid.NewV4().String()
+	contentFilename, deleteContentFile := createTempFileWithContent(t)
+	defer deleteContentFile()
+	content, _ := os.ReadFile(contentFilename)
+	size := len(content)
+	fileServer := filetransfer.NewFileServer(&StubAdapter{downloadTaskId: taskId, path: contentFilename})
+	requestUrl := fmt.Sprintf("%s?taskId=%s", downloadUrl, taskId)
+	download := func(rangeHeader string) *httptest.ResponseRecorder {
+		request := newGetRequest(requestUrl)
+		request.Header.Set("Range", rangeHeader)
+		response := httptest.NewRecorder()
+		fileServer.ServeHTTP(response, request)
+		return response
+	}
+
+	t.Run("single range", func(t *testing.T) {
+		testCases := []struct {
+			rangeHeader      string
+			wantContentRange string
+			wantBody         []byte
+		}{
+			{"bytes=0-9", fmt.Sprintf("bytes 0-9/%d", size), content[:10]},
+			{"bytes=10-", fmt.Sprintf("bytes 10-%d/%d", size-1, size), content[10:]},
+			{"bytes=-5", fmt.Sprintf("bytes %d-%d/%d", size-5, size-1, size), content[size-5:]},
+			{fmt.Sprintf("bytes=5-%d", size+100), fmt.Sprintf("bytes 5-%d/%d", size-1, size), content[5:]},
+		}
+		for _, test := range testCases {
+			response := download(test.rangeHeader)
+			testutil.AssertIntEquals(t, response.Code, http.StatusPartialContent)
+			testutil.AssertStringEqual(t, response.Header().Get("Content-Range"), test.wantContentRange)
+			testutil.AssertStringEqual(t, response.Header().Get("Content-Length"), fmt.Sprint(len(test.wantBody)))
+			testutil.AssertStringEqual(t, response.Body.String(), string(test.wantBody))
+		}
+	})
+
+	t.Run("multi range", func(t *testing.T) {
+		response := download("bytes=0-4,10-14")
+		testutil.AssertIntEquals(t, response.Code, http.StatusPartialContent)
+		testutil.AssertStringEqual(t, response.Header().Get("Content-Length"), fmt.Sprint(response.Body.Len()))
+		mediaType, params, err := mime.ParseMediaType(response.Header().Get("Content-Type"))
+		testutil.AssertNil(t, err)
+		testutil.AssertStringEqual(t, mediaType, "multipart/byteranges")
+		reader := multipart.NewReader(response.Body, params["boundary"])
+		wantParts := []struct {
+			contentRange string
+			body         []byte
+		}{
+			{fmt.Sprintf("bytes 0-4/%d", size), content[:5]},
+			{fmt.Sprintf("bytes 10-14/%d", size), content[10:15]},
+		}
+		for _, want := range wantParts {
+			part, err := reader.NextPart()
+			if err != nil {
+				t.Fatalf("problem read part: %v", err)
+			}
+			testutil.AssertStringEqual(t, part.Header.Get("Content-Range"), want.contentRange)
+			body, _ := io.ReadAll(part)
+			testutil.AssertStringEqual(t, string(body), string(want.body))
+		}
+		_, err = reader.NextPart()
+		testutil.AssertErrEquals(t, err, io.EOF)
+	})
+
+	t.Run("unsatisfiable range", func(t *testing.T) {
+		for _, rangeHeader := range []string{fmt.Sprintf("bytes=%d-", size), fmt.Sprintf("bytes=%d-%d", size, size+5), "bytes=-0"} {
+			response := download(rangeHeader)
+			testutil.AssertIntEquals(t, response.Code, http.StatusRequestedRangeNotSatisfiable)
+			testutil.AssertStringEqual(t, response.Header().Get("Content-Range"), fmt.Sprintf("bytes */%d", size))
+		}
+	})
+
+	t.Run("invalid range ignored", func(t *testing.T) {
+		for _, rangeHeader := range []string{"bytes=9-3", "items=0-1", "bytes=a-b", "bytes=5", "bytes=", "bytes=0-4,x"} {
+			response := download(rangeHeader)
+			testutil.AssertIntEquals(t, response.Code, http.StatusOK)
+			testutil.AssertStringEqual(t, response.Header().Get("Content-Range"), "")
+			testutil.AssertStringEqual(t, response.Body.String(), string(content))
+		}
+	})
+
+	t.Run("task reusable", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			response := httptest.NewRecorder()
+			fileServer.ServeHTTP(response, newGetRequest(requestUrl))
+			testutil.AssertIntEquals(t, response.Code, http.StatusOK)
+			testutil.AssertStringEqual(t, response.Header().Get("Accept-Ranges"), "bytes")
+			testutil.AssertStringEqual(t, response.Body.String(), string(content))
+		}
+	})
+}
+
+func TestDownloadFileHeaders(t *testing.T) {
+	taskId := uuid.NewV4().String()
+	path := filepath.Join(t.TempDir(), "report.json")
+	_ = os.WriteFile(path, []byte(`{"a":1}`), 0644)
+	modTime := time.Date(2021, 5, 1, 8, 0, 0, 0, time.UTC)
+	_ = os.Chtimes(path, modTime, modTime)
+	fileServer := filetransfer.NewFileServer(&StubAdapter{downloadTaskId: taskId, path: path})
+	requestUrl := fmt.Sprintf("%s?taskId=%s", downloadUrl, taskId)
+	assertHeaders := func(t *testing.T, response *httptest.ResponseRecorder) {
+		t.Helper()
+		testutil.AssertIntEquals(t, response.Code, http.StatusOK)
+		testutil.AssertStringEqual(t, response.Header().Get("Content-Length"), "7")
+		testutil.AssertStringEqual(t, response.Header().Get("Content-Type"), "application/json")
+		testutil.AssertStringEqual(t, response.Header().Get("Last-Modified"), "Sat, 01 May 2021 08:00:00 GMT")
+		testutil.AssertStringEqual(t, response.Header().Get("Accept-Ranges"), "bytes")
+		testutil.AssertStringEqual(t, response.Header().Get("Content-Disposition"), filenamePrefix+"report.json")
+	}
+
+	t.Run("get", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		fileServer.ServeHTTP(response, newGetRequest(requestUrl))
+		assertHeaders(t, response)
+		testutil.AssertStringEqual(t, response.Body.String(), `{"a":1}`)
+	})
+
+	t.Run("head", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		request, _ := http.NewRequest(http.MethodHead, requestUrl, nil)
+		fileServer.ServeHTTP(response, request)
+		assertHeaders(t, response)
+		testutil.AssertIntEquals(t, response.Body.Len(), 0)
+	})
+
+	t.Run("head task not found", func(t *testing.T) {
+		response := httptest.NewRecorder()
+		request, _ := http.NewRequest(http.MethodHead, downloadUrl+"?taskId=none", nil)
+		fileServer.ServeHTTP(response, request)
+		testutil.AssertIntEquals(t, response.Code, http.StatusBadRequest)
+	})
+
+	t.Run("unknown extension", func(t *testing.T) {
+		unknownPath := filepath.Join(t.TempDir(), "data.unknownext")
+		_ = os.WriteFile(unknownPath, []byte("data"), 0644)
+		server := filetransfer.NewFileServer(&StubAdapter{downloadTaskId: taskId, path: unknownPath})
+		response := httptest.NewRecorder()
+		server.ServeHTTP(response, newGetRequest(requestUrl))
+		testutil.AssertStringEqual(t, response.Header().Get("Content-Type"), "application/octet-stream")
+	})
+}
+
 func TestUploadByIntegration(t *testing.T) {
 	urlInit := initUploadUrl
 	urlUpload := uploadUrl
@@ -560,6 +1346,9 @@ func TestTaskNotFound(t *testing.T) {
 	test(downloadUrl, func(requestUrl string) *http.Request {
 		return newGetRequest(requestUrl)
 	})
+	test(uploadOffsetUrl, func(requestUrl string) *http.Request {
+		return newGetRequest(requestUrl)
+	})
 }
 
 func testHttpStatus(t *testing.T, requestBody interface{}, got, wantStatus int) {
@@ -0,0 +1,107 @@
+package filetransfer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"net"
+	"strings"
+)
+
+const HostKeyPolicyTofu = "tofu"
+const HostKeyPolicyKnownHosts = "knownHosts"
+const HostKeyPolicyInsecure = "insecure"
+
+var HostKeyMismatch = errors.New("host key mismatch")
+var HostKeyUnknown = errors.New("host key is unknown")
+
+const fingerprintPrefix = "SHA256:"
+
+// hostKeyVerifier 记录主机密钥校验失败的原因
+// ssh.Dial只会返回错误的文本，需要通过它判断是否为主机密钥错误
+type hostKeyVerifier struct {
+	err error
+}
+
+// createHostKeyCallback 创建主机密钥校验回调
+// 资源指定了指纹时只接受这些指纹，否则使用配置的校验策略
+func (f *FileTranDataAdapter) createHostKeyCallback(fingerprints []string) (ssh.HostKeyCallback, *hostKeyVerifier, error) {
+	check, err := f.createHostKeyCheck(fingerprints)
+	if err != nil {
+		return nil, nil, err
+	}
+	verifier := &hostKeyVerifier{}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		verifier.err = check(hostname, remote, key)
+		return verifier.err
+	}, verifier, nil
+}
+
+func (f *FileTranDataAdapter) createHostKeyCheck(fingerprints []string) (ssh.HostKeyCallback, error) {
+	if len(fingerprints) > 0 {
+		return pinnedHostKeyCheck(fingerprints), nil
+	}
+	config := f.sshConfig.HostKey
+	switch config.Policy {
+	case "", HostKeyPolicyTofu:
+		return f.tofuHostKeyCheck, nil
+	case HostKeyPolicyKnownHosts:
+		check, err := knownhosts.New(config.KnownHosts)
+		if err != nil {
+			return nil, fmt.Errorf("problem load known hosts: %v", err)
+		}
+		return knownHostsCheck(check), nil
+	case HostKeyPolicyInsecure:
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	return nil, fmt.Errorf("unknown host key policy %s", config.Policy)
+}
+
+// tofuHostKeyCheck 首次连接时信任并保存主机密钥，之后只接受保存的密钥
+func (f *FileTranDataAdapter) tofuHostKeyCheck(hostname string, _ net.Addr, key ssh.PublicKey) error {
+	host := knownhosts.Normalize(hostname)
+	authorizedKey := marshalHostKey(key)
+	trustedKey := f.dataStore.SaveHostKeyIfAbsent(host, authorizedKey)
+	if trustedKey != authorizedKey {
+		return fmt.Errorf("%w: %s presented %s", HostKeyMismatch, host, ssh.FingerprintSHA256(key))
+	}
+	return nil
+}
+
+func pinnedHostKeyCheck(fingerprints []string) ssh.HostKeyCallback {
+	return func(hostname string, _ net.Addr, key ssh.PublicKey) error {
+		fingerprint := ssh.FingerprintSHA256(key)
+		for _, pinned := range fingerprints {
+			if pinned == fingerprint {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s presented %s", HostKeyMismatch, hostname, fingerprint)
+	}
+}
+
+func knownHostsCheck(check ssh.HostKeyCallback) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := check(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) {
+			if len(keyErr.Want) == 0 {
+				return fmt.Errorf("%w: %s", HostKeyUnknown, hostname)
+			}
+			return fmt.Errorf("%w: %s presented %s", HostKeyMismatch, hostname, ssh.FingerprintSHA256(key))
+		}
+		return err
+	}
+}
+
+// marshalHostKey 将公钥转换为authorized_keys格式保存
+func marshalHostKey(key ssh.PublicKey) string {
+	return string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(key)))
+}
+
+// isFingerprintValid 只接受ssh-keygen -l输出的SHA256格式指纹
+func isFingerprintValid(fingerprint string) bool {
+	return strings.HasPrefix(fingerprint, fingerprintPrefix) && len(fingerprint) > len(fingerprintPrefix)
+}
@@ -0,0 +1,109 @@
+package filetransfer_test
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"os"
+	"path/filepath"
+	"strings"
+	"summersea.top/filetransfer"
+	testutil "summersea.top/filetransfer/test"
+	"testing"
+)
+
+func TestFileTranDataAdapter_HostKey(t *testing.T) {
+	server := testutil.StartSshServer(t, testutil.NewPasswordServerConfig(t, "test", "pwd"))
+	resource := filetransfer.Resource{Address: server.Address, Port: server.Port,
+		Account: filetransfer.Account{Name: "test", Password: "pwd"}}
+	host := knownhosts.Normalize(fmt.Sprintf("%s:%d", server.Address, server.Port))
+	otherKey := testutil.NewSigner(t).PublicKey()
+
+	t.Run("trust on first use", func(t *testing.T) {
+		store := filetransfer.NewMemoryStore()
+		adapter := filetransfer.NewFileTranDataAdapter(store)
+		assertResourceUploadSucceed(t, adapter, resource)
+		assertResourceUploadSucceed(t, adapter, resource)
+		testutil.AssertStringEqual(t, store.SaveHostKeyIfAbsent(host, "other"), marshalKey(server.HostKey.PublicKey()))
+	})
+
+	t.Run("trust on first use mismatch", func(t *testing.T) {
+		store := filetransfer.NewMemoryStore()
+		store.SaveHostKeyIfAbsent(host, marshalKey(otherKey))
+		adapter := filetransfer.NewFileTranDataAdapter(store)
+		assertResourceUploadErr(t, adapter, resource, filetransfer.HostKeyMismatch)
+	})
+
+	t.Run("pinned fingerprint", func(t *testing.T) {
+		store := filetransfer.NewMemoryStore()
+		store.SaveHostKeyIfAbsent(host, marshalKey(otherKey))
+		adapter := filetransfer.NewFileTranDataAdapter(store)
+		pinned := resource
+		pinned.Fingerprints = []string{ssh.FingerprintSHA256(otherKey), ssh.FingerprintSHA256(server.HostKey.PublicKey())}
+		assertResourceUploadSucceed(t, adapter, pinned)
+
+		pinned.Fingerprints = []string{ssh.FingerprintSHA256(otherKey)}
+		assertResourceUploadErr(t, adapter, pinned, filetransfer.HostKeyMismatch)
+	})
+
+	t.Run("known hosts", func(t *testing.T) {
+		knownHostsPath := filepath.Join(t.TempDir(), "known_hosts")
+		config := filetransfer.SshConfig{HostKey: filetransfer.HostKeyConfig{
+			Policy: filetransfer.HostKeyPolicyKnownHosts, KnownHosts: knownHostsPath}}
+		adapter := filetransfer.NewFileTranDataAdapterWithConfig(filetransfer.NewMemoryStore(), config)
+
+		writeKnownHosts(t, knownHostsPath, "")
+		assertResourceUploadErr(t, adapter, resource, filetransfer.HostKeyUnknown)
+
+		writeKnownHosts(t, knownHostsPath, knownhosts.Line([]string{host}, otherKey))
+		assertResourceUploadErr(t, adapter, resource, filetransfer.HostKeyMismatch)
+
+		writeKnownHosts(t, knownHostsPath, knownhosts.Line([]string{host}, server.HostKey.PublicKey()))
+		assertResourceUploadSucceed(t, adapter, resource)
+	})
+
+	t.Run("insecure", func(t *testing.T) {
+		store := filetransfer.NewMemoryStore()
+		store.SaveHostKeyIfAbsent(host, marshalKey(otherKey))
+		config := filetransfer.SshConfig{HostKey: filetransfer.HostKeyConfig{Policy: filetransfer.HostKeyPolicyInsecure}}
+		assertResourceUploadSucceed(t, filetransfer.NewFileTranDataAdapterWithConfig(store, config), resource)
+	})
+
+	t.Run("unknown policy", func(t *testing.T) {
+		config := filetransfer.SshConfig{HostKey: filetransfer.HostKeyConfig{Policy: "none"}}
+		adapter := filetransfer.NewFileTranDataAdapterWithConfig(filetransfer.NewMemoryStore(), config)
+		channel, err := getResourceUploadChannel(adapter, resource, t.TempDir())
+		testutil.AssertNotNil(t, err)
+		testutil.AssertNil(t, channel)
+	})
+}
+
+func assertResourceUploadSucceed(t *testing.T, adapter *filetransfer.FileTranDataAdapter, resource filetransfer.Resource) {
+	t.Helper()
+	channel, err := getResourceUploadChannel(adapter, resource, t.TempDir())
+	if err != nil {
+		t.Fatalf("problem get upload channel: %v", err)
+	}
+	testutil.AssertNil(t, channel.Close())
+}
+
+func assertResourceUploadErr(t *testing.T, adapter *filetransfer.FileTranDataAdapter, resource filetransfer.Resource, want error) {
+	t.Helper()
+	channel, err := getResourceUploadChannel(adapter, resource, t.TempDir())
+	testutil.AssertNil(t, channel)
+	if !errors.Is(err, want) {
+		t.Errorf("want %v but got %v", want, err)
+	}
+}
+
+func writeKnownHosts(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content+"\n"), 0600); err != nil {
+		t.Fatalf("could not write known hosts: %v", err)
+	}
+}
+
+func marshalKey(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
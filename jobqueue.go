@@ -0,0 +1,127 @@
+package filetransfer
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// defaultWorkers 没有配置时执行服务端任务的并发数
+const defaultWorkers = 4
+
+// defaultJobLease 没有配置时执行中的任务的租约，实例失效后租约过期，任务回到队列由其它实例执行
+const defaultJobLease = 30 * time.Second
+
+// jobPollInterval 队列为空时重新检查队列的间隔，其它实例加入的任务通过轮询获取
+const jobPollInterval = time.Second
+
+// Job 队列中等待服务端执行的任务，任务的数据按类型保存在DataStore中
+type Job struct {
+	TaskId string `json:"taskId"`
+	Type   string `json:"type"`
+}
+
+// startWorkers 启动worker从队列中获取任务并执行，多次调用只启动一次
+// 配置了workers时创建服务后即启动，也执行其它实例加入的任务，否则在本实例第一次加入任务时启动
+func (fs *FileServerController) startWorkers() {
+	fs.workersOnce.Do(func() {
+		for i := 0; i < fs.workerCount(); i++ {
+			go fs.runWorker()
+		}
+	})
+}
+
+func (fs *FileServerController) workerCount() int {
+	if fs.config.Workers > 0 {
+		return fs.config.Workers
+	}
+	return defaultWorkers
+}
+
+// pushJob 将任务加入队列，并唤醒本实例空闲的worker
+func (fs *FileServerController) pushJob(job Job) {
+	fs.startWorkers()
+	fs.dataAdapter.PushJob(job)
+	select {
+	case fs.jobWake <- struct{}{}:
+	default:
+	}
+}
+
+// runWorker 执行队列中的任务，config.Context结束后不再获取新的任务
+func (fs *FileServerController) runWorker() {
+	var stop <-chan struct{}
+	if fs.config.Context != nil {
+		stop = fs.config.Context.Done()
+	}
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		job := fs.dataAdapter.PopJob(fs.jobLease())
+		if job == nil {
+			select {
+			case <-stop:
+				return
+			case <-fs.jobWake:
+			case <-time.After(jobPollInterval):
+			}
+			continue
+		}
+		fs.executeJob(*job)
+	}
+}
+
+// jobLease 执行中的任务的租约时长，执行过程中每隔租约的三分之一续租一次
+func (fs *FileServerController) jobLease() time.Duration {
+	if fs.config.JobLease > 0 {
+		return time.Duration(fs.config.JobLease) * time.Second
+	}
+	return defaultJobLease
+}
+
+// executeJob 执行任务并在执行过程中续租，执行结束后从队列中删除任务
+// 续租失败时任务可能已被其它实例取走，此时取消本次执行，也不再删除任务的租约
+func (fs *FileServerController) executeJob(job Job) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	lost := make(chan struct{})
+	go fs.renewJob(job, done, func() {
+		close(lost)
+		cancel()
+	})
+	switch job.Type {
+	case TaskTypeCopy:
+		fs.executeCopy(ctx, job.TaskId)
+	default:
+		log.Printf("problem execute job %s: unknown type %s", job.TaskId, job.Type)
+	}
+	close(done)
+	select {
+	case <-lost:
+	default:
+		fs.dataAdapter.FinishJob(job)
+	}
+}
+
+// renewJob 定时续租直到done被关闭，续租失败时调用onLost后退出
+func (fs *FileServerController) renewJob(job Job, done <-chan struct{}, onLost func()) {
+	lease := fs.jobLease()
+	ticker := time.NewTicker(lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if !fs.dataAdapter.RenewJob(job, lease) {
+				log.Printf("problem renew job %s: lease lost", job.TaskId)
+				onLost()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package filetransfer_test
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"summersea.top/filetransfer"
+	testutil "summersea.top/filetransfer/test"
+	"testing"
+	"time"
+)
+
+func TestJobQueue(t *testing.T) {
+	resource := filetransfer.Resource{Address: "addr", Port: 22, Account: filetransfer.Account{Name: "a", Password: "pwd"}}
+	newCopyData := func(dir, name string, options filetransfer.TransferOptions) filetransfer.CopyData {
+		source := filepath.Join(dir, name+".src")
+		_ = os.WriteFile(source, make([]byte, 64*1024), 0644)
+		return filetransfer.CopyData{Source: filetransfer.CopyEndpoint{Resource: resource, Path: source},
+			Destination:     filetransfer.CopyEndpoint{Resource: resource, Path: filepath.Join(dir, name+".dst")},
+			TransferOptions: options}
+	}
+
+	t.Run("queued job picked up by new server", func(t *testing.T) {
+		adapter := &StubAdapter{}
+		taskId := filetransfer.NewTaskId()
+		copyData := newCopyData(t.TempDir(), "queued", filetransfer.TransferOptions{})
+		adapter.SaveCopyData(taskId, copyData)
+		adapter.SaveTaskStatus(taskId, filetransfer.TaskStatus{TaskId: taskId, Type: filetransfer.TaskTypeCopy,
+			State: filetransfer.TaskStatePending, Total: -1})
+		adapter.PushJob(filetransfer.Job{TaskId: taskId, Type: filetransfer.TaskTypeCopy})
+
+		fileServer := filetransfer.NewFileServerWithConfig(adapter, filetransfer.TransferConfig{Workers: 1})
+		waitTaskState(t, fileServer, taskId, filetransfer.TaskStateSucceeded)
+		_, err := os.Stat(copyData.Destination.Path)
+		testutil.AssertNil(t, err)
+		testutil.AssertNil(t, adapter.PopJob(time.Minute))
+	})
+
+	// pushQueuedJob 模拟其它实例加入的任务
+	pushQueuedJob := func(t *testing.T, adapter *StubAdapter) string {
+		taskId := filetransfer.NewTaskId()
+		adapter.SaveCopyData(taskId, newCopyData(t.TempDir(), "other", filetransfer.TransferOptions{}))
+		adapter.SaveTaskStatus(taskId, filetransfer.TaskStatus{TaskId: taskId, Type: filetransfer.TaskTypeCopy,
+			State: filetransfer.TaskStatePending, Total: -1})
+		adapter.PushJob(filetransfer.Job{TaskId: taskId, Type: filetransfer.TaskTypeCopy})
+		return taskId
+	}
+
+	t.Run("no workers without queue config", func(t *testing.T) {
+		adapter := &StubAdapter{}
+		taskId := pushQueuedJob(t, adapter)
+		fileServer := filetransfer.NewFileServer(adapter)
+		time.Sleep(1200 * time.Millisecond)
+		testutil.AssertStringEqual(t, queryTaskStatus(t, fileServer, taskId).State, filetransfer.TaskStatePending)
+		testutil.AssertNotNil(t, adapter.PopJob(time.Minute))
+	})
+
+	t.Run("workers stopped by context", func(t *testing.T) {
+		adapter := &StubAdapter{}
+		ctx, cancel := context.WithCancel(context.Background())
+		fileServer := filetransfer.NewFileServerWithConfig(adapter, filetransfer.TransferConfig{Workers: 1, Context: ctx})
+		cancel()
+		time.Sleep(100 * time.Millisecond)
+		taskId := pushQueuedJob(t, adapter)
+		time.Sleep(1200 * time.Millisecond)
+		testutil.AssertStringEqual(t, queryTaskStatus(t, fileServer, taskId).State, filetransfer.TaskStatePending)
+		testutil.AssertNotNil(t, adapter.PopJob(time.Minute))
+	})
+
+	t.Run("finished job skipped", func(t *testing.T) {
+		adapter := &StubAdapter{}
+		// 实例在复制结束后、删除租约前失效，任务再次被取出时状态已结束或复制数据已被删除
+		staleStates := []string{filetransfer.TaskStateSucceeded, filetransfer.TaskStateRunning}
+		var staleIds []string
+		for _, state := range staleStates {
+			taskId := filetransfer.NewTaskId()
+			adapter.SaveTaskStatus(taskId, filetransfer.TaskStatus{TaskId: taskId, Type: filetransfer.TaskTypeCopy,
+				State: state, Total: -1})
+			adapter.PushJob(filetransfer.Job{TaskId: taskId, Type: filetransfer.TaskTypeCopy})
+			staleIds = append(staleIds, taskId)
+		}
+		taskId := filetransfer.NewTaskId()
+		adapter.SaveCopyData(taskId, newCopyData(t.TempDir(), "next", filetransfer.TransferOptions{}))
+		adapter.SaveTaskStatus(taskId, filetransfer.TaskStatus{TaskId: taskId, Type: filetransfer.TaskTypeCopy,
+			State: filetransfer.TaskStatePending, Total: -1})
+		adapter.PushJob(filetransfer.Job{TaskId: taskId, Type: filetransfer.TaskTypeCopy})
+
+		fileServer := filetransfer.NewFileServerWithConfig(adapter, filetransfer.TransferConfig{Workers: 1})
+		waitTaskState(t, fileServer, taskId, filetransfer.TaskStateSucceeded)
+		for i, staleId := range staleIds {
+			testutil.AssertStringEqual(t, adapter.GetTaskStatus(staleId).State, staleStates[i])
+		}
+		testutil.AssertNil(t, adapter.PopJob(time.Minute))
+	})
+
+	t.Run("workers bounded", func(t *testing.T) {
+		adapter := &StubAdapter{}
+		fileServer := filetransfer.NewFileServerWithConfig(adapter, filetransfer.TransferConfig{Workers: 1})
+		dir := t.TempDir()
+		slow := filetransfer.TransferOptions{RateLimit: 1024}
+		var taskIds []string
+		for _, name := range []string{"first", "second"} {
+			body := filetransfer.CopyReqBody(newCopyData(dir, name, slow))
+			response := testCase(t, initTestCase{requestBody: body, wantResponseStatus: http.StatusAccepted}, copyUrl, fileServer)
+			taskIds = append(taskIds, extractOkBody(response.Body).Data["taskId"].(string))
+		}
+		waitTaskState(t, fileServer, taskIds[0], filetransfer.TaskStateRunning)
+		time.Sleep(200 * time.Millisecond)
+		testutil.AssertStringEqual(t, queryTaskStatus(t, fileServer, taskIds[1]).State, filetransfer.TaskStatePending)
+
+		testutil.AssertIntEquals(t, deleteTask(fileServer, taskIds[0]).Code, http.StatusAccepted)
+		waitTaskState(t, fileServer, taskIds[1], filetransfer.TaskStateRunning)
+		testutil.AssertIntEquals(t, deleteTask(fileServer, taskIds[1]).Code, http.StatusAccepted)
+		waitTaskState(t, fileServer, taskIds[1], filetransfer.TaskStateCanceled)
+	})
+
+	t.Run("lease lost stops copy", func(t *testing.T) {
+		adapter := &StubAdapter{}
+		fileServer := filetransfer.NewFileServerWithConfig(adapter, filetransfer.TransferConfig{Workers: 1, JobLease: 1})
+		dir := t.TempDir()
+		slow := filetransfer.TransferOptions{RateLimit: 1024}
+		var taskIds []string
+		for _, name := range []string{"first", "second"} {
+			body := filetransfer.CopyReqBody(newCopyData(dir, name, slow))
+			response := testCase(t, initTestCase{requestBody: body, wantResponseStatus: http.StatusAccepted}, copyUrl, fileServer)
+			taskIds = append(taskIds, extractOkBody(response.Body).Data["taskId"].(string))
+		}
+		waitTaskState(t, fileServer, taskIds[0], filetransfer.TaskStateRunning)
+		// 删除租约模拟租约过期后任务被其它实例取走，worker停止执行后取出下一个任务
+		adapter.FinishJob(filetransfer.Job{TaskId: taskIds[0], Type: filetransfer.TaskTypeCopy})
+		waitTaskState(t, fileServer, taskIds[1], filetransfer.TaskStateRunning)
+		testutil.AssertStringEqual(t, queryTaskStatus(t, fileServer, taskIds[0]).State, filetransfer.TaskStateRunning)
+		testutil.AssertNotNil(t, adapter.GetCopyData(taskIds[0]))
+		_, err := os.Stat(filepath.Join(dir, "first.dst"))
+		testutil.AssertNil(t, err)
+
+		testutil.AssertIntEquals(t, deleteTask(fileServer, taskIds[1]).Code, http.StatusAccepted)
+		waitTaskState(t, fileServer, taskIds[1], filetransfer.TaskStateCanceled)
+	})
+}
@@ -0,0 +1,119 @@
+package filetransfer
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"time"
+)
+
+// maxProxyHops 一个资源最多经过的跳板机数
+const maxProxyHops = 8
+
+// defaultDialTimeout 没有配置时连接与握手的超时时间
+const defaultDialTimeout = 10 * time.Second
+
+var handshakeTimeoutErr = errors.New("ssh handshake timed out")
+
+func (h ProxyHop) resource() Resource {
+	return Resource{Address: h.Address, Port: h.Port, Account: h.Account, Fingerprints: h.Fingerprints}
+}
+
+// dial 依次连接资源的跳板机，通过最后一个跳板机连接目标资源
+// 返回的连接关闭后跳板机的连接随之关闭
+func (f *FileTranDataAdapter) dial(resource Resource) (*ssh.Client, error) {
+	var proxies []*ssh.Client
+	for _, hop := range resource.Proxies {
+		client, err := f.dialHop(lastClient(proxies), hop.resource())
+		if err != nil {
+			closeClients(proxies)
+			return nil, fmt.Errorf("problem dial proxy %s: %w", poolHost(hop.resource()), err)
+		}
+		proxies = append(proxies, client)
+	}
+	client, err := f.dialHop(lastClient(proxies), resource)
+	if err != nil {
+		closeClients(proxies)
+		return nil, fmt.Errorf("problem dial target resource: %w", err)
+	}
+	if len(proxies) > 0 {
+		go func() {
+			_ = client.Wait()
+			closeClients(proxies)
+		}()
+	}
+	return client, nil
+}
+
+// dialHop 连接资源，via不为nil时通过via转发连接
+func (f *FileTranDataAdapter) dialHop(via *ssh.Client, resource Resource) (*ssh.Client, error) {
+	hostKeyCallback, verifier, err := f.createHostKeyCallback(resource.Fingerprints)
+	if err != nil {
+		return nil, err
+	}
+	sshConfig, cleanup, err := f.createShhConfig(resource.Account, hostKeyCallback)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	address := poolHost(resource)
+	var client *ssh.Client
+	if via == nil {
+		client, err = dialDirect(address, sshConfig)
+	} else {
+		client, err = dialThrough(via, address, sshConfig)
+	}
+	if verifier.err != nil {
+		return nil, fmt.Errorf("problem verify host key: %w", verifier.err)
+	}
+	return client, err
+}
+
+func dialDirect(address string, sshConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := net.DialTimeout("tcp", address, sshConfig.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(conn, address, sshConfig)
+}
+
+func dialThrough(via *ssh.Client, address string, sshConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := via.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(conn, address, sshConfig)
+}
+
+// newClient 在conn上完成ssh握手，握手超过sshConfig.Timeout时关闭conn
+// 通过跳板机转发的连接不支持SetDeadline，所以由定时器关闭连接
+func newClient(conn net.Conn, address string, sshConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	timer := time.AfterFunc(sshConfig.Timeout, func() { _ = conn.Close() })
+	clientConn, channels, requests, err := ssh.NewClientConn(conn, address, sshConfig)
+	if !timer.Stop() {
+		if err == nil {
+			_ = clientConn.Close()
+		}
+		return nil, fmt.Errorf("%w after %v", handshakeTimeoutErr, sshConfig.Timeout)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(clientConn, channels, requests), nil
+}
+
+func lastClient(clients []*ssh.Client) *ssh.Client {
+	if len(clients) == 0 {
+		return nil
+	}
+	return clients[len(clients)-1]
+}
+
+// closeClients 从目标一侧开始关闭连接
+func closeClients(clients []*ssh.Client) {
+	for i := len(clients) - 1; i >= 0; i-- {
+		closeWithErrLog(clients[i])
+	}
+}
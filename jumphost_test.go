@@ -0,0 +1,116 @@
+package filetransfer_test
+
+import (
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"net"
+	"net/http"
+	"strings"
+	"summersea.top/filetransfer"
+	testutil "summersea.top/filetransfer/test"
+	"testing"
+	"time"
+)
+
+func TestFileTranDataAdapter_JumpHost(t *testing.T) {
+	bastion := testutil.StartSshServer(t, testutil.NewPasswordServerConfig(t, "jump", "jpwd"))
+	target := testutil.StartSshServer(t, testutil.NewPasswordServerConfig(t, "test", "pwd"))
+	hop := filetransfer.ProxyHop{Address: bastion.Address, Port: bastion.Port,
+		Account: filetransfer.Account{Name: "jump", Password: "jpwd"}}
+	newResource := func(hops ...filetransfer.ProxyHop) filetransfer.Resource {
+		return filetransfer.Resource{Address: target.Address, Port: target.Port,
+			Account: filetransfer.Account{Name: "test", Password: "pwd"}, Proxies: hops}
+	}
+	otherKey := testutil.NewSigner(t).PublicKey()
+
+	t.Run("upload through bastion", func(t *testing.T) {
+		store := filetransfer.NewMemoryStore()
+		adapter := filetransfer.NewFileTranDataAdapter(store)
+		assertResourceUploadSucceed(t, adapter, newResource(hop))
+		for _, server := range []*testutil.SshServer{bastion, target} {
+			host := knownhosts.Normalize(fmt.Sprintf("%s:%d", server.Address, server.Port))
+			testutil.AssertStringEqual(t, store.SaveHostKeyIfAbsent(host, "other"), marshalKey(server.HostKey.PublicKey()))
+		}
+	})
+
+	t.Run("chain of bastions", func(t *testing.T) {
+		adapter := filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStore())
+		assertResourceUploadSucceed(t, adapter, newResource(hop, hop))
+	})
+
+	t.Run("bastion fingerprint pinned", func(t *testing.T) {
+		adapter := filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStore())
+		pinned := hop
+		pinned.Fingerprints = []string{ssh.FingerprintSHA256(bastion.HostKey.PublicKey())}
+		assertResourceUploadSucceed(t, adapter, newResource(pinned))
+	})
+
+	t.Run("bastion host key mismatch", func(t *testing.T) {
+		adapter := filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStore())
+		pinned := hop
+		pinned.Fingerprints = []string{ssh.FingerprintSHA256(otherKey)}
+		assertResourceUploadErr(t, adapter, newResource(pinned), filetransfer.HostKeyMismatch)
+	})
+
+	t.Run("target host key mismatch", func(t *testing.T) {
+		adapter := filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStore())
+		resource := newResource(hop)
+		resource.Fingerprints = []string{ssh.FingerprintSHA256(otherKey)}
+		assertResourceUploadErr(t, adapter, resource, filetransfer.HostKeyMismatch)
+	})
+
+	t.Run("target handshake timeout", func(t *testing.T) {
+		// 目标只接受连接不响应，握手在超时后失败而不是一直等待
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		testutil.AssertNil(t, err)
+		defer listener.Close()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+			}
+		}()
+		addr := listener.Addr().(*net.TCPAddr)
+		resource := newResource(hop)
+		resource.Address, resource.Port = addr.IP.String(), addr.Port
+		adapter := filetransfer.NewFileTranDataAdapterWithConfig(filetransfer.NewMemoryStore(), filetransfer.SshConfig{Timeout: 1})
+		start := time.Now()
+		channel, err := getResourceUploadChannel(adapter, resource, t.TempDir())
+		testutil.AssertNil(t, channel)
+		testutil.AssertTrue(t, err != nil && strings.Contains(err.Error(), "timed out"))
+		testutil.AssertTrue(t, time.Since(start) < 5*time.Second)
+	})
+
+	t.Run("bastion auth failed", func(t *testing.T) {
+		adapter := filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStore())
+		wrong := hop
+		wrong.Account.Password = "wrong"
+		channel, err := getResourceUploadChannel(adapter, newResource(wrong), t.TempDir())
+		testutil.AssertNil(t, channel)
+		testutil.AssertTrue(t, err != nil && strings.Contains(err.Error(), "problem dial proxy"))
+	})
+}
+
+func TestInitWithProxies(t *testing.T) {
+	fileServer := filetransfer.NewFileServer(&StubAdapter{})
+	account := filetransfer.Account{Name: "a", Password: "pwd"}
+	hop := filetransfer.ProxyHop{Address: "bastion", Port: 22, Account: account}
+	testCases := []struct {
+		proxies    []filetransfer.ProxyHop
+		wantStatus int
+	}{
+		{nil, http.StatusOK},
+		{[]filetransfer.ProxyHop{hop, hop}, http.StatusOK},
+		{[]filetransfer.ProxyHop{{Address: "bastion", Port: 0, Account: account}}, http.StatusBadRequest},
+		{[]filetransfer.ProxyHop{{Address: "bastion", Port: 22}}, http.StatusBadRequest},
+		{[]filetransfer.ProxyHop{{Address: "bastion", Port: 22, Account: account, Fingerprints: []string{"SHA256:"}}}, http.StatusBadRequest},
+	}
+	for _, test := range testCases {
+		resource := filetransfer.Resource{Address: "addr", Port: 22, Account: account, Proxies: test.proxies}
+		assertInitStatus(t, fileServer, resource, test.wantStatus)
+	}
+}
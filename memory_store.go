@@ -1,14 +1,63 @@
 package filetransfer
 
+import (
+	"sync"
+	"time"
+)
+
+type uploadEntry struct {
+	data     UploadData
+	offset   int64
+	expireAt time.Time
+}
+
+type downloadEntry struct {
+	data     DownloadData
+	expireAt time.Time
+}
+
+type copyEntry struct {
+	data     CopyData
+	expireAt time.Time
+}
+
+type statusEntry struct {
+	status   TaskStatus
+	expireAt time.Time
+}
+
+// MemoryStore 内存存储，任务与redis存储一样在taskExpiration后过期
 type MemoryStore struct {
-	uploadStore   map[string]UploadData
-	downloadStore map[string]DownloadData
+	mutex sync.RWMutex
+	// expiration 任务数据的存活时间
+	expiration    time.Duration
+	uploadStore   map[string]*uploadEntry
+	downloadStore map[string]*downloadEntry
+	copyStore     map[string]*copyEntry
+	hostKeyStore  map[string]string
+	statusStore   map[string]*statusEntry
+	subscribers   map[string][]chan TaskStatus
+	cancelStore   map[string]time.Time
+	jobQueue      []Job
+	jobLeases     map[Job]time.Time
 }
 
 func NewMemoryStore() *MemoryStore {
+	return NewMemoryStoreWithExpiration(taskExpiration)
+}
+
+// NewMemoryStoreWithExpiration 创建任务数据在expiration后过期的内存存储，任务状态仍保留statusExpiration
+func NewMemoryStoreWithExpiration(expiration time.Duration) *MemoryStore {
 	return &MemoryStore{
-		uploadStore:   make(map[string]UploadData),
-		downloadStore: make(map[string]DownloadData),
+		expiration:    expiration,
+		uploadStore:   make(map[string]*uploadEntry),
+		downloadStore: make(map[string]*downloadEntry),
+		copyStore:     make(map[string]*copyEntry),
+		hostKeyStore:  make(map[string]string),
+		statusStore:   make(map[string]*statusEntry),
+		subscribers:   make(map[string][]chan TaskStatus),
+		cancelStore:   make(map[string]time.Time),
+		jobLeases:     make(map[Job]time.Time),
 	}
 }
 
@@ -16,40 +65,333 @@ func (m *MemoryStore) SaveUploadData(taskId string, data UploadData) {
 	if taskId == "" {
 		return
 	}
-	m.uploadStore[taskId] = data
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.removeExpired()
+	m.uploadStore[taskId] = &uploadEntry{data: data, expireAt: time.Now().Add(m.expiration)}
+}
+
+func (m *MemoryStore) GetUploadData(taskId string) *UploadData {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	entry := m.getUploadEntry(taskId)
+	if entry == nil {
+		return nil
+	}
+	data := entry.data
+	return &data
 }
 
 func (m *MemoryStore) GetUploadDataRemove(taskId string) *UploadData {
-	if !m.IsUploadTaskExist(taskId) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	entry := m.getUploadEntry(taskId)
+	if entry == nil {
 		return nil
 	}
-	data := m.uploadStore[taskId]
 	delete(m.uploadStore, taskId)
-	return &data
+	return &entry.data
 }
 
 func (m *MemoryStore) IsUploadTaskExist(taskId string) bool {
-	_, exist := m.uploadStore[taskId]
-	return exist
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.getUploadEntry(taskId) != nil
+}
+
+// SaveUploadOffset 保存已提交的字节数，同时延长上传任务的存活时间
+func (m *MemoryStore) SaveUploadOffset(taskId string, offset int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	entry := m.getUploadEntry(taskId)
+	if entry == nil {
+		return
+	}
+	entry.offset = offset
+	entry.expireAt = time.Now().Add(m.expiration)
+}
+
+// RenewTask 延长任务数据的存活时间
+func (m *MemoryStore) RenewTask(taskId string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	expireAt := time.Now().Add(m.expiration)
+	if entry := m.getUploadEntry(taskId); entry != nil {
+		entry.expireAt = expireAt
+	}
+	if entry := m.getDownloadEntry(taskId); entry != nil {
+		entry.expireAt = expireAt
+	}
+	if entry := m.getCopyEntry(taskId); entry != nil {
+		entry.expireAt = expireAt
+	}
+}
+
+func (m *MemoryStore) GetUploadOffset(taskId string) int64 {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	entry := m.getUploadEntry(taskId)
+	if entry == nil {
+		return 0
+	}
+	return entry.offset
+}
+
+func (m *MemoryStore) SaveHostKeyIfAbsent(host string, key string) string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if trustedKey, exist := m.hostKeyStore[host]; exist {
+		return trustedKey
+	}
+	m.hostKeyStore[host] = key
+	return key
 }
 
 func (m *MemoryStore) SaveDownloadData(taskId string, data DownloadData) {
 	if taskId == "" {
 		return
 	}
-	m.downloadStore[taskId] = data
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.removeExpired()
+	m.downloadStore[taskId] = &downloadEntry{data: data, expireAt: time.Now().Add(m.expiration)}
+}
+
+func (m *MemoryStore) GetDownloadData(taskId string) *DownloadData {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	entry := m.getDownloadEntry(taskId)
+	if entry == nil {
+		return nil
+	}
+	data := entry.data
+	return &data
 }
 
 func (m *MemoryStore) GetDownloadDataRemove(taskId string) *DownloadData {
-	if !m.IsDownloadTaskExist(taskId) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	entry := m.getDownloadEntry(taskId)
+	if entry == nil {
 		return nil
 	}
-	data := m.downloadStore[taskId]
 	delete(m.downloadStore, taskId)
-	return &data
+	return &entry.data
 }
 
 func (m *MemoryStore) IsDownloadTaskExist(taskId string) bool {
-	_, exist := m.downloadStore[taskId]
-	return exist
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.getDownloadEntry(taskId) != nil
+}
+
+func (m *MemoryStore) SaveCopyData(taskId string, data CopyData) {
+	if taskId == "" {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.removeExpired()
+	m.copyStore[taskId] = &copyEntry{data: data, expireAt: time.Now().Add(m.expiration)}
+}
+
+func (m *MemoryStore) GetCopyData(taskId string) *CopyData {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	entry := m.getCopyEntry(taskId)
+	if entry == nil {
+		return nil
+	}
+	data := entry.data
+	return &data
+}
+
+func (m *MemoryStore) GetCopyDataRemove(taskId string) *CopyData {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	entry := m.getCopyEntry(taskId)
+	if entry == nil {
+		return nil
+	}
+	delete(m.copyStore, taskId)
+	return &entry.data
+}
+
+func (m *MemoryStore) IsCopyTaskExist(taskId string) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.getCopyEntry(taskId) != nil
+}
+
+func (m *MemoryStore) SaveTaskStatus(taskId string, status TaskStatus) {
+	if taskId == "" {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.removeExpired()
+	m.statusStore[taskId] = &statusEntry{status: status, expireAt: time.Now().Add(statusExpiration)}
+	for _, channel := range m.subscribers[taskId] {
+		publishStatus(channel, status)
+	}
+}
+
+func (m *MemoryStore) GetTaskStatus(taskId string) *TaskStatus {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	entry, exist := m.statusStore[taskId]
+	if !exist || time.Now().After(entry.expireAt) {
+		return nil
+	}
+	status := entry.status
+	return &status
+}
+
+func (m *MemoryStore) SubscribeTaskStatus(taskId string) (<-chan TaskStatus, func()) {
+	channel := make(chan TaskStatus, statusBufferSize)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.subscribers[taskId] = append(m.subscribers[taskId], channel)
+	var once sync.Once
+	return channel, func() {
+		once.Do(func() {
+			m.mutex.Lock()
+			defer m.mutex.Unlock()
+			m.removeSubscriber(taskId, channel)
+			close(channel)
+		})
+	}
+}
+
+// 移除订阅者，调用方需持有写锁
+func (m *MemoryStore) removeSubscriber(taskId string, channel chan TaskStatus) {
+	channels := m.subscribers[taskId]
+	for i, subscriber := range channels {
+		if subscriber == channel {
+			channels = append(channels[:i], channels[i+1:]...)
+			break
+		}
+	}
+	if len(channels) == 0 {
+		delete(m.subscribers, taskId)
+	} else {
+		m.subscribers[taskId] = channels
+	}
+}
+
+func (m *MemoryStore) SaveTaskCancel(taskId string) {
+	if taskId == "" {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.removeExpired()
+	m.cancelStore[taskId] = time.Now().Add(statusExpiration)
+}
+
+func (m *MemoryStore) IsTaskCanceled(taskId string) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	expireAt, exist := m.cancelStore[taskId]
+	return exist && !time.Now().After(expireAt)
+}
+
+func (m *MemoryStore) PushJob(job Job) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.jobQueue = append(m.jobQueue, job)
+}
+
+func (m *MemoryStore) PopJob(lease time.Duration) *Job {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	for job, expireAt := range m.jobLeases {
+		if now.After(expireAt) {
+			delete(m.jobLeases, job)
+			m.jobQueue = append([]Job{job}, m.jobQueue...)
+		}
+	}
+	if len(m.jobQueue) == 0 {
+		return nil
+	}
+	job := m.jobQueue[0]
+	m.jobQueue = m.jobQueue[1:]
+	m.jobLeases[job] = now.Add(lease)
+	return &job
+}
+
+func (m *MemoryStore) RenewJob(job Job, lease time.Duration) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	expireAt, exist := m.jobLeases[job]
+	now := time.Now()
+	if !exist || now.After(expireAt) {
+		return false
+	}
+	m.jobLeases[job] = now.Add(lease)
+	return true
+}
+
+func (m *MemoryStore) FinishJob(job Job) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.jobLeases, job)
+}
+
+// 获取未过期的上传任务，调用方需持有锁
+func (m *MemoryStore) getUploadEntry(taskId string) *uploadEntry {
+	entry, exist := m.uploadStore[taskId]
+	if !exist || time.Now().After(entry.expireAt) {
+		return nil
+	}
+	return entry
+}
+
+// 获取未过期的下载任务，调用方需持有锁
+func (m *MemoryStore) getDownloadEntry(taskId string) *downloadEntry {
+	entry, exist := m.downloadStore[taskId]
+	if !exist || time.Now().After(entry.expireAt) {
+		return nil
+	}
+	return entry
+}
+
+// 获取未过期的复制任务，调用方需持有锁
+func (m *MemoryStore) getCopyEntry(taskId string) *copyEntry {
+	entry, exist := m.copyStore[taskId]
+	if !exist || time.Now().After(entry.expireAt) {
+		return nil
+	}
+	return entry
+}
+
+// 清理过期任务，调用方需持有写锁
+func (m *MemoryStore) removeExpired() {
+	now := time.Now()
+	for taskId, entry := range m.uploadStore {
+		if now.After(entry.expireAt) {
+			delete(m.uploadStore, taskId)
+		}
+	}
+	for taskId, entry := range m.downloadStore {
+		if now.After(entry.expireAt) {
+			delete(m.downloadStore, taskId)
+		}
+	}
+	for taskId, entry := range m.copyStore {
+		if now.After(entry.expireAt) {
+			delete(m.copyStore, taskId)
+		}
+	}
+	for taskId, entry := range m.statusStore {
+		if now.After(entry.expireAt) {
+			delete(m.statusStore, taskId)
+		}
+	}
+	for taskId, expireAt := range m.cancelStore {
+		if now.After(expireAt) {
+			delete(m.cancelStore, taskId)
+		}
+	}
 }
@@ -0,0 +1,56 @@
+package filetransfer
+
+import (
+	"summersea.top/filetransfer/transferframe"
+	"sync"
+)
+
+// taskLimiters 同一任务在本实例上的并发请求共用一个限速器，最后一个请求结束后删除
+type taskLimiters struct {
+	mutex    sync.Mutex
+	clock    transferframe.Clock
+	limiters map[string]*taskLimiter
+}
+
+type taskLimiter struct {
+	limiter *transferframe.RateLimiter
+	refs    int
+}
+
+func newTaskLimiters(clock transferframe.Clock) *taskLimiters {
+	return &taskLimiters{clock: clock, limiters: map[string]*taskLimiter{}}
+}
+
+// newRateLimiter 创建每秒rate字节的限速器，clock为nil时使用系统时钟
+func newRateLimiter(rate int64, clock transferframe.Clock) (*transferframe.RateLimiter, error) {
+	if clock == nil {
+		return transferframe.NewRateLimiter(rate)
+	}
+	return transferframe.NewRateLimiterWithClock(rate, transferframe.DefaultBurst(rate), clock)
+}
+
+// acquire 获取任务的限速器，rate为每秒字节数
+func (l *taskLimiters) acquire(taskId string, rate int64) *transferframe.RateLimiter {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if saved, ok := l.limiters[taskId]; ok {
+		saved.refs++
+		return saved.limiter
+	}
+	limiter, err := newRateLimiter(rate, l.clock)
+	if err != nil {
+		return nil
+	}
+	l.limiters[taskId] = &taskLimiter{limiter: limiter, refs: 1}
+	return limiter
+}
+
+func (l *taskLimiters) release(taskId string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if saved, ok := l.limiters[taskId]; ok {
+		if saved.refs--; saved.refs <= 0 {
+			delete(l.limiters, taskId)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package filetransfer_test
+
+import (
+	"fmt"
+	uuid "github.com/satori/go.uuid"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"summersea.top/filetransfer"
+	testutil "summersea.top/filetransfer/test"
+	"testing"
+	"time"
+)
+
+func TestTransferRateLimit(t *testing.T) {
+	const size = 3000
+	// 桶容量为200字节，剩余2800字节以每秒2000字节需要1.4秒
+	const wantElapsed = 1400 * time.Millisecond
+
+	t.Run("task rate limit", func(t *testing.T) {
+		clock := testutil.NewFakeClock()
+		taskId := uuid.NewV4().String()
+		adapter := &StubAdapter{filename: filepath.Join(t.TempDir(), "limited.txt")}
+		adapter.SaveUploadData(taskId, filetransfer.UploadData{TransferOptions: filetransfer.TransferOptions{RateLimit: 2000}})
+		fileServer := filetransfer.NewFileServerWithConfig(adapter, filetransfer.TransferConfig{Clock: clock})
+		request := newPostRequestReader(fmt.Sprintf("%s?taskId=%s", uploadUrl, taskId), strings.NewReader(strings.Repeat("a", size)))
+		response := serveWithClock(t, fileServer, request, clock)
+		testutil.AssertIntEquals(t, response.Code, http.StatusNoContent)
+		testutil.AssertTrue(t, clock.Elapsed() >= wantElapsed)
+		got, _ := os.ReadFile(adapter.filename)
+		testutil.AssertIntEquals(t, len(got), size)
+	})
+
+	t.Run("global rate limit", func(t *testing.T) {
+		clock := testutil.NewFakeClock()
+		path := filepath.Join(t.TempDir(), "limited.txt")
+		_ = os.WriteFile(path, []byte(strings.Repeat("a", size)), 0644)
+		taskId := uuid.NewV4().String()
+		adapter := &StubAdapter{downloadTaskId: taskId, path: path}
+		fileServer := filetransfer.NewFileServerWithConfig(adapter, filetransfer.TransferConfig{RateLimit: 2000, Clock: clock})
+		response := serveWithClock(t, fileServer, newGetRequest(fmt.Sprintf("%s?taskId=%s", downloadUrl, taskId)), clock)
+		testutil.AssertIntEquals(t, response.Code, http.StatusOK)
+		testutil.AssertTrue(t, clock.Elapsed() >= wantElapsed)
+		got, _ := io.ReadAll(response.Body)
+		testutil.AssertIntEquals(t, len(got), size)
+	})
+}
+
+// serveWithClock 在后台处理请求，传输等待限速器时推进clock
+func serveWithClock(t *testing.T, fileServer http.Handler, request *http.Request, clock *testutil.FakeClock) *httptest.ResponseRecorder {
+	t.Helper()
+	response := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		fileServer.ServeHTTP(response, request)
+		close(done)
+	}()
+	deadline := time.After(10 * time.Second)
+	for {
+		select {
+		case <-done:
+			return response
+		case <-deadline:
+			t.Fatalf("request not finished")
+		default:
+		}
+		if clock.WaiterCount() > 0 {
+			clock.AdvanceToNext()
+		} else {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
@@ -6,11 +6,50 @@ import (
 	"github.com/go-redis/redis"
 	"log"
 	"strings"
+	"sync"
 	"time"
 )
 
 const uploadSuffix = "upload"
+const uploadOffsetSuffix = "upload-offset"
 const downloadSuffix = "download"
+const copySuffix = "copy"
+const hostKeySuffix = "hostkey"
+const statusSuffix = "status"
+const cancelSuffix = "cancel"
+const jobQueueKey = "job:queue"
+const jobLeaseKey = "job:lease"
+
+// jobNowScript 以redis服务端的时间计算租约，各实例的时钟不一致时租约也不会提前过期
+// 使用TIME之后写入数据需要按效果复制脚本
+const jobNowScript = `
+redis.replicate_commands()
+local time = redis.call('TIME')
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+`
+
+// popJobScript 将租约过期的任务放回队首，再取出队首的任务并记录租约的过期时间，ARGV[1]为租约的毫秒数
+// 队列以LPUSH加入、RPOP取出，右端为队首
+var popJobScript = redis.NewScript(jobNowScript + `
+local expired = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', now)
+for _, job in ipairs(expired) do
+	redis.call('ZREM', KEYS[2], job)
+	redis.call('RPUSH', KEYS[1], job)
+end
+local job = redis.call('RPOP', KEYS[1])
+if job then
+	redis.call('ZADD', KEYS[2], now + tonumber(ARGV[1]), job)
+end
+return job`)
+
+// renewJobScript 租约未过期时更新过期时间，ARGV[1]为租约的毫秒数，ARGV[2]为任务
+var renewJobScript = redis.NewScript(jobNowScript + `
+local expireAt = redis.call('ZSCORE', KEYS[1], ARGV[2])
+if not expireAt or tonumber(expireAt) < now then
+	return 0
+end
+redis.call('ZADD', KEYS[1], now + tonumber(ARGV[1]), ARGV[2])
+return 1`)
 
 type redisStore struct {
 	client *redis.Client
@@ -36,12 +75,11 @@ func (r redisStore) SaveUploadData(taskId string, data UploadData) {
 	}
 	key := r.createUploadKey(taskId)
 	uploadJSONData := r.data2Json(data)
-	r.client.Set(key, uploadJSONData, 10*time.Minute)
+	r.client.Set(key, uploadJSONData, taskExpiration)
 }
 
-func (r redisStore) GetUploadDataRemove(taskId string) *UploadData {
-	key := r.createUploadKey(taskId)
-	uploadJSONData, err := r.client.Get(key).Result()
+func (r redisStore) GetUploadData(taskId string) *UploadData {
+	uploadJSONData, err := r.client.Get(r.createUploadKey(taskId)).Result()
 	if err == redis.Nil {
 		return nil
 	} else if err != nil {
@@ -53,10 +91,17 @@ func (r redisStore) GetUploadDataRemove(taskId string) *UploadData {
 	if err != nil {
 		log.Printf("problem decode data: %v", err)
 	}
-	r.client.Del(key)
 	return &uploadData
 }
 
+func (r redisStore) GetUploadDataRemove(taskId string) *UploadData {
+	uploadData := r.GetUploadData(taskId)
+	if uploadData != nil {
+		r.client.Del(r.createUploadKey(taskId), r.createUploadOffsetKey(taskId))
+	}
+	return uploadData
+}
+
 func (r redisStore) IsUploadTaskExist(taskId string) bool {
 	_, err := r.client.Get(r.createUploadKey(taskId)).Result()
 	if err == redis.Nil {
@@ -68,18 +113,69 @@ func (r redisStore) IsUploadTaskExist(taskId string) bool {
 	return true
 }
 
+// SaveUploadOffset 保存已提交的字节数，同时延长上传任务的存活时间
+func (r redisStore) SaveUploadOffset(taskId string, offset int64) {
+	key := r.createUploadKey(taskId)
+	renewed, err := r.client.Expire(key, taskExpiration).Result()
+	if err != nil {
+		log.Printf("problem renew data: %v", err)
+		return
+	}
+	if !renewed {
+		return
+	}
+	r.client.Set(r.createUploadOffsetKey(taskId), offset, taskExpiration)
+}
+
+// RenewTask 延长任务数据的存活时间，不存在的key不会被创建
+func (r redisStore) RenewTask(taskId string) {
+	pipe := r.client.Pipeline()
+	defer closeWithErrLog(pipe)
+	for _, key := range []string{r.createUploadKey(taskId), r.createUploadOffsetKey(taskId), r.createDownloadKey(taskId), r.createCopyKey(taskId)} {
+		pipe.Expire(key, taskExpiration)
+	}
+	if _, err := pipe.Exec(); err != nil {
+		log.Printf("problem renew data: %v", err)
+	}
+}
+
+func (r redisStore) GetUploadOffset(taskId string) int64 {
+	offset, err := r.client.Get(r.createUploadOffsetKey(taskId)).Int64()
+	if err == redis.Nil {
+		return 0
+	} else if err != nil {
+		log.Printf("problem get data: %v", err)
+		return 0
+	}
+	return offset
+}
+
+// SaveHostKeyIfAbsent 主机密钥不会过期
+func (r redisStore) SaveHostKeyIfAbsent(host string, key string) string {
+	hostKey := r.createHostKeyKey(host)
+	if _, err := r.client.SetNX(hostKey, key, 0).Result(); err != nil {
+		log.Printf("problem save host key: %v", err)
+		return ""
+	}
+	trustedKey, err := r.client.Get(hostKey).Result()
+	if err != nil {
+		log.Printf("problem get host key: %v", err)
+		return ""
+	}
+	return trustedKey
+}
+
 func (r redisStore) SaveDownloadData(taskId string, data DownloadData) {
 	if taskId == "" {
 		return
 	}
 	key := r.createDownloadKey(taskId)
 	downloadJSONData := r.data2Json(data)
-	r.client.Set(key, downloadJSONData, 10*time.Minute)
+	r.client.Set(key, downloadJSONData, taskExpiration)
 }
 
-func (r redisStore) GetDownloadDataRemove(taskId string) *DownloadData {
-	key := r.createDownloadKey(taskId)
-	downloadJSONData, err := r.client.Get(key).Result()
+func (r redisStore) GetDownloadData(taskId string) *DownloadData {
+	downloadJSONData, err := r.client.Get(r.createDownloadKey(taskId)).Result()
 	if err == redis.Nil {
 		return nil
 	} else if err != nil {
@@ -91,10 +187,17 @@ func (r redisStore) GetDownloadDataRemove(taskId string) *DownloadData {
 	if err != nil {
 		log.Printf("problem decode data: %v", err)
 	}
-	r.client.Del(key)
 	return &downloadData
 }
 
+func (r redisStore) GetDownloadDataRemove(taskId string) *DownloadData {
+	downloadData := r.GetDownloadData(taskId)
+	if downloadData != nil {
+		r.client.Del(r.createDownloadKey(taskId))
+	}
+	return downloadData
+}
+
 func (r redisStore) IsDownloadTaskExist(taskId string) bool {
 	_, err := r.client.Get(r.createDownloadKey(taskId)).Result()
 	if err == redis.Nil {
@@ -106,16 +209,186 @@ func (r redisStore) IsDownloadTaskExist(taskId string) bool {
 	return true
 }
 
+func (r redisStore) SaveCopyData(taskId string, data CopyData) {
+	if taskId == "" {
+		return
+	}
+	r.client.Set(r.createCopyKey(taskId), r.data2Json(data), taskExpiration)
+}
+
+func (r redisStore) GetCopyData(taskId string) *CopyData {
+	copyJSONData, err := r.client.Get(r.createCopyKey(taskId)).Result()
+	if err == redis.Nil {
+		return nil
+	} else if err != nil {
+		log.Printf("problem get data: %v", err)
+		return nil
+	}
+	var copyData CopyData
+	err = json.NewDecoder(strings.NewReader(copyJSONData)).Decode(&copyData)
+	if err != nil {
+		log.Printf("problem decode data: %v", err)
+	}
+	return &copyData
+}
+
+func (r redisStore) GetCopyDataRemove(taskId string) *CopyData {
+	copyData := r.GetCopyData(taskId)
+	if copyData != nil {
+		r.client.Del(r.createCopyKey(taskId))
+	}
+	return copyData
+}
+
+func (r redisStore) IsCopyTaskExist(taskId string) bool {
+	count, err := r.client.Exists(r.createCopyKey(taskId)).Result()
+	if err != nil {
+		log.Printf("problem get data: %v", err)
+		return false
+	}
+	return count > 0
+}
+
+func (r redisStore) SaveTaskStatus(taskId string, status TaskStatus) {
+	if taskId == "" {
+		return
+	}
+	statusJSONData := r.data2Json(status)
+	r.client.Set(r.createStatusKey(taskId), statusJSONData, statusExpiration)
+	r.client.Publish(r.createStatusKey(taskId), statusJSONData)
+}
+
+func (r redisStore) GetTaskStatus(taskId string) *TaskStatus {
+	statusJSONData, err := r.client.Get(r.createStatusKey(taskId)).Result()
+	if err == redis.Nil {
+		return nil
+	} else if err != nil {
+		log.Printf("problem get data: %v", err)
+		return nil
+	}
+	var status TaskStatus
+	err = json.NewDecoder(strings.NewReader(statusJSONData)).Decode(&status)
+	if err != nil {
+		log.Printf("problem decode data: %v", err)
+		return nil
+	}
+	return &status
+}
+
+// SubscribeTaskStatus 通过redis的发布订阅接收其它实例保存的任务状态
+func (r redisStore) SubscribeTaskStatus(taskId string) (<-chan TaskStatus, func()) {
+	channel := make(chan TaskStatus, statusBufferSize)
+	pubSub := r.client.Subscribe(r.createStatusKey(taskId))
+	if _, err := pubSub.Receive(); err != nil {
+		log.Printf("problem subscribe task status: %v", err)
+		_ = pubSub.Close()
+		close(channel)
+		return channel, func() {}
+	}
+	go func() {
+		defer close(channel)
+		for message := range pubSub.Channel() {
+			var status TaskStatus
+			if err := json.Unmarshal([]byte(message.Payload), &status); err != nil {
+				log.Printf("problem decode data: %v", err)
+				continue
+			}
+			publishStatus(channel, status)
+		}
+	}()
+	var once sync.Once
+	return channel, func() {
+		once.Do(func() { closeWithErrLog(pubSub) })
+	}
+}
+
+func (r redisStore) SaveTaskCancel(taskId string) {
+	if taskId == "" {
+		return
+	}
+	r.client.Set(r.createCancelKey(taskId), 1, statusExpiration)
+}
+
+func (r redisStore) IsTaskCanceled(taskId string) bool {
+	count, err := r.client.Exists(r.createCancelKey(taskId)).Result()
+	if err != nil {
+		log.Printf("problem get data: %v", err)
+		return false
+	}
+	return count > 0
+}
+
+func (r redisStore) PushJob(job Job) {
+	if err := r.client.LPush(jobQueueKey, r.data2Json(job)).Err(); err != nil {
+		log.Printf("problem push job: %v", err)
+	}
+}
+
+// PopJob 租约的过期时间以redis服务端的毫秒时间戳保存在有序集合中，集群中的实例共享
+func (r redisStore) PopJob(lease time.Duration) *Job {
+	jobJSONData, err := popJobScript.Run(r.client, []string{jobQueueKey, jobLeaseKey}, lease.Milliseconds()).String()
+	if err == redis.Nil {
+		return nil
+	} else if err != nil {
+		log.Printf("problem pop job: %v", err)
+		return nil
+	}
+	var job Job
+	if err = json.Unmarshal([]byte(jobJSONData), &job); err != nil {
+		log.Printf("problem decode data: %v", err)
+		return nil
+	}
+	return &job
+}
+
+func (r redisStore) RenewJob(job Job, lease time.Duration) bool {
+	renewed, err := renewJobScript.Run(r.client, []string{jobLeaseKey}, lease.Milliseconds(), r.data2Json(job)).Int64()
+	if err != nil {
+		log.Printf("problem renew job: %v", err)
+		return false
+	}
+	return renewed == 1
+}
+
+func (r redisStore) FinishJob(job Job) {
+	r.client.ZRem(jobLeaseKey, r.data2Json(job))
+}
+
 // 合成上传任务的key
 func (redisStore) createUploadKey(taskId string) string {
 	return fmt.Sprintf("%s:%s", uploadSuffix, taskId)
 }
 
+// 合成上传任务已提交字节数的key
+func (redisStore) createUploadOffsetKey(taskId string) string {
+	return fmt.Sprintf("%s:%s", uploadOffsetSuffix, taskId)
+}
+
 // 合成下载任务的key
 func (redisStore) createDownloadKey(taskId string) string {
 	return fmt.Sprintf("%s:%s", downloadSuffix, taskId)
 }
 
+// 合成复制任务的key
+func (redisStore) createCopyKey(taskId string) string {
+	return fmt.Sprintf("%s:%s", copySuffix, taskId)
+}
+
+// 合成主机密钥的key
+func (redisStore) createHostKeyKey(host string) string {
+	return fmt.Sprintf("%s:%s", hostKeySuffix, host)
+}
+
+// 合成任务状态的key
+func (redisStore) createStatusKey(taskId string) string {
+	return fmt.Sprintf("%s:%s", statusSuffix, taskId)
+}
+
+// 合成任务取消标记的key
+func (redisStore) createCancelKey(taskId string) string {
+	return fmt.Sprintf("%s:%s", cancelSuffix, taskId)
+}
+
 // po转换成json
 func (r redisStore) data2Json(data interface{}) string {
 	bytes, err := json.Marshal(data)
@@ -0,0 +1,349 @@
+package filetransfer
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/sftp"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var NotDirectory = errors.New("path is not a directory")
+var DirectoryNotEmpty = errors.New("directory is not empty")
+
+// defaultListLimit 没有指定时每页返回的条目数
+const defaultListLimit = 100
+
+// maxListLimit 每页最多返回的条目数
+const maxListLimit = 1000
+
+const SortByName = "name"
+const SortBySize = "size"
+const SortByModTime = "mtime"
+
+const OrderAsc = "asc"
+const OrderDesc = "desc"
+
+// 列出目标资源上目录的内容，按请求排序、过滤后分页返回
+func (fs *FileServerController) listHandler(ctx *gin.Context) {
+	var listBody ListReqBody
+	if err := ctx.ShouldBindJSON(&listBody); err != nil {
+		ctx.JSON(http.StatusBadRequest, getInvalidParamErr())
+		return
+	}
+	if !fs.normalizeRemotePath(&listBody.RemotePath) || !fs.isListReqBodyValid(listBody) {
+		ctx.JSON(http.StatusBadRequest, getInvalidParamErr())
+		return
+	}
+	entries, err := fs.dataAdapter.ListDir(ctx.Request.Context(), listBody.Resource, listBody.Path)
+	if err != nil {
+		fs.responseRemoteErr(ctx, err)
+		return
+	}
+	if !listBody.ShowHidden {
+		entries = filterHidden(entries)
+	}
+	sortEntries(entries, listBody.Sort, listBody.Order == OrderDesc)
+	ctx.JSON(http.StatusOK, OkBody{Data: Data{"entries": pageEntries(entries, listBody.Offset, listBody.Limit),
+		"total": len(entries)}})
+}
+
+func (fs *FileServerController) isListReqBodyValid(body ListReqBody) bool {
+	if !fs.isRemotePathReqValid(body.RemotePath) {
+		return false
+	}
+	if body.Offset < 0 || body.Limit < 0 || body.Limit > maxListLimit {
+		return false
+	}
+	switch body.Sort {
+	case "", SortByName, SortBySize, SortByModTime:
+	default:
+		return false
+	}
+	switch body.Order {
+	case "", OrderAsc, OrderDesc:
+	default:
+		return false
+	}
+	return true
+}
+
+// 获取目标资源上路径的信息，路径为符号链接时返回链接本身的信息
+func (fs *FileServerController) statHandler(ctx *gin.Context) {
+	var remotePath RemotePath
+	if err := ctx.ShouldBindJSON(&remotePath); err != nil || !fs.normalizeRemotePath(&remotePath) {
+		ctx.JSON(http.StatusBadRequest, getInvalidParamErr())
+		return
+	}
+	entry, err := fs.dataAdapter.Stat(ctx.Request.Context(), remotePath.Resource, remotePath.Path)
+	if err != nil {
+		fs.responseRemoteErr(ctx, err)
+		return
+	}
+	ctx.JSON(http.StatusOK, OkBody{Data: Data{"file": entry}})
+}
+
+func (fs *FileServerController) mkdirHandler(ctx *gin.Context) {
+	var body MkdirReqBody
+	if !fs.bindRemoteReqBody(ctx, &body, &body.RemotePath) {
+		return
+	}
+	fs.responseRemoteResult(ctx, fs.dataAdapter.MakeDir(ctx.Request.Context(), body.Resource, body.Path, body.Parents))
+}
+
+func (fs *FileServerController) renameHandler(ctx *gin.Context) {
+	var body RenameReqBody
+	if !fs.bindRemoteReqBody(ctx, &body, &body.RemotePath) {
+		return
+	}
+	if !fs.isRemotePathValid(body.NewPath) {
+		ctx.JSON(http.StatusBadRequest, getInvalidParamErr())
+		return
+	}
+	newPath, ok := cleanRemotePath(body.NewPath)
+	if !ok || isRootPath(newPath) {
+		ctx.JSON(http.StatusBadRequest, getInvalidParamErr())
+		return
+	}
+	body.NewPath = newPath
+	fs.responseRemoteResult(ctx, fs.dataAdapter.Rename(ctx.Request.Context(), body.Resource, body.Path, body.NewPath))
+}
+
+// 删除文件或目录，非空目录需要设置recursive
+func (fs *FileServerController) deleteHandler(ctx *gin.Context) {
+	var body DeleteReqBody
+	if !fs.bindRemoteReqBody(ctx, &body, &body.RemotePath) {
+		return
+	}
+	fs.responseRemoteResult(ctx, fs.dataAdapter.Remove(ctx.Request.Context(), body.Resource, body.Path, body.Recursive))
+}
+
+func (fs *FileServerController) chmodHandler(ctx *gin.Context) {
+	var body ChmodReqBody
+	if !fs.bindRemoteReqBody(ctx, &body, &body.RemotePath) {
+		return
+	}
+	mode, ok := parseFileMode(body.Mode)
+	if !ok {
+		ctx.JSON(http.StatusBadRequest, getInvalidParamErr())
+		return
+	}
+	fs.responseRemoteResult(ctx, fs.dataAdapter.Chmod(ctx.Request.Context(), body.Resource, body.Path, mode))
+}
+
+func (fs *FileServerController) chownHandler(ctx *gin.Context) {
+	var body ChownReqBody
+	if !fs.bindRemoteReqBody(ctx, &body, &body.RemotePath) {
+		return
+	}
+	if body.Uid == nil || body.Gid == nil || *body.Uid < 0 || *body.Gid < 0 {
+		ctx.JSON(http.StatusBadRequest, getInvalidParamErr())
+		return
+	}
+	fs.responseRemoteResult(ctx, fs.dataAdapter.Chown(ctx.Request.Context(), body.Resource, body.Path, *body.Uid, *body.Gid))
+}
+
+func (fs *FileServerController) symlinkHandler(ctx *gin.Context) {
+	var body SymlinkReqBody
+	if !fs.bindRemoteReqBody(ctx, &body, &body.RemotePath) {
+		return
+	}
+	if body.Target == "" {
+		ctx.JSON(http.StatusBadRequest, getInvalidParamErr())
+		return
+	}
+	fs.responseRemoteResult(ctx, fs.dataAdapter.Symlink(ctx.Request.Context(), body.Resource, body.Target, body.Path))
+}
+
+// bindRemoteReqBody 解析修改远程文件的请求，这些操作不能作用于根目录，失败时返回false并已响应
+func (fs *FileServerController) bindRemoteReqBody(ctx *gin.Context, body interface{}, remotePath *RemotePath) bool {
+	if err := ctx.ShouldBindJSON(body); err != nil {
+		ctx.JSON(http.StatusBadRequest, getInvalidParamErr())
+		return false
+	}
+	if !fs.normalizeRemotePath(remotePath) || isRootPath(remotePath.Path) {
+		ctx.JSON(http.StatusBadRequest, getInvalidParamErr())
+		return false
+	}
+	return true
+}
+
+// normalizeRemotePath 校验请求中的路径并替换为规范化后的路径
+func (fs *FileServerController) normalizeRemotePath(remotePath *RemotePath) bool {
+	if !fs.isRemotePathReqValid(*remotePath) {
+		return false
+	}
+	cleaned, ok := cleanRemotePath(remotePath.Path)
+	remotePath.Path = cleaned
+	return ok
+}
+
+// cleanRemotePath 去掉路径中的.与多余的分隔符，包含..的路径被拒绝
+// 否则“/tmp/..”这样的路径可以绕过根目录检查，调用前路径需已通过isRemotePathValid
+func cleanRemotePath(remotePath string) (string, bool) {
+	for _, segment := range strings.FieldsFunc(remotePath, isPathSeparator) {
+		if segment == ".." {
+			return "", false
+		}
+	}
+	if strings.HasPrefix(remotePath, "/") {
+		return path.Clean(remotePath), true
+	}
+	// windows路径，盘符之后的部分以\或/分隔
+	cleaned := remotePath[:2]
+	for _, segment := range strings.FieldsFunc(remotePath[3:], isPathSeparator) {
+		if segment != "." {
+			cleaned += "\\" + segment
+		}
+	}
+	if cleaned == remotePath[:2] {
+		return cleaned + "\\", true
+	}
+	return cleaned, true
+}
+
+func isPathSeparator(r rune) bool {
+	return r == '/' || r == '\\'
+}
+
+func (fs *FileServerController) isRemotePathReqValid(remotePath RemotePath) bool {
+	return fs.isRemotePathValid(remotePath.Path) && fs.isResourceReqBodyValid(remotePath.Resource)
+}
+
+// isRootPath linux的根目录或windows的盘符根目录
+func isRootPath(remotePath string) bool {
+	trimmed := strings.TrimRight(remotePath, "/\\")
+	return trimmed == "" || (len(trimmed) == 2 && trimmed[1] == ':')
+}
+
+// parseFileMode 解析八进制的权限位，最多包括setuid、setgid与sticky位
+func parseFileMode(mode string) (os.FileMode, bool) {
+	if len(mode) < 3 || len(mode) > 4 {
+		return 0, false
+	}
+	value, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return 0, false
+	}
+	fileMode := os.FileMode(value & 0777)
+	if value&04000 != 0 {
+		fileMode |= os.ModeSetuid
+	}
+	if value&02000 != 0 {
+		fileMode |= os.ModeSetgid
+	}
+	if value&01000 != 0 {
+		fileMode |= os.ModeSticky
+	}
+	return fileMode, true
+}
+
+func (fs *FileServerController) responseRemoteResult(ctx *gin.Context, err error) {
+	if err != nil {
+		fs.responseRemoteErr(ctx, err)
+		return
+	}
+	ctx.Status(http.StatusNoContent)
+}
+
+// responseRemoteErr 操作目标资源上的文件失败时的响应，出错的操作与路径一同返回
+func (fs *FileServerController) responseRemoteErr(ctx *gin.Context, err error) {
+	status, errorBody := http.StatusBadRequest, NewErrorBody(ErrorCodeOperationFailed, ErrorContentOperationFailed)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		status, errorBody = http.StatusNotFound, NewErrorBody(ErrorCodeResourceNotFound, ErrorContentPathNotFound)
+	case errors.Is(err, os.ErrExist):
+		status, errorBody = http.StatusConflict, NewErrorBody(ErrorCodeAlreadyExists, ErrorContentAlreadyExists)
+	case errors.Is(err, DirectoryNotEmpty):
+		status, errorBody = http.StatusConflict, NewErrorBody(ErrorCodeDirectoryNotEmpty, ErrorContentDirectoryNotEmpty)
+	case errors.Is(err, os.ErrPermission):
+		status, errorBody = http.StatusForbidden, NewErrorBody(ErrorCodePermissionDenied, ErrorContentPermissionDenied)
+	case errors.Is(err, NotDirectory):
+		errorBody = NewErrorBody(ErrorCodeNotDirectory, ErrorContentNotDirectory)
+	default:
+		log.Printf("problem operate remote file: %v", err)
+		if transferErr, ok := getTransferErr(err); ok {
+			errorBody = transferErr
+		}
+	}
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		errorBody.Error.Operation = pathErr.Op
+		errorBody.Error.Path = pathErr.Path
+	}
+	ctx.JSON(status, errorBody)
+}
+
+func filterHidden(entries []FileEntry) []FileEntry {
+	visible := entries[:0]
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name, ".") {
+			visible = append(visible, entry)
+		}
+	}
+	return visible
+}
+
+// sortEntries 按字段排序，字段相同时按名称排序
+func sortEntries(entries []FileEntry, by string, desc bool) {
+	less := func(a, b FileEntry) bool {
+		switch by {
+		case SortBySize:
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case SortByModTime:
+			if !a.ModTime.Equal(b.ModTime) {
+				return a.ModTime.Before(b.ModTime)
+			}
+		}
+		return a.Name < b.Name
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if desc {
+			return less(entries[j], entries[i])
+		}
+		return less(entries[i], entries[j])
+	})
+}
+
+func pageEntries(entries []FileEntry, offset, limit int) []FileEntry {
+	if limit == 0 {
+		limit = defaultListLimit
+	}
+	if offset >= len(entries) {
+		return []FileEntry{}
+	}
+	end := offset + limit
+	if end > len(entries) {
+		end = len(entries)
+	}
+	return entries[offset:end]
+}
+
+// newFileEntry 根据Lstat得到的文件信息创建条目，linkTarget只在符号链接时使用
+func newFileEntry(info os.FileInfo, linkTarget string) FileEntry {
+	entry := FileEntry{Name: info.Name(), Size: info.Size(), Mode: fmt.Sprintf("%04o", info.Mode().Perm()),
+		ModTime: info.ModTime()}
+	if stat, ok := info.Sys().(*sftp.FileStat); ok {
+		entry.Uid, entry.Gid = stat.UID, stat.GID
+	}
+	switch {
+	case info.Mode().IsRegular():
+		entry.Type = FileTypeFile
+	case info.IsDir():
+		entry.Type = FileTypeDir
+	case info.Mode()&os.ModeSymlink != 0:
+		entry.Type = FileTypeSymlink
+		entry.LinkTarget = linkTarget
+	default:
+		entry.Type = FileTypeOther
+	}
+	return entry
+}
@@ -0,0 +1,393 @@
+package filetransfer_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"summersea.top/filetransfer"
+	testutil "summersea.top/filetransfer/test"
+	"testing"
+	"time"
+)
+
+const listUrl = "/file/list"
+const statUrl = "/file/stat"
+
+type listResult struct {
+	Data struct {
+		Entries []filetransfer.FileEntry `json:"entries"`
+		Total   int                      `json:"total"`
+	} `json:"data"`
+}
+
+func TestListInit(t *testing.T) {
+	fileServer := filetransfer.NewFileServer(&StubAdapter{})
+	resource := filetransfer.Resource{Address: "addr", Port: 22, Account: filetransfer.Account{Name: "a", Password: "pwd"}}
+	testCases := []struct {
+		body       filetransfer.ListReqBody
+		wantStatus int
+	}{
+		{filetransfer.ListReqBody{RemotePath: filetransfer.RemotePath{Resource: resource, Path: "/"}}, http.StatusOK},
+		{filetransfer.ListReqBody{RemotePath: filetransfer.RemotePath{Resource: resource, Path: "/var/log/"}}, http.StatusOK},
+		{filetransfer.ListReqBody{RemotePath: filetransfer.RemotePath{Resource: resource, Path: "C:\\Users"}}, http.StatusOK},
+		{filetransfer.ListReqBody{RemotePath: filetransfer.RemotePath{Resource: resource, Path: "/var"}, Sort: filetransfer.SortByModTime, Order: filetransfer.OrderDesc}, http.StatusOK},
+		{filetransfer.ListReqBody{RemotePath: filetransfer.RemotePath{Resource: resource, Path: ""}}, http.StatusBadRequest},
+		{filetransfer.ListReqBody{RemotePath: filetransfer.RemotePath{Resource: resource, Path: "var"}}, http.StatusBadRequest},
+		{filetransfer.ListReqBody{RemotePath: filetransfer.RemotePath{Resource: resource, Path: "/var"}, Sort: "owner"}, http.StatusBadRequest},
+		{filetransfer.ListReqBody{RemotePath: filetransfer.RemotePath{Resource: resource, Path: "/var"}, Order: "up"}, http.StatusBadRequest},
+		{filetransfer.ListReqBody{RemotePath: filetransfer.RemotePath{Resource: resource, Path: "/var"}, Offset: -1}, http.StatusBadRequest},
+		{filetransfer.ListReqBody{RemotePath: filetransfer.RemotePath{Resource: resource, Path: "/var"}, Limit: 1001}, http.StatusBadRequest},
+		{filetransfer.ListReqBody{RemotePath: filetransfer.RemotePath{Resource: filetransfer.Resource{Address: "addr", Port: 22}, Path: "/var"}}, http.StatusBadRequest},
+	}
+	for _, test := range testCases {
+		testCase(t, initTestCase{requestBody: test.body, wantResponseStatus: test.wantStatus}, listUrl, fileServer)
+	}
+}
+
+func TestList(t *testing.T) {
+	resource := filetransfer.Resource{Address: "addr", Port: 22, Account: filetransfer.Account{Name: "a", Password: "pwd"}}
+	now := time.Now().UTC().Truncate(time.Second)
+	entries := []filetransfer.FileEntry{
+		{Name: "b.txt", Type: filetransfer.FileTypeFile, Size: 30, ModTime: now},
+		{Name: ".profile", Type: filetransfer.FileTypeFile, Size: 10, ModTime: now.Add(-time.Hour)},
+		{Name: "a.txt", Type: filetransfer.FileTypeFile, Size: 20, ModTime: now.Add(time.Hour)},
+		{Name: "logs", Type: filetransfer.FileTypeDir, Size: 4096, ModTime: now.Add(-2 * time.Hour)},
+	}
+	fileServer := filetransfer.NewFileServer(&StubAdapter{listEntries: entries})
+	list := func(t *testing.T, body filetransfer.ListReqBody) ([]string, int) {
+		t.Helper()
+		body.Resource = resource
+		response := testCase(t, initTestCase{requestBody: body, wantResponseStatus: http.StatusOK}, listUrl, fileServer)
+		var result listResult
+		if err := json.Unmarshal(response.Body.Bytes(), &result); err != nil {
+			t.Fatalf("problem decode response: %v", err)
+		}
+		names := make([]string, 0, len(result.Data.Entries))
+		for _, entry := range result.Data.Entries {
+			names = append(names, entry.Name)
+		}
+		return names, result.Data.Total
+	}
+
+	t.Run("sorted by name without hidden", func(t *testing.T) {
+		names, total := list(t, filetransfer.ListReqBody{RemotePath: filetransfer.RemotePath{Path: "/home"}})
+		testutil.AssertStructEquals(t, names, []string{"a.txt", "b.txt", "logs"})
+		testutil.AssertIntEquals(t, total, 3)
+	})
+
+	t.Run("show hidden", func(t *testing.T) {
+		names, total := list(t, filetransfer.ListReqBody{RemotePath: filetransfer.RemotePath{Path: "/home"}, ShowHidden: true})
+		testutil.AssertStructEquals(t, names, []string{".profile", "a.txt", "b.txt", "logs"})
+		testutil.AssertIntEquals(t, total, 4)
+	})
+
+	t.Run("sorted by size desc", func(t *testing.T) {
+		names, _ := list(t, filetransfer.ListReqBody{RemotePath: filetransfer.RemotePath{Path: "/home"}, Sort: filetransfer.SortBySize, Order: filetransfer.OrderDesc})
+		testutil.AssertStructEquals(t, names, []string{"logs", "b.txt", "a.txt"})
+	})
+
+	t.Run("sorted by mtime", func(t *testing.T) {
+		names, _ := list(t, filetransfer.ListReqBody{RemotePath: filetransfer.RemotePath{Path: "/home"}, Sort: filetransfer.SortByModTime})
+		testutil.AssertStructEquals(t, names, []string{"logs", "b.txt", "a.txt"})
+	})
+
+	t.Run("paginated", func(t *testing.T) {
+		names, total := list(t, filetransfer.ListReqBody{RemotePath: filetransfer.RemotePath{Path: "/home"}, Offset: 1, Limit: 1})
+		testutil.AssertStructEquals(t, names, []string{"b.txt"})
+		testutil.AssertIntEquals(t, total, 3)
+		names, _ = list(t, filetransfer.ListReqBody{RemotePath: filetransfer.RemotePath{Path: "/home"}, Offset: 3})
+		testutil.AssertStructEquals(t, names, []string{})
+	})
+
+	t.Run("remote errors", func(t *testing.T) {
+		testCases := []struct {
+			err        error
+			wantStatus int
+			wantCode   string
+		}{
+			{fmt.Errorf("problem while search dir: %w", os.ErrNotExist), http.StatusNotFound, filetransfer.ErrorCodeResourceNotFound},
+			{filetransfer.NotDirectory, http.StatusBadRequest, filetransfer.ErrorCodeNotDirectory},
+			{fmt.Errorf("problem dial target resource: %w", filetransfer.HostKeyMismatch), http.StatusBadRequest, filetransfer.ErrorCodeHostKeyMismatch},
+		}
+		for _, test := range testCases {
+			server := filetransfer.NewFileServer(&StubAdapter{remoteErr: test.err})
+			body := filetransfer.ListReqBody{RemotePath: filetransfer.RemotePath{Resource: resource, Path: "/home"}}
+			response := testCase(t, initTestCase{requestBody: body, wantResponseStatus: test.wantStatus}, listUrl, server)
+			var errorBody filetransfer.ErrorBody
+			_ = json.Unmarshal(response.Body.Bytes(), &errorBody)
+			testutil.AssertStringEqual(t, errorBody.Error.Code, test.wantCode)
+		}
+	})
+}
+
+func TestFileTranDataAdapter_ListDir(t *testing.T) {
+	server := testutil.StartSshServer(t, testutil.NewPasswordServerConfig(t, "test", "pwd"))
+	resource := filetransfer.Resource{Address: server.Address, Port: server.Port,
+		Account: filetransfer.Account{Name: "test", Password: "pwd"}}
+	adapter := filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStore())
+	dir := t.TempDir()
+	_ = os.WriteFile(filepath.Join(dir, "a.txt"), []byte("abc"), 0640)
+	_ = os.Mkdir(filepath.Join(dir, "sub"), 0750)
+	_ = os.Symlink("a.txt", filepath.Join(dir, "link"))
+
+	t.Run("entries", func(t *testing.T) {
+		entries, err := adapter.ListDir(context.Background(), resource, dir)
+		testutil.AssertNil(t, err)
+		got := map[string]filetransfer.FileEntry{}
+		for _, entry := range entries {
+			got[entry.Name] = entry
+		}
+		testutil.AssertIntEquals(t, len(got), 3)
+		testutil.AssertStringEqual(t, got["a.txt"].Type, filetransfer.FileTypeFile)
+		testutil.AssertIntEquals(t, int(got["a.txt"].Size), 3)
+		testutil.AssertStringEqual(t, got["a.txt"].Mode, "0640")
+		testutil.AssertStringEqual(t, got["sub"].Type, filetransfer.FileTypeDir)
+		testutil.AssertStringEqual(t, got["sub"].Mode, "0750")
+		testutil.AssertStringEqual(t, got["link"].Type, filetransfer.FileTypeSymlink)
+		testutil.AssertStringEqual(t, got["link"].LinkTarget, "a.txt")
+	})
+
+	t.Run("not exist", func(t *testing.T) {
+		_, err := adapter.ListDir(context.Background(), resource, filepath.Join(dir, "none"))
+		testutil.AssertTrue(t, errors.Is(err, os.ErrNotExist))
+	})
+
+	t.Run("not directory", func(t *testing.T) {
+		_, err := adapter.ListDir(context.Background(), resource, filepath.Join(dir, "a.txt"))
+		testutil.AssertErrEquals(t, err, filetransfer.NotDirectory)
+	})
+}
+
+func TestStat(t *testing.T) {
+	resource := filetransfer.Resource{Address: "addr", Port: 22, Account: filetransfer.Account{Name: "a", Password: "pwd"}}
+	entry := filetransfer.FileEntry{Name: "a.txt", Type: filetransfer.FileTypeFile, Size: 3, Mode: "0644",
+		ModTime: time.Date(2021, 5, 1, 8, 0, 0, 0, time.UTC), Uid: 1000, Gid: 100}
+
+	t.Run("file info", func(t *testing.T) {
+		adapter := &StubAdapter{statEntry: entry}
+		fileServer := filetransfer.NewFileServer(adapter)
+		body := filetransfer.RemotePath{Resource: resource, Path: "/"}
+		response := testCase(t, initTestCase{requestBody: body, wantResponseStatus: http.StatusOK}, statUrl, fileServer)
+		var result struct {
+			Data struct {
+				File filetransfer.FileEntry `json:"file"`
+			} `json:"data"`
+		}
+		_ = json.Unmarshal(response.Body.Bytes(), &result)
+		testutil.AssertStructEquals(t, result.Data.File, entry)
+		testutil.AssertStructEquals(t, adapter.remoteCalls, []string{"stat /"})
+	})
+
+	t.Run("invalid path", func(t *testing.T) {
+		adapter := &StubAdapter{}
+		body := filetransfer.RemotePath{Resource: resource, Path: "data"}
+		testCase(t, initTestCase{requestBody: body, wantResponseStatus: http.StatusBadRequest}, statUrl, filetransfer.NewFileServer(adapter))
+		testutil.AssertIntEquals(t, len(adapter.remoteCalls), 0)
+	})
+
+	t.Run("not exist", func(t *testing.T) {
+		err := &os.PathError{Op: "stat", Path: "/none", Err: os.ErrNotExist}
+		body := filetransfer.RemotePath{Resource: resource, Path: "/none"}
+		testCase(t, initTestCase{requestBody: body, wantResponseStatus: http.StatusNotFound}, statUrl,
+			filetransfer.NewFileServer(&StubAdapter{remoteErr: err}))
+	})
+}
+
+func TestFileTranDataAdapter_Stat(t *testing.T) {
+	server := testutil.StartSshServer(t, testutil.NewPasswordServerConfig(t, "test", "pwd"))
+	resource := filetransfer.Resource{Address: server.Address, Port: server.Port,
+		Account: filetransfer.Account{Name: "test", Password: "pwd"}}
+	adapter := filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStore())
+	dir := t.TempDir()
+	file := filepath.Join(dir, "a.txt")
+	_ = os.WriteFile(file, []byte("abc"), 0640)
+	modTime := time.Date(2021, 5, 1, 8, 0, 0, 0, time.UTC)
+	_ = os.Chtimes(file, modTime, modTime)
+	_ = os.Symlink("a.txt", filepath.Join(dir, "link"))
+
+	t.Run("file", func(t *testing.T) {
+		entry, err := adapter.Stat(context.Background(), resource, file)
+		testutil.AssertNil(t, err)
+		testutil.AssertStringEqual(t, entry.Name, "a.txt")
+		testutil.AssertStringEqual(t, entry.Type, filetransfer.FileTypeFile)
+		testutil.AssertIntEquals(t, int(entry.Size), 3)
+		testutil.AssertStringEqual(t, entry.Mode, "0640")
+		testutil.AssertTrue(t, entry.ModTime.Equal(modTime))
+		testutil.AssertIntEquals(t, int(entry.Uid), os.Getuid())
+		testutil.AssertIntEquals(t, int(entry.Gid), os.Getgid())
+	})
+
+	t.Run("symlink not followed", func(t *testing.T) {
+		entry, err := adapter.Stat(context.Background(), resource, filepath.Join(dir, "link"))
+		testutil.AssertNil(t, err)
+		testutil.AssertStringEqual(t, entry.Type, filetransfer.FileTypeSymlink)
+		testutil.AssertStringEqual(t, entry.LinkTarget, "a.txt")
+	})
+
+	t.Run("not exist", func(t *testing.T) {
+		_, err := adapter.Stat(context.Background(), resource, filepath.Join(dir, "none"))
+		testutil.AssertTrue(t, errors.Is(err, os.ErrNotExist))
+	})
+}
+
+func TestRemoteOperations(t *testing.T) {
+	resource := filetransfer.Resource{Address: "addr", Port: 22, Account: filetransfer.Account{Name: "a", Password: "pwd"}}
+	remotePath := func(path string) filetransfer.RemotePath {
+		return filetransfer.RemotePath{Resource: resource, Path: path}
+	}
+	id := 0
+	testCases := []struct {
+		url        string
+		body       interface{}
+		wantStatus int
+		wantCall   string
+	}{
+		{"/file/mkdir", filetransfer.MkdirReqBody{RemotePath: remotePath("/data/new"), Parents: true}, http.StatusNoContent, "mkdir /data/new true"},
+		{"/file/mkdir", filetransfer.MkdirReqBody{RemotePath: remotePath("/")}, http.StatusBadRequest, ""},
+		{"/file/mkdir", filetransfer.MkdirReqBody{RemotePath: remotePath("data")}, http.StatusBadRequest, ""},
+		{"/file/rename", filetransfer.RenameReqBody{RemotePath: remotePath("/data/a"), NewPath: "/data/b"}, http.StatusNoContent, "rename /data/a /data/b"},
+		{"/file/rename", filetransfer.RenameReqBody{RemotePath: remotePath("/data/a")}, http.StatusBadRequest, ""},
+		{"/file/rename", filetransfer.RenameReqBody{RemotePath: remotePath("/data/a"), NewPath: "C:\\"}, http.StatusBadRequest, ""},
+		{"/file/delete", filetransfer.DeleteReqBody{RemotePath: remotePath("/data/a"), Recursive: true}, http.StatusNoContent, "remove /data/a true"},
+		{"/file/delete", filetransfer.DeleteReqBody{RemotePath: remotePath("//"), Recursive: true}, http.StatusBadRequest, ""},
+		{"/file/chmod", filetransfer.ChmodReqBody{RemotePath: remotePath("/data/a"), Mode: "0755"}, http.StatusNoContent, "chmod /data/a -rwxr-xr-x"},
+		{"/file/chmod", filetransfer.ChmodReqBody{RemotePath: remotePath("/data/a"), Mode: "1777"}, http.StatusNoContent, "chmod /data/a trwxrwxrwx"},
+		{"/file/chmod", filetransfer.ChmodReqBody{RemotePath: remotePath("/data/a"), Mode: "0999"}, http.StatusBadRequest, ""},
+		{"/file/chmod", filetransfer.ChmodReqBody{RemotePath: remotePath("/data/a"), Mode: "75"}, http.StatusBadRequest, ""},
+		{"/file/chown", filetransfer.ChownReqBody{RemotePath: remotePath("/data/a"), Uid: &id, Gid: &id}, http.StatusNoContent, "chown /data/a 0 0"},
+		{"/file/chown", filetransfer.ChownReqBody{RemotePath: remotePath("/data/a"), Uid: &id}, http.StatusBadRequest, ""},
+		{"/file/symlink", filetransfer.SymlinkReqBody{RemotePath: remotePath("/data/link"), Target: "a"}, http.StatusNoContent, "symlink a /data/link"},
+		{"/file/symlink", filetransfer.SymlinkReqBody{RemotePath: remotePath("/data/link")}, http.StatusBadRequest, ""},
+		{"/file/delete", filetransfer.DeleteReqBody{RemotePath: remotePath("/."), Recursive: true}, http.StatusBadRequest, ""},
+		{"/file/delete", filetransfer.DeleteReqBody{RemotePath: remotePath("/tmp/.."), Recursive: true}, http.StatusBadRequest, ""},
+		{"/file/delete", filetransfer.DeleteReqBody{RemotePath: remotePath("C:\\.\\"), Recursive: true}, http.StatusBadRequest, ""},
+		{"/file/delete", filetransfer.DeleteReqBody{RemotePath: remotePath("C:\\data\\.."), Recursive: true}, http.StatusBadRequest, ""},
+		{"/file/delete", filetransfer.DeleteReqBody{RemotePath: remotePath("/data/a/../b")}, http.StatusBadRequest, ""},
+		{"/file/delete", filetransfer.DeleteReqBody{RemotePath: remotePath("/data//./a/")}, http.StatusNoContent, "remove /data/a false"},
+		{"/file/delete", filetransfer.DeleteReqBody{RemotePath: remotePath("C:\\data\\.\\a\\")}, http.StatusNoContent, "remove C:\\data\\a false"},
+		{"/file/rename", filetransfer.RenameReqBody{RemotePath: remotePath("/tmp/.."), NewPath: "/data/b"}, http.StatusBadRequest, ""},
+		{"/file/rename", filetransfer.RenameReqBody{RemotePath: remotePath("/data/a"), NewPath: "/."}, http.StatusBadRequest, ""},
+		{"/file/rename", filetransfer.RenameReqBody{RemotePath: remotePath("/data/a"), NewPath: "/data/../b"}, http.StatusBadRequest, ""},
+		{"/file/rename", filetransfer.RenameReqBody{RemotePath: remotePath("/data/./a"), NewPath: "/data//b/"}, http.StatusNoContent, "rename /data/a /data/b"},
+		{"/file/chmod", filetransfer.ChmodReqBody{RemotePath: remotePath("/tmp/.."), Mode: "0755"}, http.StatusBadRequest, ""},
+		{"/file/chmod", filetransfer.ChmodReqBody{RemotePath: remotePath("/."), Mode: "0755"}, http.StatusBadRequest, ""},
+		{"/file/chown", filetransfer.ChownReqBody{RemotePath: remotePath("/tmp/.."), Uid: &id, Gid: &id}, http.StatusBadRequest, ""},
+		{"/file/chown", filetransfer.ChownReqBody{RemotePath: remotePath("/./"), Uid: &id, Gid: &id}, http.StatusBadRequest, ""},
+		{"/file/stat", remotePath("/data/.."), http.StatusBadRequest, ""},
+	}
+	for _, test := range testCases {
+		adapter := &StubAdapter{}
+		fileServer := filetransfer.NewFileServer(adapter)
+		testCase(t, initTestCase{requestBody: test.body, wantResponseStatus: test.wantStatus}, test.url, fileServer)
+		if test.wantCall == "" {
+			testutil.AssertIntEquals(t, len(adapter.remoteCalls), 0)
+		} else {
+			testutil.AssertStructEquals(t, adapter.remoteCalls, []string{test.wantCall})
+		}
+	}
+
+	t.Run("remote errors", func(t *testing.T) {
+		testCases := []struct {
+			err        error
+			wantStatus int
+			wantBody   filetransfer.ErrorBody
+		}{
+			{&os.PathError{Op: "mkdir", Path: "/data/a", Err: os.ErrExist}, http.StatusConflict,
+				filetransfer.ErrorBody{Error: filetransfer.ErrorContent{Code: filetransfer.ErrorCodeAlreadyExists,
+					Message: filetransfer.ErrorContentAlreadyExists, Operation: "mkdir", Path: "/data/a"}}},
+			{&os.PathError{Op: "remove", Path: "/data/a", Err: filetransfer.DirectoryNotEmpty}, http.StatusConflict,
+				filetransfer.ErrorBody{Error: filetransfer.ErrorContent{Code: filetransfer.ErrorCodeDirectoryNotEmpty,
+					Message: filetransfer.ErrorContentDirectoryNotEmpty, Operation: "remove", Path: "/data/a"}}},
+			{&os.PathError{Op: "chmod", Path: "/data/a", Err: os.ErrPermission}, http.StatusForbidden,
+				filetransfer.ErrorBody{Error: filetransfer.ErrorContent{Code: filetransfer.ErrorCodePermissionDenied,
+					Message: filetransfer.ErrorContentPermissionDenied, Operation: "chmod", Path: "/data/a"}}},
+			{&os.PathError{Op: "mkdir", Path: "/data/a", Err: errors.New("failure")}, http.StatusBadRequest,
+				filetransfer.ErrorBody{Error: filetransfer.ErrorContent{Code: filetransfer.ErrorCodeOperationFailed,
+					Message: filetransfer.ErrorContentOperationFailed, Operation: "mkdir", Path: "/data/a"}}},
+		}
+		for _, test := range testCases {
+			fileServer := filetransfer.NewFileServer(&StubAdapter{remoteErr: test.err})
+			body := filetransfer.MkdirReqBody{RemotePath: remotePath("/data/a")}
+			response := testCase(t, initTestCase{requestBody: body, wantResponseStatus: test.wantStatus}, "/file/mkdir", fileServer)
+			var errorBody filetransfer.ErrorBody
+			_ = json.Unmarshal(response.Body.Bytes(), &errorBody)
+			testutil.AssertStructEquals(t, errorBody, test.wantBody)
+		}
+	})
+}
+
+func TestFileTranDataAdapter_RemoteOperations(t *testing.T) {
+	server := testutil.StartSshServer(t, testutil.NewPasswordServerConfig(t, "test", "pwd"))
+	resource := filetransfer.Resource{Address: server.Address, Port: server.Port,
+		Account: filetransfer.Account{Name: "test", Password: "pwd"}}
+	adapter := filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStore())
+	assertPathErr := func(t *testing.T, err error, op string, want error) {
+		t.Helper()
+		var pathErr *os.PathError
+		testutil.AssertTrue(t, errors.As(err, &pathErr))
+		testutil.AssertStringEqual(t, pathErr.Op, op)
+		if !errors.Is(err, want) {
+			t.Errorf("want %v but got %v", want, err)
+		}
+	}
+
+	t.Run("mkdir", func(t *testing.T) {
+		dir := t.TempDir()
+		nested := filepath.Join(dir, "a", "b")
+		testutil.AssertNil(t, adapter.MakeDir(context.Background(), resource, nested, true))
+		testutil.AssertNil(t, adapter.MakeDir(context.Background(), resource, nested, true))
+		info, err := os.Stat(nested)
+		testutil.AssertTrue(t, err == nil && info.IsDir())
+		assertPathErr(t, adapter.MakeDir(context.Background(), resource, nested, false), "mkdir", os.ErrExist)
+		assertPathErr(t, adapter.MakeDir(context.Background(), resource, filepath.Join(dir, "x", "y"), false), "mkdir", os.ErrNotExist)
+	})
+
+	t.Run("rename", func(t *testing.T) {
+		dir := t.TempDir()
+		_ = os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644)
+		_ = os.WriteFile(filepath.Join(dir, "b.txt"), []byte("b"), 0644)
+		assertPathErr(t, adapter.Rename(context.Background(), resource, filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")), "rename", os.ErrExist)
+		testutil.AssertNil(t, adapter.Rename(context.Background(), resource, filepath.Join(dir, "a.txt"), filepath.Join(dir, "c.txt")))
+		got, _ := os.ReadFile(filepath.Join(dir, "c.txt"))
+		testutil.AssertStringEqual(t, string(got), "a")
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		dir := t.TempDir()
+		outside := filepath.Join(dir, "outside.txt")
+		_ = os.WriteFile(outside, []byte("keep"), 0644)
+		tree := filepath.Join(dir, "tree")
+		_ = os.MkdirAll(filepath.Join(tree, "sub"), 0755)
+		_ = os.WriteFile(filepath.Join(tree, "sub", "a.txt"), []byte("a"), 0644)
+		_ = os.Symlink(outside, filepath.Join(tree, "link"))
+		assertPathErr(t, adapter.Remove(context.Background(), resource, tree, false), "remove", filetransfer.DirectoryNotEmpty)
+		testutil.AssertNil(t, adapter.Remove(context.Background(), resource, tree, true))
+		_, err := os.Stat(tree)
+		testutil.AssertTrue(t, os.IsNotExist(err))
+		_, err = os.Stat(outside)
+		testutil.AssertNil(t, err)
+		testutil.AssertNil(t, adapter.Remove(context.Background(), resource, outside, false))
+		assertPathErr(t, adapter.Remove(context.Background(), resource, outside, false), "remove", os.ErrNotExist)
+	})
+
+	t.Run("chmod and chown", func(t *testing.T) {
+		file := filepath.Join(t.TempDir(), "a.txt")
+		_ = os.WriteFile(file, []byte("a"), 0644)
+		testutil.AssertNil(t, adapter.Chmod(context.Background(), resource, file, 0600))
+		info, _ := os.Stat(file)
+		testutil.AssertStringEqual(t, info.Mode().Perm().String(), "-rw-------")
+		testutil.AssertNil(t, adapter.Chown(context.Background(), resource, file, os.Getuid(), os.Getgid()))
+	})
+
+	t.Run("symlink", func(t *testing.T) {
+		link := filepath.Join(t.TempDir(), "link")
+		testutil.AssertNil(t, adapter.Symlink(context.Background(), resource, "a.txt", link))
+		target, _ := os.Readlink(link)
+		testutil.AssertStringEqual(t, target, "a.txt")
+		assertPathErr(t, adapter.Symlink(context.Background(), resource, "b.txt", link), "symlink", os.ErrExist)
+	})
+}
@@ -0,0 +1,88 @@
+package filetransfer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"summersea.top/filetransfer/transferframe"
+	"time"
+)
+
+// defaultRetryInterval 没有配置时第一次重试前等待的时间
+const defaultRetryInterval = time.Second
+
+// defaultMaxRetryInterval 没有配置时两次重试之间最长的等待时间
+const defaultMaxRetryInterval = 30 * time.Second
+
+// defaultRetryMultiplier 没有配置时每次重试后等待时间的倍数
+const defaultRetryMultiplier = 2
+
+// RetryPolicy 失败后按指数退避重试的策略
+type RetryPolicy struct {
+	// MaxAttempts 最多尝试的次数，包括第一次，为0或1时不重试
+	MaxAttempts int `yaml:"maxAttempts,omitempty"`
+	// InitialInterval 第一次重试前等待的时间，单位为毫秒，为0时使用defaultRetryInterval
+	InitialInterval int `yaml:"initialInterval,omitempty"`
+	// MaxInterval 两次重试之间最长的等待时间，单位为毫秒，为0时使用defaultMaxRetryInterval
+	MaxInterval int `yaml:"maxInterval,omitempty"`
+	// Multiplier 每次重试后等待时间的倍数，小于1时使用defaultRetryMultiplier
+	Multiplier float64 `yaml:"multiplier,omitempty"`
+}
+
+// canRetry 已经重试retries次后是否还能再次重试
+func (p RetryPolicy) canRetry(retries int) bool {
+	return retries+1 < p.MaxAttempts
+}
+
+// backoff 第retries+1次重试前等待的时间
+func (p RetryPolicy) backoff(retries int) time.Duration {
+	interval := defaultRetryInterval
+	if p.InitialInterval > 0 {
+		interval = time.Duration(p.InitialInterval) * time.Millisecond
+	}
+	maxInterval := defaultMaxRetryInterval
+	if p.MaxInterval > 0 {
+		maxInterval = time.Duration(p.MaxInterval) * time.Millisecond
+	}
+	multiplier := float64(defaultRetryMultiplier)
+	if p.Multiplier >= 1 {
+		multiplier = p.Multiplier
+	}
+	for i := 0; i < retries && interval < maxInterval; i++ {
+		interval = time.Duration(float64(interval) * multiplier)
+	}
+	if interval > maxInterval {
+		return maxInterval
+	}
+	return interval
+}
+
+// sleepContext 等待duration，ctx先结束时返回false
+func sleepContext(ctx context.Context, duration time.Duration) bool {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// isDialRetryable 连接失败或握手时连接被断开时可以重试，认证失败与主机密钥校验失败不重试
+func isDialRetryable(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) || errors.Is(err, handshakeTimeoutErr) {
+		return true
+	}
+	// ssh握手失败的错误没有包装原始错误，只能通过错误信息判断
+	return strings.Contains(err.Error(), "ssh: handshake failed: EOF") ||
+		strings.Contains(err.Error(), "connection reset by peer")
+}
+
+// isTransferRetryable 取消、超过截止时间以及重试也无法成功的错误不重试
+func isTransferRetryable(err error) bool {
+	return !errors.Is(err, transferframe.CancelErr) && !errors.Is(err, transferframe.DeadlineErr) &&
+		!errors.Is(err, HostKeyMismatch) && !errors.Is(err, HostKeyUnknown) && !errors.Is(err, DownloadDir)
+}
@@ -0,0 +1,227 @@
+package filetransfer_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"summersea.top/filetransfer"
+	testutil "summersea.top/filetransfer/test"
+	"summersea.top/filetransfer/transferframe"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDialRetry(t *testing.T) {
+	server := testutil.StartSshServer(t, testutil.NewPasswordServerConfig(t, "test", "pwd"))
+	retry := filetransfer.RetryPolicy{MaxAttempts: 3, InitialInterval: 10}
+
+	t.Run("handshake dropped", func(t *testing.T) {
+		proxy := startDroppingProxy(t, server, 2)
+		adapter := filetransfer.NewFileTranDataAdapterWithConfig(filetransfer.NewMemoryStore(), filetransfer.SshConfig{Retry: retry})
+		assertUploadSucceed(t, adapter, proxy.server(), filetransfer.Account{Name: "test", Password: "pwd"})
+		testutil.AssertIntEquals(t, proxy.connections(), 3)
+	})
+
+	t.Run("no retry by default", func(t *testing.T) {
+		proxy := startDroppingProxy(t, server, 1)
+		adapter := filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStore())
+		assertUploadFailed(t, adapter, proxy.server(), filetransfer.Account{Name: "test", Password: "pwd"})
+		testutil.AssertIntEquals(t, proxy.connections(), 1)
+	})
+
+	t.Run("auth failure not retried", func(t *testing.T) {
+		proxy := startDroppingProxy(t, server, 0)
+		adapter := filetransfer.NewFileTranDataAdapterWithConfig(filetransfer.NewMemoryStore(), filetransfer.SshConfig{Retry: retry})
+		assertUploadFailed(t, adapter, proxy.server(), filetransfer.Account{Name: "test", Password: "wrong"})
+		testutil.AssertIntEquals(t, proxy.connections(), 1)
+	})
+
+	t.Run("canceled while waiting", func(t *testing.T) {
+		proxy := startDroppingProxy(t, server, 1)
+		config := filetransfer.SshConfig{Retry: filetransfer.RetryPolicy{MaxAttempts: 3, InitialInterval: 60000}}
+		adapter := filetransfer.NewFileTranDataAdapterWithConfig(filetransfer.NewMemoryStore(), config)
+		resource := filetransfer.Resource{Address: proxy.server().Address, Port: proxy.server().Port,
+			Account: filetransfer.Account{Name: "test", Password: "pwd"}}
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err := adapter.ListDir(ctx, resource, t.TempDir())
+		testutil.AssertTrue(t, errors.Is(err, transferframe.CancelErr))
+		testutil.AssertTrue(t, time.Since(start) < 10*time.Second)
+		testutil.AssertIntEquals(t, proxy.connections(), 1)
+	})
+}
+
+// droppingProxy 关闭前drops个连接，之后的连接转发到ssh服务器，模拟网络抖动
+type droppingProxy struct {
+	listener net.Listener
+	target   *testutil.SshServer
+	count    int32
+	mutex    sync.Mutex
+	forwards []net.Conn
+}
+
+func startDroppingProxy(t *testing.T, target *testutil.SshServer, drops int32) *droppingProxy {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	proxy := &droppingProxy{listener: listener, target: target}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if atomic.AddInt32(&proxy.count, 1) <= drops {
+				_ = conn.Close()
+				continue
+			}
+			go proxy.forward(conn)
+		}
+	}()
+	return proxy
+}
+
+func (p *droppingProxy) forward(conn net.Conn) {
+	p.mutex.Lock()
+	p.forwards = append(p.forwards, conn)
+	p.mutex.Unlock()
+	defer conn.Close()
+	targetConn, err := net.Dial("tcp", net.JoinHostPort(p.target.Address, strconv.Itoa(p.target.Port)))
+	if err != nil {
+		return
+	}
+	defer targetConn.Close()
+	go func() { _, _ = io.Copy(targetConn, conn) }()
+	_, _ = io.Copy(conn, targetConn)
+}
+
+// breakConnections 断开所有已转发的连接，模拟连接失效
+func (p *droppingProxy) breakConnections() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, conn := range p.forwards {
+		_ = conn.Close()
+	}
+	p.forwards = nil
+}
+
+func (p *droppingProxy) connections() int {
+	return int(atomic.LoadInt32(&p.count))
+}
+
+// server 返回指向代理的服务器信息，主机密钥与目标服务器相同
+func (p *droppingProxy) server() *testutil.SshServer {
+	host, port, _ := net.SplitHostPort(p.listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	return &testutil.SshServer{Address: host, Port: portNum, HostKey: p.target.HostKey}
+}
+
+func TestCopyRetry(t *testing.T) {
+	resource := filetransfer.Resource{Address: "addr", Port: 22, Account: filetransfer.Account{Name: "a", Password: "pwd"}}
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	startCopy := func(t *testing.T, adapter filetransfer.DataAdapter, config filetransfer.TransferConfig) (string, string, func(string) filetransfer.TaskStatus) {
+		t.Helper()
+		dir := t.TempDir()
+		source := filepath.Join(dir, "source.txt")
+		_ = os.WriteFile(source, content, 0644)
+		destination := filepath.Join(dir, "destination.txt")
+		fileServer := filetransfer.NewFileServerWithConfig(adapter, config)
+		body := filetransfer.CopyReqBody{Source: filetransfer.CopyEndpoint{Resource: resource, Path: source},
+			Destination: filetransfer.CopyEndpoint{Resource: resource, Path: destination}}
+		response := testCase(t, initTestCase{requestBody: body, wantResponseStatus: 202}, copyUrl, fileServer)
+		taskId := extractOkBody(response.Body).Data["taskId"].(string)
+		return taskId, destination, func(state string) filetransfer.TaskStatus {
+			waitTaskState(t, fileServer, taskId, state)
+			return queryTaskStatus(t, fileServer, taskId)
+		}
+	}
+	retry := filetransfer.RetryPolicy{MaxAttempts: 3, InitialInterval: 10}
+
+	t.Run("resume from committed offset", func(t *testing.T) {
+		adapter := &flakyCopyAdapter{StubAdapter: &StubAdapter{}, failures: 1, failAfter: 40000}
+		_, destination, wait := startCopy(t, adapter, filetransfer.TransferConfig{Retry: retry})
+		status := wait(filetransfer.TaskStateSucceeded)
+		testutil.AssertIntEquals(t, status.Retries, 1)
+		testutil.AssertTrue(t, strings.Contains(status.LastError, errConnectionLost.Error()))
+		testutil.AssertIntEquals(t, int(status.Transferred), len(content))
+		testutil.AssertStructEquals(t, adapter.getOffsets(), []int64{0, 40000})
+		got, _ := os.ReadFile(destination)
+		testutil.AssertTrue(t, bytes.Equal(got, content))
+	})
+
+	t.Run("retries exhausted", func(t *testing.T) {
+		adapter := &flakyCopyAdapter{StubAdapter: &StubAdapter{}, failures: 3, failAfter: 10}
+		_, destination, wait := startCopy(t, adapter, filetransfer.TransferConfig{Retry: retry})
+		status := wait(filetransfer.TaskStateFailed)
+		testutil.AssertIntEquals(t, status.Retries, 2)
+		testutil.AssertTrue(t, strings.Contains(status.Error, errConnectionLost.Error()))
+		_, err := os.Stat(destination)
+		testutil.AssertTrue(t, os.IsNotExist(err))
+	})
+
+	t.Run("no retry by default", func(t *testing.T) {
+		adapter := &flakyCopyAdapter{StubAdapter: &StubAdapter{}, failures: 1, failAfter: 10}
+		_, _, wait := startCopy(t, adapter, filetransfer.TransferConfig{})
+		status := wait(filetransfer.TaskStateFailed)
+		testutil.AssertIntEquals(t, status.Retries, 0)
+	})
+}
+
+var errConnectionLost = errors.New("connection lost")
+
+// flakyCopyAdapter 前failures次打开的目标文件在写入failAfter字节后失败
+type flakyCopyAdapter struct {
+	*StubAdapter
+	mutex     sync.Mutex
+	failures  int
+	failAfter int64
+	offsets   []int64
+}
+
+func (f *flakyCopyAdapter) GetCopyDestinationChannel(ctx context.Context, taskId string, offset int64) (filetransfer.WriteCloseRollback, error) {
+	channel, err := f.StubAdapter.GetCopyDestinationChannel(ctx, taskId, offset)
+	if err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.offsets = append(f.offsets, offset)
+	if f.failures == 0 {
+		return channel, nil
+	}
+	f.failures--
+	return &failingChannel{WriteCloseRollback: channel, remaining: f.failAfter}, nil
+}
+
+func (f *flakyCopyAdapter) getOffsets() []int64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.offsets
+}
+
+type failingChannel struct {
+	filetransfer.WriteCloseRollback
+	remaining int64
+}
+
+func (f *failingChannel) Write(p []byte) (int, error) {
+	if int64(len(p)) <= f.remaining {
+		f.remaining -= int64(len(p))
+		return f.WriteCloseRollback.Write(p)
+	}
+	n, _ := f.WriteCloseRollback.Write(p[:f.remaining])
+	f.remaining = 0
+	return n, errConnectionLost
+}
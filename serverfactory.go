@@ -0,0 +1,34 @@
+package filetransfer
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"summersea.top/filetransfer/transferframe"
+)
+
+// TransferConfig 传输的默认设置，上传与下载任务初始化时可以单独指定
+type TransferConfig struct {
+	// Timeout 单次传输的最长时间，单位为秒，为0时不限制
+	Timeout int `yaml:"timeout,omitempty"`
+	// IdleTimeout 超过该时间没有读到数据时传输失败，单位为秒，为0时使用defaultIdleTimeout
+	IdleTimeout int `yaml:"idleTimeout,omitempty"`
+	// RateLimit 所有传输共享的限速，单位为字节每秒，为0时不限速
+	RateLimit int64 `yaml:"rateLimit,omitempty"`
+	// Workers 本实例执行服务端任务的并发数，大于0时创建服务后即执行队列中的任务
+	// 为0时在本实例第一次加入任务时以defaultWorkers启动
+	Workers int `yaml:"workers,omitempty"`
+	// JobLease 服务端任务的租约，单位为秒，实例失效超过该时间后任务由其它实例执行，为0时使用defaultJobLease
+	JobLease int `yaml:"jobLease,omitempty"`
+	// Retry 服务端任务传输失败时的重试策略，重试时从已写入的位置继续
+	Retry RetryPolicy `yaml:"retry,omitempty"`
+	// Clock 限速器使用的时钟，为nil时使用系统时钟，测试时可以替换
+	Clock transferframe.Clock `yaml:"-"`
+	// Context 结束后本实例的worker不再从队列中获取任务，执行中的任务继续完成，为nil时一直运行
+	Context context.Context `yaml:"-"`
+}
+
+// CreateServerByConfig 根据配置文件创建文件服务，没有配置时使用默认配置
+// 已经读取过配置时使用NewFileServerWithConfig，避免重复读取配置文件
+func CreateServerByConfig(adapter DataAdapter) *gin.Engine {
+	return NewFileServerWithConfig(adapter, LoadConfig().Transfer)
+}
@@ -0,0 +1,96 @@
+package filetransfer
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io/ioutil"
+	"net"
+	"os"
+)
+
+var UnknownAuthType = errors.New("unknown auth type")
+
+var AgentAuthDisabled = errors.New("agent auth is disabled")
+
+// createAuthMethods 根据账号的认证方式创建ssh认证方法
+// 返回的清理函数需要在握手结束后调用
+func (f *FileTranDataAdapter) createAuthMethods(account Account) ([]ssh.AuthMethod, func(), error) {
+	noop := func() {}
+	switch account.AuthType {
+	case "", AuthTypePassword:
+		return []ssh.AuthMethod{ssh.Password(account.Password)}, noop, nil
+	case AuthTypeKeyboardInteractive:
+		return []ssh.AuthMethod{ssh.KeyboardInteractive(answerAllWith(account.Password))}, noop, nil
+	case AuthTypePublicKey:
+		signer, err := parsePrivateKey([]byte(account.PrivateKey), account.Passphrase)
+		if err != nil {
+			return nil, noop, err
+		}
+		return []ssh.AuthMethod{ssh.PublicKeys(signer)}, noop, nil
+	case AuthTypeKeyId:
+		signer, err := f.loadConfiguredKey(account.KeyId)
+		if err != nil {
+			return nil, noop, err
+		}
+		return []ssh.AuthMethod{ssh.PublicKeys(signer)}, noop, nil
+	case AuthTypeAgent:
+		if !f.sshConfig.AllowAgent {
+			return nil, noop, AgentAuthDisabled
+		}
+		conn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+		if err != nil {
+			return nil, noop, fmt.Errorf("problem connect ssh agent: %v", err)
+		}
+		agentClient := agent.NewClient(conn)
+		return []ssh.AuthMethod{ssh.PublicKeysCallback(agentClient.Signers)}, func() { closeWithErrLog(conn) }, nil
+	}
+	return nil, noop, UnknownAuthType
+}
+
+// IsAgentAuthAllowed 配置文件允许时才能使用ssh agent认证
+func (f *FileTranDataAdapter) IsAgentAuthAllowed() bool {
+	return f.sshConfig.AllowAgent
+}
+
+// loadConfiguredKey 读取配置文件中keyId对应的私钥
+func (f *FileTranDataAdapter) loadConfiguredKey(keyId string) (ssh.Signer, error) {
+	for _, key := range f.sshConfig.Keys {
+		if key.Id != keyId {
+			continue
+		}
+		pemBytes, err := ioutil.ReadFile(key.Path)
+		if err != nil {
+			return nil, fmt.Errorf("problem read key %s: %v", keyId, err)
+		}
+		return parsePrivateKey(pemBytes, key.Passphrase)
+	}
+	return nil, fmt.Errorf("key %s is not configured", keyId)
+}
+
+// parsePrivateKey 解析PEM格式的私钥，passphrase为空时视为未加密
+func parsePrivateKey(pemBytes []byte, passphrase string) (ssh.Signer, error) {
+	var signer ssh.Signer
+	var err error
+	if passphrase == "" {
+		signer, err = ssh.ParsePrivateKey(pemBytes)
+	} else {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("problem parse private key: %v", err)
+	}
+	return signer, nil
+}
+
+// answerAllWith 键盘交互认证时用同一个答案回答服务端的所有问题
+func answerAllWith(answer string) ssh.KeyboardInteractiveChallenge {
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i := range questions {
+			answers[i] = answer
+		}
+		return answers, nil
+	}
+}
@@ -0,0 +1,183 @@
+package filetransfer_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"net"
+	"os"
+	"path/filepath"
+	"summersea.top/filetransfer"
+	testutil "summersea.top/filetransfer/test"
+	"testing"
+)
+
+const authTestContent = "auth test content"
+
+func TestFileTranDataAdapter_AuthMethods(t *testing.T) {
+	t.Run("password", func(t *testing.T) {
+		server := testutil.StartSshServer(t, testutil.NewPasswordServerConfig(t, "test", "pwd"))
+		account := filetransfer.Account{Name: "test", Password: "pwd"}
+		assertUploadSucceed(t, filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStore()), server, account)
+
+		account.Password = "wrong"
+		assertUploadFailed(t, filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStore()), server, account)
+	})
+
+	t.Run("keyboard interactive", func(t *testing.T) {
+		config := &ssh.ServerConfig{
+			KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+				answers, err := client(conn.User(), "", []string{"Password: ", "Code: "}, []bool{false, false})
+				if err != nil || len(answers) != 2 || answers[0] != "pwd" {
+					return nil, testutil.ErrAuthFailed
+				}
+				return nil, nil
+			},
+		}
+		server := testutil.StartSshServer(t, config)
+		account := filetransfer.Account{Name: "test", AuthType: filetransfer.AuthTypeKeyboardInteractive, Password: "pwd"}
+		assertUploadSucceed(t, filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStore()), server, account)
+
+		account.AuthType = filetransfer.AuthTypePassword
+		assertUploadFailed(t, filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStore()), server, account)
+	})
+
+	t.Run("public key", func(t *testing.T) {
+		for _, passphrase := range []string{"", "secret"} {
+			privateKey := testutil.NewPrivateKeyPEM(t, passphrase)
+			server := testutil.StartSshServer(t, publicKeyServerConfig(t, parseSigner(t, privateKey, passphrase).PublicKey()))
+			account := filetransfer.Account{Name: "test", AuthType: filetransfer.AuthTypePublicKey,
+				PrivateKey: privateKey, Passphrase: passphrase}
+			assertUploadSucceed(t, filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStore()), server, account)
+
+			account.PrivateKey = testutil.NewPrivateKeyPEM(t, passphrase)
+			assertUploadFailed(t, filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStore()), server, account)
+		}
+	})
+
+	t.Run("key id", func(t *testing.T) {
+		privateKey := testutil.NewPrivateKeyPEM(t, "secret")
+		keyPath := filepath.Join(t.TempDir(), "deploy")
+		if err := os.WriteFile(keyPath, []byte(privateKey), 0600); err != nil {
+			t.Fatalf("could not write key: %v", err)
+		}
+		server := testutil.StartSshServer(t, publicKeyServerConfig(t, parseSigner(t, privateKey, "secret").PublicKey()))
+		config := filetransfer.SshConfig{Keys: []filetransfer.SshKeyConfig{{Id: "deploy", Path: keyPath, Passphrase: "secret"}}}
+		account := filetransfer.Account{Name: "test", AuthType: filetransfer.AuthTypeKeyId, KeyId: "deploy"}
+		assertUploadSucceed(t, filetransfer.NewFileTranDataAdapterWithConfig(filetransfer.NewMemoryStore(), config), server, account)
+
+		account.KeyId = "missing"
+		assertUploadFailed(t, filetransfer.NewFileTranDataAdapterWithConfig(filetransfer.NewMemoryStore(), config), server, account)
+	})
+
+	t.Run("agent", func(t *testing.T) {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		signer, _ := ssh.NewSignerFromKey(key)
+		keyring := agent.NewKeyring()
+		_ = keyring.Add(agent.AddedKey{PrivateKey: key})
+		t.Setenv("SSH_AUTH_SOCK", serveAgent(t, keyring))
+		server := testutil.StartSshServer(t, publicKeyServerConfig(t, signer.PublicKey()))
+		account := filetransfer.Account{Name: "test", AuthType: filetransfer.AuthTypeAgent}
+		config := filetransfer.SshConfig{AllowAgent: true}
+		assertUploadSucceed(t, filetransfer.NewFileTranDataAdapterWithConfig(filetransfer.NewMemoryStore(), config), server, account)
+		// 配置文件没有允许时不使用服务端的agent
+		assertUploadFailed(t, filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStore()), server, account)
+
+		t.Setenv("SSH_AUTH_SOCK", filepath.Join(t.TempDir(), "missing.sock"))
+		assertUploadFailed(t, filetransfer.NewFileTranDataAdapterWithConfig(filetransfer.NewMemoryStore(), config), server, account)
+	})
+
+	t.Run("unknown auth type", func(t *testing.T) {
+		server := testutil.StartSshServer(t, testutil.NewPasswordServerConfig(t, "test", "pwd"))
+		account := filetransfer.Account{Name: "test", AuthType: "token", Password: "pwd"}
+		assertUploadFailed(t, filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStore()), server, account)
+	})
+}
+
+func assertUploadSucceed(t *testing.T, adapter *filetransfer.FileTranDataAdapter, server *testutil.SshServer, account filetransfer.Account) {
+	t.Helper()
+	dir := t.TempDir()
+	channel, err := getUploadChannel(adapter, server, account, dir)
+	if err != nil {
+		t.Fatalf("problem get upload channel: %v", err)
+	}
+	_, err = channel.Write([]byte(authTestContent))
+	testutil.AssertNil(t, err)
+	testutil.AssertNil(t, channel.(filetransfer.Committer).Commit())
+	testutil.AssertNil(t, channel.Close())
+	got, _ := os.ReadFile(filepath.Join(dir, "auth.txt"))
+	testutil.AssertStringEqual(t, string(got), authTestContent)
+}
+
+func assertUploadFailed(t *testing.T, adapter *filetransfer.FileTranDataAdapter, server *testutil.SshServer, account filetransfer.Account) {
+	t.Helper()
+	channel, err := getUploadChannel(adapter, server, account, t.TempDir())
+	testutil.AssertNotNil(t, err)
+	testutil.AssertNil(t, channel)
+}
+
+func getUploadChannel(adapter *filetransfer.FileTranDataAdapter, server *testutil.SshServer, account filetransfer.Account, dir string) (filetransfer.WriteCloseRollback, error) {
+	resource := filetransfer.Resource{Address: server.Address, Port: server.Port, Account: account}
+	return getResourceUploadChannel(adapter, resource, dir)
+}
+
+func getResourceUploadChannel(adapter *filetransfer.FileTranDataAdapter, resource filetransfer.Resource, dir string) (filetransfer.WriteCloseRollback, error) {
+	taskId := filetransfer.NewTaskId()
+	adapter.SaveUploadData(taskId, filetransfer.UploadData{Resource: resource, Path: dir, Filename: "auth.txt"})
+	return adapter.GetUploadChannel(context.Background(), taskId, filetransfer.UploadOptions{})
+}
+
+func publicKeyServerConfig(t *testing.T, authorized ssh.PublicKey) *ssh.ServerConfig {
+	t.Helper()
+	return &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if bytes.Equal(key.Marshal(), authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, testutil.ErrAuthFailed
+		},
+	}
+}
+
+func parseSigner(t *testing.T, privateKey, passphrase string) ssh.Signer {
+	t.Helper()
+	var signer ssh.Signer
+	var err error
+	if passphrase == "" {
+		signer, err = ssh.ParsePrivateKey([]byte(privateKey))
+	} else {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(privateKey), []byte(passphrase))
+	}
+	if err != nil {
+		t.Fatalf("could not parse key: %v", err)
+	}
+	return signer
+}
+
+// serveAgent 在unix socket上提供ssh agent服务，返回socket路径
+func serveAgent(t *testing.T, keyring agent.Agent) string {
+	t.Helper()
+	socketPath := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("could not listen agent socket: %v", err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = agent.ServeAgent(keyring, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return socketPath
+}
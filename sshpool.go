@@ -0,0 +1,326 @@
+package filetransfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"hash"
+	"log"
+	"strconv"
+	"strings"
+	"summersea.top/filetransfer/transferframe"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultPoolMaxIdle 没有配置时每组连接最多保留的空闲连接数
+const defaultPoolMaxIdle = 2
+
+// defaultPoolIdleTimeout 没有配置时空闲连接的存活时间
+const defaultPoolIdleTimeout = 60 * time.Second
+
+// poolWaitTimeout 同一主机的连接数达到上限时等待其它连接归还的最长时间
+const poolWaitTimeout = 30 * time.Second
+
+// healthCheckTimeout 复用空闲连接前检查连接是否可用的最长时间
+const healthCheckTimeout = 5 * time.Second
+
+var TooManyConnections = errors.New("too many connections to host")
+
+// PoolConfig ssh连接池的配置
+type PoolConfig struct {
+	// MaxIdle 相同地址、端口、用户与凭据的连接最多保留的空闲连接数，为0时使用默认值，小于0时不复用连接
+	MaxIdle int `yaml:"maxIdle,omitempty"`
+	// MaxPerHost 同一地址与端口最多同时打开的连接数，包括空闲连接，为0时不限制
+	MaxPerHost int `yaml:"maxPerHost,omitempty"`
+	// IdleTimeout 空闲连接的存活时间，单位为秒，为0时使用默认值
+	IdleTimeout int `yaml:"idleTimeout,omitempty"`
+}
+
+// sshPool 复用ssh连接，每次取出的连接只被一个任务使用，任务在连接上打开自己的sftp会话
+type sshPool struct {
+	config PoolConfig
+	mutex  sync.Mutex
+	idle   map[string][]*idleConn
+	// opened 每个主机已打开的连接数，包括空闲连接，只在限制连接数时记录
+	opened map[string]int
+	// wakes 等待主机连接数的任务在连接归还或关闭时被唤醒
+	wakes map[string]chan struct{}
+}
+
+type idleConn struct {
+	client *ssh.Client
+	host   string
+	timer  *time.Timer
+}
+
+func newSshPool(config PoolConfig) *sshPool {
+	return &sshPool{config: config, idle: make(map[string][]*idleConn), opened: make(map[string]int),
+		wakes: make(map[string]chan struct{})}
+}
+
+// poolKey 连接的分组键，凭据、信任的指纹与跳板机以摘要的形式参与分组，不同凭据的连接不会被共用
+func poolKey(resource Resource) string {
+	digest := sha256.New()
+	writeResourceHash(digest, resource)
+	for _, hop := range resource.Proxies {
+		hop := hop.resource()
+		writeResourceHash(digest, hop)
+		writeHashField(digest, hop.Account.Name)
+		writeHashField(digest, poolHost(hop))
+	}
+	return fmt.Sprintf("%s@%s:%s", resource.Account.Name, poolHost(resource), hex.EncodeToString(digest.Sum(nil)))
+}
+
+func writeResourceHash(digest hash.Hash, resource Resource) {
+	account := resource.Account
+	for _, field := range []string{account.AuthType, account.Password, account.PrivateKey, account.Passphrase,
+		account.KeyId, strings.Join(resource.Fingerprints, ",")} {
+		writeHashField(digest, field)
+	}
+}
+
+// writeHashField 写入长度前缀，避免相邻字段拼接后产生相同的摘要
+func writeHashField(digest hash.Hash, field string) {
+	digest.Write([]byte(strconv.Itoa(len(field))))
+	digest.Write([]byte{':'})
+	digest.Write([]byte(field))
+}
+
+func poolHost(resource Resource) string {
+	return fmt.Sprintf("%s:%d", resource.Address, resource.Port)
+}
+
+// get 取出可用的空闲连接，没有时通过dial创建新的连接
+// 主机的连接数达到上限时先关闭该主机其它分组的空闲连接，仍然不够时等待其它连接归还，ctx结束时停止等待
+func (p *sshPool) get(ctx context.Context, resource Resource, dial func() (*ssh.Client, error)) (*pooledConn, error) {
+	key, host := poolKey(resource), poolHost(resource)
+	var timeout <-chan time.Time
+	for {
+		if client := p.takeIdle(key, host); client != nil {
+			return &pooledConn{pool: p, key: key, host: host, client: client}, nil
+		}
+		wake := p.acquireHost(host)
+		if wake == nil {
+			break
+		}
+		if conn, idleKey := p.findIdle(host); conn != nil {
+			if p.removeIdle(idleKey, conn) {
+				p.discard(conn.client, host)
+			}
+			continue
+		}
+		if timeout == nil {
+			timer := time.NewTimer(poolWaitTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-wake:
+		case <-timeout:
+			return nil, fmt.Errorf("problem connect %s: %w", host, TooManyConnections)
+		case <-ctx.Done():
+			return nil, fmt.Errorf("problem wait for connection to %s: %w", host, transferframe.CancelErr)
+		}
+	}
+	client, err := dial()
+	if err != nil {
+		p.releaseHost(host)
+		return nil, err
+	}
+	return &pooledConn{pool: p, key: key, host: host, client: client}, nil
+}
+
+// takeIdle 取出通过健康检查的空闲连接，检查失败的连接被关闭
+func (p *sshPool) takeIdle(key, host string) *ssh.Client {
+	for {
+		conn := p.popIdle(key)
+		if conn == nil {
+			return nil
+		}
+		if isConnHealthy(conn.client) {
+			return conn.client
+		}
+		log.Printf("problem reuse connection to %s: health check failed", host)
+		p.discard(conn.client, host)
+	}
+}
+
+func (p *sshPool) popIdle(key string) *idleConn {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	conns := p.idle[key]
+	if len(conns) == 0 {
+		return nil
+	}
+	conn := conns[len(conns)-1]
+	p.setIdle(key, conns[:len(conns)-1])
+	conn.timer.Stop()
+	return conn
+}
+
+// setIdle 调用方需持有锁
+func (p *sshPool) setIdle(key string, conns []*idleConn) {
+	if len(conns) == 0 {
+		delete(p.idle, key)
+	} else {
+		p.idle[key] = conns
+	}
+}
+
+// put 归还连接，空闲连接已满或不复用连接时关闭连接
+func (p *sshPool) put(key, host string, client *ssh.Client) {
+	p.mutex.Lock()
+	if len(p.idle[key]) >= p.maxIdle() {
+		p.mutex.Unlock()
+		p.discard(client, host)
+		return
+	}
+	conn := &idleConn{client: client, host: host}
+	conn.timer = time.AfterFunc(p.idleTimeout(), func() { p.expire(key, conn) })
+	p.idle[key] = append(p.idle[key], conn)
+	p.wakeHost(host)
+	p.mutex.Unlock()
+}
+
+// expire 关闭超过存活时间的空闲连接，连接已被取出时不做处理
+func (p *sshPool) expire(key string, conn *idleConn) {
+	if !p.removeIdle(key, conn) {
+		return
+	}
+	p.discard(conn.client, conn.host)
+}
+
+func (p *sshPool) removeIdle(key string, conn *idleConn) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	conns := p.idle[key]
+	for i, idle := range conns {
+		if idle == conn {
+			p.setIdle(key, append(conns[:i:i], conns[i+1:]...))
+			conn.timer.Stop()
+			return true
+		}
+	}
+	return false
+}
+
+// discard 关闭连接并释放主机的连接数
+func (p *sshPool) discard(client *ssh.Client, host string) {
+	closeWithErrLog(client)
+	p.releaseHost(host)
+}
+
+// acquireHost 占用主机的一个连接数，成功时返回nil，达到上限时返回连接归还或关闭时被关闭的通道
+func (p *sshPool) acquireHost(host string) <-chan struct{} {
+	if p.config.MaxPerHost <= 0 {
+		return nil
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.opened[host] < p.config.MaxPerHost {
+		p.opened[host]++
+		return nil
+	}
+	wake, exist := p.wakes[host]
+	if !exist {
+		wake = make(chan struct{})
+		p.wakes[host] = wake
+	}
+	return wake
+}
+
+func (p *sshPool) releaseHost(host string) {
+	if p.config.MaxPerHost <= 0 {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.opened[host]--; p.opened[host] <= 0 {
+		delete(p.opened, host)
+	}
+	p.wakeHost(host)
+}
+
+// wakeHost 唤醒等待主机连接数的任务，调用方需持有锁
+func (p *sshPool) wakeHost(host string) {
+	if wake, exist := p.wakes[host]; exist {
+		close(wake)
+		delete(p.wakes, host)
+	}
+}
+
+// findIdle 查找主机上任意一组的空闲连接
+func (p *sshPool) findIdle(host string) (*idleConn, string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for key, conns := range p.idle {
+		for _, conn := range conns {
+			if conn.host == host {
+				return conn, key
+			}
+		}
+	}
+	return nil, ""
+}
+
+func (p *sshPool) maxIdle() int {
+	if p.config.MaxIdle == 0 {
+		return defaultPoolMaxIdle
+	}
+	if p.config.MaxIdle < 0 {
+		return 0
+	}
+	return p.config.MaxIdle
+}
+
+func (p *sshPool) idleTimeout() time.Duration {
+	if p.config.IdleTimeout > 0 {
+		return time.Duration(p.config.IdleTimeout) * time.Second
+	}
+	return defaultPoolIdleTimeout
+}
+
+// isConnHealthy 通过keepalive请求检查连接，服务端拒绝请求也说明连接可用
+func isConnHealthy(client *ssh.Client) bool {
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		result <- err
+	}()
+	timer := time.NewTimer(healthCheckTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-result:
+		return err == nil
+	case <-timer.C:
+		return false
+	}
+}
+
+// pooledConn 从连接池取出的连接，关闭时归还到连接池
+type pooledConn struct {
+	pool   *sshPool
+	key    string
+	host   string
+	client *ssh.Client
+	closed int32
+}
+
+func (c *pooledConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		c.pool.put(c.key, c.host, c.client)
+	}
+	return nil
+}
+
+// discard 连接不可用时关闭连接而不是归还
+func (c *pooledConn) discard() {
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		c.pool.discard(c.client, c.host)
+	}
+}
@@ -0,0 +1,102 @@
+package filetransfer_test
+
+import (
+	"context"
+	"errors"
+	"summersea.top/filetransfer"
+	testutil "summersea.top/filetransfer/test"
+	"summersea.top/filetransfer/transferframe"
+	"testing"
+	"time"
+)
+
+func TestSshPool(t *testing.T) {
+	server := testutil.StartSshServer(t, testutil.NewPasswordServerConfig(t, "test", "pwd"))
+	account := filetransfer.Account{Name: "test", Password: "pwd"}
+
+	t.Run("connection reused", func(t *testing.T) {
+		proxy := startDroppingProxy(t, server, 0)
+		adapter := filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStore())
+		assertUploadSucceed(t, adapter, proxy.server(), account)
+		assertUploadSucceed(t, adapter, proxy.server(), account)
+		testutil.AssertIntEquals(t, proxy.connections(), 1)
+	})
+
+	t.Run("different credentials not shared", func(t *testing.T) {
+		proxy := startDroppingProxy(t, server, 0)
+		adapter := filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStore())
+		assertUploadSucceed(t, adapter, proxy.server(), account)
+		assertUploadFailed(t, adapter, proxy.server(), filetransfer.Account{Name: "test", Password: "wrong"})
+		testutil.AssertIntEquals(t, proxy.connections(), 2)
+	})
+
+	t.Run("pooling disabled", func(t *testing.T) {
+		proxy := startDroppingProxy(t, server, 0)
+		adapter := filetransfer.NewFileTranDataAdapterWithConfig(filetransfer.NewMemoryStore(),
+			filetransfer.SshConfig{Pool: filetransfer.PoolConfig{MaxIdle: -1}})
+		assertUploadSucceed(t, adapter, proxy.server(), account)
+		assertUploadSucceed(t, adapter, proxy.server(), account)
+		testutil.AssertIntEquals(t, proxy.connections(), 2)
+	})
+
+	t.Run("broken connection replaced", func(t *testing.T) {
+		proxy := startDroppingProxy(t, server, 0)
+		adapter := filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStore())
+		assertUploadSucceed(t, adapter, proxy.server(), account)
+		proxy.breakConnections()
+		assertUploadSucceed(t, adapter, proxy.server(), account)
+		testutil.AssertIntEquals(t, proxy.connections(), 2)
+	})
+
+	t.Run("idle connection expired", func(t *testing.T) {
+		proxy := startDroppingProxy(t, server, 0)
+		adapter := filetransfer.NewFileTranDataAdapterWithConfig(filetransfer.NewMemoryStore(),
+			filetransfer.SshConfig{Pool: filetransfer.PoolConfig{IdleTimeout: 1}})
+		assertUploadSucceed(t, adapter, proxy.server(), account)
+		time.Sleep(1100 * time.Millisecond)
+		assertUploadSucceed(t, adapter, proxy.server(), account)
+		testutil.AssertIntEquals(t, proxy.connections(), 2)
+	})
+
+	t.Run("wait for max per host", func(t *testing.T) {
+		proxy := startDroppingProxy(t, server, 0)
+		adapter := filetransfer.NewFileTranDataAdapterWithConfig(filetransfer.NewMemoryStore(),
+			filetransfer.SshConfig{Pool: filetransfer.PoolConfig{MaxPerHost: 1}})
+		first, err := getUploadChannel(adapter, proxy.server(), account, t.TempDir())
+		testutil.AssertNil(t, err)
+		opened := make(chan filetransfer.WriteCloseRollback)
+		go func() {
+			second, _ := getUploadChannel(adapter, proxy.server(), account, t.TempDir())
+			opened <- second
+		}()
+		select {
+		case <-opened:
+			t.Fatalf("second connection opened beyond max per host")
+		case <-time.After(50 * time.Millisecond):
+		}
+		testutil.AssertNil(t, first.Close())
+		second := <-opened
+		testutil.AssertNotNil(t, second)
+		testutil.AssertNil(t, second.Close())
+		testutil.AssertIntEquals(t, proxy.connections(), 1)
+	})
+
+	t.Run("wait for max per host canceled", func(t *testing.T) {
+		proxy := startDroppingProxy(t, server, 0)
+		adapter := filetransfer.NewFileTranDataAdapterWithConfig(filetransfer.NewMemoryStore(),
+			filetransfer.SshConfig{Pool: filetransfer.PoolConfig{MaxPerHost: 1}})
+		first, err := getUploadChannel(adapter, proxy.server(), account, t.TempDir())
+		testutil.AssertNil(t, err)
+		defer first.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		taskId := filetransfer.NewTaskId()
+		resource := filetransfer.Resource{Address: proxy.server().Address, Port: proxy.server().Port, Account: account}
+		adapter.SaveUploadData(taskId, filetransfer.UploadData{Resource: resource, Path: t.TempDir(), Filename: "wait.txt"})
+		start := time.Now()
+		second, err := adapter.GetUploadChannel(ctx, taskId, filetransfer.UploadOptions{})
+		testutil.AssertNil(t, second)
+		testutil.AssertTrue(t, errors.Is(err, transferframe.CancelErr))
+		testutil.AssertTrue(t, time.Since(start) < time.Second)
+	})
+}
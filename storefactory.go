@@ -18,7 +18,11 @@ type RedisConfig struct {
 }
 
 func CreateStoreByConfig() DataStore {
-	storeConfig := getStoreConfig()
+	return CreateStoreWithConfig(LoadConfig().Store)
+}
+
+// CreateStoreWithConfig 根据已读取的配置创建存储，redis不可用时使用内存存储
+func CreateStoreWithConfig(storeConfig StoreConfig) DataStore {
 	if storeConfig.Type == "redis" {
 		dataStore, err := handleRedisConfig(storeConfig.Config.Redis)
 		if err != nil {
@@ -44,12 +48,3 @@ func handleStoreConfig() DataStore {
 	log.Printf("[info] success to create memory store")
 	return NewMemoryStore()
 }
-
-func getStoreConfig() *StoreConfig {
-	content, err := NewYamlContent("")
-	if err != nil {
-		log.Printf("[error]problem get yaml content: %v \n", err)
-		return &StoreConfig{}
-	}
-	return &content.Store
-}
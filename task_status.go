@@ -0,0 +1,401 @@
+package filetransfer
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"summersea.top/filetransfer/transferframe"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// progressInterval 传输过程中保存进度的间隔
+const progressInterval = time.Second
+
+// cancelPollInterval 传输过程中检查任务是否被取消的间隔
+const cancelPollInterval = 500 * time.Millisecond
+
+// defaultIdleTimeout 没有配置空闲超时时使用的值
+const defaultIdleTimeout = 5 * time.Minute
+
+// progressKeepAlive 推送进度时没有状态变化的情况下重新检查任务状态的间隔
+const progressKeepAlive = 15 * time.Second
+
+// 查询任务状态，任务在传输完成前过期时状态为expired
+func (fs *FileServerController) taskStatusHandler(ctx *gin.Context) {
+	status := fs.getTaskStatus(ctx.Param("taskId"))
+	if status == nil {
+		ctx.JSON(http.StatusBadRequest, getTaskNotFoundErr())
+		return
+	}
+	ctx.JSON(http.StatusOK, OkBody{Data: Data{"task": status}})
+}
+
+// 以Server-Sent Events推送任务进度，任务结束后关闭连接
+// 状态通过DataStore的发布订阅传递，订阅的实例不需要是执行传输的实例
+func (fs *FileServerController) taskProgressHandler(ctx *gin.Context) {
+	taskId := ctx.Param("taskId")
+	statusChannel, cancel := fs.dataAdapter.SubscribeTaskStatus(taskId)
+	defer cancel()
+	status := fs.getTaskStatus(taskId)
+	if status == nil {
+		ctx.JSON(http.StatusBadRequest, getTaskNotFoundErr())
+		return
+	}
+	ctx.Header("Cache-Control", "no-cache")
+	// 禁止nginx缓存响应，否则进度无法及时送达
+	ctx.Header("X-Accel-Buffering", "no")
+	meter := &rateMeter{}
+	ctx.SSEvent("progress", meter.event(*status))
+	ctx.Writer.Flush()
+	if isTaskFinished(status.State) {
+		return
+	}
+	ticker := time.NewTicker(progressKeepAlive)
+	defer ticker.Stop()
+	ctx.Stream(func(io.Writer) bool {
+		select {
+		case <-ctx.Request.Context().Done():
+			return false
+		case received, ok := <-statusChannel:
+			if !ok {
+				return false
+			}
+			status = &received
+		case <-ticker.C:
+			if status = fs.getTaskStatus(taskId); status == nil {
+				return false
+			}
+		}
+		ctx.SSEvent("progress", meter.event(*status))
+		return !isTaskFinished(status.State)
+	})
+}
+
+// 取消任务，正在传输的任务由执行传输的实例异步停止并回滚，返回202
+// 等待中的任务立即取消，已上传的部分会被删除，返回204
+func (fs *FileServerController) taskCancelHandler(ctx *gin.Context) {
+	taskId := ctx.Param("taskId")
+	status := fs.getTaskStatus(taskId)
+	if status == nil {
+		ctx.JSON(http.StatusBadRequest, getTaskNotFoundErr())
+		return
+	}
+	if isTaskFinished(status.State) {
+		ctx.JSON(http.StatusConflict, getTaskFinishedErr())
+		return
+	}
+	fs.dataAdapter.CancelTask(taskId)
+	if status.State == TaskStateRunning {
+		ctx.Status(http.StatusAccepted)
+		return
+	}
+	if status.Type == TaskTypeUpload {
+		fs.removeUploaded(ctx.Request.Context(), taskId)
+		fs.dataAdapter.FinishUpload(taskId)
+	}
+	if status.Type == TaskTypeCopy {
+		fs.dataAdapter.FinishCopy(taskId)
+	}
+	now := time.Now()
+	status.State = TaskStateCanceled
+	status.Error = transferframe.CancelErr.Error()
+	status.EndTime = &now
+	fs.dataAdapter.SaveTaskStatus(taskId, *status)
+	ctx.Status(http.StatusNoContent)
+}
+
+// removeUploaded 删除等待续传的上传任务已提交的部分
+func (fs *FileServerController) removeUploaded(ctx context.Context, taskId string) {
+	offset := fs.dataAdapter.GetUploadOffset(taskId)
+	if offset == 0 {
+		return
+	}
+	if err := fs.dataAdapter.RemoveUploadTemp(ctx, taskId); err != nil {
+		log.Printf("problem remove canceled upload: %v", err)
+	}
+}
+
+// getTaskStatus 获取任务状态，任务在传输完成前过期时状态为expired
+// 本实例上仍在传输的任务不会被标记为expired
+func (fs *FileServerController) getTaskStatus(taskId string) *TaskStatus {
+	status := fs.dataAdapter.GetTaskStatus(taskId)
+	if status == nil {
+		return nil
+	}
+	if (status.State == TaskStatePending || status.State == TaskStateRunning) && !fs.isTaskExist(*status) &&
+		!fs.runningTasks.contains(taskId) {
+		status.State = TaskStateExpired
+	}
+	return status
+}
+
+// runningTasks 记录本实例上正在传输的任务，同一任务可能有多个并发的请求
+type runningTasks struct {
+	mutex  sync.Mutex
+	counts map[string]int
+}
+
+func newRunningTasks() *runningTasks {
+	return &runningTasks{counts: map[string]int{}}
+}
+
+func (r *runningTasks) add(taskId string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.counts[taskId]++
+}
+
+func (r *runningTasks) remove(taskId string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.counts[taskId]--; r.counts[taskId] <= 0 {
+		delete(r.counts, taskId)
+	}
+}
+
+func (r *runningTasks) contains(taskId string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.counts[taskId] > 0
+}
+
+// isTransferStopped 传输是否因取消、超时或请求断开而停止
+func isTransferStopped(err error) bool {
+	return errors.Is(err, transferframe.CancelErr) || errors.Is(err, transferframe.DeadlineErr) ||
+		errors.Is(err, transferframe.IdleTimeoutErr)
+}
+
+func isTaskFinished(state string) bool {
+	return state == TaskStateSucceeded || state == TaskStateFailed || state == TaskStateExpired ||
+		state == TaskStateCanceled
+}
+
+// rateMeter 根据相邻两次进度计算传输速率与剩余时间
+type rateMeter struct {
+	lastTransferred int64
+	lastTime        time.Time
+	rate            float64
+}
+
+func (m *rateMeter) event(status TaskStatus) ProgressEvent {
+	now := time.Now()
+	if status.State != TaskStateRunning {
+		m.rate = 0
+	} else if elapsed := now.Sub(m.lastTime).Seconds(); !m.lastTime.IsZero() && elapsed > 0 &&
+		status.Transferred >= m.lastTransferred {
+		m.rate = float64(status.Transferred-m.lastTransferred) / elapsed
+	}
+	m.lastTransferred = status.Transferred
+	m.lastTime = now
+	event := ProgressEvent{TaskStatus: status, Rate: m.rate, Eta: -1}
+	if status.State == TaskStateRunning && status.Total >= 0 && m.rate > 0 {
+		event.Eta = int64(math.Ceil(float64(status.Total-status.Transferred) / m.rate))
+	}
+	return event
+}
+
+func (fs *FileServerController) isTaskExist(status TaskStatus) bool {
+	switch status.Type {
+	case TaskTypeDownload:
+		return fs.dataAdapter.IsDownloadTaskExist(status.TaskId)
+	case TaskTypeCopy:
+		return fs.dataAdapter.IsCopyTaskExist(status.TaskId)
+	}
+	return fs.dataAdapter.IsUploadTaskExist(status.TaskId)
+}
+
+// getTransferOptions 获取任务的超时设置，任务没有指定时使用配置中的值
+// 任务的限速与配置中的全局限速分别生效，这里只返回任务的限速
+func (fs *FileServerController) getTransferOptions(taskId, taskType string) TransferOptions {
+	options := TransferOptions{Timeout: fs.config.Timeout, IdleTimeout: fs.config.IdleTimeout}
+	var taskOptions TransferOptions
+	switch taskType {
+	case TaskTypeDownload:
+		if data := fs.dataAdapter.GetDownloadData(taskId); data != nil {
+			taskOptions = data.TransferOptions
+		}
+	case TaskTypeCopy:
+		if data := fs.dataAdapter.GetCopyData(taskId); data != nil {
+			taskOptions = data.TransferOptions
+		}
+	default:
+		if data := fs.dataAdapter.GetUploadData(taskId); data != nil {
+			taskOptions = data.TransferOptions
+		}
+	}
+	if taskOptions.Timeout > 0 {
+		options.Timeout = taskOptions.Timeout
+	}
+	if taskOptions.IdleTimeout > 0 {
+		options.IdleTimeout = taskOptions.IdleTimeout
+	}
+	options.RateLimit = taskOptions.RateLimit
+	return options
+}
+
+func isTransferOptionsValid(options TransferOptions) bool {
+	return options.Timeout >= 0 && options.IdleTimeout >= 0 && options.RateLimit >= 0
+}
+
+func (fs *FileServerController) saveTaskPending(taskId, taskType string) {
+	fs.dataAdapter.SaveTaskStatus(taskId, TaskStatus{TaskId: taskId, Type: taskType, State: TaskStatePending, Total: -1})
+}
+
+// taskTracker 记录一次请求中的传输进度，进度保存在DataStore中，集群中的其它实例也能查询
+// 同时轮询任务的取消标记，任务被取消、请求结束或超过截止时间后ctx结束
+type taskTracker struct {
+	adapter     DataAdapter
+	status      TaskStatus
+	ctx         context.Context
+	cancel      context.CancelFunc
+	idleTimeout time.Duration
+	// limiters 本次传输需要等待的限速器
+	limiters []*transferframe.RateLimiter
+	// release 释放任务的限速器并移除本实例上的传输记录
+	release func()
+	// canceled 任务被用户取消时为1
+	canceled int32
+}
+
+// startTracking 将任务标记为running，transferred为之前已完成的字节数，total未知时为-1
+// parent一般为请求的ctx，客户端断开后传输随之停止
+func (fs *FileServerController) startTracking(parent context.Context, taskId, taskType string, transferred, total int64) *taskTracker {
+	status := TaskStatus{TaskId: taskId, Type: taskType}
+	if saved := fs.dataAdapter.GetTaskStatus(taskId); saved != nil {
+		status = *saved
+	}
+	now := time.Now()
+	if status.StartTime == nil {
+		status.StartTime = &now
+	}
+	status.State = TaskStateRunning
+	status.Transferred = transferred
+	status.Total = total
+	status.EndTime = nil
+	status.Error = ""
+	options := fs.getTransferOptions(taskId, taskType)
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if options.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, time.Duration(options.Timeout)*time.Second)
+	} else {
+		ctx, cancel = context.WithCancel(parent)
+	}
+	fs.runningTasks.add(taskId)
+	tracker := &taskTracker{adapter: fs.dataAdapter, status: status, ctx: ctx, cancel: cancel,
+		idleTimeout: defaultIdleTimeout, release: func() { fs.runningTasks.remove(taskId) }}
+	if options.IdleTimeout > 0 {
+		tracker.idleTimeout = time.Duration(options.IdleTimeout) * time.Second
+	}
+	if options.RateLimit > 0 {
+		tracker.limiters = append(tracker.limiters, fs.taskLimiters.acquire(taskId, options.RateLimit))
+		tracker.release = func() {
+			fs.runningTasks.remove(taskId)
+			fs.taskLimiters.release(taskId)
+		}
+	}
+	if fs.globalLimiter != nil {
+		tracker.limiters = append(tracker.limiters, fs.globalLimiter)
+	}
+	tracker.save()
+	go tracker.watchCancel()
+	return tracker
+}
+
+// watchCancel 任务被取消或本次传输结束时退出
+func (t *taskTracker) watchCancel() {
+	ticker := time.NewTicker(cancelPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-ticker.C:
+			if t.checkCanceled() {
+				return
+			}
+		}
+	}
+}
+
+// checkCanceled 检查任务的取消标记，任务被取消时停止本次传输
+func (t *taskTracker) checkCanceled() bool {
+	if !t.adapter.IsTaskCanceled(t.status.TaskId) {
+		return false
+	}
+	atomic.StoreInt32(&t.canceled, 1)
+	t.cancel()
+	return true
+}
+
+// isCanceled 任务是否被用户取消，请求断开或超时不算取消
+func (t *taskTracker) isCanceled() bool {
+	return atomic.LoadInt32(&t.canceled) == 1
+}
+
+func (t *taskTracker) setTotal(total int64) {
+	t.status.Total = total
+	t.save()
+}
+
+// progressWriter 创建统计本次传输进度的TransferWriter，多次传输的进度会累加
+func (t *taskTracker) progressWriter() transferframe.TransferWriter {
+	var reported int64
+	writer, _ := transferframe.NewProgressWriter(progressInterval, func(transferred int64) {
+		t.status.Transferred += transferred - reported
+		reported = transferred
+		t.save()
+	})
+	return writer
+}
+
+// retry 记录一次重试，transferred为重试时继续传输的位置
+func (t *taskTracker) retry(err error, transferred int64) {
+	t.status.Retries++
+	t.status.LastError = err.Error()
+	t.status.Transferred = transferred
+	t.save()
+}
+
+// abandon 停止本次传输但不更新任务状态，任务已由其它实例接手时使用
+func (t *taskTracker) abandon() {
+	t.cancel()
+	t.release()
+}
+
+// finish 结束本次传输，出错时任务失败，done为false时任务等待续传
+func (t *taskTracker) finish(err error, done bool) {
+	t.cancel()
+	t.release()
+	now := time.Now()
+	switch {
+	case err != nil && t.isCanceled():
+		t.status.State = TaskStateCanceled
+		t.status.Error = err.Error()
+		t.status.EndTime = &now
+	case err != nil:
+		t.status.State = TaskStateFailed
+		t.status.Error = err.Error()
+		t.status.EndTime = &now
+	case done:
+		t.status.State = TaskStateSucceeded
+		t.status.EndTime = &now
+	default:
+		t.status.State = TaskStatePending
+	}
+	t.save()
+}
+
+// save 保存任务状态，传输中的任务同时延长任务数据的存活时间
+func (t *taskTracker) save() {
+	t.adapter.SaveTaskStatus(t.status.TaskId, t.status)
+	if t.status.State == TaskStateRunning {
+		t.adapter.RenewTask(t.status.TaskId)
+	}
+}
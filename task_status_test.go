@@ -0,0 +1,486 @@
+package filetransfer_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	uuid "github.com/satori/go.uuid"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"summersea.top/filetransfer"
+	testutil "summersea.top/filetransfer/test"
+	"summersea.top/filetransfer/transferframe"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const taskStatusUrl = "/file/task/"
+
+func TestTaskStatus(t *testing.T) {
+	resource := filetransfer.Resource{Address: "addr", Port: 22, Account: filetransfer.Account{Name: "a", Password: "pwd"}}
+
+	t.Run("unknown task", func(t *testing.T) {
+		fileServer := filetransfer.NewFileServer(&StubAdapter{})
+		response := httptest.NewRecorder()
+		fileServer.ServeHTTP(response, newGetRequest(taskStatusUrl+uuid.NewV4().String()))
+		testutil.AssertIntEquals(t, response.Code, http.StatusBadRequest)
+	})
+
+	t.Run("upload lifecycle", func(t *testing.T) {
+		adapter := &StubAdapter{filename: filepath.Join(t.TempDir(), "status.txt")}
+		fileServer := filetransfer.NewFileServer(adapter)
+		body := filetransfer.UploadInitReqBody{Resource: resource, Path: "/root", Filename: "status.txt"}
+		response := testCase(t, initTestCase{requestBody: body, wantResponseStatus: http.StatusOK}, initUploadUrl, fileServer)
+		taskId := extractOkBody(response.Body).Data["taskId"].(string)
+
+		status := queryTaskStatus(t, fileServer, taskId)
+		testutil.AssertStringEqual(t, status.State, filetransfer.TaskStatePending)
+		testutil.AssertStringEqual(t, status.Type, filetransfer.TaskTypeUpload)
+		testutil.AssertTrue(t, status.Total == -1)
+		testutil.AssertNil(t, status.StartTime)
+
+		requestUrl := fmt.Sprintf("%s?taskId=%s", uploadUrl, taskId)
+		request := newPostRequestReader(requestUrl, strings.NewReader("01234"))
+		request.Header.Set("Content-Range", "bytes 0-4/10")
+		fileServer.ServeHTTP(httptest.NewRecorder(), request)
+		status = queryTaskStatus(t, fileServer, taskId)
+		testutil.AssertStringEqual(t, status.State, filetransfer.TaskStatePending)
+		testutil.AssertTrue(t, status.Transferred == 5 && status.Total == 10)
+		testutil.AssertNotNil(t, status.StartTime)
+
+		request = newPostRequestReader(requestUrl, strings.NewReader("56789"))
+		request.Header.Set("Content-Range", "bytes 5-9/10")
+		fileServer.ServeHTTP(httptest.NewRecorder(), request)
+		status = queryTaskStatus(t, fileServer, taskId)
+		testutil.AssertStringEqual(t, status.State, filetransfer.TaskStateSucceeded)
+		testutil.AssertTrue(t, status.Transferred == 10 && status.Total == 10)
+		testutil.AssertNotNil(t, status.EndTime)
+	})
+
+	t.Run("upload failed", func(t *testing.T) {
+		taskId := uuid.NewV4().String()
+		adapter := &StubAdapter{uploadTaskId: taskId, filename: filepath.Join(t.TempDir(), "failed.txt"),
+			commitErr: filetransfer.IncompleteWrite}
+		fileServer := filetransfer.NewFileServer(adapter)
+		request := newPostRequestReader(fmt.Sprintf("%s?taskId=%s", uploadUrl, taskId), strings.NewReader("content"))
+		fileServer.ServeHTTP(httptest.NewRecorder(), request)
+		status := queryTaskStatus(t, fileServer, taskId)
+		testutil.AssertStringEqual(t, status.State, filetransfer.TaskStateFailed)
+		testutil.AssertTrue(t, strings.Contains(status.Error, filetransfer.IncompleteWrite.Error()))
+		testutil.AssertNotNil(t, status.EndTime)
+	})
+
+	t.Run("download succeeded", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "download.txt")
+		_ = os.WriteFile(filename, []byte("download content"), 0644)
+		adapter := &StubAdapter{}
+		fileServer := filetransfer.NewFileServer(adapter)
+		body := filetransfer.DownloadInitReqBody{Resource: resource, Path: filename}
+		response := testCase(t, initTestCase{requestBody: body, wantResponseStatus: http.StatusOK}, initDownloadUrl, fileServer)
+		taskId := extractOkBody(response.Body).Data["taskId"].(string)
+		fileServer.ServeHTTP(httptest.NewRecorder(), newGetRequest(fmt.Sprintf("%s?taskId=%s", downloadUrl, taskId)))
+		status := queryTaskStatus(t, fileServer, taskId)
+		testutil.AssertStringEqual(t, status.State, filetransfer.TaskStateSucceeded)
+		testutil.AssertStringEqual(t, status.Type, filetransfer.TaskTypeDownload)
+		testutil.AssertTrue(t, status.Transferred == 16 && status.Total == 16)
+	})
+
+	t.Run("expired task", func(t *testing.T) {
+		taskId := uuid.NewV4().String()
+		adapter := &StubAdapter{}
+		adapter.SaveTaskStatus(taskId, filetransfer.TaskStatus{TaskId: taskId, Type: filetransfer.TaskTypeUpload,
+			State: filetransfer.TaskStateRunning, Total: -1})
+		fileServer := filetransfer.NewFileServer(adapter)
+		status := queryTaskStatus(t, fileServer, taskId)
+		testutil.AssertStringEqual(t, status.State, filetransfer.TaskStateExpired)
+	})
+}
+
+func queryTaskStatus(t *testing.T, fileServer http.Handler, taskId string) filetransfer.TaskStatus {
+	t.Helper()
+	response := httptest.NewRecorder()
+	fileServer.ServeHTTP(response, newGetRequest(taskStatusUrl+taskId))
+	testutil.AssertIntEquals(t, response.Code, http.StatusOK)
+	var body struct {
+		Data struct {
+			Task filetransfer.TaskStatus `json:"task"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		t.Fatalf("problem decode status: %v", err)
+	}
+	return body.Data.Task
+}
+
+func TestTaskExpirationRenewed(t *testing.T) {
+	server := testutil.StartSshServer(t, testutil.NewPasswordServerConfig(t, "test", "pwd"))
+	resource := filetransfer.Resource{Address: server.Address, Port: server.Port,
+		Account: filetransfer.Account{Name: "test", Password: "pwd"}}
+	// 任务数据1.5秒后过期，上传持续3.5秒，传输中每秒保存进度时延长存活时间
+	adapter := filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStoreWithExpiration(1500 * time.Millisecond))
+	fileServer := filetransfer.NewFileServer(adapter)
+	dir := t.TempDir()
+	taskId := filetransfer.NewTaskId()
+	adapter.SaveUploadData(taskId, filetransfer.UploadData{Resource: resource, Path: dir, Filename: "slow.txt"})
+	reader, writer := io.Pipe()
+	go func() {
+		for i := 0; i < 35; i++ {
+			time.Sleep(100 * time.Millisecond)
+			_, _ = writer.Write([]byte("a"))
+		}
+		_ = writer.Close()
+	}()
+	response := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		fileServer.ServeHTTP(response, newPostRequestReader(fmt.Sprintf("%s?taskId=%s", uploadUrl, taskId), reader))
+		close(done)
+	}()
+	time.Sleep(2500 * time.Millisecond)
+	testutil.AssertStringEqual(t, queryTaskStatus(t, fileServer, taskId).State, filetransfer.TaskStateRunning)
+	<-done
+	testutil.AssertIntEquals(t, response.Code, http.StatusNoContent)
+	testutil.AssertStringEqual(t, queryTaskStatus(t, fileServer, taskId).State, filetransfer.TaskStateSucceeded)
+	got, _ := os.ReadFile(filepath.Join(dir, "slow.txt"))
+	testutil.AssertStringEqual(t, string(got), strings.Repeat("a", 35))
+}
+
+func TestTaskProgress(t *testing.T) {
+	t.Run("unknown task", func(t *testing.T) {
+		fileServer := filetransfer.NewFileServer(&StubAdapter{})
+		response := httptest.NewRecorder()
+		fileServer.ServeHTTP(response, newGetRequest(taskStatusUrl+uuid.NewV4().String()+"/progress"))
+		testutil.AssertIntEquals(t, response.Code, http.StatusBadRequest)
+	})
+
+	t.Run("finished task", func(t *testing.T) {
+		taskId := uuid.NewV4().String()
+		adapter := &StubAdapter{}
+		adapter.SaveTaskStatus(taskId, filetransfer.TaskStatus{TaskId: taskId, Type: filetransfer.TaskTypeUpload,
+			State: filetransfer.TaskStateSucceeded, Transferred: 3, Total: 3})
+		server := httptest.NewServer(filetransfer.NewFileServer(adapter))
+		defer server.Close()
+		events := readProgressEvents(t, server.URL+taskStatusUrl+taskId+"/progress")
+		event := <-events
+		testutil.AssertStringEqual(t, event.State, filetransfer.TaskStateSucceeded)
+		testutil.AssertTrue(t, event.Eta == -1)
+		_, ok := <-events
+		testutil.AssertFalse(t, ok)
+	})
+
+	t.Run("stream until upload finished", func(t *testing.T) {
+		taskId := uuid.NewV4().String()
+		adapter := &StubAdapter{uploadTaskId: taskId, filename: filepath.Join(t.TempDir(), "progress.txt")}
+		adapter.SaveTaskStatus(taskId, filetransfer.TaskStatus{TaskId: taskId, Type: filetransfer.TaskTypeUpload,
+			State: filetransfer.TaskStatePending, Total: -1})
+		server := httptest.NewServer(filetransfer.NewFileServer(adapter))
+		defer server.Close()
+		events := readProgressEvents(t, server.URL+taskStatusUrl+taskId+"/progress")
+		testutil.AssertStringEqual(t, (<-events).State, filetransfer.TaskStatePending)
+
+		response, err := http.Post(fmt.Sprintf("%s%s?taskId=%s", server.URL, uploadUrl, taskId), "", strings.NewReader("content"))
+		if err != nil {
+			t.Fatalf("problem upload: %v", err)
+		}
+		_ = response.Body.Close()
+		var last filetransfer.ProgressEvent
+		for event := range events {
+			last = event
+		}
+		testutil.AssertStringEqual(t, last.State, filetransfer.TaskStateSucceeded)
+		testutil.AssertTrue(t, last.Transferred == 7)
+	})
+
+	t.Run("running task not expired", func(t *testing.T) {
+		taskId := uuid.NewV4().String()
+		adapter := &dataGoneAdapter{StubAdapter: &StubAdapter{uploadTaskId: taskId, filename: filepath.Join(t.TempDir(), "progress.txt")}}
+		adapter.SaveTaskStatus(taskId, filetransfer.TaskStatus{TaskId: taskId, Type: filetransfer.TaskTypeUpload,
+			State: filetransfer.TaskStatePending, Total: -1})
+		fileServer := filetransfer.NewFileServer(adapter)
+		server := httptest.NewServer(fileServer)
+		defer server.Close()
+		reader, writer := io.Pipe()
+		uploaded := make(chan struct{})
+		go func() {
+			defer close(uploaded)
+			response, err := http.Post(fmt.Sprintf("%s%s?taskId=%s", server.URL, uploadUrl, taskId), "", reader)
+			if err == nil {
+				_ = response.Body.Close()
+			}
+		}()
+		_, _ = writer.Write([]byte("abc"))
+		waitTaskState(t, fileServer, taskId, filetransfer.TaskStateRunning)
+		// 任务数据已经过期，但传输仍在本实例上进行
+		atomic.StoreInt32(&adapter.gone, 1)
+		testutil.AssertStringEqual(t, queryTaskStatus(t, fileServer, taskId).State, filetransfer.TaskStateRunning)
+		events := readProgressEvents(t, server.URL+taskStatusUrl+taskId+"/progress")
+		testutil.AssertStringEqual(t, (<-events).State, filetransfer.TaskStateRunning)
+		_ = writer.Close()
+		<-uploaded
+		var last filetransfer.ProgressEvent
+		for event := range events {
+			last = event
+		}
+		testutil.AssertStringEqual(t, last.State, filetransfer.TaskStateSucceeded)
+	})
+}
+
+// dataGoneAdapter gone为1时上传任务的数据不存在，模拟传输过程中任务数据过期
+type dataGoneAdapter struct {
+	*StubAdapter
+	gone int32
+}
+
+func (d *dataGoneAdapter) IsUploadTaskExist(taskId string) bool {
+	return atomic.LoadInt32(&d.gone) == 0 && d.StubAdapter.IsUploadTaskExist(taskId)
+}
+
+// readProgressEvents 读取SSE中的进度事件，连接关闭后关闭通道
+func readProgressEvents(t *testing.T, url string) <-chan filetransfer.ProgressEvent {
+	t.Helper()
+	response, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("problem get progress: %v", err)
+	}
+	testutil.AssertIntEquals(t, response.StatusCode, http.StatusOK)
+	testutil.AssertStringEqual(t, response.Header.Get("Content-Type"), "text/event-stream")
+	events := make(chan filetransfer.ProgressEvent, 16)
+	go func() {
+		defer close(events)
+		defer response.Body.Close()
+		scanner := bufio.NewScanner(response.Body)
+		for scanner.Scan() {
+			data := strings.TrimPrefix(scanner.Text(), "data:")
+			if data == scanner.Text() {
+				continue
+			}
+			var event filetransfer.ProgressEvent
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				t.Errorf("problem decode event: %v", err)
+				return
+			}
+			events <- event
+		}
+	}()
+	return events
+}
+
+func TestTaskCancel(t *testing.T) {
+	t.Run("unknown task", func(t *testing.T) {
+		fileServer := filetransfer.NewFileServer(&StubAdapter{})
+		response := deleteTask(fileServer, uuid.NewV4().String())
+		testutil.AssertIntEquals(t, response.Code, http.StatusBadRequest)
+	})
+
+	t.Run("finished task", func(t *testing.T) {
+		taskId := uuid.NewV4().String()
+		adapter := &StubAdapter{}
+		adapter.SaveTaskStatus(taskId, filetransfer.TaskStatus{TaskId: taskId, State: filetransfer.TaskStateSucceeded})
+		response := deleteTask(filetransfer.NewFileServer(adapter), taskId)
+		testutil.AssertIntEquals(t, response.Code, http.StatusConflict)
+		testutil.AssertStringEqual(t, extractErrorBody(t, response).Error.Code, filetransfer.ErrorCodeTaskFinished)
+	})
+
+	t.Run("pending upload removes committed part", func(t *testing.T) {
+		taskId := uuid.NewV4().String()
+		adapter := &StubAdapter{uploadTaskId: taskId, filename: filepath.Join(t.TempDir(), "cancel.txt")}
+		fileServer := filetransfer.NewFileServer(adapter)
+		request := newPostRequestReader(fmt.Sprintf("%s?taskId=%s", uploadUrl, taskId), strings.NewReader("01234"))
+		request.Header.Set("Content-Range", "bytes 0-4/10")
+		fileServer.ServeHTTP(httptest.NewRecorder(), request)
+
+		response := deleteTask(fileServer, taskId)
+		testutil.AssertIntEquals(t, response.Code, http.StatusNoContent)
+		_, err := os.Stat(adapter.filename)
+		testutil.AssertTrue(t, os.IsNotExist(err))
+		testutil.AssertFalse(t, adapter.IsUploadTaskExist(taskId))
+		testutil.AssertStringEqual(t, queryTaskStatus(t, fileServer, taskId).State, filetransfer.TaskStateCanceled)
+	})
+
+	t.Run("pending upload removes temp file", func(t *testing.T) {
+		server := testutil.StartSshServer(t, testutil.NewPasswordServerConfig(t, "test", "pwd"))
+		resource := filetransfer.Resource{Address: server.Address, Port: server.Port,
+			Account: filetransfer.Account{Name: "test", Password: "pwd"}}
+		adapter := filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStore())
+		fileServer := filetransfer.NewFileServer(adapter)
+		dir := t.TempDir()
+		existing := filepath.Join(dir, "keep.txt")
+		_ = os.WriteFile(existing, []byte("old"), 0644)
+		taskId := filetransfer.NewTaskId()
+		adapter.SaveUploadData(taskId, filetransfer.UploadData{Resource: resource, Path: dir, Filename: "keep.txt"})
+		request := newPostRequestReader(fmt.Sprintf("%s?taskId=%s", uploadUrl, taskId), strings.NewReader("01234"))
+		request.Header.Set("Content-Range", "bytes 0-4/10")
+		fileServer.ServeHTTP(httptest.NewRecorder(), request)
+
+		testutil.AssertIntEquals(t, deleteTask(fileServer, taskId).Code, http.StatusNoContent)
+		// 只删除临时文件，已存在的目标文件保持不变
+		entries, _ := os.ReadDir(dir)
+		testutil.AssertIntEquals(t, len(entries), 1)
+		got, _ := os.ReadFile(existing)
+		testutil.AssertStringEqual(t, string(got), "old")
+	})
+
+	t.Run("pending download", func(t *testing.T) {
+		taskId := uuid.NewV4().String()
+		adapter := &StubAdapter{}
+		adapter.SaveDownloadData(taskId, filetransfer.DownloadData{Path: createRandomFilename("cancel", ".txt")})
+		adapter.SaveTaskStatus(taskId, filetransfer.TaskStatus{TaskId: taskId, Type: filetransfer.TaskTypeDownload,
+			State: filetransfer.TaskStatePending, Total: -1})
+		fileServer := filetransfer.NewFileServer(adapter)
+		testutil.AssertIntEquals(t, deleteTask(fileServer, taskId).Code, http.StatusNoContent)
+
+		response := httptest.NewRecorder()
+		fileServer.ServeHTTP(response, newGetRequest(fmt.Sprintf("%s?taskId=%s", downloadUrl, taskId)))
+		testutil.AssertIntEquals(t, response.Code, http.StatusBadRequest)
+		testutil.AssertStringEqual(t, extractErrorBody(t, response).Error.Code, filetransfer.ErrorCodeTaskCanceled)
+	})
+
+	t.Run("running upload rolls back", func(t *testing.T) {
+		taskId := uuid.NewV4().String()
+		adapter := &StubAdapter{uploadTaskId: taskId, filename: filepath.Join(t.TempDir(), "running.txt")}
+		adapter.SaveTaskStatus(taskId, filetransfer.TaskStatus{TaskId: taskId, Type: filetransfer.TaskTypeUpload,
+			State: filetransfer.TaskStatePending, Total: -1})
+		fileServer := filetransfer.NewFileServer(adapter)
+		server := httptest.NewServer(fileServer)
+		defer server.Close()
+
+		bodyReader, bodyWriter := io.Pipe()
+		defer bodyWriter.Close()
+		responses := make(chan *http.Response, 1)
+		go func() {
+			response, err := http.Post(fmt.Sprintf("%s%s?taskId=%s", server.URL, uploadUrl, taskId), "", bodyReader)
+			if err != nil {
+				t.Errorf("problem upload: %v", err)
+			}
+			responses <- response
+		}()
+		go func() {
+			for {
+				if _, err := bodyWriter.Write([]byte("chunk")); err != nil {
+					return
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+		}()
+		waitTaskState(t, fileServer, taskId, filetransfer.TaskStateRunning)
+		testutil.AssertIntEquals(t, deleteTask(fileServer, taskId).Code, http.StatusAccepted)
+
+		select {
+		case response := <-responses:
+			testutil.AssertIntEquals(t, response.StatusCode, http.StatusBadRequest)
+			var errorBody filetransfer.ErrorBody
+			_ = json.NewDecoder(response.Body).Decode(&errorBody)
+			_ = response.Body.Close()
+			testutil.AssertStringEqual(t, errorBody.Error.Code, filetransfer.ErrorCodeTaskCanceled)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("upload not canceled")
+		}
+		_, err := os.Stat(adapter.filename)
+		testutil.AssertTrue(t, os.IsNotExist(err))
+		testutil.AssertStringEqual(t, queryTaskStatus(t, fileServer, taskId).State, filetransfer.TaskStateCanceled)
+	})
+}
+
+func TestTransferTimeout(t *testing.T) {
+	newTimeoutServer := func(config filetransfer.TransferConfig, timeout filetransfer.TransferOptions) (*StubAdapter, http.Handler, string) {
+		taskId := uuid.NewV4().String()
+		adapter := &StubAdapter{filename: filepath.Join(t.TempDir(), "timeout.txt")}
+		adapter.SaveUploadData(taskId, filetransfer.UploadData{TransferOptions: timeout})
+		return adapter, filetransfer.NewFileServerWithConfig(adapter, config), taskId
+	}
+
+	t.Run("task idle timeout", func(t *testing.T) {
+		adapter, fileServer, taskId := newTimeoutServer(filetransfer.TransferConfig{IdleTimeout: 60},
+			filetransfer.TransferOptions{IdleTimeout: 1})
+		bodyWriter, responses := postStalledUpload(t, fileServer, taskId)
+		defer bodyWriter.Close()
+		_, _ = bodyWriter.Write([]byte("chunk"))
+
+		assertTimeoutResponse(t, responses)
+		testutil.AssertIntEquals(t, int(adapter.GetUploadOffset(taskId)), len("chunk"))
+		status := queryTaskStatus(t, fileServer, taskId)
+		testutil.AssertStringEqual(t, status.State, filetransfer.TaskStateFailed)
+		testutil.AssertTrue(t, strings.Contains(status.Error, transferframe.IdleTimeoutErr.Error()))
+	})
+
+	t.Run("config deadline", func(t *testing.T) {
+		_, fileServer, taskId := newTimeoutServer(filetransfer.TransferConfig{Timeout: 1}, filetransfer.TransferOptions{})
+		bodyWriter, responses := postStalledUpload(t, fileServer, taskId)
+		defer bodyWriter.Close()
+		go func() {
+			for {
+				if _, err := bodyWriter.Write([]byte("chunk")); err != nil {
+					return
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+		}()
+
+		assertTimeoutResponse(t, responses)
+		status := queryTaskStatus(t, fileServer, taskId)
+		testutil.AssertStringEqual(t, status.State, filetransfer.TaskStateFailed)
+		testutil.AssertTrue(t, strings.Contains(status.Error, transferframe.DeadlineErr.Error()))
+	})
+}
+
+// postStalledUpload 以管道作为请求体上传，写入管道的数据才会被发送
+func postStalledUpload(t *testing.T, fileServer http.Handler, taskId string) (*io.PipeWriter, <-chan *http.Response) {
+	server := httptest.NewServer(fileServer)
+	t.Cleanup(server.Close)
+	bodyReader, bodyWriter := io.Pipe()
+	responses := make(chan *http.Response, 1)
+	go func() {
+		response, err := http.Post(fmt.Sprintf("%s%s?taskId=%s", server.URL, uploadUrl, taskId), "", bodyReader)
+		if err != nil {
+			t.Errorf("problem upload: %v", err)
+		}
+		responses <- response
+	}()
+	return bodyWriter, responses
+}
+
+func assertTimeoutResponse(t *testing.T, responses <-chan *http.Response) {
+	t.Helper()
+	select {
+	case response := <-responses:
+		testutil.AssertIntEquals(t, response.StatusCode, http.StatusBadRequest)
+		var errorBody filetransfer.ErrorBody
+		_ = json.NewDecoder(response.Body).Decode(&errorBody)
+		_ = response.Body.Close()
+		testutil.AssertStringEqual(t, errorBody.Error.Code, "TransferTimeout")
+	case <-time.After(5 * time.Second):
+		t.Fatalf("upload not timed out")
+	}
+}
+
+func deleteTask(fileServer http.Handler, taskId string) *httptest.ResponseRecorder {
+	request, _ := http.NewRequest(http.MethodDelete, taskStatusUrl+taskId, nil)
+	response := httptest.NewRecorder()
+	fileServer.ServeHTTP(response, request)
+	return response
+}
+
+func waitTaskState(t *testing.T, fileServer http.Handler, taskId, state string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for queryTaskStatus(t, fileServer, taskId).State != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("task not %s", state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func extractErrorBody(t *testing.T, response *httptest.ResponseRecorder) filetransfer.ErrorBody {
+	t.Helper()
+	var errorBody filetransfer.ErrorBody
+	if err := json.NewDecoder(response.Body).Decode(&errorBody); err != nil {
+		t.Fatalf("problem decode error body: %v", err)
+	}
+	return errorBody
+}
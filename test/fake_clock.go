@@ -0,0 +1,72 @@
+package testutil
+
+import (
+	"sync"
+	"time"
+)
+
+// FakeClock 实现限速器使用的时钟，只有调用AdvanceToNext时时间才会前进
+type FakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at      time.Time
+	channel chan time.Time
+}
+
+func NewFakeClock() *FakeClock {
+	return &FakeClock{now: time.Unix(0, 0)}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	channel := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), channel: channel})
+	return channel
+}
+
+func (c *FakeClock) WaiterCount() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.waiters)
+}
+
+// AdvanceToNext 时间前进到最早的等待者，并唤醒到期的等待者
+func (c *FakeClock) AdvanceToNext() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.waiters) == 0 {
+		return
+	}
+	next := c.waiters[0].at
+	for _, waiter := range c.waiters {
+		if waiter.at.Before(next) {
+			next = waiter.at
+		}
+	}
+	c.now = next
+	remain := c.waiters[:0]
+	for _, waiter := range c.waiters {
+		if waiter.at.After(next) {
+			remain = append(remain, waiter)
+		} else {
+			waiter.channel <- next
+		}
+	}
+	c.waiters = remain
+}
+
+// Elapsed 从开始到现在经过的时间
+func (c *FakeClock) Elapsed() time.Duration {
+	return c.Now().Sub(time.Unix(0, 0))
+}
@@ -0,0 +1,189 @@
+package testutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// SshServer 进程内的ssh服务器，提供sftp子系统，用于测试
+type SshServer struct {
+	Address  string
+	Port     int
+	HostKey  ssh.Signer
+	listener net.Listener
+	config   *ssh.ServerConfig
+	wg       sync.WaitGroup
+}
+
+// NewPasswordServerConfig 创建只接受指定用户名与密码的服务端配置
+func NewPasswordServerConfig(t *testing.T, name, password string) *ssh.ServerConfig {
+	t.Helper()
+	config := &ssh.ServerConfig{}
+	config.PasswordCallback = func(conn ssh.ConnMetadata, pwd []byte) (*ssh.Permissions, error) {
+		if conn.User() == name && string(pwd) == password {
+			return nil, nil
+		}
+		return nil, ErrAuthFailed
+	}
+	return config
+}
+
+// StartSshServer 使用随机主机密钥在随机端口启动ssh服务器，测试结束时自动关闭
+// config只需设置认证回调
+func StartSshServer(t *testing.T, config *ssh.ServerConfig) *SshServer {
+	t.Helper()
+	hostKey := NewSigner(t)
+	config.AddHostKey(hostKey)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %v", err)
+	}
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+	server := &SshServer{Address: host, Port: portNum, HostKey: hostKey, listener: listener, config: config}
+	server.wg.Add(1)
+	go server.serve()
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Close 关闭服务器并等待监听协程退出
+func (s *SshServer) Close() {
+	_ = s.listener.Close()
+	s.wg.Wait()
+}
+
+func (s *SshServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *SshServer) handleConn(conn net.Conn) {
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	defer serverConn.Close()
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		switch newChannel.ChannelType() {
+		case "session":
+			go handleSession(newChannel)
+		case "direct-tcpip":
+			go handleDirectTcpip(newChannel)
+		default:
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+func handleSession(newChannel ssh.NewChannel) {
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	for request := range requests {
+		isSftp := request.Type == "subsystem" && len(request.Payload) > 4 && string(request.Payload[4:]) == "sftp"
+		_ = request.Reply(isSftp, nil)
+		if !isSftp {
+			continue
+		}
+		go ssh.DiscardRequests(requests)
+		server, err := sftp.NewServer(channel)
+		if err != nil {
+			return
+		}
+		if err = server.Serve(); err != nil && err != io.EOF {
+			return
+		}
+		_ = server.Close()
+		return
+	}
+}
+
+var ErrAuthFailed = errors.New("auth failed")
+
+// directTcpipPayload 转发请求的目标与来源，格式见RFC 4254第7.2节
+type directTcpipPayload struct {
+	Host       string
+	Port       uint32
+	OriginHost string
+	OriginPort uint32
+}
+
+// handleDirectTcpip 将通道转发到请求的地址，使服务器可以作为跳板机
+func handleDirectTcpip(newChannel ssh.NewChannel) {
+	var payload directTcpipPayload
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, "invalid payload")
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+	if err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	go func() {
+		_, _ = io.Copy(conn, channel)
+		_ = conn.Close()
+	}()
+	_, _ = io.Copy(channel, conn)
+	_ = channel.Close()
+}
+
+// NewSigner 创建随机的ecdsa签名器
+func NewSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	signer, err := ssh.ParsePrivateKey([]byte(NewPrivateKeyPEM(t, "")))
+	if err != nil {
+		t.Fatalf("could not create signer: %v", err)
+	}
+	return signer
+}
+
+// NewPrivateKeyPEM 创建PEM格式的ecdsa私钥，passphrase不为空时加密私钥
+func NewPrivateKeyPEM(t *testing.T, passphrase string) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate key: %v", err)
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("could not marshal key: %v", err)
+	}
+	block := &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	if passphrase != "" {
+		// ssh仍支持解析旧式加密的PEM私钥
+		block, err = x509.EncryptPEMBlock(rand.Reader, block.Type, der, []byte(passphrase), x509.PEMCipherAES256)
+		if err != nil {
+			t.Fatalf("could not encrypt key: %v", err)
+		}
+	}
+	return string(pem.EncodeToMemory(block))
+}
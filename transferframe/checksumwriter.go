@@ -0,0 +1,85 @@
+package transferframe
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"hash"
+)
+
+const (
+	ChecksumMD5    = "md5"
+	ChecksumSHA1   = "sha1"
+	ChecksumSHA256 = "sha256"
+)
+
+var UnsupportedAlgorithm = errors.New("unsupported checksum algorithm")
+
+// ChecksumWriter 在传输过程中计算数据的摘要
+type ChecksumWriter struct {
+	algorithm string
+	hash      hash.Hash
+}
+
+// NewChecksumWriter 创建摘要计算器，algorithm可选md5、sha1、sha256
+func NewChecksumWriter(algorithm string) (*ChecksumWriter, error) {
+	newHash := getHashFunc(algorithm)
+	if newHash == nil {
+		return nil, UnsupportedAlgorithm
+	}
+	return &ChecksumWriter{algorithm: algorithm, hash: newHash()}, nil
+}
+
+// IsChecksumAlgorithmValid 判断是否支持该摘要算法
+func IsChecksumAlgorithmValid(algorithm string) bool {
+	return getHashFunc(algorithm) != nil
+}
+
+// ChecksumSize 摘要的字节数，不支持的算法返回0
+func ChecksumSize(algorithm string) int {
+	newHash := getHashFunc(algorithm)
+	if newHash == nil {
+		return 0
+	}
+	return newHash().Size()
+}
+
+func getHashFunc(algorithm string) func() hash.Hash {
+	switch algorithm {
+	case ChecksumMD5:
+		return md5.New
+	case ChecksumSHA1:
+		return sha1.New
+	case ChecksumSHA256:
+		return sha256.New
+	}
+	return nil
+}
+
+func (c *ChecksumWriter) BeforeTransfer() error {
+	return nil
+}
+
+func (c *ChecksumWriter) Write(bytes []byte) error {
+	_, err := c.hash.Write(bytes)
+	return err
+}
+
+func (c *ChecksumWriter) AfterTransfer() {
+	// Do nothing
+}
+
+func (c *ChecksumWriter) ErrorTransfer(error) {
+	// Do nothing
+}
+
+// Algorithm 摘要算法
+func (c *ChecksumWriter) Algorithm() string {
+	return c.algorithm
+}
+
+// Sum 已传输数据的摘要，可以在传输结束后调用
+func (c *ChecksumWriter) Sum() []byte {
+	return c.hash.Sum(nil)
+}
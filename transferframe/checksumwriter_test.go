@@ -0,0 +1,40 @@
+package transferframe_test
+
+import (
+	"encoding/hex"
+	"strings"
+	testutil "summersea.top/filetransfer/test"
+	"summersea.top/filetransfer/transferframe"
+	"testing"
+)
+
+func TestNewChecksumWriter(t *testing.T) {
+	_, err := transferframe.NewChecksumWriter("crc32")
+	testutil.AssertErrEquals(t, err, transferframe.UnsupportedAlgorithm)
+	testutil.AssertFalse(t, transferframe.IsChecksumAlgorithmValid(""))
+	testutil.AssertIntEquals(t, transferframe.ChecksumSize("crc32"), 0)
+	testutil.AssertIntEquals(t, transferframe.ChecksumSize(transferframe.ChecksumSHA256), 32)
+}
+
+func TestChecksumWriter(t *testing.T) {
+	input := strings.Repeat("a", 3000)
+	testCases := []struct {
+		algorithm string
+		want      string
+	}{
+		{transferframe.ChecksumMD5, "6ca003d00c9bb4569a4a27d751db7a89"},
+		{transferframe.ChecksumSHA1, "00dc3a91d5ec3983f907020d265e10bb036a1ba2"},
+		{transferframe.ChecksumSHA256, "556ac82f23f64d2f41b3fb3b9a171791364021aa95c0af6df9e2b5e1d88c8038"},
+	}
+	for _, test := range testCases {
+		t.Run(test.algorithm, func(t *testing.T) {
+			writer, err := transferframe.NewChecksumWriter(test.algorithm)
+			testutil.AssertNil(t, err)
+			manager, _ := transferframe.NewTransferManager(strings.NewReader(input))
+			_ = manager.AddWriter(writer)
+			testutil.AssertNil(t, manager.StartTransfer())
+			testutil.AssertStringEqual(t, writer.Algorithm(), test.algorithm)
+			testutil.AssertStringEqual(t, hex.EncodeToString(writer.Sum()), test.want)
+		})
+	}
+}
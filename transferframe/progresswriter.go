@@ -0,0 +1,50 @@
+package transferframe
+
+import (
+	"time"
+)
+
+// ProgressReporter 上报已传输的字节数
+type ProgressReporter func(transferred int64)
+
+// ProgressWriter 统计已传输的字节数，每隔interval上报一次进度，传输结束时一定会上报最终进度
+type ProgressWriter struct {
+	report      ProgressReporter
+	interval    time.Duration
+	transferred int64
+	lastReport  time.Time
+}
+
+func NewProgressWriter(interval time.Duration, report ProgressReporter) (*ProgressWriter, error) {
+	if report == nil {
+		return nil, NilParamErr
+	}
+	return &ProgressWriter{report: report, interval: interval}, nil
+}
+
+func (p *ProgressWriter) BeforeTransfer() error {
+	p.lastReport = time.Now()
+	return nil
+}
+
+func (p *ProgressWriter) Write(bytes []byte) error {
+	p.transferred += int64(len(bytes))
+	if now := time.Now(); now.Sub(p.lastReport) >= p.interval {
+		p.lastReport = now
+		p.report(p.transferred)
+	}
+	return nil
+}
+
+func (p *ProgressWriter) AfterTransfer() {
+	p.report(p.transferred)
+}
+
+func (p *ProgressWriter) ErrorTransfer(error) {
+	p.report(p.transferred)
+}
+
+// Transferred 已传输的字节数
+func (p *ProgressWriter) Transferred() int64 {
+	return p.transferred
+}
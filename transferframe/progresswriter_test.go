@@ -0,0 +1,52 @@
+package transferframe_test
+
+import (
+	"strings"
+	testutil "summersea.top/filetransfer/test"
+	"summersea.top/filetransfer/transferframe"
+	"testing"
+	"time"
+)
+
+func TestNewProgressWriter(t *testing.T) {
+	_, err := transferframe.NewProgressWriter(time.Second, nil)
+	testutil.AssertErrEquals(t, err, transferframe.NilParamErr)
+}
+
+func TestProgressWriter(t *testing.T) {
+	input := strings.Repeat("a", 3000)
+
+	t.Run("report every write", func(t *testing.T) {
+		var reports []int64
+		writer, _ := transferframe.NewProgressWriter(0, func(transferred int64) {
+			reports = append(reports, transferred)
+		})
+		manager, _ := transferframe.NewTransferManager(strings.NewReader(input))
+		_ = manager.AddWriter(writer)
+		testutil.AssertNil(t, manager.StartTransfer())
+		testutil.AssertStructEquals(t, reports, []int64{1024, 2048, 3000, 3000})
+		testutil.AssertTrue(t, writer.Transferred() == 3000)
+	})
+
+	t.Run("report final progress only", func(t *testing.T) {
+		var reports []int64
+		writer, _ := transferframe.NewProgressWriter(time.Hour, func(transferred int64) {
+			reports = append(reports, transferred)
+		})
+		manager, _ := transferframe.NewTransferManager(strings.NewReader(input))
+		_ = manager.AddWriter(writer)
+		testutil.AssertNil(t, manager.StartTransfer())
+		testutil.AssertStructEquals(t, reports, []int64{3000})
+	})
+
+	t.Run("report on read error", func(t *testing.T) {
+		var reports []int64
+		writer, _ := transferframe.NewProgressWriter(time.Hour, func(transferred int64) {
+			reports = append(reports, transferred)
+		})
+		manager, _ := transferframe.NewTransferManager(StubReader{})
+		_ = manager.AddWriter(writer)
+		testutil.AssertNotNil(t, manager.StartTransfer())
+		testutil.AssertStructEquals(t, reports, []int64{0})
+	})
+}
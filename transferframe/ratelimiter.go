@@ -0,0 +1,100 @@
+package transferframe
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Clock 限速器使用的时钟，测试时可以替换
+type Clock interface {
+	Now() time.Time
+	// After 经过d后向返回的channel发送当前时间
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// RateLimiter 令牌桶限速器，每个字节消耗一个令牌，可以在多个传输之间共享
+// 等待的传输按预约令牌的顺序获得令牌，并发的传输平分带宽
+type RateLimiter struct {
+	mutex  sync.Mutex
+	clock  Clock
+	rate   float64
+	burst  int64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter 创建每秒rate字节的限速器，桶容量为DefaultBurst(rate)
+func NewRateLimiter(rate int64) (*RateLimiter, error) {
+	return NewRateLimiterWithClock(rate, DefaultBurst(rate), systemClock{})
+}
+
+// DefaultBurst 每秒rate字节的限速器默认的桶容量，为rate的十分之一
+func DefaultBurst(rate int64) int64 {
+	burst := rate / 10
+	if burst < 1 {
+		burst = 1
+	}
+	return burst
+}
+
+// NewRateLimiterWithClock 创建每秒rate字节、桶容量为burst的限速器，桶初始是满的
+func NewRateLimiterWithClock(rate, burst int64, clock Clock) (*RateLimiter, error) {
+	if rate <= 0 || burst <= 0 {
+		return nil, errors.New("rate and burst must be positive")
+	}
+	if clock == nil {
+		return nil, NilParamErr
+	}
+	return &RateLimiter{clock: clock, rate: float64(rate), burst: burst, tokens: float64(burst), last: clock.Now()}, nil
+}
+
+// WaitN 等待n个令牌，超过桶容量时分多次等待
+// error ctx结束时返回ctx.Err()，已预约的令牌不会归还
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	for remain := int64(n); remain > 0; {
+		take := remain
+		if take > l.burst {
+			take = l.burst
+		}
+		if wait := l.reserve(take); wait > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-l.clock.After(wait):
+			}
+		}
+		remain -= take
+	}
+	return nil
+}
+
+// reserve 预约n个令牌，返回令牌可用前需要等待的时间
+func (l *RateLimiter) reserve(n int64) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := l.clock.Now()
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens += elapsed.Seconds() * l.rate
+		if l.tokens > float64(l.burst) {
+			l.tokens = float64(l.burst)
+		}
+		l.last = now
+	}
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
@@ -0,0 +1,131 @@
+package transferframe_test
+
+import (
+	"context"
+	"io"
+	"strings"
+	testutil "summersea.top/filetransfer/test"
+	"summersea.top/filetransfer/transferframe"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// runTransfers 并发执行传输，所有未结束的传输都在等待时推进时间，返回每个传输结束时经过的时间
+func runTransfers(t *testing.T, clock *testutil.FakeClock, managers ...*transferframe.TransferManager) []time.Duration {
+	t.Helper()
+	finished := make([]time.Duration, len(managers))
+	var running int32 = int32(len(managers))
+	for i, manager := range managers {
+		go func(i int, manager *transferframe.TransferManager) {
+			if err := manager.StartTransfer(); err != nil {
+				t.Errorf("problem transfer: %v", err)
+			}
+			finished[i] = clock.Elapsed()
+			atomic.AddInt32(&running, -1)
+		}(i, manager)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for atomic.LoadInt32(&running) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("transfers not finished")
+		}
+		if clock.WaiterCount() == int(atomic.LoadInt32(&running)) {
+			clock.AdvanceToNext()
+		} else {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	return finished
+}
+
+func newLimitedManager(reader io.Reader, writer io.Writer, limiters ...*transferframe.RateLimiter) *transferframe.TransferManager {
+	manager, _ := transferframe.NewTransferManager(reader)
+	basicWriter, _ := transferframe.NewBasicWriter(writer)
+	_ = manager.AddWriter(basicWriter)
+	for _, limiter := range limiters {
+		_ = manager.AddRateLimiter(limiter)
+	}
+	return manager
+}
+
+func TestNewRateLimiter(t *testing.T) {
+	_, err := transferframe.NewRateLimiter(0)
+	testutil.AssertNotNil(t, err)
+	_, err = transferframe.NewRateLimiterWithClock(1000, 100, nil)
+	testutil.AssertErrEquals(t, err, transferframe.NilParamErr)
+	manager, _ := transferframe.NewTransferManager(strings.NewReader(""))
+	testutil.AssertErrEquals(t, manager.AddRateLimiter(nil), transferframe.NilParamErr)
+}
+
+func TestRateLimiter(t *testing.T) {
+	t.Run("throughput", func(t *testing.T) {
+		clock := testutil.NewFakeClock()
+		limiter, _ := transferframe.NewRateLimiterWithClock(1000, 1000, clock)
+		output := &strings.Builder{}
+		manager := newLimitedManager(strings.NewReader(strings.Repeat("a", 10000)), output, limiter)
+
+		finished := runTransfers(t, clock, manager)
+		testutil.AssertIntEquals(t, output.Len(), 10000)
+		// 桶初始是满的，剩余9000字节需要9秒
+		assertDurationNear(t, finished[0], 9*time.Second, time.Millisecond)
+	})
+
+	t.Run("shared fairly", func(t *testing.T) {
+		clock := testutil.NewFakeClock()
+		limiter, _ := transferframe.NewRateLimiterWithClock(1024, 1024, clock)
+		outputs := []*strings.Builder{{}, {}}
+		managers := []*transferframe.TransferManager{
+			newLimitedManager(strings.NewReader(strings.Repeat("a", 10240)), outputs[0], limiter),
+			newLimitedManager(strings.NewReader(strings.Repeat("b", 10240)), outputs[1], limiter),
+		}
+
+		finished := runTransfers(t, clock, managers...)
+		testutil.AssertIntEquals(t, outputs[0].Len(), 10240)
+		testutil.AssertIntEquals(t, outputs[1].Len(), 10240)
+		// 共20480字节，除去初始的1024字节需要19秒
+		// 两个传输交替获得令牌，先开始的传输最多领先两块，不公平时先结束的传输只需要约9秒
+		last := finished[0]
+		if finished[1] > last {
+			last = finished[1]
+		}
+		assertDurationNear(t, last, 19*time.Second, time.Millisecond)
+		assertDurationNear(t, finished[0], finished[1], 2*time.Second)
+	})
+
+	t.Run("strictest limiter wins", func(t *testing.T) {
+		clock := testutil.NewFakeClock()
+		taskLimiter, _ := transferframe.NewRateLimiterWithClock(500, 500, clock)
+		globalLimiter, _ := transferframe.NewRateLimiterWithClock(1000, 1000, clock)
+		manager := newLimitedManager(strings.NewReader(strings.Repeat("a", 5000)), io.Discard, taskLimiter, globalLimiter)
+
+		finished := runTransfers(t, clock, manager)
+		assertDurationNear(t, finished[0], 9*time.Second, time.Millisecond)
+	})
+
+	t.Run("canceled while waiting", func(t *testing.T) {
+		clock := testutil.NewFakeClock()
+		limiter, _ := transferframe.NewRateLimiterWithClock(1, 1, clock)
+		manager := newLimitedManager(strings.NewReader(strings.Repeat("a", 100)), io.Discard, limiter)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- manager.StartTransferContext(ctx) }()
+		for clock.WaiterCount() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+		select {
+		case err := <-done:
+			testutil.AssertErrEquals(t, err, transferframe.CancelErr)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("transfer not canceled")
+		}
+	})
+}
+
+func assertDurationNear(t *testing.T, got, want, tolerance time.Duration) {
+	t.Helper()
+	if got < want-tolerance || got > want+tolerance {
+		t.Errorf("want %v but got %v", want, got)
+	}
+}
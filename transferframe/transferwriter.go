@@ -1,19 +1,32 @@
 package transferframe
 
 import (
+	"context"
 	"errors"
 	"io"
 	"log"
+	"sync"
+	"time"
 )
 
 var ReaderErr = errors.New("reader error")
 
+// CancelErr 传输被取消时传给ErrorTransfer并由StartTransferContext返回
+var CancelErr = errors.New("transfer canceled")
+
+// DeadlineErr 超过ctx的截止时间
+var DeadlineErr = errors.New("transfer deadline exceeded")
+
+// IdleTimeoutErr 超过空闲时间没有读到数据
+var IdleTimeoutErr = errors.New("transfer idle timeout")
+
 const bufferSize = 1024
 
 type TransferWriter interface {
 	// BeforeTransfer 传输之前调用，若出现异常则踢出传输链，并立即调用ErrorTransfer
 	BeforeTransfer() error
 	// Write 每次从io.Reader中读取部分字节后，会调用传输链上的每一个Writer的Write([]byte)方法，传输过程。
+	// 底层连接关闭时Write必须返回，传输停止时不会一直等待阻塞在Write中的输出端
 	Write([]byte) error
 	// AfterTransfer 若传输全程不出现问题，则会调用此方法以结束传输，可以不实现
 	AfterTransfer()
@@ -53,9 +66,61 @@ func (b *BasicWriter) ErrorTransfer(err error) {
 	log.Printf("problem transfer: %v", err)
 }
 
+// WriterPolicy 输出端跟不上读取速度、队列已满时的处理方式
+type WriterPolicy int
+
+const (
+	// PolicyBlock 等待该输出端，读取随之变慢
+	PolicyBlock WriterPolicy = iota
+	// PolicyDrop 踢出该输出端并传入LaggingWriterErr，其它输出端继续传输
+	PolicyDrop
+	// PolicyFail 整个传输失败并返回LaggingWriterErr
+	PolicyFail
+)
+
+// LaggingWriterErr 输出端的队列已满
+var LaggingWriterErr = errors.New("transfer writer falls behind")
+
+// WriterError 必需的输出端写入失败，Err为写入时的错误
+type WriterError struct {
+	Err error
+}
+
+func (e *WriterError) Error() string {
+	return "transfer writer failed: " + e.Err.Error()
+}
+
+func (e *WriterError) Unwrap() error {
+	return e.Err
+}
+
+// DefaultBufferSize 默认每次读取的字节数
+const DefaultBufferSize = bufferSize
+
+// defaultQueueSize 默认每个输出端最多排队的块数
+const defaultQueueSize = 16
+
+// abortWaitTimeout 中止传输时等待输出端结束的最长时间
+const abortWaitTimeout = time.Second
+
+// WriterOptions 输出端的选项
+type WriterOptions struct {
+	Policy WriterPolicy
+	// QueueSize 最多排队的块数，为0时使用默认值
+	QueueSize int
+	// Required 为true时该输出端写入失败会停止整个传输，否则只踢出该输出端
+	Required bool
+}
+
 type TransferManager struct {
-	reader  io.Reader
-	writers []TransferWriter
+	reader       io.Reader
+	writers      []*writerWorker
+	idleTimeout  time.Duration
+	rateLimiters []*RateLimiter
+	bufferSize   int
+	pool         sync.Pool
+	// failed 必需的输出端写入失败时收到该输出端的错误
+	failed chan error
 }
 
 // NewTransferManager 创建传输管理器
@@ -65,91 +130,286 @@ func NewTransferManager(reader io.Reader) (*TransferManager, error) {
 	if reader == nil {
 		return nil, errors.New("got nil reader")
 	} else {
-		manager := &TransferManager{reader: reader, writers: []TransferWriter{}}
+		manager := &TransferManager{reader: reader, writers: []*writerWorker{}, bufferSize: DefaultBufferSize}
 		return manager, nil
 	}
 }
 
-// AddWriter 添加传输输入端
+// AddWriter 添加传输输入端，队列已满时等待该输出端
 // error 传入参数为nil时会抛出异常
 func (t *TransferManager) AddWriter(writer TransferWriter) error {
+	return t.AddWriterWithOptions(writer, WriterOptions{})
+}
+
+// AddWriterWithOptions 按options添加传输输出端，每个输出端在单独的协程中写入
+// error 传入参数为nil时会抛出异常
+func (t *TransferManager) AddWriterWithOptions(writer TransferWriter, options WriterOptions) error {
 	if writer == nil {
 		return errors.New("got nil writer")
-	} else {
-		t.writers = append(t.writers, writer)
-		return nil
 	}
+	if options.QueueSize <= 0 {
+		options.QueueSize = defaultQueueSize
+	}
+	t.writers = append(t.writers, &writerWorker{writer: writer, policy: options.Policy, queueSize: options.QueueSize,
+		required: options.Required})
+	return nil
+}
+
+// SetIdleTimeout 超过timeout没有读到数据或输出端一直不接收数据时传输失败，为0时不限制
+func (t *TransferManager) SetIdleTimeout(timeout time.Duration) {
+	t.idleTimeout = timeout
+}
+
+// SetBufferSize 设置每次读取的字节数，较大的值可以减少大文件传输的开销
+// error size不是正数时返回异常
+func (t *TransferManager) SetBufferSize(size int) error {
+	if size <= 0 {
+		return errors.New("buffer size must be positive")
+	}
+	t.bufferSize = size
+	return nil
+}
+
+// AddRateLimiter 添加限速器，每次分发给输出端之前等待所有限速器的令牌
+// error 传入参数为nil时会抛出异常
+func (t *TransferManager) AddRateLimiter(limiter *RateLimiter) error {
+	if limiter == nil {
+		return NilParamErr
+	}
+	t.rateLimiters = append(t.rateLimiters, limiter)
+	return nil
 }
 
 // StartTransfer 开始传输
 // 如果没有输出端，也会读完输入端
 // error 输入端出现异常时返回该异常，在此之前会调用所有输出端的异常结束方法，并传入ReadErr
 func (t *TransferManager) StartTransfer() error {
+	return t.StartTransferContext(context.Background())
+}
+
+// StartTransferContext 开始传输，ctx取消、超过ctx的截止时间或空闲超时后停止传输
+// 读取与每个输出端的写入都在单独的协程中进行，慢的输出端按各自的WriterPolicy处理，不会拖慢其它输出端
+// 正常结束时所有输出端结束后才返回，阻塞的读取不会妨碍传输停止，停止后读取协程在读取返回时退出
+// 中止传输时最多等待abortWaitTimeout，仍阻塞在Write中的输出端由调用方关闭底层连接，Write返回后再调用ErrorTransfer
+// error ctx取消时返回CancelErr，超过截止时间返回DeadlineErr，空闲超时返回IdleTimeoutErr，
+// 输出端跟不上且策略为PolicyFail时返回LaggingWriterErr，必需的输出端写入失败时返回*WriterError，
+// 返回之前会调用所有输出端的异常结束方法并传入同一个error
+func (t *TransferManager) StartTransferContext(ctx context.Context) error {
 	t.callBeforeFunc()
-	err := t.doTransfer()
-	if err != nil {
-		t.callReadErr()
-		return err
+	t.pool.New = func() interface{} { return make([]byte, t.bufferSize) }
+	t.failed = make(chan error, 1)
+	for _, worker := range t.writers {
+		worker.start(t.failed)
 	}
-	t.callAfterFunc()
-	return nil
+	err := t.doTransfer(ctx)
+	switch {
+	case err == nil:
+		t.stopWorkers(nil, false)
+		// 读入端结束后必需的输出端才写入失败时，其余输出端已经正常结束
+		select {
+		case failedErr := <-t.failed:
+			err = &WriterError{Err: failedErr}
+		default:
+		}
+	case isWriterError(err):
+		t.stopWorkers(err, true)
+	case err == CancelErr || err == DeadlineErr || err == LaggingWriterErr || err == IdleTimeoutErr:
+		// 已排队的数据不再写入
+		t.stopWorkers(err, true)
+	default:
+		t.stopWorkers(ReaderErr, false)
+	}
+	return err
 }
 
-// doTransfer 执行传输过程
-// error 当出现读入端错误时会返回该错误，该方法不会在读入错误时调用ErrorTransfer方法
-func (t *TransferManager) doTransfer() error {
-	buf := make([]byte, bufferSize)
-	reader := t.reader
-	writers := t.writers
+type readResult struct {
+	buf []byte
+	n   int
+	err error
+}
+
+// doTransfer 执行传输过程，将读到的数据分发给每个输出端
+// error 当出现读入端错误时会返回该错误，传输被停止时返回对应的错误，该方法不会调用ErrorTransfer方法
+func (t *TransferManager) doTransfer(ctx context.Context) error {
+	results := make(chan readResult)
+	stop := make(chan struct{})
+	defer close(stop)
+	go t.readLoop(results, stop)
+
+	var idle <-chan time.Time
+	var idleTimer *time.Timer
+	if t.idleTimeout > 0 {
+		idleTimer = time.NewTimer(t.idleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
 	for {
-		readLen, err := reader.Read(buf)
-		if readLen > 0 {
-			i := 0
-			for _, writer := range writers {
-				writeErr := writer.Write(buf[:readLen])
-				if writeErr != nil {
-					writer.ErrorTransfer(writeErr)
-				} else {
-					writers[i] = writer
-					i++
-				}
+		if err := contextErr(ctx); err != nil {
+			return err
+		}
+		var result readResult
+		select {
+		case <-ctx.Done():
+			return contextErr(ctx)
+		case <-idle:
+			return IdleTimeoutErr
+		case err := <-t.failed:
+			return &WriterError{Err: err}
+		case result = <-results:
+		}
+		if result.n > 0 {
+			if err := t.waitRateLimiters(ctx, result.n); err != nil {
+				t.pool.Put(result.buf)
+				return err
+			}
+			if err := t.dispatch(ctx, idle, newChunk(result.buf[:result.n], &t.pool)); err != nil {
+				return err
 			}
-			if i != len(writers) {
-				writers = writers[:i]
+			if idleTimer != nil {
+				resetTimer(idleTimer, t.idleTimeout)
 			}
+		} else {
+			t.pool.Put(result.buf)
 		}
-		if err == io.EOF {
-			t.writers = writers
+		if result.err == io.EOF {
 			return nil
-		} else if err != nil {
-			return err
+		} else if result.err != nil {
+			return result.err
 		}
 	}
 }
 
-func (t *TransferManager) callReadErr() {
-	for _, writer := range t.writers {
-		writer.ErrorTransfer(ReaderErr)
+// readLoop 依次读取输入端，stop关闭后退出
+func (t *TransferManager) readLoop(results chan<- readResult, stop <-chan struct{}) {
+	for {
+		buf := t.pool.Get().([]byte)
+		n, err := t.reader.Read(buf)
+		select {
+		case results <- readResult{buf: buf, n: n, err: err}:
+		case <-stop:
+			return
+		}
+		if err != nil {
+			return
+		}
 	}
 }
 
+// dispatch 将一块数据放入每个输出端的队列，队列已满时按输出端的策略处理
+// 等待输出端时idle到期返回IdleTimeoutErr
+func (t *TransferManager) dispatch(ctx context.Context, idle <-chan time.Time, data *chunk) error {
+	data.refs = int32(len(t.writers)) + 1
+	defer data.release()
+	for _, worker := range t.writers {
+		if worker.stopped {
+			data.release()
+			continue
+		}
+		select {
+		case worker.queue <- data:
+			continue
+		case <-worker.done:
+			data.release()
+			continue
+		default:
+		}
+		switch worker.policy {
+		case PolicyDrop:
+			data.release()
+			worker.stop(LaggingWriterErr, true)
+		case PolicyFail:
+			data.release()
+			return LaggingWriterErr
+		default:
+			select {
+			case worker.queue <- data:
+			case <-worker.done:
+				data.release()
+			case <-ctx.Done():
+				data.release()
+				return contextErr(ctx)
+			case <-idle:
+				data.release()
+				return IdleTimeoutErr
+			}
+		}
+	}
+	return nil
+}
+
+func isWriterError(err error) bool {
+	_, ok := err.(*WriterError)
+	return ok
+}
+
+// stopWorkers 停止所有输出端并等待结束，abort为true时不再写入已排队的数据，且最多等待abortWaitTimeout
+// err为nil时输出端写完后调用AfterTransfer，否则调用ErrorTransfer
+func (t *TransferManager) stopWorkers(err error, abort bool) {
+	for _, worker := range t.writers {
+		if !worker.stopped {
+			worker.stop(err, abort)
+		}
+	}
+	if !abort {
+		for _, worker := range t.writers {
+			<-worker.done
+		}
+		return
+	}
+	timer := time.NewTimer(abortWaitTimeout)
+	defer timer.Stop()
+	for _, worker := range t.writers {
+		select {
+		case <-worker.done:
+		case <-timer.C:
+			log.Printf("problem stop transfer: writer blocked after %v", abortWaitTimeout)
+			return
+		}
+	}
+}
+
+// waitRateLimiters 等待n个字节的令牌，ctx结束时返回对应的错误
+func (t *TransferManager) waitRateLimiters(ctx context.Context, n int) error {
+	for _, limiter := range t.rateLimiters {
+		if limiter.WaitN(ctx, n) != nil {
+			return contextErr(ctx)
+		}
+	}
+	return nil
+}
+
+func contextErr(ctx context.Context) error {
+	switch ctx.Err() {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return DeadlineErr
+	default:
+		return CancelErr
+	}
+}
+
+func resetTimer(timer *time.Timer, timeout time.Duration) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+	timer.Reset(timeout)
+}
+
 func (t *TransferManager) callBeforeFunc() {
 	i := 0
 	writers := t.writers
-	for _, writer := range writers {
-		err := writer.BeforeTransfer()
+	for _, worker := range writers {
+		err := worker.writer.BeforeTransfer()
 		if err != nil {
-			writer.ErrorTransfer(err)
+			worker.writer.ErrorTransfer(err)
 		} else {
-			writers[i] = writer
+			writers[i] = worker
 			i++
 		}
 	}
 	t.writers = writers[:i]
 }
-
-func (t *TransferManager) callAfterFunc() {
-	for _, writer := range t.writers {
-		writer.AfterTransfer()
-	}
-}
@@ -2,11 +2,14 @@ package transferframe_test
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"io"
 	"strings"
 	testutil "summersea.top/filetransfer/test"
 	"summersea.top/filetransfer/transferframe"
 	"testing"
+	"time"
 )
 
 var stubBeforeErr = errors.New("stub before err")
@@ -130,6 +133,255 @@ func TestTransferManager_StartTransfer(t *testing.T) {
 	})
 }
 
+func TestTransferManager_StartTransferContext(t *testing.T) {
+	t.Run("canceled before transfer", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		writer := &stubTransferWriter{}
+		manager := createManagerWithWriter(writer)
+		err := manager.StartTransferContext(ctx)
+		testutil.AssertErrEquals(t, err, transferframe.CancelErr)
+		testutil.AssertIntEquals(t, writer.writeCall, 0)
+		testutil.AssertIntEquals(t, writer.afterCall, 0)
+		testutil.AssertErrEquals(t, writer.gotErr, transferframe.CancelErr)
+	})
+
+	t.Run("canceled while transferring", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		reader := &cancelReader{reader: strings.NewReader(strings.Repeat("a", 4096)), cancel: cancel}
+		manager, _ := transferframe.NewTransferManager(reader)
+		writer := &stubTransferWriter{}
+		_ = manager.AddWriter(writer)
+		err := manager.StartTransferContext(ctx)
+		testutil.AssertErrEquals(t, err, transferframe.CancelErr)
+		// 读取与写入并行，取消时最多已经写入了第一次读到的数据
+		testutil.AssertTrue(t, writer.writeCall <= 1)
+		testutil.AssertErrEquals(t, writer.gotErr, transferframe.CancelErr)
+	})
+
+	t.Run("canceled while reader blocked", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		reader, _ := io.Pipe()
+		manager, _ := transferframe.NewTransferManager(reader)
+		writer := &stubTransferWriter{}
+		_ = manager.AddWriter(writer)
+		time.AfterFunc(10*time.Millisecond, cancel)
+		err := manager.StartTransferContext(ctx)
+		testutil.AssertErrEquals(t, err, transferframe.CancelErr)
+		testutil.AssertErrEquals(t, writer.gotErr, transferframe.CancelErr)
+		_ = reader.Close()
+	})
+
+	t.Run("deadline exceeded", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		reader, writer := io.Pipe()
+		go func() {
+			for {
+				if _, err := writer.Write([]byte("slow")); err != nil {
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}()
+		manager, _ := transferframe.NewTransferManager(reader)
+		transferWriter := &stubTransferWriter{}
+		_ = manager.AddWriter(transferWriter)
+		err := manager.StartTransferContext(ctx)
+		testutil.AssertErrEquals(t, err, transferframe.DeadlineErr)
+		testutil.AssertErrEquals(t, transferWriter.gotErr, transferframe.DeadlineErr)
+		_ = reader.Close()
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		reader, writer := io.Pipe()
+		go func() {
+			_, _ = writer.Write([]byte(testInput))
+		}()
+		manager, _ := transferframe.NewTransferManager(reader)
+		transferWriter := &stubTransferWriter{}
+		_ = manager.AddWriter(transferWriter)
+		manager.SetIdleTimeout(20 * time.Millisecond)
+		err := manager.StartTransferContext(context.Background())
+		testutil.AssertErrEquals(t, err, transferframe.IdleTimeoutErr)
+		testutil.AssertStringEqual(t, transferWriter.stringBuf.String(), testInput)
+		testutil.AssertErrEquals(t, transferWriter.gotErr, transferframe.IdleTimeoutErr)
+		_ = reader.Close()
+	})
+
+	t.Run("deadline exceeded while writer blocked", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		release := make(chan struct{})
+		defer close(release)
+		manager, _ := transferframe.NewTransferManager(strings.NewReader(strings.Repeat("a", 64*1024)))
+		_ = manager.AddWriterWithOptions(&slowTransferWriter{release: release}, transferframe.WriterOptions{QueueSize: 1})
+		err := startTransferWithin(t, manager, ctx, 5*time.Second)
+		testutil.AssertErrEquals(t, err, transferframe.DeadlineErr)
+	})
+
+	t.Run("idle timeout while writer blocked", func(t *testing.T) {
+		release := make(chan struct{})
+		defer close(release)
+		manager, _ := transferframe.NewTransferManager(strings.NewReader(strings.Repeat("a", 64*1024)))
+		blocked := &slowTransferWriter{release: release}
+		_ = manager.AddWriterWithOptions(blocked, transferframe.WriterOptions{QueueSize: 1})
+		manager.SetIdleTimeout(20 * time.Millisecond)
+		err := startTransferWithin(t, manager, context.Background(), 5*time.Second)
+		testutil.AssertErrEquals(t, err, transferframe.IdleTimeoutErr)
+	})
+
+	t.Run("idle timeout reset by data", func(t *testing.T) {
+		reader, writer := io.Pipe()
+		go func() {
+			for i := 0; i < 5; i++ {
+				time.Sleep(10 * time.Millisecond)
+				_, _ = writer.Write([]byte("a"))
+			}
+			_ = writer.Close()
+		}()
+		manager, _ := transferframe.NewTransferManager(reader)
+		transferWriter := &stubTransferWriter{}
+		_ = manager.AddWriter(transferWriter)
+		manager.SetIdleTimeout(40 * time.Millisecond)
+		testutil.AssertNil(t, manager.StartTransferContext(context.Background()))
+		testutil.AssertStringEqual(t, transferWriter.stringBuf.String(), "aaaaa")
+	})
+}
+
+func TestTransferManager_WriterPolicy(t *testing.T) {
+	input := strings.Repeat("a", 64*1024)
+
+	t.Run("block waits for slow writer", func(t *testing.T) {
+		manager, _ := transferframe.NewTransferManager(strings.NewReader(input))
+		slow := &slowTransferWriter{delay: time.Millisecond}
+		fast := &stubTransferWriter{}
+		_ = manager.AddWriterWithOptions(slow, transferframe.WriterOptions{Policy: transferframe.PolicyBlock, QueueSize: 1})
+		_ = manager.AddWriter(fast)
+		testutil.AssertNil(t, manager.StartTransfer())
+		testutil.AssertStringEqual(t, slow.stringBuf.String(), input)
+		testutil.AssertStringEqual(t, fast.stringBuf.String(), input)
+		testutil.AssertIntEquals(t, slow.afterCall, 1)
+	})
+
+	t.Run("drop lagging writer", func(t *testing.T) {
+		manager, _ := transferframe.NewTransferManager(strings.NewReader(input))
+		release := make(chan struct{})
+		slow := &slowTransferWriter{release: release}
+		fast := &stubTransferWriter{}
+		_ = manager.AddWriterWithOptions(slow, transferframe.WriterOptions{Policy: transferframe.PolicyDrop, QueueSize: 1})
+		_ = manager.AddWriter(&hookTransferWriter{TransferWriter: fast, afterTransfer: func() { close(release) }})
+		testutil.AssertNil(t, manager.StartTransfer())
+		testutil.AssertStringEqual(t, fast.stringBuf.String(), input)
+		testutil.AssertIntEquals(t, fast.afterCall, 1)
+		testutil.AssertErrEquals(t, slow.gotErr, transferframe.LaggingWriterErr)
+		testutil.AssertIntEquals(t, slow.afterCall, 0)
+	})
+
+	t.Run("fail on lagging writer", func(t *testing.T) {
+		manager, _ := transferframe.NewTransferManager(strings.NewReader(input))
+		release := make(chan struct{})
+		slow := &slowTransferWriter{release: release}
+		fast := &stubTransferWriter{}
+		_ = manager.AddWriterWithOptions(slow, transferframe.WriterOptions{Policy: transferframe.PolicyFail, QueueSize: 1})
+		_ = manager.AddWriter(fast)
+		time.AfterFunc(10*time.Millisecond, func() { close(release) })
+		err := manager.StartTransfer()
+		testutil.AssertErrEquals(t, err, transferframe.LaggingWriterErr)
+		testutil.AssertErrEquals(t, slow.gotErr, transferframe.LaggingWriterErr)
+		testutil.AssertErrEquals(t, fast.gotErr, transferframe.LaggingWriterErr)
+		testutil.AssertIntEquals(t, fast.afterCall, 0)
+	})
+
+	t.Run("required writer err stops transfer", func(t *testing.T) {
+		reader, pipeWriter := io.Pipe()
+		go func() { _, _ = pipeWriter.Write([]byte(testInput)) }()
+		manager, _ := transferframe.NewTransferManager(reader)
+		failing := &stubTransferWriter{shouldWriteErr: true}
+		other := &stubTransferWriter{}
+		_ = manager.AddWriterWithOptions(failing, transferframe.WriterOptions{Required: true})
+		_ = manager.AddWriter(other)
+		err := manager.StartTransfer()
+		var writerErr *transferframe.WriterError
+		testutil.AssertTrue(t, errors.As(err, &writerErr))
+		testutil.AssertErrEquals(t, writerErr.Err, stubWriteErr)
+		testutil.AssertErrEquals(t, failing.gotErr, stubWriteErr)
+		testutil.AssertErrEquals(t, other.gotErr, err)
+		testutil.AssertIntEquals(t, other.afterCall, 0)
+		_ = reader.Close()
+	})
+
+	t.Run("required writer err after reader ends", func(t *testing.T) {
+		failing := &stubTransferWriter{shouldWriteErr: true}
+		manager, _ := transferframe.NewTransferManager(strings.NewReader(input))
+		_ = manager.AddWriterWithOptions(failing, transferframe.WriterOptions{Required: true})
+		err := manager.StartTransfer()
+		testutil.AssertTrue(t, errors.Is(err, stubWriteErr))
+	})
+}
+
+func TestTransferManager_SetBufferSize(t *testing.T) {
+	manager, _ := transferframe.NewTransferManager(strings.NewReader(strings.Repeat("a", 10000)))
+	testutil.AssertNotNil(t, manager.SetBufferSize(0))
+	testutil.AssertNil(t, manager.SetBufferSize(4096))
+	writer := &stubTransferWriter{}
+	_ = manager.AddWriter(writer)
+	testutil.AssertNil(t, manager.StartTransfer())
+	testutil.AssertIntEquals(t, writer.writeCall, 3)
+	testutil.AssertIntEquals(t, writer.stringBuf.Len(), 10000)
+}
+
+// slowTransferWriter 每次写入前等待delay，release不为nil时等待release关闭
+type slowTransferWriter struct {
+	stubTransferWriter
+	delay   time.Duration
+	release <-chan struct{}
+}
+
+func (s *slowTransferWriter) Write(bytes []byte) error {
+	if s.release != nil {
+		<-s.release
+	}
+	time.Sleep(s.delay)
+	return s.stubTransferWriter.Write(bytes)
+}
+
+// hookTransferWriter 在AfterTransfer之后调用afterTransfer
+type hookTransferWriter struct {
+	transferframe.TransferWriter
+	afterTransfer func()
+}
+
+func (h *hookTransferWriter) AfterTransfer() {
+	h.TransferWriter.AfterTransfer()
+	h.afterTransfer()
+}
+
+// cancelReader 第一次读取后取消传输
+type cancelReader struct {
+	reader io.Reader
+	cancel context.CancelFunc
+}
+
+func (c *cancelReader) Read(p []byte) (int, error) {
+	c.cancel()
+	return c.reader.Read(p)
+}
+
+// startTransferWithin 在后台开始传输，超过timeout没有返回时测试失败
+func startTransferWithin(t *testing.T, manager *transferframe.TransferManager, ctx context.Context, timeout time.Duration) error {
+	t.Helper()
+	result := make(chan error, 1)
+	go func() { result <- manager.StartTransferContext(ctx) }()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		t.Fatalf("transfer not stopped in %v", timeout)
+		return nil
+	}
+}
+
 func createManagerWithWriter(writer transferframe.TransferWriter) *transferframe.TransferManager {
 	manager := createCommonManager()
 	_ = manager.AddWriter(writer)
@@ -162,3 +414,88 @@ func TestBasicWriter_Write(t *testing.T) {
 	testutil.AssertNil(t, err)
 	testutil.AssertStringEqual(t, buf.String(), testInput)
 }
+
+// sequentialTransfer 原来的传输方式：每读到1KB依次同步写入每个输出端，作为基准测试的对照
+func sequentialTransfer(reader io.Reader, writers []transferframe.TransferWriter) error {
+	buf := make([]byte, transferframe.DefaultBufferSize)
+	for {
+		n, err := reader.Read(buf)
+		for _, writer := range writers {
+			if n > 0 {
+				_ = writer.Write(buf[:n])
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// latencyWriter 模拟每次写入都有网络延迟的镜像目标
+type latencyWriter struct {
+	delay time.Duration
+}
+
+func (l *latencyWriter) BeforeTransfer() error { return nil }
+
+func (l *latencyWriter) Write([]byte) error {
+	time.Sleep(l.delay)
+	return nil
+}
+
+func (l *latencyWriter) AfterTransfer() {}
+
+func (l *latencyWriter) ErrorTransfer(error) {}
+
+func BenchmarkTransfer(b *testing.B) {
+	input := bytes.Repeat([]byte("a"), 4<<20)
+	checksumWriters := func() []transferframe.TransferWriter {
+		md5Writer, _ := transferframe.NewChecksumWriter(transferframe.ChecksumMD5)
+		sha1Writer, _ := transferframe.NewChecksumWriter(transferframe.ChecksumSHA1)
+		sha256Writer, _ := transferframe.NewChecksumWriter(transferframe.ChecksumSHA256)
+		return []transferframe.TransferWriter{md5Writer, sha1Writer, sha256Writer}
+	}
+	concurrentTransfer := func(bufferSize int) func(io.Reader, []transferframe.TransferWriter) error {
+		return func(reader io.Reader, writers []transferframe.TransferWriter) error {
+			manager, _ := transferframe.NewTransferManager(reader)
+			_ = manager.SetBufferSize(bufferSize)
+			for _, writer := range writers {
+				_ = manager.AddWriter(writer)
+			}
+			return manager.StartTransfer()
+		}
+	}
+	transfers := []struct {
+		name     string
+		transfer func(io.Reader, []transferframe.TransferWriter) error
+	}{
+		{"sequential", sequentialTransfer},
+		{"concurrent-1KB", concurrentTransfer(1024)},
+		{"concurrent-32KB", concurrentTransfer(32 * 1024)},
+	}
+	for _, transfer := range transfers {
+		b.Run("checksums/"+transfer.name, func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			for i := 0; i < b.N; i++ {
+				_ = transfer.transfer(bytes.NewReader(input), checksumWriters())
+			}
+		})
+	}
+	// 三个每次写入延迟50微秒的目标，顺序写入时延迟叠加
+	mirrorInput := input[:256<<10]
+	for _, transfer := range transfers {
+		b.Run("mirrors/"+transfer.name, func(b *testing.B) {
+			b.SetBytes(int64(len(mirrorInput)))
+			for i := 0; i < b.N; i++ {
+				writers := []transferframe.TransferWriter{
+					&latencyWriter{delay: 50 * time.Microsecond},
+					&latencyWriter{delay: 50 * time.Microsecond},
+					&latencyWriter{delay: 50 * time.Microsecond},
+				}
+				_ = transfer.transfer(bytes.NewReader(mirrorInput), writers)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package transferframe
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// chunk 分发给多个输出端的一块数据，所有输出端写完后缓冲区回到池中
+type chunk struct {
+	data []byte
+	refs int32
+	pool *sync.Pool
+}
+
+func newChunk(data []byte, pool *sync.Pool) *chunk {
+	return &chunk{data: data, pool: pool}
+}
+
+func (c *chunk) release() {
+	if atomic.AddInt32(&c.refs, -1) == 0 {
+		c.pool.Put(c.data[:cap(c.data)])
+	}
+}
+
+// writerWorker 在单独的协程中将队列中的数据写入输出端，输出端的方法只在该协程中调用
+type writerWorker struct {
+	writer    TransferWriter
+	policy    WriterPolicy
+	queueSize int
+	queue     chan *chunk
+	abort     chan struct{}
+	// done 协程退出后关闭
+	done chan struct{}
+	// endErr 结束的原因，在关闭queue或abort之前设置
+	endErr error
+	// stopped 是否已经停止分发，只在分发的协程中读写
+	stopped bool
+	// required 写入失败时通过failed通知管理器停止传输
+	required bool
+	failed   chan<- error
+}
+
+func (w *writerWorker) start(failed chan<- error) {
+	w.failed = failed
+	w.queue = make(chan *chunk, w.queueSize)
+	w.abort = make(chan struct{})
+	w.done = make(chan struct{})
+	go w.run()
+}
+
+// stop 停止分发，err为结束的原因，abort为true时不再写入已排队的数据
+func (w *writerWorker) stop(err error, abort bool) {
+	w.stopped = true
+	w.endErr = err
+	if abort {
+		close(w.abort)
+	}
+	close(w.queue)
+}
+
+func (w *writerWorker) run() {
+	defer close(w.done)
+	for {
+		if w.isAborted() {
+			w.discard()
+			w.writer.ErrorTransfer(w.endErr)
+			return
+		}
+		var data *chunk
+		var ok bool
+		select {
+		case <-w.abort:
+			continue
+		case data, ok = <-w.queue:
+		}
+		if !ok {
+			w.finish()
+			return
+		}
+		if w.isAborted() {
+			data.release()
+			continue
+		}
+		err := w.writer.Write(data.data)
+		data.release()
+		if err != nil {
+			w.writer.ErrorTransfer(err)
+			w.discard()
+			if w.required {
+				w.notifyFailed(err)
+			}
+			return
+		}
+	}
+}
+
+// notifyFailed 只需通知第一个失败的输出端，之后的失败不再等待
+func (w *writerWorker) notifyFailed(err error) {
+	select {
+	case w.failed <- err:
+	default:
+	}
+}
+
+func (w *writerWorker) isAborted() bool {
+	select {
+	case <-w.abort:
+		return true
+	default:
+		return false
+	}
+}
+
+// discard 释放队列中剩余的数据
+func (w *writerWorker) discard() {
+	for {
+		select {
+		case data, ok := <-w.queue:
+			if !ok {
+				return
+			}
+			data.release()
+		default:
+			return
+		}
+	}
+}
+
+func (w *writerWorker) finish() {
+	if w.endErr == nil {
+		w.writer.AfterTransfer()
+	} else {
+		w.writer.ErrorTransfer(w.endErr)
+	}
+}
@@ -1,30 +1,260 @@
 package filetransfer
 
+import (
+	"errors"
+	"summersea.top/filetransfer/transferframe"
+	"time"
+)
+
 const ErrorCodeInvalidParam = "InvalidParam"
 const ErrorContentInvalidParam = "Invalid Parameter"
 const ErrorCodeResourceNotFound = "ResourceNotFound"
 const ErrorContentTaskNotFound = "The task id is not found"
+const ErrorCodeHostKeyMismatch = "HostKeyMismatch"
+const ErrorContentHostKeyMismatch = "The host key of target resource does not match the trusted key"
+const ErrorCodeHostKeyUnknown = "HostKeyUnknown"
+const ErrorContentHostKeyUnknown = "The host key of target resource is unknown"
+const ErrorCodeOffsetMismatch = "OffsetMismatch"
+const ErrorContentOffsetMismatch = "The offset does not match the committed offset"
+const ErrorCodeTaskCanceled = "TaskCanceled"
+const ErrorContentTaskCanceled = "The task has been canceled"
+const ErrorCodeTaskFinished = "TaskFinished"
+const ErrorContentTaskFinished = "The task has already finished"
+const ErrorCodeTransferTimeout = "TransferTimeout"
+const ErrorContentTransferTimeout = "The transfer timed out"
+const ErrorCodeChecksumMismatch = "ChecksumMismatch"
+const ErrorContentChecksumMismatch = "The checksum of uploaded data does not match"
+const ErrorCodeTransferFailed = "TransferFailed"
+const ErrorContentTransferFailed = "The file transfer failed"
+const ErrorContentPathNotFound = "The path does not exist on target resource"
+const ErrorCodeNotDirectory = "NotDirectory"
+const ErrorContentNotDirectory = "The path is not a directory"
+const ErrorCodeAlreadyExists = "AlreadyExists"
+const ErrorContentAlreadyExists = "The path already exists on target resource"
+const ErrorCodeDirectoryNotEmpty = "DirectoryNotEmpty"
+const ErrorContentDirectoryNotEmpty = "The directory is not empty, set recursive to delete it"
+const ErrorCodePermissionDenied = "PermissionDenied"
+const ErrorContentPermissionDenied = "Permission denied on target resource"
+const ErrorCodeOperationFailed = "OperationFailed"
+const ErrorContentOperationFailed = "The operation on target resource failed"
 
 type Resource struct {
 	Address string  `json:"address"`
 	Port    int     `json:"port"`
 	Account Account `json:"account"`
+	// Fingerprints 信任的主机密钥SHA256指纹，指定后不再使用配置的校验策略
+	Fingerprints []string `json:"fingerprints,omitempty"`
+	// Proxies 依次经过的跳板机，由最后一个跳板机连接目标资源
+	Proxies []ProxyHop `json:"proxies,omitempty"`
+}
+
+// ProxyHop 跳板机，每个跳板机单独认证并校验主机密钥
+type ProxyHop struct {
+	Address      string   `json:"address"`
+	Port         int      `json:"port"`
+	Account      Account  `json:"account"`
+	Fingerprints []string `json:"fingerprints,omitempty"`
 }
 
+const AuthTypePassword = "password"
+const AuthTypePublicKey = "publicKey"
+const AuthTypeKeyId = "keyId"
+const AuthTypeKeyboardInteractive = "keyboardInteractive"
+const AuthTypeAgent = "agent"
+
 type Account struct {
-	Name     string `json:"name"`
+	Name string `json:"name"`
+	// AuthType 认证方式，为空时使用密码认证
+	AuthType string `json:"authType,omitempty"`
+	// Password 密码认证与键盘交互认证时使用
 	Password string `json:"password"`
+	// PrivateKey PEM格式的私钥，公钥认证时使用
+	PrivateKey string `json:"privateKey,omitempty"`
+	// Passphrase 私钥的密码，私钥未加密时为空
+	Passphrase string `json:"passphrase,omitempty"`
+	// KeyId 服务端配置的私钥id
+	KeyId string `json:"keyId,omitempty"`
 }
 
 type UploadInitReqBody struct {
 	Resource Resource `json:"resource"`
 	Path     string   `json:"path"`
 	Filename string   `json:"filename"`
+	// Extract 不为空时按该格式解压上传的压缩包到Path，此时Filename可以为空
+	Extract string `json:"extract,omitempty"`
+	// Checksum 文件的期望摘要，只能在一次请求中上传整个文件时使用
+	Checksum *Checksum `json:"checksum,omitempty"`
+	// Targets 额外的上传目标，上传的数据同时写入Resource与每个目标
+	Targets []UploadTarget `json:"targets,omitempty"`
+	// RollbackPolicy 部分目标失败时的回滚策略，可选all、failed，默认为all
+	RollbackPolicy string `json:"rollbackPolicy,omitempty"`
+	TransferOptions
+	FileAttributes
+}
+
+// FileAttributes 上传结束后设置的文件属性，未指定的属性保持目标资源的默认值，解压上传时不支持
+type FileAttributes struct {
+	// Mode 八进制的权限位，如0755
+	Mode string `json:"mode,omitempty"`
+	// Uid Gid 文件的所有者，需要同时指定
+	Uid *int `json:"uid,omitempty"`
+	Gid *int `json:"gid,omitempty"`
+	// ModTime 修改时间
+	ModTime *time.Time `json:"mtime,omitempty"`
+	// PreserveTime 为true时使用上传请求中Last-Modified头的时间作为修改时间，请求没有该头时使用ModTime
+	PreserveTime bool `json:"preserveTime,omitempty"`
 }
 
 type DownloadInitReqBody struct {
 	Resource Resource `json:"resource"`
 	Path     string   `json:"path"`
+	// Archive 打包格式，可选zip、tar、tar.gz，为空时只能下载文件
+	Archive string `json:"archive,omitempty"`
+	TransferOptions
+}
+
+// CopyReqBody 服务端之间复制文件的请求，数据不经过客户端
+type CopyReqBody struct {
+	Source      CopyEndpoint `json:"source"`
+	Destination CopyEndpoint `json:"destination"`
+	TransferOptions
+}
+
+// CopyEndpoint 复制的一端，Path为包括文件名的绝对路径
+type CopyEndpoint struct {
+	Resource Resource `json:"resource"`
+	Path     string   `json:"path"`
+}
+
+// RemotePath 目标资源上的路径，远程文件操作的请求都包含该字段
+type RemotePath struct {
+	Resource Resource `json:"resource"`
+	Path     string   `json:"path"`
+}
+
+// ListReqBody 列出目标资源上目录内容的请求
+type ListReqBody struct {
+	RemotePath
+	// Offset 跳过排序后的前Offset个条目
+	Offset int `json:"offset,omitempty"`
+	// Limit 最多返回的条目数，为0时使用默认值
+	Limit int `json:"limit,omitempty"`
+	// Sort 排序字段，可选name、size、mtime，默认为name
+	Sort string `json:"sort,omitempty"`
+	// Order 排序方向，可选asc、desc，默认为asc
+	Order string `json:"order,omitempty"`
+	// ShowHidden 为true时返回以.开头的文件
+	ShowHidden bool `json:"showHidden,omitempty"`
+}
+
+// MkdirReqBody 创建目录的请求
+type MkdirReqBody struct {
+	RemotePath
+	// Parents 为true时同时创建不存在的上级目录，目录已存在时不报错
+	Parents bool `json:"parents,omitempty"`
+}
+
+// RenameReqBody 重命名或移动的请求，NewPath已存在时失败
+type RenameReqBody struct {
+	RemotePath
+	NewPath string `json:"newPath"`
+}
+
+// DeleteReqBody 删除文件或目录的请求
+type DeleteReqBody struct {
+	RemotePath
+	// Recursive 为true时才能删除非空目录
+	Recursive bool `json:"recursive,omitempty"`
+}
+
+// ChmodReqBody 修改权限的请求
+type ChmodReqBody struct {
+	RemotePath
+	// Mode 八进制的权限位，如0755
+	Mode string `json:"mode"`
+}
+
+// ChownReqBody 修改所有者的请求
+type ChownReqBody struct {
+	RemotePath
+	Uid *int `json:"uid"`
+	Gid *int `json:"gid"`
+}
+
+// SymlinkReqBody 在Path处创建指向Target的符号链接
+type SymlinkReqBody struct {
+	RemotePath
+	Target string `json:"target"`
+}
+
+const FileTypeFile = "file"
+const FileTypeDir = "dir"
+const FileTypeSymlink = "symlink"
+const FileTypeOther = "other"
+
+// FileEntry 目录中的一个条目，符号链接不会被跟随
+type FileEntry struct {
+	Name string `json:"name"`
+	// Type 条目类型，可选file、dir、symlink、other
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+	// Mode 八进制的权限位，如0644
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"mtime"`
+	// Uid Gid 文件的所有者，服务端没有返回时为0
+	Uid uint32 `json:"uid"`
+	Gid uint32 `json:"gid"`
+	// LinkTarget 符号链接指向的路径，只有符号链接有该字段
+	LinkTarget string `json:"linkTarget,omitempty"`
+}
+
+// TransferOptions 任务的传输设置，为0时使用配置文件中的设置
+type TransferOptions struct {
+	// Timeout 单次传输的最长时间，单位为秒
+	Timeout int `json:"timeout,omitempty"`
+	// IdleTimeout 超过该时间没有读到数据时传输失败，单位为秒
+	IdleTimeout int `json:"idleTimeout,omitempty"`
+	// RateLimit 任务的限速，单位为字节每秒，同一任务的并发请求共享
+	RateLimit int64 `json:"rateLimit,omitempty"`
+}
+
+const TaskTypeUpload = "upload"
+const TaskTypeDownload = "download"
+const TaskTypeCopy = "copy"
+
+const TaskStatePending = "pending"
+const TaskStateRunning = "running"
+const TaskStateSucceeded = "succeeded"
+const TaskStateFailed = "failed"
+const TaskStateExpired = "expired"
+const TaskStateCanceled = "canceled"
+
+// TaskStatus 任务的状态与传输进度
+type TaskStatus struct {
+	TaskId string `json:"taskId"`
+	Type   string `json:"type"`
+	State  string `json:"state"`
+	// Transferred 已传输的字节数，续传的上传任务包含之前已提交的字节数
+	Transferred int64 `json:"transferred"`
+	// Total 总字节数，未知时为-1
+	Total     int64      `json:"total"`
+	StartTime *time.Time `json:"startTime,omitempty"`
+	EndTime   *time.Time `json:"endTime,omitempty"`
+	// Error 最近一次传输失败的原因
+	Error string `json:"error,omitempty"`
+	// Retries 服务端任务自动重试的次数
+	Retries int `json:"retries,omitempty"`
+	// LastError 最近一次重试的原因
+	LastError string `json:"lastError,omitempty"`
+}
+
+// ProgressEvent 推送给订阅者的进度事件
+type ProgressEvent struct {
+	TaskStatus
+	// Rate 传输速率，单位为字节每秒
+	Rate float64 `json:"rate"`
+	// Eta 预计剩余秒数，未知时为-1
+	Eta int64 `json:"eta"`
 }
 
 type OkBody struct {
@@ -40,12 +270,53 @@ type ErrorBody struct {
 type ErrorContent struct {
 	Message string `json:"message"`
 	Code    string `json:"code"`
+	// Operation 操作远程文件失败时出错的操作，如mkdir、rename
+	Operation string `json:"operation,omitempty"`
+	// Path 操作远程文件失败时出错的路径
+	Path string `json:"path,omitempty"`
 }
 
 func getTaskNotFoundErr() ErrorBody {
 	return NewErrorBody(ErrorCodeResourceNotFound, ErrorContentTaskNotFound)
 }
 
+func getTaskCanceledErr() ErrorBody {
+	return NewErrorBody(ErrorCodeTaskCanceled, ErrorContentTaskCanceled)
+}
+
+func getTaskFinishedErr() ErrorBody {
+	return NewErrorBody(ErrorCodeTaskFinished, ErrorContentTaskFinished)
+}
+
+func getOffsetMismatchErr() ErrorBody {
+	return NewErrorBody(ErrorCodeOffsetMismatch, ErrorContentOffsetMismatch)
+}
+
+// getTransferErr 将传输过程中可识别的错误转换为对应的错误信息
+func getTransferErr(err error) (ErrorBody, bool) {
+	switch {
+	case errors.Is(err, HostKeyMismatch):
+		return NewErrorBody(ErrorCodeHostKeyMismatch, ErrorContentHostKeyMismatch), true
+	case errors.Is(err, HostKeyUnknown):
+		return NewErrorBody(ErrorCodeHostKeyUnknown, ErrorContentHostKeyUnknown), true
+	case errors.Is(err, transferframe.CancelErr):
+		return getTaskCanceledErr(), true
+	case errors.Is(err, transferframe.DeadlineErr), errors.Is(err, transferframe.IdleTimeoutErr):
+		return NewErrorBody(ErrorCodeTransferTimeout, ErrorContentTransferTimeout), true
+	case errors.Is(err, ChecksumMismatch):
+		return NewErrorBody(ErrorCodeChecksumMismatch, ErrorContentChecksumMismatch), true
+	}
+	return ErrorBody{}, false
+}
+
+// getUploadFileErr 多文件上传中单个文件失败时的错误信息
+func getUploadFileErr(err error) ErrorBody {
+	if errorBody, ok := getTransferErr(err); ok {
+		return errorBody
+	}
+	return NewErrorBody(ErrorCodeTransferFailed, ErrorContentTransferFailed)
+}
+
 func getInvalidParamErr() ErrorBody {
 	return NewErrorBody(ErrorCodeInvalidParam, ErrorContentInvalidParam)
 }
@@ -0,0 +1,64 @@
+package filetransfer
+
+import (
+	"fmt"
+	"github.com/pkg/sftp"
+	"net/http"
+	"time"
+)
+
+func isFileAttributesValid(attrs FileAttributes, extract string) bool {
+	if attrs == (FileAttributes{}) {
+		return true
+	}
+	if extract != "" {
+		return false
+	}
+	if attrs.Mode != "" {
+		if _, ok := parseFileMode(attrs.Mode); !ok {
+			return false
+		}
+	}
+	if (attrs.Uid == nil) != (attrs.Gid == nil) {
+		return false
+	}
+	return attrs.Uid == nil || (*attrs.Uid >= 0 && *attrs.Gid >= 0)
+}
+
+// parseLastModified 解析上传请求或part中的Last-Modified头，没有该头时返回零值
+func parseLastModified(header http.Header) (time.Time, error) {
+	value := header.Get("Last-Modified")
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return http.ParseTime(value)
+}
+
+// withClientModTime 设置了PreserveTime且客户端提供了修改时间时使用客户端的时间
+func (a FileAttributes) withClientModTime(modTime time.Time) FileAttributes {
+	if a.PreserveTime && !modTime.IsZero() {
+		a.ModTime = &modTime
+	}
+	return a
+}
+
+// applyFileAttributes 设置文件属性，修改所有者可能清除setuid位，所以先修改所有者再修改权限
+func applyFileAttributes(client *sftp.Client, path string, attrs FileAttributes) error {
+	if attrs.Uid != nil {
+		if err := client.Chown(path, *attrs.Uid, *attrs.Gid); err != nil {
+			return fmt.Errorf("problem chown %s: %w", path, err)
+		}
+	}
+	if attrs.Mode != "" {
+		mode, _ := parseFileMode(attrs.Mode)
+		if err := client.Chmod(path, mode); err != nil {
+			return fmt.Errorf("problem chmod %s: %w", path, err)
+		}
+	}
+	if attrs.ModTime != nil {
+		if err := client.Chtimes(path, *attrs.ModTime, *attrs.ModTime); err != nil {
+			return fmt.Errorf("problem set mtime of %s: %w", path, err)
+		}
+	}
+	return nil
+}
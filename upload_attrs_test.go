@@ -0,0 +1,143 @@
+package filetransfer_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"summersea.top/filetransfer"
+	testutil "summersea.top/filetransfer/test"
+	"testing"
+	"time"
+)
+
+func TestUploadInitWithAttributes(t *testing.T) {
+	fileServer := filetransfer.NewFileServer(&StubAdapter{})
+	resource := filetransfer.Resource{Address: "addr", Port: 22, Account: filetransfer.Account{Name: "a", Password: "pwd"}}
+	id, negative := 1000, -1
+	modTime := time.Date(2021, 5, 1, 8, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		attrs      filetransfer.FileAttributes
+		extract    string
+		wantStatus int
+	}{
+		{filetransfer.FileAttributes{Mode: "0755", Uid: &id, Gid: &id, ModTime: &modTime}, "", http.StatusOK},
+		{filetransfer.FileAttributes{PreserveTime: true}, "", http.StatusOK},
+		{filetransfer.FileAttributes{Mode: "0999"}, "", http.StatusBadRequest},
+		{filetransfer.FileAttributes{Uid: &id}, "", http.StatusBadRequest},
+		{filetransfer.FileAttributes{Uid: &negative, Gid: &id}, "", http.StatusBadRequest},
+		{filetransfer.FileAttributes{Mode: "0755"}, "zip", http.StatusBadRequest},
+	}
+	for _, test := range testCases {
+		body := filetransfer.UploadInitReqBody{Resource: resource, Path: "/root", Filename: "a.txt",
+			Extract: test.extract, FileAttributes: test.attrs}
+		testCase(t, initTestCase{requestBody: body, wantResponseStatus: test.wantStatus}, initUploadUrl, fileServer)
+	}
+}
+
+func TestUploadAttributesOptions(t *testing.T) {
+	const lastModified = "Sat, 01 May 2021 08:00:00 GMT"
+	upload := func(t *testing.T, headers map[string]string, body string) (*StubAdapter, int) {
+		t.Helper()
+		adapter := &StubAdapter{uploadTaskId: filetransfer.NewTaskId(), filename: filepath.Join(t.TempDir(), "a.txt")}
+		request := newPostRequestReader(fmt.Sprintf("%s?taskId=%s", uploadUrl, adapter.uploadTaskId), bytes.NewBufferString(body))
+		for key, value := range headers {
+			request.Header.Set(key, value)
+		}
+		response := httptest.NewRecorder()
+		filetransfer.NewFileServer(adapter).ServeHTTP(response, request)
+		return adapter, response.Code
+	}
+
+	t.Run("last modified", func(t *testing.T) {
+		adapter, status := upload(t, map[string]string{"Last-Modified": lastModified}, "abc")
+		testutil.AssertIntEquals(t, status, http.StatusNoContent)
+		testutil.AssertIntEquals(t, len(adapter.uploadOptions), 1)
+		testutil.AssertTrue(t, adapter.uploadOptions[0].ModTime.Equal(time.Date(2021, 5, 1, 8, 0, 0, 0, time.UTC)))
+		testutil.AssertTrue(t, !adapter.uploadOptions[0].Partial)
+	})
+
+	t.Run("invalid last modified", func(t *testing.T) {
+		adapter, status := upload(t, map[string]string{"Last-Modified": "yesterday"}, "abc")
+		testutil.AssertIntEquals(t, status, http.StatusBadRequest)
+		testutil.AssertIntEquals(t, len(adapter.uploadOptions), 0)
+	})
+
+	t.Run("partial", func(t *testing.T) {
+		testCases := []struct {
+			contentRange string
+			wantPartial  bool
+		}{
+			{"bytes 0-2/6", true},
+			{"bytes 0-2/3", false},
+		}
+		for _, test := range testCases {
+			adapter, status := upload(t, map[string]string{"Content-Range": test.contentRange}, "abc")
+			testutil.AssertIntEquals(t, status, http.StatusNoContent)
+			testutil.AssertTrue(t, adapter.uploadOptions[0].Partial == test.wantPartial)
+		}
+	})
+}
+
+func TestFileTranDataAdapter_UploadAttributes(t *testing.T) {
+	server := testutil.StartSshServer(t, testutil.NewPasswordServerConfig(t, "test", "pwd"))
+	resource := filetransfer.Resource{Address: server.Address, Port: server.Port,
+		Account: filetransfer.Account{Name: "test", Password: "pwd"}}
+	adapter := filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStore())
+	uid, gid := os.Getuid(), os.Getgid()
+	modTime := time.Date(2021, 5, 1, 8, 0, 0, 0, time.UTC)
+	clientTime := time.Date(2022, 6, 2, 9, 0, 0, 0, time.UTC)
+	upload := func(t *testing.T, attrs filetransfer.FileAttributes, options filetransfer.UploadOptions) string {
+		t.Helper()
+		dir := t.TempDir()
+		taskId := filetransfer.NewTaskId()
+		adapter.SaveUploadData(taskId, filetransfer.UploadData{Resource: resource, Path: dir, Filename: "a.sh",
+			FileAttributes: attrs})
+		channel, err := adapter.GetUploadChannel(context.Background(), taskId, options)
+		if err != nil {
+			t.Fatalf("problem get upload channel: %v", err)
+		}
+		_, err = channel.Write([]byte("#!/bin/sh"))
+		testutil.AssertNil(t, err)
+		testutil.AssertNil(t, channel.(filetransfer.Committer).Commit())
+		testutil.AssertNil(t, channel.Close())
+		if options.Partial {
+			return filepath.Join(dir, fmt.Sprintf(".a.sh.%s.part", taskId))
+		}
+		return filepath.Join(dir, "a.sh")
+	}
+	stat := func(t *testing.T, path string) os.FileInfo {
+		t.Helper()
+		info, err := os.Stat(path)
+		testutil.AssertNil(t, err)
+		return info
+	}
+
+	t.Run("attributes applied", func(t *testing.T) {
+		info := stat(t, upload(t, filetransfer.FileAttributes{Mode: "0750", Uid: &uid, Gid: &gid, ModTime: &modTime},
+			filetransfer.UploadOptions{}))
+		testutil.AssertStringEqual(t, info.Mode().Perm().String(), "-rwxr-x---")
+		testutil.AssertTrue(t, info.ModTime().Equal(modTime))
+	})
+
+	t.Run("client time preserved", func(t *testing.T) {
+		info := stat(t, upload(t, filetransfer.FileAttributes{ModTime: &modTime, PreserveTime: true},
+			filetransfer.UploadOptions{ModTime: clientTime}))
+		testutil.AssertTrue(t, info.ModTime().Equal(clientTime))
+	})
+
+	t.Run("client time ignored", func(t *testing.T) {
+		info := stat(t, upload(t, filetransfer.FileAttributes{ModTime: &modTime}, filetransfer.UploadOptions{ModTime: clientTime}))
+		testutil.AssertTrue(t, info.ModTime().Equal(modTime))
+	})
+
+	t.Run("partial upload not applied", func(t *testing.T) {
+		info := stat(t, upload(t, filetransfer.FileAttributes{Mode: "0750", ModTime: &modTime},
+			filetransfer.UploadOptions{Partial: true}))
+		testutil.AssertTrue(t, info.Mode().Perm() != 0750)
+		testutil.AssertTrue(t, !info.ModTime().Equal(modTime))
+	})
+}
@@ -0,0 +1,141 @@
+package filetransfer
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+)
+
+var IncompleteWrite = errors.New("incomplete write")
+
+// UploadFileResult 多文件上传中单个文件的上传结果
+type UploadFileResult struct {
+	Filename string        `json:"filename"`
+	Size     int64         `json:"size"`
+	Error    *ErrorContent `json:"error,omitempty"`
+}
+
+func isMultipartUpload(request *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// multipartUploadHandler 依次将每个文件part上传为Path下的同名文件，不会缓存整个文件
+// 单个文件失败不影响其它文件，全部处理完后结束上传任务
+func (fs *FileServerController) multipartUploadHandler(ctx *gin.Context, taskId string) {
+	reader, err := ctx.Request.MultipartReader()
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, getInvalidParamErr())
+		return
+	}
+	tracker := fs.startTracking(ctx.Request.Context(), taskId, TaskTypeUpload, 0, -1)
+	results := make([]UploadFileResult, 0)
+	var lastErr error
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("problem read multipart: %v", err)
+			tracker.finish(err, false)
+			ctx.JSON(http.StatusBadRequest, getInvalidParamErr())
+			return
+		}
+		if part.FormName() == "" || part.FileName() == "" {
+			closeWithErrLog(part)
+			continue
+		}
+		result, err := fs.handleUploadPart(taskId, part, tracker)
+		closeWithErrLog(part)
+		if tracker.isCanceled() {
+			tracker.finish(err, false)
+			fs.dataAdapter.FinishUpload(taskId)
+			fs.responseUploadErr(ctx, err)
+			return
+		}
+		// 超时或请求断开后无法继续读取后续的part
+		if isTransferStopped(err) {
+			tracker.finish(err, true)
+			fs.dataAdapter.FinishUpload(taskId)
+			fs.responseUploadErr(ctx, err)
+			return
+		}
+		if err != nil {
+			lastErr = err
+		}
+		results = append(results, result)
+	}
+	if len(results) == 0 {
+		tracker.finish(nil, false)
+		ctx.JSON(http.StatusBadRequest, getInvalidParamErr())
+		return
+	}
+	tracker.finish(lastErr, true)
+	fs.dataAdapter.FinishUpload(taskId)
+	ctx.JSON(http.StatusOK, OkBody{Data: Data{"files": results}})
+}
+
+// handleUploadPart 上传一个文件part，返回该文件的结果与失败原因
+// part头中的Content-MD5与Digest用于校验该文件，Last-Modified为客户端提供的修改时间
+func (fs *FileServerController) handleUploadPart(taskId string, part *multipart.Part, tracker *taskTracker) (UploadFileResult, error) {
+	filename := part.FileName()
+	result := UploadFileResult{Filename: filename}
+	if !isPartFilenameValid(filename) {
+		_, _ = io.Copy(io.Discard, part)
+		errorBody := getInvalidParamErr()
+		result.Error = &errorBody.Error
+		return result, fmt.Errorf("invalid filename %s", filename)
+	}
+	expected, err := parseChecksumHeader(part.Header)
+	if err != nil {
+		_, _ = io.Copy(io.Discard, part)
+		errorBody := getInvalidParamErr()
+		result.Error = &errorBody.Error
+		return result, fmt.Errorf("problem parse checksum of %s: %w", filename, err)
+	}
+	modTime, err := parseLastModified(http.Header(part.Header))
+	if err != nil {
+		_, _ = io.Copy(io.Discard, part)
+		errorBody := getInvalidParamErr()
+		result.Error = &errorBody.Error
+		return result, fmt.Errorf("problem parse last modified of %s: %w", filename, err)
+	}
+	counter := &countReader{reader: part}
+	target, err := fs.handleUpload(taskId, counter, UploadOptions{Filename: filename, ModTime: modTime}, expected, tracker)
+	result.Size = target.written()
+	if target.rolledBack {
+		result.Size = 0
+	}
+	if err == nil && result.Size != counter.count {
+		err = fmt.Errorf("%w: wrote %d of %d bytes", IncompleteWrite, result.Size, counter.count)
+	}
+	if err != nil {
+		log.Printf("problem upload %s: %v", filename, err)
+		_, _ = io.Copy(io.Discard, part)
+		errorBody := getUploadFileErr(err)
+		result.Error = &errorBody.Error
+	}
+	return result, err
+}
+
+func isPartFilenameValid(filename string) bool {
+	return filename != "." && filename != ".." && !strings.ContainsAny(filename, "/\\")
+}
+
+type countReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.count += int64(n)
+	return n, err
+}
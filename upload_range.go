@@ -0,0 +1,104 @@
+package filetransfer
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var InvalidUploadRange = errors.New("invalid upload range")
+
+// uploadRange 上传请求声明的写入位置
+type uploadRange struct {
+	// ranged 请求是否声明了写入位置，未声明时视为完整上传
+	ranged bool
+	start  int64
+	// end 本次请求写入的最后一个字节的位置，未声明写入位置时为-1
+	end int64
+	// total 文件总大小，未声明写入位置时为-1
+	total int64
+}
+
+// isComplete 判断提交了committed字节后上传是否结束
+func (u uploadRange) isComplete(committed int64) bool {
+	if !u.ranged {
+		return true
+	}
+	return committed >= u.total
+}
+
+// isFinal 判断本次请求写完后上传是否结束，结束时临时文件会被重命名为目标文件
+func (u uploadRange) isFinal() bool {
+	if !u.ranged {
+		return true
+	}
+	return u.end+1 == u.total
+}
+
+// isWhole 判断长度为contentLength的请求体是否为整个文件
+func (u uploadRange) isWhole(contentLength int64) bool {
+	if !u.ranged {
+		return true
+	}
+	return u.start == 0 && contentLength == u.total
+}
+
+// parseUploadRange 从请求中解析写入位置
+// 优先使用Content-Range请求头，格式为 bytes start-end/total
+// 其次使用URL参数offset与size，此时请求需要携带Content-Length
+// 断点续传必须声明文件总大小，否则无法判断哪一次请求结束上传
+func parseUploadRange(request *http.Request) (uploadRange, error) {
+	contentRange := request.Header.Get("Content-Range")
+	if contentRange != "" {
+		return parseContentRange(contentRange)
+	}
+	query := request.URL.Query()
+	offsetParam := query.Get("offset")
+	if offsetParam == "" {
+		return uploadRange{end: -1, total: -1}, nil
+	}
+	offset, err := strconv.ParseInt(offsetParam, 10, 64)
+	if err != nil || offset < 0 {
+		return uploadRange{}, InvalidUploadRange
+	}
+	total, err := strconv.ParseInt(query.Get("size"), 10, 64)
+	if err != nil || total < offset {
+		return uploadRange{}, InvalidUploadRange
+	}
+	contentLength := request.ContentLength
+	if contentLength < 0 || offset+contentLength > total {
+		return uploadRange{}, InvalidUploadRange
+	}
+	return uploadRange{ranged: true, start: offset, end: offset + contentLength - 1, total: total}, nil
+}
+
+func parseContentRange(contentRange string) (uploadRange, error) {
+	const prefix = "bytes "
+	if !strings.HasPrefix(contentRange, prefix) {
+		return uploadRange{}, InvalidUploadRange
+	}
+	spec := strings.TrimSpace(contentRange[len(prefix):])
+	sepIndex := strings.Index(spec, "/")
+	if sepIndex < 0 {
+		return uploadRange{}, InvalidUploadRange
+	}
+	rangeSpec, totalSpec := spec[:sepIndex], spec[sepIndex+1:]
+	total, err := strconv.ParseInt(totalSpec, 10, 64)
+	if err != nil || total < 0 {
+		return uploadRange{}, InvalidUploadRange
+	}
+	bounds := strings.Split(rangeSpec, "-")
+	if len(bounds) != 2 {
+		return uploadRange{}, InvalidUploadRange
+	}
+	start, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil || start < 0 {
+		return uploadRange{}, InvalidUploadRange
+	}
+	end, err := strconv.ParseInt(bounds[1], 10, 64)
+	if err != nil || end < start || end >= total {
+		return uploadRange{}, InvalidUploadRange
+	}
+	return uploadRange{ranged: true, start: start, end: end, total: total}, nil
+}
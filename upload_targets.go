@@ -0,0 +1,306 @@
+package filetransfer
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/kirinlabs/utils/str"
+	"io"
+	"net/http"
+	"summersea.top/filetransfer/transferframe"
+	"sync/atomic"
+)
+
+// RollbackAll 任一目标失败时回滚所有目标
+const RollbackAll = "all"
+
+// RollbackFailed 只回滚失败的目标，成功的目标保留
+const RollbackFailed = "failed"
+
+// targetQueueSize 多目标上传时每个目标最多排队的块数，排满时该目标被踢出，不会拖慢其它目标
+const targetQueueSize = 64
+
+// allTargetsFailed 所有目标都已失败，不再读取请求体
+var allTargetsFailed = errors.New("all upload targets failed")
+
+// UploadTarget 额外的上传目标
+type UploadTarget struct {
+	Resource Resource `json:"resource"`
+	Path     string   `json:"path"`
+	Filename string   `json:"filename"`
+}
+
+// UploadTargetResult 多目标上传中单个目标的上传结果
+type UploadTargetResult struct {
+	Address  string `json:"address"`
+	Path     string `json:"path"`
+	Filename string `json:"filename,omitempty"`
+	Size     int64  `json:"size"`
+	// RolledBack 已写入的数据是否被删除
+	RolledBack bool          `json:"rolledBack"`
+	Error      *ErrorContent `json:"error,omitempty"`
+}
+
+// forTarget 获取第target个目标的上传数据，0为Resource，之后依次为Targets
+func (u UploadData) forTarget(target int) (UploadData, bool) {
+	if target == 0 {
+		return u, true
+	}
+	if target < 0 || target > len(u.Targets) {
+		return u, false
+	}
+	data := u
+	data.Resource = u.Targets[target-1].Resource
+	data.Path = u.Targets[target-1].Path
+	data.Filename = u.Targets[target-1].Filename
+	return data, true
+}
+
+func isRollbackPolicyValid(policy string) bool {
+	return policy == "" || policy == RollbackAll || policy == RollbackFailed
+}
+
+func (fs *FileServerController) isUploadTargetValid(target UploadTarget, extract string) bool {
+	if !str.StartsWith(target.Path, "/") || str.StartsWith(target.Filename, "/") {
+		return false
+	}
+	if extract == "" && target.Filename == "" {
+		return false
+	}
+	return fs.isResourceReqBodyValid(target.Resource)
+}
+
+// uploadTarget 一个上传目标的传输状态，作为TransferWriter接收上传的数据
+type uploadTarget struct {
+	channel    WriteCloseRollback
+	counter    *countWriter
+	err        error
+	rolledBack bool
+	// committed 数据已确认，确认后的目标不再回滚，否则会删除上传前已存在的文件
+	committed bool
+	// live 仍在写入的目标数，所有目标共享
+	live *int32
+}
+
+func (u *uploadTarget) BeforeTransfer() error {
+	return nil
+}
+
+func (u *uploadTarget) Write(bytes []byte) error {
+	if _, err := u.counter.Write(bytes); err != nil {
+		u.err = fmt.Errorf("problem write upload channel: %w", err)
+		return err
+	}
+	return nil
+}
+
+func (u *uploadTarget) AfterTransfer() {
+	// Do nothing
+}
+
+// ErrorTransfer 写入失败的原因已经在Write中记录，跟不上读取速度被踢出时在此记录
+func (u *uploadTarget) ErrorTransfer(err error) {
+	if u.err == nil && errors.Is(err, transferframe.LaggingWriterErr) {
+		u.err = fmt.Errorf("problem write upload channel: %w", err)
+	}
+	atomic.AddInt32(u.live, -1)
+}
+
+// targetsReader 所有目标都失败后不再读取请求体，返回allTargetsFailed
+type targetsReader struct {
+	reader io.Reader
+	live   *int32
+}
+
+func (t targetsReader) Read(p []byte) (int, error) {
+	if atomic.LoadInt32(t.live) <= 0 {
+		return 0, allTargetsFailed
+	}
+	return t.reader.Read(p)
+}
+
+func (u *uploadTarget) written() int64 {
+	if u.counter == nil {
+		return 0
+	}
+	return u.counter.count
+}
+
+// uploadToTargets 将reader同时上传到count个目标，单个目标失败不影响其它目标
+// 多个目标时跟不上读取速度的目标被踢出，所有目标都失败后停止读取reader
+// 写完的目标还没有确认，调用方按回滚策略调用commitTargets或rollBackTarget，最后调用closeTargets
+// error 读取失败、被取消、超时或摘要不一致时返回，此时所有目标都失败
+func (fs *FileServerController) uploadToTargets(taskId string, reader io.Reader, options UploadOptions, count int,
+	expected expectedChecksums, tracker *taskTracker) ([]*uploadTarget, error) {
+	targets := make([]*uploadTarget, count)
+	writers := make([]transferframe.TransferWriter, 0, count)
+	live := new(int32)
+	for i := range targets {
+		targets[i] = &uploadTarget{live: live}
+		targetOptions := options
+		targetOptions.Target = i
+		channel, err := fs.dataAdapter.GetUploadChannel(tracker.ctx, taskId, targetOptions)
+		if err != nil {
+			targets[i].err = fmt.Errorf("problem create upload channel %w", err)
+			continue
+		}
+		targets[i].channel = channel
+		targets[i].counter = &countWriter{writer: channel}
+		writers = append(writers, targets[i])
+	}
+	if len(writers) == 0 {
+		return targets, nil
+	}
+	*live = int32(len(writers))
+	checksumWriters := expected.writers()
+	var extraWriters []transferframe.TransferWriter
+	for _, writer := range checksumWriters {
+		extraWriters = append(extraWriters, writer)
+	}
+	manager, err := fs.newTransferManager(targetsReader{reader: reader, live: live}, extraWriters)
+	if err != nil {
+		return targets, err
+	}
+	// 只有一个目标时读取随目标变慢，多个目标时慢的目标不能拖慢其它目标
+	targetOptions := transferframe.WriterOptions{}
+	if count > 1 {
+		targetOptions = transferframe.WriterOptions{Policy: transferframe.PolicyDrop, QueueSize: targetQueueSize}
+	}
+	for _, writer := range writers {
+		_ = manager.AddWriterWithOptions(writer, targetOptions)
+	}
+	err = fs.startTransfer(manager, tracker)
+	if errors.Is(err, allTargetsFailed) {
+		// 每个目标的错误已经记录
+		return targets, nil
+	}
+	if err == nil {
+		err = expected.verify(checksumWriters)
+	}
+	if err != nil {
+		for _, target := range targets {
+			if target.channel != nil && (tracker.isCanceled() || errors.Is(err, ChecksumMismatch)) {
+				fs.rollBackTarget(target)
+			}
+			if target.err == nil {
+				target.err = err
+			}
+		}
+		return targets, err
+	}
+	return targets, nil
+}
+
+// commitTargets 依次确认没有失败的目标，确认失败的目标被回滚
+// policy不为RollbackFailed时在第一个确认失败的目标处停止，之后的目标留给调用方回滚
+func (fs *FileServerController) commitTargets(targets []*uploadTarget, policy string) {
+	for _, target := range targets {
+		if target.err != nil || target.rolledBack {
+			continue
+		}
+		if committer, ok := target.channel.(Committer); ok {
+			if err := committer.Commit(); err != nil {
+				fs.rollBackTarget(target)
+				target.err = fmt.Errorf("problem commit upload: %w", err)
+				if policy != RollbackFailed {
+					return
+				}
+				continue
+			}
+		}
+		target.committed = true
+	}
+}
+
+func closeTargets(targets []*uploadTarget) {
+	for _, target := range targets {
+		if target.channel != nil {
+			closeWithErrLog(target.channel)
+		}
+	}
+}
+
+func (fs *FileServerController) rollBackTarget(target *uploadTarget) {
+	if target.channel != nil && !target.rolledBack && !target.committed {
+		fs.rollBack(target.channel)
+		target.rolledBack = true
+	}
+}
+
+// multiTargetUploadHandler 将一次上传同时写入多个目标，按rollbackPolicy处理部分失败，不支持断点续传与multipart
+func (fs *FileServerController) multiTargetUploadHandler(ctx *gin.Context, taskId string, data UploadData) {
+	uploadRange, err := parseUploadRange(ctx.Request)
+	if err != nil || uploadRange.ranged || isMultipartUpload(ctx.Request) {
+		ctx.JSON(http.StatusBadRequest, getInvalidParamErr())
+		return
+	}
+	expected, err := fs.getExpectedChecksums(taskId, ctx.Request, uploadRange)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, getInvalidParamErr())
+		return
+	}
+	modTime, err := parseLastModified(ctx.Request.Header)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, getInvalidParamErr())
+		return
+	}
+	tracker := fs.startTracking(ctx.Request.Context(), taskId, TaskTypeUpload, 0, ctx.Request.ContentLength)
+	targets, err := fs.uploadToTargets(taskId, ctx.Request.Body, UploadOptions{ModTime: modTime}, len(data.Targets)+1, expected, tracker)
+	defer closeTargets(targets)
+	if err != nil {
+		// 多目标上传不能续传，已写入的数据没有保留的必要
+		for _, target := range targets {
+			fs.rollBackTarget(target)
+		}
+		tracker.finish(err, false)
+		if tracker.isCanceled() {
+			fs.dataAdapter.FinishUpload(taskId)
+		}
+		fs.responseUploadErr(ctx, err)
+		return
+	}
+	// 先按回滚策略确认，all策略下有目标失败时一个都不确认，只删除临时文件
+	failed := countFailedTargets(targets)
+	if failed == 0 || data.RollbackPolicy == RollbackFailed {
+		fs.commitTargets(targets, data.RollbackPolicy)
+		failed = countFailedTargets(targets)
+	}
+	if failed > 0 {
+		for _, target := range targets {
+			if data.RollbackPolicy != RollbackFailed || target.err != nil {
+				fs.rollBackTarget(target)
+			}
+		}
+		// 所有目标都失败时请求体没有读完
+		ctx.Header("Connection", "close")
+		err = fmt.Errorf("%d of %d upload targets failed", failed, len(targets))
+	}
+	tracker.finish(err, true)
+	fs.dataAdapter.FinishUpload(taskId)
+	ctx.JSON(http.StatusOK, OkBody{Data: Data{"targets": getTargetResults(data, targets)}})
+}
+
+func countFailedTargets(targets []*uploadTarget) int {
+	failed := 0
+	for _, target := range targets {
+		if target.err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+func getTargetResults(data UploadData, targets []*uploadTarget) []UploadTargetResult {
+	results := make([]UploadTargetResult, 0, len(targets))
+	for i, target := range targets {
+		targetData, _ := data.forTarget(i)
+		result := UploadTargetResult{Address: targetData.Resource.Address, Path: targetData.Path,
+			Filename: targetData.Filename, Size: target.written(), RolledBack: target.rolledBack}
+		if target.err != nil {
+			errorBody := getUploadFileErr(target.err)
+			result.Error = &errorBody.Error
+		}
+		results = append(results, result)
+	}
+	return results
+}
@@ -0,0 +1,277 @@
+package filetransfer_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	uuid "github.com/satori/go.uuid"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"summersea.top/filetransfer"
+	testutil "summersea.top/filetransfer/test"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUploadInitWithTargets(t *testing.T) {
+	fileServer := filetransfer.NewFileServer(&StubAdapter{})
+	resource := filetransfer.Resource{Address: "addr", Port: 22, Account: filetransfer.Account{Name: "a", Password: "pwd"}}
+	testCases := []struct {
+		name       string
+		target     filetransfer.UploadTarget
+		policy     string
+		wantStatus int
+	}{
+		{"valid", filetransfer.UploadTarget{Resource: resource, Path: "/root", Filename: "a.txt"}, "", http.StatusOK},
+		{"rollback failed", filetransfer.UploadTarget{Resource: resource, Path: "/root", Filename: "a.txt"},
+			filetransfer.RollbackFailed, http.StatusOK},
+		{"unknown policy", filetransfer.UploadTarget{Resource: resource, Path: "/root", Filename: "a.txt"}, "none",
+			http.StatusBadRequest},
+		{"relative path", filetransfer.UploadTarget{Resource: resource, Path: "root", Filename: "a.txt"}, "",
+			http.StatusBadRequest},
+		{"no filename", filetransfer.UploadTarget{Resource: resource, Path: "/root"}, "", http.StatusBadRequest},
+		{"no resource", filetransfer.UploadTarget{Path: "/root", Filename: "a.txt"}, "", http.StatusBadRequest},
+	}
+	for _, test := range testCases {
+		t.Run(test.name, func(t *testing.T) {
+			body := filetransfer.UploadInitReqBody{Resource: resource, Path: "/root", Filename: "a.txt",
+				Targets: []filetransfer.UploadTarget{test.target}, RollbackPolicy: test.policy}
+			testCase(t, initTestCase{requestBody: body, wantResponseStatus: test.wantStatus}, initUploadUrl, fileServer)
+		})
+	}
+}
+
+func TestMultiTargetUpload(t *testing.T) {
+	const content = "fan out content"
+	type targetsBody struct {
+		Data struct {
+			Targets []filetransfer.UploadTargetResult `json:"targets"`
+		} `json:"data"`
+	}
+	newTargetsServer := func(policy string, targetDirs ...string) (*StubAdapter, http.Handler, string) {
+		taskId := uuid.NewV4().String()
+		adapter := &StubAdapter{filename: filepath.Join(t.TempDir(), "main.txt")}
+		targets := make([]filetransfer.UploadTarget, 0, len(targetDirs))
+		for _, dir := range targetDirs {
+			targets = append(targets, filetransfer.UploadTarget{Path: dir, Filename: "target.txt"})
+		}
+		adapter.SaveUploadData(taskId, filetransfer.UploadData{Targets: targets, RollbackPolicy: policy})
+		return adapter, filetransfer.NewFileServer(adapter), taskId
+	}
+	upload := func(t *testing.T, fileServer http.Handler, taskId string, header http.Header) (int, targetsBody) {
+		request := newPostRequestReader(fmt.Sprintf("%s?taskId=%s", uploadUrl, taskId), strings.NewReader(content))
+		for key, values := range header {
+			request.Header[key] = values
+		}
+		response := httptest.NewRecorder()
+		fileServer.ServeHTTP(response, request)
+		var body targetsBody
+		_ = json.NewDecoder(response.Body).Decode(&body)
+		return response.Code, body
+	}
+	assertContent := func(t *testing.T, filename string) {
+		t.Helper()
+		got, err := os.ReadFile(filename)
+		testutil.AssertNil(t, err)
+		testutil.AssertStringEqual(t, string(got), content)
+	}
+	assertNotExist := func(t *testing.T, filename string) {
+		t.Helper()
+		_, err := os.Stat(filename)
+		testutil.AssertTrue(t, os.IsNotExist(err))
+	}
+
+	t.Run("all succeeded", func(t *testing.T) {
+		dirs := []string{t.TempDir(), t.TempDir()}
+		adapter, fileServer, taskId := newTargetsServer("", dirs...)
+		code, body := upload(t, fileServer, taskId, nil)
+		testutil.AssertIntEquals(t, code, http.StatusOK)
+		testutil.AssertIntEquals(t, len(body.Data.Targets), 3)
+		for _, result := range body.Data.Targets {
+			testutil.AssertTrue(t, result.Error == nil)
+			testutil.AssertIntEquals(t, int(result.Size), len(content))
+		}
+		assertContent(t, adapter.filename)
+		for _, dir := range dirs {
+			assertContent(t, filepath.Join(dir, "target.txt"))
+		}
+		testutil.AssertFalse(t, adapter.IsUploadTaskExist(taskId))
+	})
+
+	t.Run("rollback all", func(t *testing.T) {
+		dir := t.TempDir()
+		adapter, fileServer, taskId := newTargetsServer(filetransfer.RollbackAll, dir, filepath.Join(dir, "missing"))
+		code, body := upload(t, fileServer, taskId, nil)
+		testutil.AssertIntEquals(t, code, http.StatusOK)
+		testutil.AssertIntEquals(t, len(body.Data.Targets), 3)
+		testutil.AssertTrue(t, body.Data.Targets[0].RolledBack)
+		testutil.AssertTrue(t, body.Data.Targets[1].RolledBack)
+		testutil.AssertStringEqual(t, body.Data.Targets[2].Error.Code, filetransfer.ErrorCodeTransferFailed)
+		assertNotExist(t, adapter.filename)
+		assertNotExist(t, filepath.Join(dir, "target.txt"))
+	})
+
+	t.Run("rollback failed", func(t *testing.T) {
+		dir := t.TempDir()
+		adapter, fileServer, taskId := newTargetsServer(filetransfer.RollbackFailed, dir, filepath.Join(dir, "missing"))
+		code, body := upload(t, fileServer, taskId, nil)
+		testutil.AssertIntEquals(t, code, http.StatusOK)
+		testutil.AssertFalse(t, body.Data.Targets[0].RolledBack)
+		testutil.AssertTrue(t, body.Data.Targets[0].Error == nil)
+		testutil.AssertTrue(t, body.Data.Targets[2].Error != nil)
+		assertContent(t, adapter.filename)
+		assertContent(t, filepath.Join(dir, "target.txt"))
+	})
+
+	// newWriteServer 多目标上传的服务，目标的写入由write处理
+	newWriteServer := func(policy string, write func(target int, channel io.Writer, p []byte) (int, error),
+		targetDirs ...string) (*StubAdapter, http.Handler, string) {
+		adapter, _, taskId := newTargetsServer(policy, targetDirs...)
+		return adapter, filetransfer.NewFileServer(&targetWriteAdapter{StubAdapter: adapter, write: write}), taskId
+	}
+
+	t.Run("slow target dropped", func(t *testing.T) {
+		release := make(chan struct{})
+		write := func(target int, channel io.Writer, p []byte) (int, error) {
+			if target == 2 {
+				<-release
+			}
+			return channel.Write(p)
+		}
+		dirs := []string{t.TempDir(), t.TempDir()}
+		adapter, fileServer, taskId := newWriteServer(filetransfer.RollbackFailed, write, dirs...)
+		body := bytes.Repeat([]byte("a"), 4*1024*1024)
+		done := make(chan *httptest.ResponseRecorder)
+		go func() {
+			response := httptest.NewRecorder()
+			fileServer.ServeHTTP(response, newPostRequestReader(fmt.Sprintf("%s?taskId=%s", uploadUrl, taskId), bytes.NewReader(body)))
+			done <- response
+		}()
+		// 阻塞的目标不会拖慢其它目标，其它目标写完后再放开阻塞的目标
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			info, err := os.Stat(filepath.Join(dirs[0], "target.txt"))
+			if err == nil && info.Size() == int64(len(body)) {
+				break
+			}
+			if time.Now().After(deadline) {
+				close(release)
+				t.Fatalf("other targets throttled by the slow target")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		close(release)
+		response := <-done
+		testutil.AssertIntEquals(t, response.Code, http.StatusOK)
+		var result targetsBody
+		_ = json.NewDecoder(response.Body).Decode(&result)
+		testutil.AssertTrue(t, result.Data.Targets[0].Error == nil)
+		testutil.AssertTrue(t, result.Data.Targets[1].Error == nil)
+		testutil.AssertTrue(t, result.Data.Targets[2].Error != nil)
+		testutil.AssertTrue(t, result.Data.Targets[2].RolledBack)
+		info, _ := os.Stat(adapter.filename)
+		testutil.AssertTrue(t, info.Size() == int64(len(body)))
+	})
+
+	t.Run("failed targets stop reading body", func(t *testing.T) {
+		write := func(int, io.Writer, []byte) (int, error) {
+			return 0, errors.New("disk full")
+		}
+		_, fileServer, taskId := newWriteServer(filetransfer.RollbackAll, write, t.TempDir())
+		body := &countingReader{reader: bytes.NewReader(make([]byte, 16*1024*1024))}
+		response := httptest.NewRecorder()
+		fileServer.ServeHTTP(response, newPostRequestReader(fmt.Sprintf("%s?taskId=%s", uploadUrl, taskId), body))
+		testutil.AssertIntEquals(t, response.Code, http.StatusOK)
+		testutil.AssertStringEqual(t, response.Header().Get("Connection"), "close")
+		var result targetsBody
+		_ = json.NewDecoder(response.Body).Decode(&result)
+		for _, target := range result.Data.Targets {
+			testutil.AssertTrue(t, target.Error != nil)
+		}
+		testutil.AssertTrue(t, atomic.LoadInt64(&body.count) < 4*1024*1024)
+	})
+
+	t.Run("ranged upload rejected", func(t *testing.T) {
+		_, fileServer, taskId := newTargetsServer("", t.TempDir())
+		code, _ := upload(t, fileServer, taskId, http.Header{"Content-Range": {"bytes 0-14/30"}})
+		testutil.AssertIntEquals(t, code, http.StatusBadRequest)
+	})
+}
+
+func TestFileTranDataAdapter_MultiTargetUpload(t *testing.T) {
+	server := testutil.StartSshServer(t, testutil.NewPasswordServerConfig(t, "test", "pwd"))
+	resource := filetransfer.Resource{Address: server.Address, Port: server.Port,
+		Account: filetransfer.Account{Name: "test", Password: "pwd"}}
+	adapter := filetransfer.NewFileTranDataAdapter(filetransfer.NewMemoryStore())
+	testCases := []struct {
+		policy      string
+		wantContent string
+	}{
+		{filetransfer.RollbackAll, "old"},
+		{filetransfer.RollbackFailed, "new"},
+	}
+	for _, test := range testCases {
+		t.Run(test.policy, func(t *testing.T) {
+			dir := t.TempDir()
+			existing := filepath.Join(dir, "a.txt")
+			_ = os.WriteFile(existing, []byte("old"), 0644)
+			taskId := filetransfer.NewTaskId()
+			adapter.SaveUploadData(taskId, filetransfer.UploadData{Resource: resource, Path: dir, Filename: "a.txt",
+				Targets:        []filetransfer.UploadTarget{{Resource: resource, Path: filepath.Join(dir, "missing"), Filename: "a.txt"}},
+				RollbackPolicy: test.policy})
+			request := newPostRequestReader(fmt.Sprintf("%s?taskId=%s", uploadUrl, taskId), strings.NewReader("new"))
+			response := httptest.NewRecorder()
+			filetransfer.NewFileServer(adapter).ServeHTTP(response, request)
+			testutil.AssertIntEquals(t, response.Code, http.StatusOK)
+			got, err := os.ReadFile(existing)
+			testutil.AssertNil(t, err)
+			testutil.AssertStringEqual(t, string(got), test.wantContent)
+			// 临时文件都已被删除或重命名
+			entries, _ := os.ReadDir(dir)
+			testutil.AssertIntEquals(t, len(entries), 1)
+		})
+	}
+}
+
+// targetWriteAdapter 上传通道的写入由write处理，target为目标的序号
+type targetWriteAdapter struct {
+	*StubAdapter
+	write func(target int, channel io.Writer, p []byte) (int, error)
+}
+
+func (a *targetWriteAdapter) GetUploadChannel(ctx context.Context, taskId string, options filetransfer.UploadOptions) (filetransfer.WriteCloseRollback, error) {
+	channel, err := a.StubAdapter.GetUploadChannel(ctx, taskId, options)
+	if err != nil || channel == nil {
+		return channel, err
+	}
+	return &targetWriteChannel{WriteCloseRollback: channel, target: options.Target, write: a.write}, nil
+}
+
+type targetWriteChannel struct {
+	filetransfer.WriteCloseRollback
+	target int
+	write  func(target int, channel io.Writer, p []byte) (int, error)
+}
+
+func (c *targetWriteChannel) Write(p []byte) (int, error) {
+	return c.write(c.target, c.WriteCloseRollback, p)
+}
+
+// countingReader 记录已读取的字节数
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	atomic.AddInt64(&c.count, int64(n))
+	return n, err
+}
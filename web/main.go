@@ -6,9 +6,10 @@ import (
 )
 
 func main() {
-	store := filetransfer.CreateStoreByConfig()
-	adapter := filetransfer.NewFileTranDataAdapter(store)
-	server := filetransfer.NewFileServer(adapter)
+	config := filetransfer.LoadConfig()
+	store := filetransfer.CreateStoreWithConfig(config.Store)
+	adapter := filetransfer.NewFileTranDataAdapterWithConfig(store, config.Ssh)
+	server := filetransfer.NewFileServerWithConfig(adapter, config.Transfer)
 
 	err := server.Run(":8080")
 	if err != nil {
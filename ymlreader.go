@@ -3,11 +3,14 @@ package filetransfer
 import (
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
+	"log"
 	"runtime"
 )
 
 type YamlContent struct {
-	Store StoreConfig `yaml:"store"`
+	Store    StoreConfig    `yaml:"store"`
+	Ssh      SshConfig      `yaml:"ssh,omitempty"`
+	Transfer TransferConfig `yaml:"transfer,omitempty"`
 }
 
 func NewYamlContent(path string) (*YamlContent, error) {
@@ -26,6 +29,16 @@ func NewYamlContent(path string) (*YamlContent, error) {
 	return &yamlContent, nil
 }
 
+// LoadConfig 读取默认路径的配置文件，读取失败时返回空配置，各项使用默认值
+func LoadConfig() *YamlContent {
+	content, err := NewYamlContent("")
+	if err != nil {
+		log.Printf("[error]problem get yaml content: %v \n", err)
+		return &YamlContent{}
+	}
+	return content
+}
+
 func getDefaultConfigPath() string {
 	os := runtime.GOOS
 	if os == "linux" {